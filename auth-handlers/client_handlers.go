@@ -0,0 +1,157 @@
+package authhandlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	responseutils "github.com/geekible-ltd/response-utils"
+	"github.com/gin-gonic/gin"
+)
+
+// registerClientRoutes lets tenant administrators manage the OAuth clients of
+// their own tenant
+func (h *AuthHandlers) registerClientRoutes() {
+	clientGroup := h.ginEngine.Group("/tenant/clients")
+	clientGroup.Use(h.bearerAuthMiddleware(), h.requireRoles(config.UserRoleSuperAdmin, config.UserRoleAdmin, config.UserRoleTenantAdmin))
+	{
+		clientGroup.GET("", func(ctx *gin.Context) {
+			tenantID, ok := tenantIDFromContext(ctx)
+			if !ok {
+				return
+			}
+
+			clients, err := h.ClientService.GetClients(tenantID)
+			if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to get clients"))
+				return
+			}
+			responseutils.SuccessResponse(ctx, http.StatusOK, clients, "Clients retrieved successfully")
+		})
+
+		clientGroup.POST("", func(ctx *gin.Context) {
+			var clientDTO dto.ClientRegistrationDTO
+			if err := ctx.ShouldBindJSON(&clientDTO); err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("Invalid request body"))
+				return
+			}
+
+			tenantID, ok := tenantIDFromContext(ctx)
+			if !ok {
+				return
+			}
+
+			credentials, err := h.ClientService.RegisterClient(tenantID, clientDTO)
+			if isClientValidationError(err) {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest(err.Error()))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to register client"))
+				return
+			}
+			responseutils.SuccessResponse(ctx, http.StatusCreated, credentials, "Client registered successfully")
+		})
+
+		clientGroup.GET("/:clientId", func(ctx *gin.Context) {
+			tenantID, ok := tenantIDFromContext(ctx)
+			if !ok {
+				return
+			}
+
+			client, err := h.ClientService.GetClient(tenantID, ctx.Param("clientId"))
+			if errors.Is(err, config.ErrClientNotFound) {
+				responseutils.ErrorResponse(ctx, responseutils.NotFound("Client"))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to get client"))
+				return
+			}
+			responseutils.SuccessResponse(ctx, http.StatusOK, client, "Client retrieved successfully")
+		})
+
+		clientGroup.PUT("/:clientId", func(ctx *gin.Context) {
+			var clientDTO dto.ClientRequestDTO
+			if err := ctx.ShouldBindJSON(&clientDTO); err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("Invalid request body"))
+				return
+			}
+
+			tenantID, ok := tenantIDFromContext(ctx)
+			if !ok {
+				return
+			}
+
+			err := h.ClientService.UpdateClient(tenantID, ctx.Param("clientId"), clientDTO)
+			if errors.Is(err, config.ErrClientNotFound) {
+				responseutils.ErrorResponse(ctx, responseutils.NotFound("Client"))
+				return
+			} else if isClientValidationError(err) {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest(err.Error()))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to update client"))
+				return
+			}
+			responseutils.SuccessResponse(ctx, http.StatusOK, nil, "Client updated successfully")
+		})
+
+		clientGroup.POST("/:clientId/secret", func(ctx *gin.Context) {
+			tenantID, ok := tenantIDFromContext(ctx)
+			if !ok {
+				return
+			}
+
+			credentials, err := h.ClientService.RotateClientSecret(tenantID, ctx.Param("clientId"))
+			if errors.Is(err, config.ErrClientNotFound) {
+				responseutils.ErrorResponse(ctx, responseutils.NotFound("Client"))
+				return
+			} else if errors.Is(err, config.ErrInvalidClient) {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("Public clients have no secret"))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to rotate client secret"))
+				return
+			}
+			responseutils.SuccessResponse(ctx, http.StatusOK, credentials, "Client secret rotated successfully")
+		})
+
+		clientGroup.DELETE("/:clientId", func(ctx *gin.Context) {
+			tenantID, ok := tenantIDFromContext(ctx)
+			if !ok {
+				return
+			}
+
+			err := h.ClientService.DeleteClient(tenantID, ctx.Param("clientId"))
+			if errors.Is(err, config.ErrClientNotFound) {
+				responseutils.ErrorResponse(ctx, responseutils.NotFound("Client"))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to delete client"))
+				return
+			}
+			responseutils.SuccessResponse(ctx, http.StatusOK, nil, "Client deleted successfully")
+		})
+	}
+}
+
+// tenantIDFromContext returns the tenant of the authenticated user, writing an
+// error response if it is missing
+func tenantIDFromContext(ctx *gin.Context) (uint, bool) {
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		responseutils.ErrorResponse(ctx, responseutils.Unauthorized("Unauthorized"))
+		return 0, false
+	}
+
+	tenantID, err := claims.TenantID()
+	if err != nil {
+		responseutils.ErrorResponse(ctx, responseutils.Unauthorized("Unauthorized"))
+		return 0, false
+	}
+	return tenantID, true
+}
+
+func isClientValidationError(err error) bool {
+	return errors.Is(err, config.ErrInvalidRedirectURI) || errors.Is(err, config.ErrInvalidGrantType) || errors.Is(err, config.ErrInvalidScope)
+}
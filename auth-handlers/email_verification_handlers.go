@@ -0,0 +1,52 @@
+package authhandlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	responseutils "github.com/geekible-ltd/response-utils"
+	"github.com/gin-gonic/gin"
+)
+
+// registerEmailVerificationRoutes confirms users' email addresses with the
+// token sent on registration
+func (h *AuthHandlers) registerEmailVerificationRoutes() {
+	emailGroup := h.ginEngine.Group("/auth/email")
+	{
+		emailGroup.POST("/verify", func(ctx *gin.Context) {
+			var verifyDTO dto.VerifyEmailDTO
+			if err := ctx.ShouldBindJSON(&verifyDTO); err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("Invalid request body"))
+				return
+			}
+			err := h.EmailVerificationService.Verify(verifyDTO)
+			if errors.Is(err, config.ErrInvalidVerificationToken) {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("Verification token is invalid or expired; request a new one"))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to verify email"))
+				return
+			}
+			responseutils.SuccessResponse(ctx, http.StatusOK, nil, "Email verified successfully")
+		})
+
+		emailGroup.POST("/resend", func(ctx *gin.Context) {
+			var resendDTO dto.ResendVerificationDTO
+			if err := ctx.ShouldBindJSON(&resendDTO); err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("Invalid request body"))
+				return
+			}
+			err := h.EmailVerificationService.Resend(resendDTO)
+			if errors.Is(err, config.ErrMailerNotConfigured) {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("Email verification is not configured"))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to send verification email"))
+				return
+			}
+			responseutils.SuccessResponse(ctx, http.StatusOK, nil, "If the email belongs to an unverified account, a verification email has been sent")
+		})
+	}
+}
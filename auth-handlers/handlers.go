@@ -1,52 +1,118 @@
 package authhandlers
 
 import (
+	"errors"
 	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
 
 	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/internal/config"
 	"github.com/geekible-ltd/auth-server/internal/service"
 	ginmiddleware "github.com/geekible-ltd/gin-middleware"
-	authmodels "github.com/geekible-ltd/gin-middleware/auth-models"
 	responseutils "github.com/geekible-ltd/response-utils"
 	"github.com/gin-gonic/gin"
 )
 
 type AuthHandlers struct {
-	jwtSecret            string
-	ginEngine            *gin.Engine
-	LoginService         *service.LoginService
-	RegistrationService  *service.UserRegistrationService
-	TenantService        *service.TenantService
-	UserService          *service.UserService
-	TenantLicenceService *service.TenantLicenceService
+	ginEngine                *gin.Engine
+	KeyService               *service.KeyService
+	TokenService             *service.TokenService
+	RevocationService        *service.RevocationService
+	LoginService             *service.LoginService
+	RegistrationService      *service.UserRegistrationService
+	TenantService            *service.TenantService
+	UserService              *service.UserService
+	TenantLicenceService     *service.TenantLicenceService
+	ClientService            *service.ClientService
+	OAuthService             *service.OAuthService
+	MFAService               *service.MFAService
+	WebAuthnService          *service.WebAuthnService
+	PasswordlessService      *service.PasswordlessService
+	TenantSettingsService    *service.TenantSettingsService
+	PasswordResetService     *service.PasswordResetService
+	EmailVerificationService *service.EmailVerificationService
+	UserImportService        *service.UserImportService
+
+	loginURL              string
+	consentURL            string
+	deviceVerificationURL string
+	stepUpMaxAge          time.Duration
+	trustedProxies        []netip.Prefix
 }
 
 func NewAuthHandlers(
-	jwtSecret string,
 	ginEngine *gin.Engine,
+	keyService *service.KeyService,
+	tokenService *service.TokenService,
+	revocationService *service.RevocationService,
 	loginService *service.LoginService,
 	registrationService *service.UserRegistrationService,
 	tenantService *service.TenantService,
 	userService *service.UserService,
-	tenantLicenceService *service.TenantLicenceService) *AuthHandlers {
+	tenantLicenceService *service.TenantLicenceService,
+	clientService *service.ClientService,
+	oauthService *service.OAuthService,
+	mfaService *service.MFAService,
+	webAuthnService *service.WebAuthnService,
+	passwordlessService *service.PasswordlessService,
+	tenantSettingsService *service.TenantSettingsService,
+	passwordResetService *service.PasswordResetService,
+	emailVerificationService *service.EmailVerificationService,
+	userImportService *service.UserImportService,
+	loginURL string,
+	consentURL string,
+	deviceVerificationURL string,
+	stepUpMaxAge time.Duration,
+	trustedProxies []netip.Prefix) *AuthHandlers {
 
 	// Apply middleware to the provided engine
 	ginEngine.Use(ginmiddleware.RateLimitMiddleware(10, 20))
 
 	return &AuthHandlers{
-		jwtSecret:            jwtSecret,
-		ginEngine:            ginEngine,
-		LoginService:         loginService,
-		RegistrationService:  registrationService,
-		TenantService:        tenantService,
-		UserService:          userService,
-		TenantLicenceService: tenantLicenceService,
+		ginEngine:                ginEngine,
+		KeyService:               keyService,
+		TokenService:             tokenService,
+		RevocationService:        revocationService,
+		LoginService:             loginService,
+		RegistrationService:      registrationService,
+		TenantService:            tenantService,
+		UserService:              userService,
+		TenantLicenceService:     tenantLicenceService,
+		ClientService:            clientService,
+		OAuthService:             oauthService,
+		MFAService:               mfaService,
+		WebAuthnService:          webAuthnService,
+		PasswordlessService:      passwordlessService,
+		TenantSettingsService:    tenantSettingsService,
+		PasswordResetService:     passwordResetService,
+		EmailVerificationService: emailVerificationService,
+		UserImportService:        userImportService,
+
+		loginURL:              loginURL,
+		consentURL:            consentURL,
+		deviceVerificationURL: deviceVerificationURL,
+		stepUpMaxAge:          stepUpMaxAge,
+		trustedProxies:        trustedProxies,
 	}
 }
 
 func (h *AuthHandlers) RegisterRoutes() {
 	h.registerRegisterRoutes()
 	h.registerLoginRoutes()
+	h.registerWellKnownRoutes()
+	h.registerOAuthRoutes()
+	h.registerUserInfoRoutes()
+	h.registerClientRoutes()
+	h.registerMFARoutes()
+	h.registerWebAuthnRoutes()
+	h.registerPasswordlessRoutes()
+	h.registerTenantSettingsRoutes()
+	h.registerUserRoutes()
+	h.registerTenantLicenceRoutes()
+	h.registerPasswordRoutes()
+	h.registerEmailVerificationRoutes()
 }
 
 func (h *AuthHandlers) registerRegisterRoutes() {
@@ -58,16 +124,26 @@ func (h *AuthHandlers) registerRegisterRoutes() {
 				responseutils.ErrorResponse(ctx, responseutils.BadRequest("Invalid request body"))
 				return
 			}
-			if err := h.RegistrationService.RegisterTenant(tenantDTO); err != nil {
+			// Registrations for existing tenants and emails get the same
+			// response, so it does not reveal who has an account
+			err := h.RegistrationService.RegisterTenant(tenantDTO)
+			if errors.Is(err, config.ErrVerificationEmailNotSent) {
+				responseutils.SuccessResponse(ctx, http.StatusCreated, nil, "Registration received, but the email could not be sent")
+				return
+			} else if respondPasswordPolicyError(ctx, err) {
+				return
+			} else if err != nil {
 				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to register tenant"))
 				return
 			}
 
-			responseutils.SuccessResponse(ctx, http.StatusCreated, nil, "Tenant registered successfully")
+			responseutils.SuccessResponse(ctx, http.StatusCreated, nil, "Registration received; check your email")
 		})
 
+		// Only tenant administrators can add users, and tokens issued to OAuth
+		// clients cannot, even when they act for an administrator
 		authGroupProtected := authGroup.Group("/user-management")
-		authGroupProtected.Use(ginmiddleware.BearerAuthMiddleware(h.jwtSecret))
+		authGroupProtected.Use(h.bearerAuthMiddleware(), h.requireRoles(config.UserRoleSuperAdmin, config.UserRoleAdmin, config.UserRoleTenantAdmin))
 		{
 			authGroupProtected.POST("/new-user", func(ctx *gin.Context) {
 				var userDTO dto.UserRegistrationDTO
@@ -76,15 +152,21 @@ func (h *AuthHandlers) registerRegisterRoutes() {
 					return
 				}
 
-				tokenData, exists := ctx.Get(ginmiddleware.TokenKey)
-				if !exists {
-					responseutils.ErrorResponse(ctx, responseutils.Unauthorized("Unauthorized"))
+				tenantID, _, ok := userFromContext(ctx)
+				if !ok {
 					return
 				}
 
-				token := tokenData.(authmodels.TokenDTO)
-
-				if err := h.RegistrationService.RegisterUser(token.CompanyID.(uint), userDTO); err != nil {
+				err := h.RegistrationService.RegisterUser(tenantID, userDTO)
+				if errors.Is(err, config.ErrVerificationEmailNotSent) {
+					responseutils.SuccessResponse(ctx, http.StatusCreated, nil, "User registered successfully, but the verification email could not be sent")
+					return
+				} else if errors.Is(err, config.ErrUserAlreadyExists) {
+					responseutils.ErrorResponse(ctx, responseutils.Conflict("This email cannot be used"))
+					return
+				} else if respondPasswordPolicyError(ctx, err) {
+					return
+				} else if err != nil {
 					responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to register user"))
 					return
 				}
@@ -104,12 +186,177 @@ func (h *AuthHandlers) registerLoginRoutes() {
 				responseutils.ErrorResponse(ctx, responseutils.BadRequest("Invalid request body"))
 				return
 			}
-			loginResponse, err := h.LoginService.Login(loginDTO, ctx.ClientIP())
-			if err != nil {
+			loginResponse, err := h.LoginService.Login(loginDTO, h.clientIP(ctx))
+			// Locked out accounts look like wrong passwords, or the lock would
+			// tell whether an account exists
+			if errors.Is(err, config.ErrUserNotFound) || errors.Is(err, config.ErrInvalidPassword) || errors.Is(err, config.ErrAccountLocked) {
+				responseutils.ErrorResponse(ctx, responseutils.Unauthorized("Invalid email or password"))
+				return
+			} else if errors.Is(err, config.ErrUserInactive) {
+				responseutils.ErrorResponse(ctx, responseutils.Forbidden("Account is disabled"))
+				return
+			} else if errors.Is(err, config.ErrEmailNotVerified) {
+				responseutils.ErrorResponse(ctx, responseutils.Forbidden("Email address has not been verified"))
+				return
+			} else if errors.Is(err, config.ErrPasswordExpired) {
+				responseutils.ErrorResponse(ctx, responseutils.Forbidden("Password has expired; change it at /auth/password/expired"))
+				return
+			} else if err != nil {
 				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to login"))
 				return
 			}
+			if loginResponse.MFARequired {
+				responseutils.SuccessResponse(ctx, http.StatusOK, loginResponse, "MFA verification required")
+				return
+			} else if loginResponse.MFAEnrolmentRequired {
+				responseutils.SuccessResponse(ctx, http.StatusOK, loginResponse, "MFA enrolment required")
+				return
+			}
+			setSessionCookie(ctx, loginResponse.AccessToken, int(loginResponse.ExpiresIn))
 			responseutils.SuccessResponse(ctx, http.StatusOK, loginResponse, "Login successful")
 		})
+
+		authGroup.POST("/refresh", func(ctx *gin.Context) {
+			var refreshDTO dto.RefreshTokenDTO
+			if err := ctx.ShouldBindJSON(&refreshDTO); err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("Invalid request body"))
+				return
+			}
+			loginResponse, err := h.LoginService.Refresh(refreshDTO)
+			if errors.Is(err, config.ErrInvalidRefreshToken) || errors.Is(err, config.ErrRefreshTokenExpired) || errors.Is(err, config.ErrRefreshTokenReused) {
+				responseutils.ErrorResponse(ctx, responseutils.Unauthorized("Invalid refresh token"))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to refresh token"))
+				return
+			}
+			responseutils.SuccessResponse(ctx, http.StatusOK, loginResponse, "Token refreshed successfully")
+		})
+
+		authGroupProtected := authGroup.Group("")
+		authGroupProtected.Use(h.bearerAuthMiddleware())
+		{
+			authGroupProtected.POST("/logout", func(ctx *gin.Context) {
+				claims, ok := claimsFromContext(ctx)
+				if !ok {
+					responseutils.ErrorResponse(ctx, responseutils.Unauthorized("Unauthorized"))
+					return
+				}
+				if err := h.LoginService.Logout(claims); err != nil {
+					responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to logout"))
+					return
+				}
+				setSessionCookie(ctx, "", -1)
+				responseutils.SuccessResponse(ctx, http.StatusOK, nil, "Logout successful")
+			})
+
+			authGroupProtected.POST("/logout-all", func(ctx *gin.Context) {
+				claims, ok := claimsFromContext(ctx)
+				if !ok {
+					responseutils.ErrorResponse(ctx, responseutils.Unauthorized("Unauthorized"))
+					return
+				}
+				if claims.IsClientToken() {
+					responseutils.ErrorResponse(ctx, responseutils.BadRequest("Client tokens have no user sessions"))
+					return
+				}
+				if err := h.LoginService.LogoutAll(claims); err != nil {
+					responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to logout"))
+					return
+				}
+				setSessionCookie(ctx, "", -1)
+				responseutils.SuccessResponse(ctx, http.StatusOK, nil, "Logged out of all sessions")
+			})
+
+			authGroupProtected.POST("/reauthenticate", func(ctx *gin.Context) {
+				var reauthDTO dto.ReauthenticateDTO
+				if err := ctx.ShouldBindJSON(&reauthDTO); err != nil {
+					responseutils.ErrorResponse(ctx, responseutils.BadRequest("Invalid request body"))
+					return
+				}
+				if reauthDTO.Password == "" && reauthDTO.Code == "" && len(reauthDTO.Credential) == 0 {
+					responseutils.ErrorResponse(ctx, responseutils.BadRequest("A password, code or security key credential is required"))
+					return
+				}
+
+				if _, _, ok := userFromContext(ctx); !ok {
+					return
+				}
+				claims, _ := claimsFromContext(ctx)
+
+				loginResponse, err := h.LoginService.Reauthenticate(claims, reauthDTO)
+				if errors.Is(err, config.ErrUserNotFound) || errors.Is(err, config.ErrInvalidPassword) || errors.Is(err, config.ErrInvalidMFACode) ||
+					errors.Is(err, config.ErrInvalidWebAuthnSession) || errors.Is(err, config.ErrWebAuthnVerificationFailed) {
+					responseutils.ErrorResponse(ctx, responseutils.Unauthorized("Re-authentication failed"))
+					return
+				} else if respondAccountLockedError(ctx, err) {
+					return
+				} else if errors.Is(err, config.ErrWebAuthnNotConfigured) {
+					responseutils.ErrorResponse(ctx, responseutils.BadRequest("WebAuthn is not configured"))
+					return
+				} else if err != nil {
+					responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to re-authenticate"))
+					return
+				}
+				setSessionCookie(ctx, loginResponse.AccessToken, int(loginResponse.ExpiresIn))
+				responseutils.SuccessResponse(ctx, http.StatusOK, loginResponse, "Re-authentication successful")
+			})
+		}
+	}
+}
+
+// respondAccountLockedError tells a locked out user when they can try again if
+// err is a *service.AccountLockedError, and reports whether it did
+func respondAccountLockedError(ctx *gin.Context, err error) bool {
+	var lockedErr *service.AccountLockedError
+	if !errors.As(err, &lockedErr) {
+		return false
+	}
+	retryAfter := int(time.Until(lockedErr.LockedUntil)/time.Second) + 1
+	ctx.Header("Retry-After", strconv.Itoa(retryAfter))
+	responseutils.ErrorResponse(ctx, responseutils.NewResponseError(responseutils.ErrUserAccountLocked, "Account is temporarily locked after too many failed attempts; try again later or reset your password", http.StatusLocked).
+		WithDetails("locked_until", lockedErr.LockedUntil))
+	return true
+}
+
+func (h *AuthHandlers) registerWellKnownRoutes() {
+	wellKnownGroup := h.ginEngine.Group("/.well-known")
+	{
+		// Served as a bare JWK Set so standard JOSE libraries can consume it
+		wellKnownGroup.GET("/jwks.json", func(ctx *gin.Context) {
+			jwks, err := h.KeyService.JWKS()
+			if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to load signing keys"))
+				return
+			}
+			ctx.Header("Cache-Control", "public, max-age=300")
+			ctx.JSON(http.StatusOK, jwks)
+		})
+
+		wellKnownGroup.GET("/openid-configuration", func(ctx *gin.Context) {
+			baseURL := h.baseURL(ctx)
+			ctx.Header("Cache-Control", "public, max-age=300")
+			ctx.JSON(http.StatusOK, dto.OpenIDConfigurationDTO{
+				Issuer:                            h.TokenService.Issuer(),
+				AuthorizationEndpoint:             baseURL + "/oauth/authorize",
+				TokenEndpoint:                     baseURL + "/oauth/token",
+				UserInfoEndpoint:                  baseURL + "/userinfo",
+				JWKSURI:                           baseURL + "/.well-known/jwks.json",
+				RevocationEndpoint:                baseURL + "/oauth/revoke",
+				IntrospectionEndpoint:             baseURL + "/oauth/introspect",
+				DeviceAuthorizationEndpoint:       baseURL + "/oauth/device_authorization",
+				ScopesSupported:                   service.SupportedScopes(),
+				ResponseTypesSupported:            []string{config.ResponseTypeCode},
+				GrantTypesSupported:               service.SupportedGrantTypes(),
+				SubjectTypesSupported:             []string{"public"},
+				IDTokenSigningAlgValuesSupported:  []string{h.KeyService.Algorithm()},
+				TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+				CodeChallengeMethodsSupported:     []string{config.CodeChallengeMethodS256},
+				ACRValuesSupported:                []string{config.ACRSingleFactor, config.ACRMultiFactor},
+				PromptValuesSupported:             []string{config.PromptNone, config.PromptLogin, config.PromptConsent},
+				ClaimsSupported:                   []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "acr", "amr", "nonce", "azp", "company_id", "name", "given_name", "family_name", "email", "email_verified"},
+				AuthorizationResponseIssParameter: true,
+			})
+		})
 	}
 }
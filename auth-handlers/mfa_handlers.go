@@ -0,0 +1,243 @@
+package authhandlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	responseutils "github.com/geekible-ltd/response-utils"
+	"github.com/gin-gonic/gin"
+)
+
+// registerMFARoutes serves the second login step and lets users manage their
+// own second factors
+func (h *AuthHandlers) registerMFARoutes() {
+	mfaGroup := h.ginEngine.Group("/auth/mfa")
+	{
+		mfaGroup.POST("/verify", func(ctx *gin.Context) {
+			var verifyDTO dto.MFAVerifyDTO
+			if err := ctx.ShouldBindJSON(&verifyDTO); err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("Invalid request body"))
+				return
+			}
+			loginResponse, err := h.LoginService.VerifyMFA(verifyDTO, h.clientIP(ctx))
+			if errors.Is(err, config.ErrInvalidMFAToken) {
+				responseutils.ErrorResponse(ctx, responseutils.Unauthorized("MFA token is invalid or expired; log in again"))
+				return
+			} else if errors.Is(err, config.ErrInvalidMFACode) {
+				responseutils.ErrorResponse(ctx, responseutils.Unauthorized("Invalid MFA code"))
+				return
+			} else if respondAccountLockedError(ctx, err) {
+				return
+			} else if errors.Is(err, config.ErrWebAuthnVerificationFailed) || errors.Is(err, config.ErrInvalidWebAuthnSession) {
+				responseutils.ErrorResponse(ctx, responseutils.Unauthorized("Security key verification failed"))
+				return
+			} else if errors.Is(err, config.ErrWebAuthnNotConfigured) {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("WebAuthn is not configured"))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to verify MFA"))
+				return
+			}
+			setSessionCookie(ctx, loginResponse.AccessToken, int(loginResponse.ExpiresIn))
+			responseutils.SuccessResponse(ctx, http.StatusOK, loginResponse, "Login successful")
+		})
+
+		mfaGroup.POST("/enrol/totp", func(ctx *gin.Context) {
+			var mfaDTO dto.MFATokenDTO
+			if err := ctx.ShouldBindJSON(&mfaDTO); err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("Invalid request body"))
+				return
+			}
+			enrolment, err := h.MFAService.EnrolTOTPForChallenge(mfaDTO.MFAToken)
+			if errors.Is(err, config.ErrInvalidMFAToken) {
+				responseutils.ErrorResponse(ctx, responseutils.Unauthorized("MFA token is invalid or expired; log in again"))
+				return
+			} else if errors.Is(err, config.ErrMFAAlreadyEnabled) {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("TOTP is already enabled"))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to start TOTP enrolment"))
+				return
+			}
+			ctx.Header("Cache-Control", "no-store")
+			responseutils.SuccessResponse(ctx, http.StatusOK, enrolment, "Scan the QR code and confirm with a code")
+		})
+
+		mfaGroup.POST("/enrol/totp/confirm", func(ctx *gin.Context) {
+			var verifyDTO dto.MFAVerifyDTO
+			if err := ctx.ShouldBindJSON(&verifyDTO); err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("Invalid request body"))
+				return
+			}
+			loginResponse, err := h.LoginService.CompleteTOTPEnrolment(verifyDTO, h.clientIP(ctx))
+			if errors.Is(err, config.ErrInvalidMFAToken) {
+				responseutils.ErrorResponse(ctx, responseutils.Unauthorized("MFA token is invalid or expired; log in again"))
+				return
+			} else if errors.Is(err, config.ErrMFAAlreadyEnabled) || errors.Is(err, config.ErrMFAEnrolmentNotStarted) || errors.Is(err, config.ErrInvalidMFACode) {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest(err.Error()))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to confirm TOTP"))
+				return
+			}
+			ctx.Header("Cache-Control", "no-store")
+			setSessionCookie(ctx, loginResponse.AccessToken, int(loginResponse.ExpiresIn))
+			responseutils.SuccessResponse(ctx, http.StatusOK, loginResponse, "TOTP enabled; store the recovery codes safely")
+		})
+
+		mfaGroup.POST("/enrol/webauthn/begin", func(ctx *gin.Context) {
+			var mfaDTO dto.MFATokenDTO
+			if err := ctx.ShouldBindJSON(&mfaDTO); err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("Invalid request body"))
+				return
+			}
+			options, err := h.MFAService.BeginWebAuthnEnrolment(mfaDTO.MFAToken)
+			if errors.Is(err, config.ErrInvalidMFAToken) {
+				responseutils.ErrorResponse(ctx, responseutils.Unauthorized("MFA token is invalid or expired; log in again"))
+				return
+			} else if errors.Is(err, config.ErrWebAuthnNotConfigured) {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("WebAuthn is not configured"))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to start registration"))
+				return
+			}
+			responseutils.SuccessResponse(ctx, http.StatusOK, options, "Registration started")
+		})
+
+		mfaGroup.POST("/enrol/webauthn/finish", func(ctx *gin.Context) {
+			var registrationDTO dto.WebAuthnRegistrationDTO
+			if err := ctx.ShouldBindJSON(&registrationDTO); err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("Invalid request body"))
+				return
+			}
+			loginResponse, err := h.LoginService.CompleteWebAuthnEnrolment(registrationDTO, h.clientIP(ctx))
+			if errors.Is(err, config.ErrInvalidMFAToken) {
+				responseutils.ErrorResponse(ctx, responseutils.Unauthorized("MFA token is invalid or expired; log in again"))
+				return
+			} else if errors.Is(err, config.ErrWebAuthnNotConfigured) || errors.Is(err, config.ErrInvalidWebAuthnSession) || errors.Is(err, config.ErrWebAuthnVerificationFailed) {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest(err.Error()))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to register credential"))
+				return
+			}
+			ctx.Header("Cache-Control", "no-store")
+			setSessionCookie(ctx, loginResponse.AccessToken, int(loginResponse.ExpiresIn))
+			responseutils.SuccessResponse(ctx, http.StatusOK, loginResponse, "Credential registered successfully")
+		})
+
+		mfaGroupProtected := mfaGroup.Group("")
+		mfaGroupProtected.Use(h.bearerAuthMiddleware())
+		{
+			mfaGroupProtected.GET("", func(ctx *gin.Context) {
+				tenantID, userID, ok := userFromContext(ctx)
+				if !ok {
+					return
+				}
+
+				status, err := h.MFAService.Status(tenantID, userID)
+				if err != nil {
+					responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to get MFA status"))
+					return
+				}
+				responseutils.SuccessResponse(ctx, http.StatusOK, status, "MFA status retrieved successfully")
+			})
+
+			mfaGroupProtected.POST("/totp", func(ctx *gin.Context) {
+				tenantID, userID, ok := userFromContext(ctx)
+				if !ok {
+					return
+				}
+
+				enrolment, err := h.MFAService.EnrolTOTP(tenantID, userID)
+				if errors.Is(err, config.ErrMFAAlreadyEnabled) {
+					responseutils.ErrorResponse(ctx, responseutils.BadRequest("TOTP is already enabled"))
+					return
+				} else if err != nil {
+					responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to start TOTP enrolment"))
+					return
+				}
+				ctx.Header("Cache-Control", "no-store")
+				responseutils.SuccessResponse(ctx, http.StatusOK, enrolment, "Scan the QR code and confirm with a code")
+			})
+
+			mfaGroupProtected.POST("/totp/confirm", func(ctx *gin.Context) {
+				var codeDTO dto.MFACodeDTO
+				if err := ctx.ShouldBindJSON(&codeDTO); err != nil {
+					responseutils.ErrorResponse(ctx, responseutils.BadRequest("Invalid request body"))
+					return
+				}
+
+				tenantID, userID, ok := userFromContext(ctx)
+				if !ok {
+					return
+				}
+
+				recoveryCodes, err := h.MFAService.ConfirmTOTP(tenantID, userID, codeDTO.Code)
+				if errors.Is(err, config.ErrMFAAlreadyEnabled) || errors.Is(err, config.ErrMFAEnrolmentNotStarted) || errors.Is(err, config.ErrInvalidMFACode) {
+					responseutils.ErrorResponse(ctx, responseutils.BadRequest(err.Error()))
+					return
+				} else if err != nil {
+					responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to confirm TOTP"))
+					return
+				}
+				ctx.Header("Cache-Control", "no-store")
+				responseutils.SuccessResponse(ctx, http.StatusOK, recoveryCodes, "TOTP enabled; store the recovery codes safely")
+			})
+
+			mfaGroupProtected.DELETE("/totp", func(ctx *gin.Context) {
+				var codeDTO dto.MFACodeDTO
+				if err := ctx.ShouldBindJSON(&codeDTO); err != nil {
+					responseutils.ErrorResponse(ctx, responseutils.BadRequest("Invalid request body"))
+					return
+				}
+
+				tenantID, userID, ok := userFromContext(ctx)
+				if !ok {
+					return
+				}
+
+				err := h.MFAService.DisableTOTP(tenantID, userID, codeDTO.Code)
+				if errors.Is(err, config.ErrMFANotEnabled) || errors.Is(err, config.ErrInvalidMFACode) {
+					responseutils.ErrorResponse(ctx, responseutils.BadRequest(err.Error()))
+					return
+				} else if respondAccountLockedError(ctx, err) {
+					return
+				} else if err != nil {
+					responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to disable TOTP"))
+					return
+				}
+				responseutils.SuccessResponse(ctx, http.StatusOK, nil, "TOTP disabled")
+			})
+
+			mfaGroupProtected.POST("/recovery-codes", func(ctx *gin.Context) {
+				var codeDTO dto.MFACodeDTO
+				if err := ctx.ShouldBindJSON(&codeDTO); err != nil {
+					responseutils.ErrorResponse(ctx, responseutils.BadRequest("Invalid request body"))
+					return
+				}
+
+				tenantID, userID, ok := userFromContext(ctx)
+				if !ok {
+					return
+				}
+
+				recoveryCodes, err := h.MFAService.RegenerateRecoveryCodes(tenantID, userID, codeDTO.Code)
+				if errors.Is(err, config.ErrMFANotEnabled) || errors.Is(err, config.ErrInvalidMFACode) {
+					responseutils.ErrorResponse(ctx, responseutils.BadRequest(err.Error()))
+					return
+				} else if respondAccountLockedError(ctx, err) {
+					return
+				} else if err != nil {
+					responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to regenerate recovery codes"))
+					return
+				}
+				ctx.Header("Cache-Control", "no-store")
+				responseutils.SuccessResponse(ctx, http.StatusOK, recoveryCodes, "Recovery codes regenerated")
+			})
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package authhandlers
+
+import (
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/service"
+	ginmiddleware "github.com/geekible-ltd/gin-middleware"
+	authmodels "github.com/geekible-ltd/gin-middleware/auth-models"
+	responseutils "github.com/geekible-ltd/response-utils"
+	"github.com/gin-gonic/gin"
+)
+
+// ClaimsKey is the context key holding the *service.AccessTokenClaims of an authenticated request
+const ClaimsKey = "access_token_claims"
+
+// bearerAuthMiddleware validates the bearer token and rejects revoked tokens.
+// The parsed token is also stored under ginmiddleware.TokenKey so handlers
+// written against gin-middleware keep working.
+func (h *AuthHandlers) bearerAuthMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		scheme, tokenString, found := strings.Cut(ctx.GetHeader("Authorization"), " ")
+		if !found || !strings.EqualFold(scheme, "Bearer") || tokenString == "" {
+			responseutils.ErrorResponse(ctx, responseutils.Unauthorized("Missing or invalid Authorization header"))
+			ctx.Abort()
+			return
+		}
+
+		claims, err := h.TokenService.ParseAccessToken(tokenString)
+		if err != nil {
+			responseutils.ErrorResponse(ctx, responseutils.Unauthorized("Invalid token"))
+			ctx.Abort()
+			return
+		}
+
+		revoked, err := h.RevocationService.IsRevoked(claims)
+		if err != nil {
+			responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to validate token"))
+			ctx.Abort()
+			return
+		} else if revoked {
+			responseutils.ErrorResponse(ctx, responseutils.Unauthorized("Token has been revoked"))
+			ctx.Abort()
+			return
+		}
+
+		ctx.Set(ClaimsKey, claims)
+		ctx.Set(ginmiddleware.TokenKey, authmodels.TokenDTO{
+			Sub:       claims.Subject,
+			CompanyID: claims.CompanyID,
+			Email:     claims.Email,
+			FirstName: claims.FirstName,
+			LastName:  claims.LastName,
+			Role:      claims.Role,
+			Exp:       claims.ExpiresAt.Unix(),
+			Iat:       claims.IssuedAt.Unix(),
+		})
+
+		ctx.Next()
+	}
+}
+
+// requireRoles allows only users holding one of the roles. It must run after
+// bearerAuthMiddleware. Tokens issued to OAuth clients are limited to their
+// granted scopes and are never accepted for role-based routes.
+func (h *AuthHandlers) requireRoles(roles ...string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		claims, ok := claimsFromContext(ctx)
+		if !ok {
+			responseutils.ErrorResponse(ctx, responseutils.Unauthorized("Unauthorized"))
+			ctx.Abort()
+			return
+		}
+
+		if claims.ClientID == "" {
+			for _, role := range roles {
+				if claims.Role == role {
+					ctx.Next()
+					return
+				}
+			}
+		}
+
+		responseutils.ErrorResponse(ctx, responseutils.Forbidden("Insufficient permissions"))
+		ctx.Abort()
+	}
+}
+
+// requireRecentAuth allows only users who logged in or re-authenticated at
+// /auth/reauthenticate within the step-up max age. It must run after
+// bearerAuthMiddleware.
+func (h *AuthHandlers) requireRecentAuth() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if !h.recentlyAuthenticated(ctx) {
+			ctx.Abort()
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// recentlyAuthenticated reports whether the user of the request authenticated
+// within the step-up max age. Otherwise it responds with the RFC 9470
+// insufficient_user_authentication challenge. Tokens issued to OAuth clients
+// never count as a recent authentication.
+func (h *AuthHandlers) recentlyAuthenticated(ctx *gin.Context) bool {
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		responseutils.ErrorResponse(ctx, responseutils.Unauthorized("Unauthorized"))
+		return false
+	}
+
+	authTime, ok := claims.AuthenticatedAt()
+	if ok && claims.ClientID == "" && time.Since(authTime) <= h.stepUpMaxAge {
+		return true
+	}
+
+	maxAge := strconv.Itoa(int(h.stepUpMaxAge.Seconds()))
+	ctx.Header("WWW-Authenticate", `Bearer error="insufficient_user_authentication", error_description="Recent authentication required", max_age=`+maxAge)
+	responseutils.ErrorResponse(ctx, responseutils.Unauthorized("Recent authentication required; re-authenticate at /auth/reauthenticate"))
+	return false
+}
+
+// claimsFromContext returns the claims stored by bearerAuthMiddleware
+func claimsFromContext(ctx *gin.Context) (*service.AccessTokenClaims, bool) {
+	value, exists := ctx.Get(ClaimsKey)
+	if !exists {
+		return nil, false
+	}
+	claims, ok := value.(*service.AccessTokenClaims)
+	return claims, ok
+}
+
+// sessionClaims authenticates the user of a browser request from the session
+// cookie set at login, or from a bearer token. Tokens issued to OAuth clients
+// are not accepted as a login session.
+func (h *AuthHandlers) sessionClaims(ctx *gin.Context) (*service.AccessTokenClaims, bool) {
+	tokenString, err := ctx.Cookie(config.SessionCookieName)
+	if err != nil || tokenString == "" {
+		scheme, bearerToken, found := strings.Cut(ctx.GetHeader("Authorization"), " ")
+		if !found || !strings.EqualFold(scheme, "Bearer") || bearerToken == "" {
+			return nil, false
+		}
+		tokenString = bearerToken
+	}
+
+	claims, err := h.TokenService.ParseAccessToken(tokenString)
+	if err != nil || claims.ClientID != "" {
+		return nil, false
+	}
+
+	revoked, err := h.RevocationService.IsRevoked(claims)
+	if err != nil || revoked {
+		return nil, false
+	}
+	return claims, true
+}
+
+// clientIP returns the address a login comes from, which decides whether it
+// is from a tenant's trusted network. X-Forwarded-For is set by the client
+// unless a proxy replaces it, so it is only believed when the peer is one of
+// the proxies set with WithTrustedProxies, whatever the gin engine trusts.
+func (h *AuthHandlers) clientIP(ctx *gin.Context) string {
+	addr, err := netip.ParseAddr(ctx.RemoteIP())
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap()
+
+	header := strings.Join(ctx.Request.Header.Values("X-Forwarded-For"), ",")
+	if header == "" {
+		return addr.String()
+	}
+
+	// Walk back from the nearest proxy to the first address a trusted proxy
+	// did not forward. Unreadable addresses leave the client unknown.
+	forwarded := strings.Split(header, ",")
+	for i := len(forwarded) - 1; i >= 0 && h.isTrustedProxy(addr); i-- {
+		next, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			return ""
+		}
+		addr = next.Unmap()
+	}
+	return addr.String()
+}
+
+func (h *AuthHandlers) isTrustedProxy(addr netip.Addr) bool {
+	for _, proxy := range h.trustedProxies {
+		if proxy.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// setSessionCookie stores the login session used by /oauth/authorize. A
+// negative maxAge clears it.
+func setSessionCookie(ctx *gin.Context, accessToken string, maxAge int) {
+	ctx.SetSameSite(http.SameSiteLaxMode)
+	ctx.SetCookie(config.SessionCookieName, accessToken, maxAge, "/oauth", "", true, true)
+}
+
+// userFromContext returns the tenant and user of a bearer-authenticated
+// request. Tokens issued to OAuth clients cannot manage the user's account.
+func userFromContext(ctx *gin.Context) (uint, uint, bool) {
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		responseutils.ErrorResponse(ctx, responseutils.Unauthorized("Unauthorized"))
+		return 0, 0, false
+	}
+	if claims.ClientID != "" {
+		responseutils.ErrorResponse(ctx, responseutils.Forbidden("Client tokens cannot manage user accounts"))
+		return 0, 0, false
+	}
+
+	tenantID, err := claims.TenantID()
+	if err != nil {
+		responseutils.ErrorResponse(ctx, responseutils.Unauthorized("Unauthorized"))
+		return 0, 0, false
+	}
+	userID, err := claims.UserID()
+	if err != nil {
+		responseutils.ErrorResponse(ctx, responseutils.Unauthorized("Unauthorized"))
+		return 0, 0, false
+	}
+	return tenantID, userID, true
+}
@@ -0,0 +1,49 @@
+package authhandlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestClientIP(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	proxies := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+
+	tests := []struct {
+		name           string
+		trustedProxies []netip.Prefix
+		remoteAddr     string
+		forwardedFor   []string
+		want           string
+	}{
+		{name: "uses the peer without a forwarded address", trustedProxies: proxies, remoteAddr: "203.0.113.7:1234", want: "203.0.113.7"},
+		{name: "ignores a forwarded address without trusted proxies", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"192.0.2.1"}, want: "10.0.0.1"},
+		{name: "ignores a forwarded address from an untrusted peer", trustedProxies: proxies, remoteAddr: "203.0.113.7:1234", forwardedFor: []string{"192.0.2.1"}, want: "203.0.113.7"},
+		{name: "uses the address a trusted proxy forwarded", trustedProxies: proxies, remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"192.0.2.1"}, want: "192.0.2.1"},
+		{name: "skips a chain of trusted proxies", trustedProxies: proxies, remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"192.0.2.1, 10.0.0.2"}, want: "192.0.2.1"},
+		{name: "stops at the first untrusted address", trustedProxies: proxies, remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"192.0.2.1, 198.51.100.9"}, want: "198.51.100.9"},
+		{name: "reads repeated headers in order", trustedProxies: proxies, remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"192.0.2.1", "10.0.0.2"}, want: "192.0.2.1"},
+		{name: "leaves the client unknown for an unreadable address", trustedProxies: proxies, remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"unknown"}, want: ""},
+		{name: "uses the last trusted proxy when all addresses are proxies", trustedProxies: proxies, remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"10.0.0.2"}, want: "10.0.0.2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &AuthHandlers{trustedProxies: tt.trustedProxies}
+			ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+			ctx.Request = httptest.NewRequest(http.MethodPost, "/auth/login", nil)
+			ctx.Request.RemoteAddr = tt.remoteAddr
+			for _, forwardedFor := range tt.forwardedFor {
+				ctx.Request.Header.Add("X-Forwarded-For", forwardedFor)
+			}
+
+			if got := h.clientIP(ctx); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,409 @@
+package authhandlers
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"github.com/geekible-ltd/auth-server/internal/service"
+	responseutils "github.com/geekible-ltd/response-utils"
+	"github.com/gin-gonic/gin"
+)
+
+// OAuth endpoints respond with bare RFC 6749 style bodies rather than the
+// responseutils envelope so standard OAuth client libraries can parse them.
+func (h *AuthHandlers) registerOAuthRoutes() {
+	oauthGroup := h.ginEngine.Group("/oauth")
+	{
+		authorize := func(ctx *gin.Context) {
+			var request dto.AuthorizationRequestDTO
+			if err := ctx.ShouldBind(&request); err != nil {
+				oauthError(ctx, http.StatusBadRequest, config.OAuthErrorInvalidRequest, "Invalid authorization request")
+				return
+			}
+
+			client, redirectURI, err := h.OAuthService.ValidateAuthorizationRequest(request)
+			if err != nil {
+				h.authorizationError(ctx, redirectURI, request.State, err)
+				return
+			}
+
+			session, ok := h.sessionClaims(ctx)
+			if !ok || h.OAuthService.LoginRequired(request, session) {
+				if request.Prompt == config.PromptNone || h.loginURL == "" {
+					h.authorizationError(ctx, redirectURI, request.State, &service.OAuthError{Code: config.OAuthErrorLoginRequired})
+					return
+				}
+				// Send the user to log in, then back here to resume the request
+				params := url.Values{"return_to": {authorizationReturnTo(ctx)}}
+				if ok {
+					params.Set("prompt", config.PromptLogin)
+				}
+				redirectWithParams(ctx, h.loginURL, params)
+				return
+			}
+
+			// The consent page answers with a POST, which the Lax session cookie
+			// is not sent with from other sites
+			if request.Consent != "" && ctx.Request.Method == http.MethodPost {
+				if request.Consent != config.ConsentApprove {
+					h.authorizationError(ctx, redirectURI, request.State, &service.OAuthError{Code: config.OAuthErrorAccessDenied, Description: "The user denied the request"})
+					return
+				}
+				if err := h.OAuthService.GrantConsent(client, request, session); err != nil {
+					h.authorizationError(ctx, redirectURI, request.State, err)
+					return
+				}
+			} else {
+				consentRequired, err := h.OAuthService.ConsentRequired(client, request, session)
+				if err != nil {
+					h.authorizationError(ctx, redirectURI, request.State, err)
+					return
+				}
+				if consentRequired {
+					if request.Prompt == config.PromptNone || h.consentURL == "" {
+						h.authorizationError(ctx, redirectURI, request.State, &service.OAuthError{Code: config.OAuthErrorConsentRequired})
+						return
+					}
+					redirectWithParams(ctx, h.consentURL, url.Values{
+						"return_to":   {authorizationReturnTo(ctx)},
+						"client_id":   {client.ClientID},
+						"client_name": {client.Name},
+						"scope":       {request.Scope},
+					})
+					return
+				}
+			}
+
+			code, err := h.OAuthService.Authorize(client, redirectURI, request, session)
+			if err != nil {
+				h.authorizationError(ctx, redirectURI, request.State, err)
+				return
+			}
+
+			params := url.Values{"code": {code}, "iss": {h.TokenService.Issuer()}}
+			if request.State != "" {
+				params.Set("state", request.State)
+			}
+			redirectWithParams(ctx, redirectURI, params)
+		}
+		oauthGroup.GET("/authorize", authorize)
+		oauthGroup.POST("/authorize", authorize)
+
+		oauthGroup.POST("/token", func(ctx *gin.Context) {
+			client, ok := h.authenticateClient(ctx, true)
+			if !ok {
+				return
+			}
+
+			var request dto.TokenRequestDTO
+			if err := ctx.ShouldBind(&request); err != nil {
+				oauthError(ctx, http.StatusBadRequest, config.OAuthErrorInvalidRequest, "Invalid token request")
+				return
+			}
+
+			response, err := h.OAuthService.Token(client, request)
+			if err != nil {
+				var oauthErr *service.OAuthError
+				if errors.As(err, &oauthErr) {
+					oauthError(ctx, http.StatusBadRequest, oauthErr.Code, oauthErr.Description)
+					return
+				}
+				oauthError(ctx, http.StatusInternalServerError, config.OAuthErrorServerError, "")
+				return
+			}
+			ctx.Header("Cache-Control", "no-store")
+			ctx.Header("Pragma", "no-cache")
+			ctx.JSON(http.StatusOK, response)
+		})
+
+		oauthGroup.POST("/device_authorization", func(ctx *gin.Context) {
+			client, ok := h.authenticateClient(ctx, true)
+			if !ok {
+				return
+			}
+
+			verificationURI := h.deviceVerificationURL
+			if verificationURI == "" {
+				verificationURI = h.baseURL(ctx) + "/oauth/device"
+			}
+
+			response, err := h.OAuthService.StartDeviceAuthorization(client, ctx.PostForm("scope"), verificationURI)
+			if err != nil {
+				var oauthErr *service.OAuthError
+				if errors.As(err, &oauthErr) {
+					oauthError(ctx, http.StatusBadRequest, oauthErr.Code, oauthErr.Description)
+					return
+				}
+				oauthError(ctx, http.StatusInternalServerError, config.OAuthErrorServerError, "")
+				return
+			}
+			ctx.Header("Cache-Control", "no-store")
+			ctx.JSON(http.StatusOK, response)
+		})
+
+		// The user verification endpoints are called by the logged-in user's
+		// browser or app, so they use the standard response envelope
+		oauthGroup.GET("/device", func(ctx *gin.Context) {
+			session, ok := h.sessionClaims(ctx)
+			if !ok {
+				if h.loginURL != "" {
+					returnTo := ctx.Request.URL.RequestURI()
+					redirectWithParams(ctx, h.loginURL, url.Values{"return_to": {returnTo}})
+					return
+				}
+				responseutils.ErrorResponse(ctx, responseutils.Unauthorized("Login required"))
+				return
+			}
+
+			userCode := ctx.Query("user_code")
+			if userCode == "" {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("user_code is required"))
+				return
+			}
+
+			deviceAuthorization, err := h.OAuthService.GetDeviceAuthorization(userCode, session)
+			if errors.Is(err, config.ErrInvalidUserCode) {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("Invalid or expired user code"))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to get device authorization"))
+				return
+			}
+			responseutils.SuccessResponse(ctx, http.StatusOK, deviceAuthorization, "Device authorization pending")
+		})
+
+		oauthGroup.POST("/device", func(ctx *gin.Context) {
+			session, ok := h.sessionClaims(ctx)
+			if !ok {
+				responseutils.ErrorResponse(ctx, responseutils.Unauthorized("Login required"))
+				return
+			}
+
+			var verificationDTO dto.DeviceVerificationRequestDTO
+			if err := ctx.ShouldBind(&verificationDTO); err != nil || verificationDTO.UserCode == "" {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("Invalid request body"))
+				return
+			}
+
+			err := h.OAuthService.VerifyDeviceAuthorization(verificationDTO.UserCode, verificationDTO.Approve, session)
+			if errors.Is(err, config.ErrInvalidUserCode) {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("Invalid or expired user code"))
+				return
+			} else if errors.Is(err, config.ErrUserNotFound) {
+				responseutils.ErrorResponse(ctx, responseutils.Unauthorized("Login required"))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to verify device"))
+				return
+			}
+
+			message := "Device denied"
+			if verificationDTO.Approve {
+				message = "Device approved"
+			}
+			responseutils.SuccessResponse(ctx, http.StatusOK, nil, message)
+		})
+
+		oauthGroup.POST("/introspect", func(ctx *gin.Context) {
+			client, ok := h.authenticateClient(ctx, false)
+			if !ok {
+				return
+			}
+
+			token := ctx.PostForm("token")
+			if token == "" {
+				oauthError(ctx, http.StatusBadRequest, "invalid_request", "token is required")
+				return
+			}
+
+			response, err := h.OAuthService.Introspect(client, token, ctx.PostForm("token_type_hint"))
+			if err != nil {
+				oauthError(ctx, http.StatusInternalServerError, "server_error", "")
+				return
+			}
+			ctx.Header("Cache-Control", "no-store")
+			ctx.JSON(http.StatusOK, response)
+		})
+
+		// RFC 7009 lets public clients revoke their own tokens; the service
+		// ignores tokens issued to any other client
+		oauthGroup.POST("/revoke", func(ctx *gin.Context) {
+			client, ok := h.authenticateClient(ctx, true)
+			if !ok {
+				return
+			}
+
+			token := ctx.PostForm("token")
+			if token == "" {
+				oauthError(ctx, http.StatusBadRequest, "invalid_request", "token is required")
+				return
+			}
+
+			if err := h.OAuthService.Revoke(client, token, ctx.PostForm("token_type_hint")); err != nil {
+				oauthError(ctx, http.StatusServiceUnavailable, "server_error", "")
+				return
+			}
+			ctx.Status(http.StatusOK)
+		})
+	}
+}
+
+func (h *AuthHandlers) registerUserInfoRoutes() {
+	userInfoGroup := h.ginEngine.Group("/userinfo")
+	userInfoGroup.Use(h.bearerAuthMiddleware())
+	{
+		userInfo := func(ctx *gin.Context) {
+			claims, ok := claimsFromContext(ctx)
+			if !ok {
+				oauthError(ctx, http.StatusUnauthorized, "invalid_token", "")
+				return
+			}
+
+			response, err := h.OAuthService.UserInfo(claims)
+			var oauthErr *service.OAuthError
+			if errors.As(err, &oauthErr) {
+				ctx.Header("WWW-Authenticate", `Bearer error="`+oauthErr.Code+`"`)
+				oauthError(ctx, http.StatusForbidden, oauthErr.Code, oauthErr.Description)
+				return
+			} else if errors.Is(err, config.ErrInvalidToken) {
+				oauthError(ctx, http.StatusUnauthorized, "invalid_token", "")
+				return
+			} else if err != nil {
+				oauthError(ctx, http.StatusInternalServerError, config.OAuthErrorServerError, "")
+				return
+			}
+			ctx.Header("Cache-Control", "no-store")
+			ctx.JSON(http.StatusOK, response)
+		}
+		userInfoGroup.GET("", userInfo)
+		userInfoGroup.POST("", userInfo)
+	}
+}
+
+// authenticateClient reads client credentials from HTTP Basic auth
+// (client_secret_basic) or the form body (client_secret_post). When
+// allowPublic is set a public client may identify itself by client_id alone.
+func (h *AuthHandlers) authenticateClient(ctx *gin.Context, allowPublic bool) (*models.Client, bool) {
+	clientID, clientSecret, ok := ctx.Request.BasicAuth()
+	if ok {
+		// RFC 6749 section 2.3.1 form-encodes the credentials before Basic encoding
+		var err error
+		if clientID, err = url.QueryUnescape(clientID); err != nil {
+			ok = false
+		} else if clientSecret, err = url.QueryUnescape(clientSecret); err != nil {
+			ok = false
+		}
+	} else {
+		clientID = ctx.PostForm("client_id")
+		clientSecret = ctx.PostForm("client_secret")
+		ok = clientID != "" && clientSecret != ""
+
+		if allowPublic && clientID != "" && clientSecret == "" {
+			if client, err := h.ClientService.AuthenticatePublic(clientID); err == nil {
+				return client, true
+			}
+		}
+	}
+
+	if ok {
+		client, err := h.ClientService.Authenticate(clientID, clientSecret)
+		if err == nil {
+			return client, true
+		}
+	}
+
+	ctx.Header("WWW-Authenticate", `Basic realm="oauth"`)
+	oauthError(ctx, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+	return nil, false
+}
+
+// authorizationError reports an authorization request error by redirecting
+// back to the client, or directly when there is no trusted redirect URI
+func (h *AuthHandlers) authorizationError(ctx *gin.Context, redirectURI, state string, err error) {
+	var oauthErr *service.OAuthError
+	if !errors.As(err, &oauthErr) {
+		oauthErr = &service.OAuthError{Code: config.OAuthErrorServerError}
+	}
+
+	if redirectURI == "" {
+		oauthError(ctx, http.StatusBadRequest, oauthErr.Code, oauthErr.Description)
+		return
+	}
+
+	params := url.Values{"error": {oauthErr.Code}, "iss": {h.TokenService.Issuer()}}
+	if oauthErr.Description != "" {
+		params.Set("error_description", oauthErr.Description)
+	}
+	if state != "" {
+		params.Set("state", state)
+	}
+	redirectWithParams(ctx, redirectURI, params)
+}
+
+// baseURL returns the public URL of the server, taken from the issuer when it
+// is an absolute URL and from the request otherwise
+func (h *AuthHandlers) baseURL(ctx *gin.Context) string {
+	if u, err := url.Parse(h.TokenService.Issuer()); err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" {
+		return strings.TrimSuffix(u.String(), "/")
+	}
+
+	scheme := "http"
+	if ctx.Request.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + ctx.Request.Host
+}
+
+// authorizationReturnTo is the authorization request to resume after the user
+// logs in or answers the consent page. Having done so, it no longer asks for
+// a login or consent prompt or a maximum authentication age.
+func authorizationReturnTo(ctx *gin.Context) string {
+	params := url.Values{}
+	for key, values := range ctx.Request.Form {
+		params[key] = values
+	}
+	params.Del("consent")
+	params.Del("max_age")
+
+	var prompt []string
+	for _, value := range strings.Fields(params.Get("prompt")) {
+		if value != config.PromptLogin && value != config.PromptConsent {
+			prompt = append(prompt, value)
+		}
+	}
+	if len(prompt) == 0 {
+		params.Del("prompt")
+	} else {
+		params.Set("prompt", strings.Join(prompt, " "))
+	}
+
+	return ctx.Request.URL.Path + "?" + params.Encode()
+}
+
+// redirectWithParams redirects to target with params added to its query string
+func redirectWithParams(ctx *gin.Context, target string, params url.Values) {
+	u, err := url.Parse(target)
+	if err != nil {
+		oauthError(ctx, http.StatusInternalServerError, config.OAuthErrorServerError, "")
+		return
+	}
+
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	u.RawQuery = query.Encode()
+
+	ctx.Header("Cache-Control", "no-store")
+	ctx.Redirect(http.StatusFound, u.String())
+}
+
+func oauthError(ctx *gin.Context, status int, code, description string) {
+	ctx.Header("Cache-Control", "no-store")
+	ctx.AbortWithStatusJSON(status, dto.OAuthErrorDTO{Error: code, ErrorDescription: description})
+}
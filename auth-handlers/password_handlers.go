@@ -0,0 +1,120 @@
+package authhandlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/service"
+	responseutils "github.com/geekible-ltd/response-utils"
+	"github.com/gin-gonic/gin"
+)
+
+// registerPasswordRoutes serves password resets by email, password changes by
+// signed-in users and changes of expired passwords
+func (h *AuthHandlers) registerPasswordRoutes() {
+	passwordGroup := h.ginEngine.Group("/auth/password")
+	{
+		passwordGroup.POST("/forgot", func(ctx *gin.Context) {
+			var forgotDTO dto.ForgotPasswordDTO
+			if err := ctx.ShouldBindJSON(&forgotDTO); err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("Invalid request body"))
+				return
+			}
+			err := h.PasswordResetService.RequestReset(forgotDTO)
+			if errors.Is(err, config.ErrMailerNotConfigured) {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("Password reset is not configured"))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to start password reset"))
+				return
+			}
+			responseutils.SuccessResponse(ctx, http.StatusOK, nil, "If the email belongs to an account, a password reset link has been sent")
+		})
+
+		passwordGroup.POST("/reset", func(ctx *gin.Context) {
+			var resetDTO dto.ResetPasswordDTO
+			if err := ctx.ShouldBindJSON(&resetDTO); err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("Invalid request body"))
+				return
+			}
+			err := h.PasswordResetService.ResetPassword(resetDTO)
+			if errors.Is(err, config.ErrInvalidResetToken) {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("Reset token is invalid or expired; request a new one"))
+				return
+			} else if respondPasswordPolicyError(ctx, err) {
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to reset password"))
+				return
+			}
+			responseutils.SuccessResponse(ctx, http.StatusOK, nil, "Password reset successfully")
+		})
+
+		passwordGroup.POST("/expired", func(ctx *gin.Context) {
+			var changeDTO dto.ExpiredPasswordChangeDTO
+			if err := ctx.ShouldBindJSON(&changeDTO); err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("Invalid request body"))
+				return
+			}
+			err := h.UserService.ChangeExpiredPassword(changeDTO)
+			if errors.Is(err, config.ErrUserNotFound) || errors.Is(err, config.ErrInvalidPassword) || errors.Is(err, config.ErrAccountLocked) {
+				responseutils.ErrorResponse(ctx, responseutils.Unauthorized("Invalid email or password"))
+				return
+			} else if errors.Is(err, config.ErrPasswordNotExpired) {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("Password has not expired; log in and use /auth/password/change"))
+				return
+			} else if respondPasswordPolicyError(ctx, err) {
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to change password"))
+				return
+			}
+			responseutils.SuccessResponse(ctx, http.StatusOK, nil, "Password changed successfully; log in with the new password")
+		})
+
+		passwordGroupProtected := passwordGroup.Group("")
+		passwordGroupProtected.Use(h.bearerAuthMiddleware())
+		{
+			passwordGroupProtected.POST("/change", func(ctx *gin.Context) {
+				var changeDTO dto.ChangePasswordDTO
+				if err := ctx.ShouldBindJSON(&changeDTO); err != nil {
+					responseutils.ErrorResponse(ctx, responseutils.BadRequest("Invalid request body"))
+					return
+				}
+
+				tenantID, userID, ok := userFromContext(ctx)
+				if !ok {
+					return
+				}
+				claims, _ := claimsFromContext(ctx)
+
+				err := h.UserService.ChangePassword(tenantID, userID, claims.SessionID, changeDTO)
+				if errors.Is(err, config.ErrInvalidPassword) || errors.Is(err, config.ErrUserNotFound) {
+					responseutils.ErrorResponse(ctx, responseutils.Unauthorized("Current password is incorrect"))
+					return
+				} else if respondAccountLockedError(ctx, err) {
+					return
+				} else if respondPasswordPolicyError(ctx, err) {
+					return
+				} else if err != nil {
+					responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to change password"))
+					return
+				}
+				responseutils.SuccessResponse(ctx, http.StatusOK, nil, "Password changed successfully")
+			})
+		}
+	}
+}
+
+// respondPasswordPolicyError writes a validation error listing the policy
+// violations if err is a *service.PasswordPolicyError, and reports whether it did
+func respondPasswordPolicyError(ctx *gin.Context, err error) bool {
+	var policyErr *service.PasswordPolicyError
+	if !errors.As(err, &policyErr) {
+		return false
+	}
+	responseutils.ErrorResponse(ctx, responseutils.ValidationError("Password does not meet the password policy").WithDetails("violations", policyErr.Violations))
+	return true
+}
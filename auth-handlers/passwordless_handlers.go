@@ -0,0 +1,63 @@
+package authhandlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	responseutils "github.com/geekible-ltd/response-utils"
+	"github.com/gin-gonic/gin"
+)
+
+// registerPasswordlessRoutes serves email sign-in with a one-time code or
+// magic link
+func (h *AuthHandlers) registerPasswordlessRoutes() {
+	passwordlessGroup := h.ginEngine.Group("/auth/passwordless")
+	{
+		passwordlessGroup.POST("/start", func(ctx *gin.Context) {
+			var startDTO dto.PasswordlessStartDTO
+			if err := ctx.ShouldBindJSON(&startDTO); err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("Invalid request body"))
+				return
+			}
+			startResponse, err := h.PasswordlessService.Start(startDTO)
+			if errors.Is(err, config.ErrMailerNotConfigured) {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("Passwordless login is not configured"))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to start passwordless login"))
+				return
+			}
+			responseutils.SuccessResponse(ctx, http.StatusOK, startResponse, "If the email belongs to an account, a sign-in code has been sent")
+		})
+
+		passwordlessGroup.POST("/verify", func(ctx *gin.Context) {
+			var verifyDTO dto.PasswordlessVerifyDTO
+			if err := ctx.ShouldBindJSON(&verifyDTO); err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("Invalid request body"))
+				return
+			}
+			loginResponse, err := h.LoginService.LoginWithPasswordless(verifyDTO, h.clientIP(ctx))
+			// Start hands out a token for any email, so every failure looks the
+			// same whether or not the token belongs to an account
+			if errors.Is(err, config.ErrInvalidPasswordlessToken) || errors.Is(err, config.ErrInvalidPasswordlessCode) ||
+				errors.Is(err, config.ErrAccountLocked) || errors.Is(err, config.ErrTenantNotFound) {
+				responseutils.ErrorResponse(ctx, responseutils.Unauthorized("Sign-in code is invalid or expired"))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to login"))
+				return
+			}
+			if loginResponse.MFARequired {
+				responseutils.SuccessResponse(ctx, http.StatusOK, loginResponse, "MFA verification required")
+				return
+			} else if loginResponse.MFAEnrolmentRequired {
+				responseutils.SuccessResponse(ctx, http.StatusOK, loginResponse, "MFA enrolment required")
+				return
+			}
+			setSessionCookie(ctx, loginResponse.AccessToken, int(loginResponse.ExpiresIn))
+			responseutils.SuccessResponse(ctx, http.StatusOK, loginResponse, "Login successful")
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package authhandlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	responseutils "github.com/geekible-ltd/response-utils"
+	"github.com/gin-gonic/gin"
+)
+
+// registerTenantLicenceRoutes shows tenant administrators their tenant's
+// licence. Only administrators can change it, and only after a recent
+// authentication.
+func (h *AuthHandlers) registerTenantLicenceRoutes() {
+	licenceGroup := h.ginEngine.Group("/tenant/licence")
+	licenceGroup.Use(h.bearerAuthMiddleware())
+	{
+		licenceGroup.GET("", h.requireRoles(config.UserRoleSuperAdmin, config.UserRoleAdmin, config.UserRoleTenantAdmin), func(ctx *gin.Context) {
+			tenantID, ok := tenantIDFromContext(ctx)
+			if !ok {
+				return
+			}
+
+			licence, err := h.TenantLicenceService.GetTenantLicenceByTenantID(tenantID)
+			if errors.Is(err, config.ErrTenantLicenceNotFound) {
+				responseutils.ErrorResponse(ctx, responseutils.NotFound("Tenant licence"))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to get tenant licence"))
+				return
+			}
+			responseutils.SuccessResponse(ctx, http.StatusOK, licence, "Tenant licence retrieved successfully")
+		})
+
+		licenceGroup.PUT("", h.requireRoles(config.UserRoleSuperAdmin, config.UserRoleAdmin), h.requireRecentAuth(), func(ctx *gin.Context) {
+			var licenceDTO dto.TenantLicenceUpdateRequestDTO
+			if err := ctx.ShouldBindJSON(&licenceDTO); err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("Invalid request body"))
+				return
+			}
+
+			tenantID, ok := tenantIDFromContext(ctx)
+			if !ok {
+				return
+			}
+
+			err := h.TenantLicenceService.UpdateTenantLicence(tenantID, &licenceDTO)
+			if errors.Is(err, config.ErrTenantLicenceNotFound) {
+				responseutils.ErrorResponse(ctx, responseutils.NotFound("Tenant licence"))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to update tenant licence"))
+				return
+			}
+			responseutils.SuccessResponse(ctx, http.StatusOK, nil, "Tenant licence updated successfully")
+		})
+	}
+}
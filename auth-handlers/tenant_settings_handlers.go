@@ -0,0 +1,162 @@
+package authhandlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	responseutils "github.com/geekible-ltd/response-utils"
+	"github.com/gin-gonic/gin"
+)
+
+// registerTenantSettingsRoutes lets tenant administrators manage the security
+// policies of their own tenant
+func (h *AuthHandlers) registerTenantSettingsRoutes() {
+	settingsGroup := h.ginEngine.Group("/tenant/settings")
+	settingsGroup.Use(h.bearerAuthMiddleware(), h.requireRoles(config.UserRoleSuperAdmin, config.UserRoleAdmin, config.UserRoleTenantAdmin))
+	{
+		settingsGroup.GET("/mfa", func(ctx *gin.Context) {
+			tenantID, ok := tenantIDFromContext(ctx)
+			if !ok {
+				return
+			}
+
+			policy, err := h.TenantSettingsService.GetMFAPolicy(tenantID)
+			if errors.Is(err, config.ErrTenantNotFound) {
+				responseutils.ErrorResponse(ctx, responseutils.NotFound("Tenant"))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to get MFA policy"))
+				return
+			}
+			responseutils.SuccessResponse(ctx, http.StatusOK, policy, "MFA policy retrieved successfully")
+		})
+
+		settingsGroup.PUT("/mfa", func(ctx *gin.Context) {
+			var policyDTO dto.MFAPolicyDTO
+			if err := ctx.ShouldBindJSON(&policyDTO); err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("Invalid request body"))
+				return
+			}
+
+			tenantID, ok := tenantIDFromContext(ctx)
+			if !ok {
+				return
+			}
+
+			err := h.TenantSettingsService.UpdateMFAPolicy(tenantID, policyDTO)
+			if errors.Is(err, config.ErrTenantNotFound) {
+				responseutils.ErrorResponse(ctx, responseutils.NotFound("Tenant"))
+				return
+			} else if errors.Is(err, config.ErrInvalidRole) || errors.Is(err, config.ErrInvalidNetwork) {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest(err.Error()))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to update MFA policy"))
+				return
+			}
+			responseutils.SuccessResponse(ctx, http.StatusOK, nil, "MFA policy updated successfully")
+		})
+
+		settingsGroup.GET("/email-verification", func(ctx *gin.Context) {
+			tenantID, ok := tenantIDFromContext(ctx)
+			if !ok {
+				return
+			}
+
+			policy, err := h.TenantSettingsService.GetEmailVerificationPolicy(tenantID)
+			if errors.Is(err, config.ErrTenantNotFound) {
+				responseutils.ErrorResponse(ctx, responseutils.NotFound("Tenant"))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to get email verification policy"))
+				return
+			}
+			responseutils.SuccessResponse(ctx, http.StatusOK, policy, "Email verification policy retrieved successfully")
+		})
+
+		settingsGroup.PUT("/email-verification", func(ctx *gin.Context) {
+			var policyDTO dto.EmailVerificationPolicyDTO
+			if err := ctx.ShouldBindJSON(&policyDTO); err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("Invalid request body"))
+				return
+			}
+
+			tenantID, ok := tenantIDFromContext(ctx)
+			if !ok {
+				return
+			}
+
+			err := h.TenantSettingsService.UpdateEmailVerificationPolicy(tenantID, policyDTO)
+			if errors.Is(err, config.ErrTenantNotFound) {
+				responseutils.ErrorResponse(ctx, responseutils.NotFound("Tenant"))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to update email verification policy"))
+				return
+			}
+			responseutils.SuccessResponse(ctx, http.StatusOK, nil, "Email verification policy updated successfully")
+		})
+
+		settingsGroup.GET("/password-policy", func(ctx *gin.Context) {
+			tenantID, ok := tenantIDFromContext(ctx)
+			if !ok {
+				return
+			}
+
+			policy, err := h.TenantSettingsService.GetPasswordPolicy(tenantID)
+			if errors.Is(err, config.ErrTenantNotFound) {
+				responseutils.ErrorResponse(ctx, responseutils.NotFound("Tenant"))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to get password policy"))
+				return
+			}
+			responseutils.SuccessResponse(ctx, http.StatusOK, policy, "Password policy retrieved successfully")
+		})
+
+		settingsGroup.PUT("/password-policy", func(ctx *gin.Context) {
+			var policyDTO dto.PasswordPolicyDTO
+			if err := ctx.ShouldBindJSON(&policyDTO); err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("Invalid request body"))
+				return
+			}
+
+			tenantID, ok := tenantIDFromContext(ctx)
+			if !ok {
+				return
+			}
+
+			err := h.TenantSettingsService.UpdatePasswordPolicy(tenantID, policyDTO)
+			if errors.Is(err, config.ErrTenantNotFound) {
+				responseutils.ErrorResponse(ctx, responseutils.NotFound("Tenant"))
+				return
+			} else if errors.Is(err, config.ErrInvalidPasswordPolicy) {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest(err.Error()))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to update password policy"))
+				return
+			}
+			responseutils.SuccessResponse(ctx, http.StatusOK, nil, "Password policy updated successfully")
+		})
+
+		settingsGroup.DELETE("/password-policy", func(ctx *gin.Context) {
+			tenantID, ok := tenantIDFromContext(ctx)
+			if !ok {
+				return
+			}
+
+			err := h.TenantSettingsService.ResetPasswordPolicy(tenantID)
+			if errors.Is(err, config.ErrTenantNotFound) {
+				responseutils.ErrorResponse(ctx, responseutils.NotFound("Tenant"))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to reset password policy"))
+				return
+			}
+			responseutils.SuccessResponse(ctx, http.StatusOK, nil, "Password policy reset to the server default")
+		})
+	}
+}
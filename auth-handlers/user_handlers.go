@@ -0,0 +1,241 @@
+package authhandlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	responseutils "github.com/geekible-ltd/response-utils"
+	"github.com/gin-gonic/gin"
+)
+
+// roleRank orders the user roles by privilege. Administrators can only manage
+// users holding, and assign, roles up to their own.
+var roleRank = map[string]int{
+	config.UserRoleTenantUser:  1,
+	config.UserRoleTenantAdmin: 2,
+	config.UserRoleAdmin:       3,
+	config.UserRoleSuperAdmin:  4,
+}
+
+// registerUserRoutes lets tenant administrators manage the users of their own
+// tenant. Role changes, deletions and imports require a recent authentication.
+// Locked out users can be unlocked before their lock expires.
+func (h *AuthHandlers) registerUserRoutes() {
+	userGroup := h.ginEngine.Group("/users")
+	userGroup.Use(h.bearerAuthMiddleware(), h.requireRoles(config.UserRoleSuperAdmin, config.UserRoleAdmin, config.UserRoleTenantAdmin))
+	{
+		userGroup.GET("", func(ctx *gin.Context) {
+			tenantID, ok := tenantIDFromContext(ctx)
+			if !ok {
+				return
+			}
+
+			users, err := h.UserService.GetAllUsers(tenantID)
+			if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to get users"))
+				return
+			}
+			responseutils.SuccessResponse(ctx, http.StatusOK, users, "Users retrieved successfully")
+		})
+
+		userGroup.GET("/:id", func(ctx *gin.Context) {
+			userID, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+			if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.NotFound("User"))
+				return
+			}
+
+			tenantID, ok := tenantIDFromContext(ctx)
+			if !ok {
+				return
+			}
+
+			user, err := h.UserService.GetUserByID(tenantID, uint(userID))
+			if errors.Is(err, config.ErrUserNotFound) {
+				responseutils.ErrorResponse(ctx, responseutils.NotFound("User"))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to get user"))
+				return
+			}
+			responseutils.SuccessResponse(ctx, http.StatusOK, user, "User retrieved successfully")
+		})
+
+		userGroup.PUT("/:id", func(ctx *gin.Context) {
+			var userDTO dto.UserUpdateRequestDTO
+			if err := ctx.ShouldBindJSON(&userDTO); err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("Invalid request body"))
+				return
+			}
+
+			userID, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+			if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.NotFound("User"))
+				return
+			}
+
+			tenantID, ok := tenantIDFromContext(ctx)
+			if !ok {
+				return
+			}
+
+			user, err := h.UserService.GetUserByID(tenantID, uint(userID))
+			if errors.Is(err, config.ErrUserNotFound) {
+				responseutils.ErrorResponse(ctx, responseutils.NotFound("User"))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to get user"))
+				return
+			}
+
+			if !canManageRole(ctx, user.Role) || (userDTO.Role != "" && !canManageRole(ctx, userDTO.Role)) {
+				responseutils.ErrorResponse(ctx, responseutils.Forbidden("Insufficient permissions"))
+				return
+			}
+			if userDTO.Role != "" && userDTO.Role != user.Role && !h.recentlyAuthenticated(ctx) {
+				return
+			}
+
+			err = h.UserService.UpdateUser(tenantID, uint(userID), userDTO)
+			if errors.Is(err, config.ErrUserNotFound) {
+				responseutils.ErrorResponse(ctx, responseutils.NotFound("User"))
+				return
+			} else if errors.Is(err, config.ErrInvalidRole) {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest(err.Error()))
+				return
+			} else if errors.Is(err, config.ErrUserAlreadyExists) {
+				responseutils.ErrorResponse(ctx, responseutils.Conflict("A user with this email already exists"))
+				return
+			} else if errors.Is(err, config.ErrVerificationEmailNotSent) {
+				responseutils.SuccessResponse(ctx, http.StatusOK, nil, "User updated successfully, but the verification email could not be sent")
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to update user"))
+				return
+			}
+			responseutils.SuccessResponse(ctx, http.StatusOK, nil, "User updated successfully")
+		})
+
+		userGroup.DELETE("/:id", h.requireRecentAuth(), func(ctx *gin.Context) {
+			userID, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+			if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.NotFound("User"))
+				return
+			}
+
+			tenantID, ok := tenantIDFromContext(ctx)
+			if !ok {
+				return
+			}
+
+			user, err := h.UserService.GetUserByID(tenantID, uint(userID))
+			if errors.Is(err, config.ErrUserNotFound) {
+				responseutils.ErrorResponse(ctx, responseutils.NotFound("User"))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to get user"))
+				return
+			}
+			if !canManageRole(ctx, user.Role) {
+				responseutils.ErrorResponse(ctx, responseutils.Forbidden("Insufficient permissions"))
+				return
+			}
+
+			err = h.UserService.DeleteUser(tenantID, uint(userID))
+			if errors.Is(err, config.ErrUserNotFound) {
+				responseutils.ErrorResponse(ctx, responseutils.NotFound("User"))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to delete user"))
+				return
+			}
+			responseutils.SuccessResponse(ctx, http.StatusOK, nil, "User deleted successfully")
+		})
+
+		userGroup.POST("/:id/unlock", func(ctx *gin.Context) {
+			userID, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+			if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.NotFound("User"))
+				return
+			}
+
+			tenantID, ok := tenantIDFromContext(ctx)
+			if !ok {
+				return
+			}
+
+			user, err := h.UserService.GetUserByID(tenantID, uint(userID))
+			if errors.Is(err, config.ErrUserNotFound) {
+				responseutils.ErrorResponse(ctx, responseutils.NotFound("User"))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to get user"))
+				return
+			}
+			if !canManageRole(ctx, user.Role) {
+				responseutils.ErrorResponse(ctx, responseutils.Forbidden("Insufficient permissions"))
+				return
+			}
+
+			err = h.UserService.UnlockUser(tenantID, uint(userID))
+			if errors.Is(err, config.ErrUserNotFound) {
+				responseutils.ErrorResponse(ctx, responseutils.NotFound("User"))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to unlock user"))
+				return
+			}
+			responseutils.SuccessResponse(ctx, http.StatusOK, nil, "User unlocked successfully")
+		})
+
+		userGroup.POST("/import", h.requireRecentAuth(), func(ctx *gin.Context) {
+			var importDTO dto.UserImportRequestDTO
+			if err := ctx.ShouldBindJSON(&importDTO); err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("Invalid request body"))
+				return
+			}
+
+			tenantID, ok := tenantIDFromContext(ctx)
+			if !ok {
+				return
+			}
+
+			for _, userDTO := range importDTO.Users {
+				if !canManageRole(ctx, userDTO.Role) {
+					responseutils.ErrorResponse(ctx, responseutils.Forbidden("Insufficient permissions"))
+					return
+				}
+			}
+
+			result, err := h.UserImportService.ImportUsers(tenantID, importDTO.Users)
+			if errors.Is(err, config.ErrTooManyUsersToImport) {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest(fmt.Sprintf("At most %d users can be imported at once", config.MaxUsersPerImport)))
+				return
+			} else if errors.Is(err, config.ErrTenantLicenceNotFound) {
+				responseutils.ErrorResponse(ctx, responseutils.NotFound("Tenant licence"))
+				return
+			} else if errors.Is(err, config.ErrTenantLicenceExpired) {
+				responseutils.ErrorResponse(ctx, responseutils.Forbidden("Tenant licence has expired"))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to import users"))
+				return
+			}
+			responseutils.SuccessResponse(ctx, http.StatusOK, result, "Users imported")
+		})
+	}
+}
+
+// canManageRole reports whether the authenticated user's role is at least as
+// privileged as role
+func canManageRole(ctx *gin.Context, role string) bool {
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		return false
+	}
+	return roleRank[role] <= roleRank[claims.Role]
+}
@@ -0,0 +1,180 @@
+package authhandlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	responseutils "github.com/geekible-ltd/response-utils"
+	"github.com/gin-gonic/gin"
+)
+
+// registerWebAuthnRoutes serves passkey logins, security key assertions for
+// the MFA step and lets users manage their own credentials
+func (h *AuthHandlers) registerWebAuthnRoutes() {
+	webAuthnGroup := h.ginEngine.Group("/auth/webauthn")
+	{
+		webAuthnGroup.POST("/login/begin", func(ctx *gin.Context) {
+			options, err := h.WebAuthnService.BeginLogin()
+			if errors.Is(err, config.ErrWebAuthnNotConfigured) {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("WebAuthn is not configured"))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to start passkey login"))
+				return
+			}
+			responseutils.SuccessResponse(ctx, http.StatusOK, options, "Passkey login started")
+		})
+
+		webAuthnGroup.POST("/login/finish", func(ctx *gin.Context) {
+			var loginDTO dto.WebAuthnLoginDTO
+			if err := ctx.ShouldBindJSON(&loginDTO); err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("Invalid request body"))
+				return
+			}
+			loginResponse, err := h.LoginService.LoginWithPasskey(loginDTO, h.clientIP(ctx))
+			if errors.Is(err, config.ErrWebAuthnNotConfigured) {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("WebAuthn is not configured"))
+				return
+			} else if errors.Is(err, config.ErrInvalidWebAuthnSession) || errors.Is(err, config.ErrWebAuthnVerificationFailed) || errors.Is(err, config.ErrTenantNotFound) {
+				responseutils.ErrorResponse(ctx, responseutils.Unauthorized("Passkey verification failed"))
+				return
+			} else if errors.Is(err, config.ErrEmailNotVerified) {
+				responseutils.ErrorResponse(ctx, responseutils.Forbidden("Email address has not been verified"))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to login"))
+				return
+			}
+			setSessionCookie(ctx, loginResponse.AccessToken, int(loginResponse.ExpiresIn))
+			responseutils.SuccessResponse(ctx, http.StatusOK, loginResponse, "Login successful")
+		})
+
+		webAuthnGroup.POST("/mfa/begin", func(ctx *gin.Context) {
+			var mfaDTO dto.MFATokenDTO
+			if err := ctx.ShouldBindJSON(&mfaDTO); err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("Invalid request body"))
+				return
+			}
+			options, err := h.MFAService.BeginWebAuthnChallenge(mfaDTO.MFAToken)
+			if errors.Is(err, config.ErrInvalidMFAToken) {
+				responseutils.ErrorResponse(ctx, responseutils.Unauthorized("MFA token is invalid or expired; log in again"))
+				return
+			} else if errors.Is(err, config.ErrWebAuthnNotConfigured) {
+				responseutils.ErrorResponse(ctx, responseutils.BadRequest("WebAuthn is not configured"))
+				return
+			} else if err != nil {
+				responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to start security key verification"))
+				return
+			}
+			responseutils.SuccessResponse(ctx, http.StatusOK, options, "Security key verification started")
+		})
+
+		webAuthnGroupProtected := webAuthnGroup.Group("")
+		webAuthnGroupProtected.Use(h.bearerAuthMiddleware())
+		{
+			webAuthnGroupProtected.GET("/credentials", func(ctx *gin.Context) {
+				tenantID, userID, ok := userFromContext(ctx)
+				if !ok {
+					return
+				}
+
+				credentials, err := h.WebAuthnService.GetCredentials(tenantID, userID)
+				if err != nil {
+					responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to get credentials"))
+					return
+				}
+				responseutils.SuccessResponse(ctx, http.StatusOK, credentials, "Credentials retrieved successfully")
+			})
+
+			webAuthnGroupProtected.POST("/register/begin", func(ctx *gin.Context) {
+				tenantID, userID, ok := userFromContext(ctx)
+				if !ok {
+					return
+				}
+
+				options, err := h.WebAuthnService.BeginRegistration(tenantID, userID)
+				if errors.Is(err, config.ErrWebAuthnNotConfigured) {
+					responseutils.ErrorResponse(ctx, responseutils.BadRequest("WebAuthn is not configured"))
+					return
+				} else if err != nil {
+					responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to start registration"))
+					return
+				}
+				responseutils.SuccessResponse(ctx, http.StatusOK, options, "Registration started")
+			})
+
+			webAuthnGroupProtected.POST("/register/finish", func(ctx *gin.Context) {
+				var registrationDTO dto.WebAuthnRegistrationDTO
+				if err := ctx.ShouldBindJSON(&registrationDTO); err != nil {
+					responseutils.ErrorResponse(ctx, responseutils.BadRequest("Invalid request body"))
+					return
+				}
+
+				tenantID, userID, ok := userFromContext(ctx)
+				if !ok {
+					return
+				}
+
+				enrolment, err := h.MFAService.EnrolWebAuthn(tenantID, userID, registrationDTO)
+				if errors.Is(err, config.ErrWebAuthnNotConfigured) || errors.Is(err, config.ErrInvalidWebAuthnSession) || errors.Is(err, config.ErrWebAuthnVerificationFailed) {
+					responseutils.ErrorResponse(ctx, responseutils.BadRequest(err.Error()))
+					return
+				} else if err != nil {
+					responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to register credential"))
+					return
+				}
+				ctx.Header("Cache-Control", "no-store")
+				responseutils.SuccessResponse(ctx, http.StatusCreated, enrolment, "Credential registered successfully")
+			})
+
+			webAuthnGroupProtected.DELETE("/credentials/:id", func(ctx *gin.Context) {
+				credentialID, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+				if err != nil {
+					responseutils.ErrorResponse(ctx, responseutils.NotFound("Credential"))
+					return
+				}
+
+				tenantID, userID, ok := userFromContext(ctx)
+				if !ok {
+					return
+				}
+
+				err = h.MFAService.RemoveWebAuthnCredential(tenantID, userID, uint(credentialID))
+				if errors.Is(err, config.ErrWebAuthnCredentialNotFound) {
+					responseutils.ErrorResponse(ctx, responseutils.NotFound("Credential"))
+					return
+				} else if err != nil {
+					responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to delete credential"))
+					return
+				}
+				responseutils.SuccessResponse(ctx, http.StatusOK, nil, "Credential deleted successfully")
+			})
+
+			webAuthnGroupProtected.POST("/reauthenticate/begin", func(ctx *gin.Context) {
+				tenantID, userID, ok := userFromContext(ctx)
+				if !ok {
+					return
+				}
+
+				options, err := h.WebAuthnService.BeginReauthentication(tenantID, userID)
+				if errors.Is(err, config.ErrWebAuthnNotConfigured) {
+					responseutils.ErrorResponse(ctx, responseutils.BadRequest("WebAuthn is not configured"))
+					return
+				} else if errors.Is(err, config.ErrWebAuthnCredentialNotFound) {
+					responseutils.ErrorResponse(ctx, responseutils.BadRequest("No security keys or passkeys are registered"))
+					return
+				} else if errors.Is(err, config.ErrUserNotFound) {
+					responseutils.ErrorResponse(ctx, responseutils.Unauthorized("Unauthorized"))
+					return
+				} else if err != nil {
+					responseutils.ErrorResponse(ctx, responseutils.InternalServerError("Failed to start security key verification"))
+					return
+				}
+				responseutils.SuccessResponse(ctx, http.StatusOK, options, "Security key verification started")
+			})
+		}
+	}
+}
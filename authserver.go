@@ -1,54 +1,291 @@
 package authserver
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"time"
+
 	authhandlers "github.com/geekible-ltd/auth-server/auth-handlers"
+	"github.com/geekible-ltd/auth-server/internal/config"
 	"github.com/geekible-ltd/auth-server/internal/models"
 	"github.com/geekible-ltd/auth-server/internal/repository"
 	"github.com/geekible-ltd/auth-server/internal/service"
+	"github.com/geekible-ltd/auth-server/mailer"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
 
 // AuthServer provides database migration and initialization for the auth server
 type AuthServer struct {
-	db                   *gorm.DB
-	jwtSecret            string
-	LoginService         *service.LoginService
-	RegistrationService  *service.UserRegistrationService
-	TenantService        *service.TenantService
-	UserService          *service.UserService
-	TenantLicenceService *service.TenantLicenceService
+	db                       *gorm.DB
+	KeyService               *service.KeyService
+	TokenService             *service.TokenService
+	RefreshTokenService      *service.RefreshTokenService
+	RevocationService        *service.RevocationService
+	LoginService             *service.LoginService
+	RegistrationService      *service.UserRegistrationService
+	TenantService            *service.TenantService
+	UserService              *service.UserService
+	TenantLicenceService     *service.TenantLicenceService
+	ClientService            *service.ClientService
+	OAuthService             *service.OAuthService
+	MFAService               *service.MFAService
+	WebAuthnService          *service.WebAuthnService
+	PasswordlessService      *service.PasswordlessService
+	TenantSettingsService    *service.TenantSettingsService
+	PasswordResetService     *service.PasswordResetService
+	EmailVerificationService *service.EmailVerificationService
+	UserImportService        *service.UserImportService
+
+	loginURL              string
+	consentURL            string
+	deviceVerificationURL string
+	stepUpMaxAge          time.Duration
+	trustedProxies        []netip.Prefix
+	configErr             error
 }
 
-// New creates a new AuthServer instance
-func NewAuthServer(db *gorm.DB, jwtSecret string) *AuthServer {
+// NewAuthServer creates a new AuthServer instance. An invalid configuration,
+// such as a malformed signing key encryption key, WebAuthn relying party or
+// password pepper or trusted proxy, is reported by Validate and stops
+// RegisterRoutes.
+func NewAuthServer(db *gorm.DB, jwtSecret string, opts ...Option) *AuthServer {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+
 	// Initialize repositories
 	userRepo := repository.NewUserRepository(db)
 	tenantRepo := repository.NewTenantRepository(db)
 	tenantLicenceRepo := repository.NewTenantLicenceRepository(db)
+	refreshTokenRepo := repository.NewRefreshTokenRepository(db)
+	tokenRevocationRepo := repository.NewTokenRevocationRepository(db)
+	signingKeyRepo := repository.NewSigningKeyRepository(db)
+	clientRepo := repository.NewClientRepository(db)
+	clientConsentRepo := repository.NewClientConsentRepository(db)
+	authorizationCodeRepo := repository.NewAuthorizationCodeRepository(db)
+	deviceCodeRepo := repository.NewDeviceCodeRepository(db)
+	mfaChallengeRepo := repository.NewMFAChallengeRepository(db)
+	recoveryCodeRepo := repository.NewRecoveryCodeRepository(db)
+	webAuthnCredentialRepo := repository.NewWebAuthnCredentialRepository(db)
+	webAuthnSessionRepo := repository.NewWebAuthnSessionRepository(db)
+	passwordlessChallengeRepo := repository.NewPasswordlessChallengeRepository(db)
+	tenantSettingsRepo := repository.NewTenantSettingsRepository(db)
+	passwordHistoryRepo := repository.NewPasswordHistoryRepository(db)
+
+	// Authenticator apps show the token issuer unless a name is configured
+	if o.mfaIssuer == "" {
+		o.mfaIssuer = o.tokenIssuer
+	}
+	if o.webAuthnRPDisplayName == "" {
+		o.webAuthnRPDisplayName = o.mfaIssuer
+	}
+
+	// Emails go out in the background, so response times do not reveal
+	// which addresses have accounts
+	if o.mailer != nil {
+		o.mailer = mailer.NewBackgroundMailer(o.mailer, func(message mailer.Message, err error) {
+			log.Printf("auth-server: sending %q email failed: %v", message.Subject, err)
+		})
+	}
+
+	// Retired keys must outlive every token they signed
+	if o.keyRetention < o.accessTokenTTL {
+		o.keyRetention = o.accessTokenTTL
+	}
+
+	var configErrs []error
+	keyService, err := service.NewKeyService(signingKeyRepo, jwtSecret, o.signingAlgorithm, o.keyRotationInterval, o.keyRotationOverlap, o.keyRetention, o.keyEncryptionKey)
+	if err != nil {
+		configErrs = append(configErrs, fmt.Errorf("signing key encryption key: %w", err))
+	}
+	tokenService := service.NewTokenService(keyService, o.tokenIssuer, o.tokenAudience, o.accessTokenTTL)
+	refreshTokenService := service.NewRefreshTokenService(refreshTokenRepo, o.refreshTokenTTL)
+	revocationService := service.NewRevocationService(tokenRevocationRepo, refreshTokenRepo)
+	clientService := service.NewClientService(clientRepo, tenantRepo, refreshTokenRepo, clientConsentRepo)
+	webAuthnService, err := service.NewWebAuthnService(userRepo, webAuthnCredentialRepo, webAuthnSessionRepo, o.webAuthnRPID, o.webAuthnRPDisplayName, o.webAuthnRPOrigins, o.webAuthnSessionTTL)
+	if err != nil {
+		configErrs = append(configErrs, fmt.Errorf("webauthn: %w", err))
+	}
+	tenantSettingsService := service.NewTenantSettingsService(tenantSettingsRepo, tenantRepo, o.passwordPolicy)
+	passwordHashService, err := service.NewPasswordHashService(userRepo, o.passwordHasher, o.passwordPepperVersion, o.passwordPeppers)
+	if err != nil {
+		configErrs = append(configErrs, fmt.Errorf("password pepper: %w", err))
+	}
+	var trustedProxies []netip.Prefix
+	for _, proxy := range o.trustedProxies {
+		prefix, err := service.ParseNetwork(proxy)
+		if err != nil {
+			configErrs = append(configErrs, fmt.Errorf("trusted proxy %q: %w", proxy, config.ErrInvalidNetwork))
+			continue
+		}
+		trustedProxies = append(trustedProxies, prefix)
+	}
+	lockoutService := service.NewLockoutService(userRepo, o.maxFailedLoginAttempts, o.lockoutDuration, o.maxLockoutDuration)
+	passwordPolicyService := service.NewPasswordPolicyService(passwordHistoryRepo, tenantSettingsService, passwordHashService, o.breachedPasswordChecker)
+	passwordlessService := service.NewPasswordlessService(userRepo, passwordlessChallengeRepo, lockoutService, o.mailer, o.passwordlessLinkURL, o.passwordlessTTL)
+	emailVerificationService := service.NewEmailVerificationService(userRepo, o.mailer, o.emailVerificationLinkURL, o.emailVerificationTTL)
+	mfaService := service.NewMFAService(userRepo, mfaChallengeRepo, recoveryCodeRepo, webAuthnService, o.mfaIssuer, o.mfaChallengeTTL, lockoutService)
 
 	// Initialize services with repositories
 	return &AuthServer{
-		db:                   db,
-		jwtSecret:            jwtSecret,
-		LoginService:         service.NewLoginService(userRepo, tenantRepo),
-		RegistrationService:  service.NewUserRegistrationService(userRepo, tenantRepo, tenantLicenceRepo),
-		TenantService:        service.NewTenantService(tenantRepo),
-		UserService:          service.NewUserService(userRepo),
-		TenantLicenceService: service.NewTenantLicenceService(tenantLicenceRepo),
+		db:                       db,
+		KeyService:               keyService,
+		TokenService:             tokenService,
+		RefreshTokenService:      refreshTokenService,
+		RevocationService:        revocationService,
+		LoginService:             service.NewLoginService(userRepo, tenantRepo, tokenService, refreshTokenService, revocationService, mfaService, webAuthnService, passwordlessService, tenantSettingsService, passwordPolicyService, passwordHashService, lockoutService),
+		RegistrationService:      service.NewUserRegistrationService(userRepo, tenantRepo, tenantLicenceRepo, revocationService, emailVerificationService, passwordPolicyService, passwordHashService),
+		TenantService:            service.NewTenantService(tenantRepo, revocationService),
+		UserService:              service.NewUserService(userRepo, revocationService, passwordPolicyService, passwordHashService, lockoutService, emailVerificationService),
+		TenantLicenceService:     service.NewTenantLicenceService(tenantLicenceRepo),
+		ClientService:            clientService,
+		OAuthService:             service.NewOAuthService(userRepo, authorizationCodeRepo, deviceCodeRepo, clientService, tokenService, refreshTokenService, revocationService, o.authorizationCodeTTL, o.deviceCodeTTL, clientConsentRepo),
+		MFAService:               mfaService,
+		WebAuthnService:          webAuthnService,
+		PasswordlessService:      passwordlessService,
+		TenantSettingsService:    tenantSettingsService,
+		PasswordResetService:     service.NewPasswordResetService(userRepo, revocationService, passwordPolicyService, passwordHashService, o.mailer, o.passwordResetLinkURL, o.passwordResetTTL),
+		EmailVerificationService: emailVerificationService,
+		UserImportService:        service.NewUserImportService(userRepo, tenantLicenceRepo),
+
+		loginURL:              o.loginURL,
+		consentURL:            o.consentURL,
+		deviceVerificationURL: o.deviceVerificationURL,
+		stepUpMaxAge:          o.stepUpMaxAge,
+		trustedProxies:        trustedProxies,
+		configErr:             errors.Join(configErrs...),
 	}
 }
 
-// MigrateDB runs automatic database migrations for all auth server models
+// Validate returns the configuration errors found by NewAuthServer, or nil
+// if the server is ready to serve requests
+func (a *AuthServer) Validate() error {
+	if a.configErr != nil {
+		return fmt.Errorf("auth-server: invalid configuration: %w", a.configErr)
+	}
+	return nil
+}
+
+// MigrateDB runs automatic database migrations for all auth server models.
+// The first time it runs against a database of a version whose failed login
+// lockout deactivated users, it logs how many users that may have left
+// deactivated. Reactivating them is up to the operator, with
+// UserService.ReactivateLegacyLockouts or the reactivate-lockouts command.
 func (a *AuthServer) MigrateDB() error {
-	return a.db.AutoMigrate(
+	// Databases from before time-based lockouts have no locked_until column
+	legacyLockout := a.db.Migrator().HasTable(&models.User{}) && !a.db.Migrator().HasColumn(&models.User{}, "LockedUntil")
+
+	err := a.db.AutoMigrate(
 		&models.User{},
 		&models.Tenant{},
 		&models.TenantLicence{},
+		&models.RefreshToken{},
+		&models.RevokedToken{},
+		&models.TokenRevocation{},
+		&models.SigningKey{},
+		&models.Client{},
+		&models.ClientConsent{},
+		&models.AuthorizationCode{},
+		&models.DeviceCode{},
+		&models.MFAChallenge{},
+		&models.RecoveryCode{},
+		&models.WebAuthnCredential{},
+		&models.WebAuthnSession{},
+		&models.PasswordlessChallenge{},
+		&models.TenantSettings{},
+		&models.PasswordHistory{},
 	)
+	if err != nil || !legacyLockout {
+		return err
+	}
+
+	lockedOut, err := a.UserService.LegacyLockouts()
+	if err != nil {
+		return err
+	}
+	if len(lockedOut) > 0 {
+		log.Printf("auth-server: %d inactive users may have been deactivated by the old failed login lockout; review them with reactivate-lockouts -dry-run", len(lockedOut))
+	}
+	return nil
 }
 
-func (a *AuthServer) RegisterRoutes(ginEngine *gin.Engine) {
-	authHandlers := authhandlers.NewAuthHandlers(a.jwtSecret, ginEngine, a.LoginService, a.RegistrationService, a.TenantService, a.UserService, a.TenantLicenceService)
+// StartKeyRotation ensures an asymmetric signing key exists and then rotates
+// keys in the background according to the configured schedule until ctx is
+// cancelled. It is a no-op for HS256.
+func (a *AuthServer) StartKeyRotation(ctx context.Context) error {
+	if a.KeyService.IsSymmetric() {
+		return nil
+	}
+	if err := a.KeyService.RotateIfDue(); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(config.KeyRotationCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := a.KeyService.RotateIfDue(); err != nil {
+					log.Printf("auth-server: signing key rotation failed: %v", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// StartExpiryCleanup periodically deletes expired refresh tokens,
+// authorization codes, device codes, MFA challenges, WebAuthn sessions,
+// passwordless sign-ins and revoked token records until ctx is cancelled
+func (a *AuthServer) StartExpiryCleanup(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(config.ExpiryCleanupInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := a.RefreshTokenService.PurgeExpired(); err != nil {
+					log.Printf("auth-server: purging expired refresh tokens failed: %v", err)
+				}
+				if err := a.OAuthService.PurgeExpired(); err != nil {
+					log.Printf("auth-server: purging expired codes failed: %v", err)
+				}
+				if err := a.MFAService.PurgeExpired(); err != nil {
+					log.Printf("auth-server: purging expired MFA challenges failed: %v", err)
+				}
+				if err := a.WebAuthnService.PurgeExpired(); err != nil {
+					log.Printf("auth-server: purging expired WebAuthn sessions failed: %v", err)
+				}
+				if err := a.PasswordlessService.PurgeExpired(); err != nil {
+					log.Printf("auth-server: purging expired passwordless sign-ins failed: %v", err)
+				}
+				if err := a.RevocationService.PurgeExpired(); err != nil {
+					log.Printf("auth-server: purging expired revocations failed: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// RegisterRoutes adds the auth server's routes to the engine. It adds none
+// and returns the error from Validate if the configuration is invalid, rather
+// than serve requests that would fail.
+func (a *AuthServer) RegisterRoutes(ginEngine *gin.Engine) error {
+	if err := a.Validate(); err != nil {
+		return err
+	}
+
+	authHandlers := authhandlers.NewAuthHandlers(ginEngine, a.KeyService, a.TokenService, a.RevocationService, a.LoginService, a.RegistrationService, a.TenantService, a.UserService, a.TenantLicenceService, a.ClientService, a.OAuthService, a.MFAService, a.WebAuthnService, a.PasswordlessService, a.TenantSettingsService, a.PasswordResetService, a.EmailVerificationService, a.UserImportService, a.loginURL, a.consentURL, a.deviceVerificationURL, a.stepUpMaxAge, a.trustedProxies)
 	authHandlers.RegisterRoutes()
+	return nil
 }
@@ -0,0 +1,98 @@
+package authserver
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestValidate(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	pepper := []byte(strings.Repeat("p", config.MinPasswordPepperLength))
+
+	tests := []struct {
+		name    string
+		opts    []Option
+		invalid bool
+		// wantErr is the sentinel the error wraps, if there is one
+		wantErr error
+	}{
+		{name: "accepts the defaults"},
+		{name: "accepts a pepper", opts: []Option{WithPasswordPepper(1, map[int][]byte{1: pepper})}},
+		{name: "rejects a short signing key encryption key", opts: []Option{WithSigningAlgorithm(config.SigningAlgorithmRS256), WithSigningKeyEncryptionKey([]byte("short"))}, invalid: true, wantErr: config.ErrSigningKeyEncryptionKey},
+		{name: "rejects a current pepper version without a key", opts: []Option{WithPasswordPepper(2, map[int][]byte{1: pepper})}, invalid: true, wantErr: config.ErrInvalidPasswordPepper},
+		{name: "accepts trusted proxies", opts: []Option{WithTrustedProxies("10.0.0.0/8", "192.0.2.1")}},
+		{name: "rejects an invalid trusted proxy", opts: []Option{WithTrustedProxies("10.0.0.0/33")}, invalid: true, wantErr: config.ErrInvalidNetwork},
+		{name: "rejects a WebAuthn relying party without origins", opts: []Option{WithWebAuthn("example.com", "Example")}, invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Discard})
+			if err != nil {
+				t.Fatal(err)
+			}
+			authServer := NewAuthServer(db, "test-secret", tt.opts...)
+
+			err = authServer.Validate()
+			if (err != nil) != tt.invalid || (tt.wantErr != nil && !errors.Is(err, tt.wantErr)) {
+				t.Fatalf("Validate() error = %v, want invalid %v with %v", err, tt.invalid, tt.wantErr)
+			}
+
+			// An invalid server adds no routes
+			router := gin.New()
+			registerErr := authServer.RegisterRoutes(router)
+			if (registerErr != nil) != tt.invalid || (len(router.Routes()) == 0) != tt.invalid {
+				t.Errorf("RegisterRoutes() error = %v with %d routes, want invalid %v", registerErr, len(router.Routes()), tt.invalid)
+			}
+		})
+	}
+}
+
+func TestMigrateDBLeavesLegacyLockouts(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to :memory: is a separate database
+	sqlDB.SetMaxOpenConns(1)
+	authServer := NewAuthServer(db, "test-secret")
+	if err := authServer.MigrateDB(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A user the lockout of an earlier version deactivated, in a database
+	// from before locked_until
+	user := &models.User{TenantID: 1, Email: "user@example.com", Role: config.UserRoleTenantUser}
+	if err := db.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(user).Updates(map[string]interface{}{"is_active": false, "failed_login_attempts": config.LegacyMaxFailedLoginAttempts}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Migrator().DropColumn(&models.User{}, "LockedUntil"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := authServer.MigrateDB(); err != nil {
+		t.Fatal(err)
+	}
+	var got models.User
+	if err := db.First(&got, user.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if got.IsActive {
+		t.Error("MigrateDB() reactivated the user")
+	}
+}
@@ -0,0 +1,81 @@
+// Package breached defines how the auth server screens new passwords against
+// known data breaches, and provides an offline implementation that reads a
+// Have I Been Pwned style SHA-1 range corpus from disk.
+package breached
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Checker reports whether a password is known to have been exposed in a data
+// breach. Implementations should return an error rather than false when they
+// cannot tell, so a broken corpus does not quietly let such passwords through.
+type Checker interface {
+	IsBreached(password string) (bool, error)
+}
+
+// prefixLength is the number of hex digits of the SHA-1 hash that name a range file
+const prefixLength = 5
+
+// RangeFileChecker looks passwords up in a directory of range files, as
+// written by the Have I Been Pwned downloader. Each file is named after the
+// first five hex digits of the SHA-1 hashes it holds, e.g. "5BAA6.txt", and
+// lists the remaining 35 digits of each hash with its breach count, one
+// "SUFFIX:COUNT" per line. Passwords are hashed locally and never leave the
+// machine.
+type RangeFileChecker struct {
+	Dir string
+	// MinCount ignores hashes seen in fewer breaches, to only reject
+	// passwords that are commonly used by attackers. Zero counts every hash.
+	MinCount int
+}
+
+func NewRangeFileChecker(dir string, minCount int) *RangeFileChecker {
+	return &RangeFileChecker{
+		Dir:      dir,
+		MinCount: minCount,
+	}
+}
+
+func (c *RangeFileChecker) IsBreached(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:prefixLength], hash[prefixLength:]
+
+	file, err := os.Open(filepath.Join(c.Dir, prefix+".txt"))
+	if errors.Is(err, fs.ErrNotExist) {
+		// A partial corpus has no file for ranges without breached hashes,
+		// but a missing directory means the corpus is misconfigured
+		if _, statErr := os.Stat(c.Dir); statErr != nil {
+			return false, statErr
+		}
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lineSuffix, count, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if !strings.EqualFold(lineSuffix, suffix) {
+			continue
+		}
+		if c.MinCount > 0 {
+			n, err := strconv.Atoi(count)
+			if err == nil && n < c.MinCount {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+	return false, scanner.Err()
+}
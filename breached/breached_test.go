@@ -0,0 +1,60 @@
+package breached
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeRange writes the range file holding password's hash, with the given
+// breach count, among unrelated hashes
+func writeRange(t *testing.T, dir, password, count string) {
+	t.Helper()
+
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	lines := "0018A45C4D1DEF81644B54AB7F969B88D65:1\r\n" + hash[prefixLength:] + ":" + count + "\r\n00D4F6E8FA6EECAD2A3AA415EEC418D38EC:2\r\n"
+	if err := os.WriteFile(filepath.Join(dir, hash[:prefixLength]+".txt"), []byte(lines), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRangeFileChecker(t *testing.T) {
+	tests := []struct {
+		name     string
+		count    string
+		minCount int
+		password string
+		missing  bool
+		want     bool
+		wantErr  bool
+	}{
+		{name: "finds a breached password", count: "3861493", password: "password", want: true},
+		{name: "ignores a hash below the minimum count", count: "2", minCount: 10, password: "password"},
+		{name: "finds a hash at the minimum count", count: "10", minCount: 10, password: "password", want: true},
+		{name: "counts a hash without a count when a minimum is set", count: "", minCount: 10, password: "password", want: true},
+		{name: "treats a missing range file as not breached", count: "1", password: "another-password-entirely"},
+		{name: "fails when the corpus directory is missing", password: "password", missing: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeRange(t, dir, "password", tt.count)
+			if tt.missing {
+				dir = filepath.Join(dir, "missing")
+			}
+
+			got, err := NewRangeFileChecker(dir, tt.minCount).IsBreached(tt.password)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("IsBreached() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("IsBreached() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+// Command import-users imports users exported from another identity provider
+// into a tenant, keeping their password hashes. The input is a JSON file in
+// the format of POST /users/import:
+//
+//	import-users -db auth.db -tenant 1 -file users.json
+//
+// It opens a SQLite database like the example server; to import into another
+// database, call AuthServer.UserImportService.ImportUsers the same way with
+// that database's GORM driver.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/geekible-ltd/auth-server"
+	"github.com/geekible-ltd/auth-server/dto"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func main() {
+	dbPath := flag.String("db", "test.db", "SQLite database file")
+	tenantID := flag.Uint("tenant", 0, "ID of the tenant to import the users into")
+	filePath := flag.String("file", "", "JSON file with the users to import, or - for standard input")
+	flag.Parse()
+
+	if *tenantID == 0 || *filePath == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	input := os.Stdin
+	if *filePath != "-" {
+		file, err := os.Open(*filePath)
+		if err != nil {
+			log.Fatal("Failed to open import file:", err)
+		}
+		defer file.Close()
+		input = file
+	}
+
+	var importDTO dto.UserImportRequestDTO
+	if err := json.NewDecoder(input).Decode(&importDTO); err != nil {
+		log.Fatal("Failed to read import file:", err)
+	}
+
+	db, err := gorm.Open(sqlite.Open(*dbPath), &gorm.Config{})
+	if err != nil {
+		log.Fatal("Failed to connect to database:", err)
+	}
+
+	// Importing issues no tokens, so no signing secret is needed
+	authServer := authserver.NewAuthServer(db, "")
+	result, err := authServer.UserImportService.ImportUsers(*tenantID, importDTO.Users)
+	if err != nil {
+		log.Fatal("Import failed:", err)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(result); err != nil {
+		log.Fatal(err)
+	}
+	if len(result.Failed) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,58 @@
+// Command reactivate-lockouts reactivates users that the failed login lockout
+// of earlier versions deactivated. Lockouts now expire by themselves, but
+// users deactivated before the upgrade stay inactive until reactivated.
+// With -dry-run it lists the users it would reactivate and changes nothing:
+//
+//	reactivate-lockouts -db auth.db -dry-run
+//	reactivate-lockouts -db auth.db
+//
+// Users an administrator deactivated after as many failed logins match too,
+// so review the list first. It opens a SQLite database like the example
+// server; for another database, call AuthServer.UserService.LegacyLockouts
+// and ReactivateLegacyLockouts with that database's GORM driver.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/geekible-ltd/auth-server"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func main() {
+	dbPath := flag.String("db", "test.db", "SQLite database file")
+	dryRun := flag.Bool("dry-run", false, "list the users that would be reactivated without changing them")
+	flag.Parse()
+
+	db, err := gorm.Open(sqlite.Open(*dbPath), &gorm.Config{})
+	if err != nil {
+		log.Fatal("Failed to connect to database:", err)
+	}
+
+	// Reactivating issues no tokens, so no signing secret is needed
+	authServer := authserver.NewAuthServer(db, "")
+	if *dryRun {
+		users, err := authServer.UserService.LegacyLockouts()
+		if err != nil {
+			log.Fatal("Failed to list users:", err)
+		}
+
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(users); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	reactivated, err := authServer.UserService.ReactivateLegacyLockouts()
+	if err != nil {
+		log.Fatal("Reactivation failed:", err)
+	}
+	fmt.Printf("Reactivated %d users\n", reactivated)
+}
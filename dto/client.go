@@ -0,0 +1,39 @@
+package dto
+
+import "time"
+
+type ClientRegistrationDTO struct {
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	GrantTypes   []string `json:"grant_types"`
+	Scopes       []string `json:"scopes"`
+	IsPublic     bool     `json:"is_public"`
+	IsFirstParty bool     `json:"is_first_party"`
+}
+
+type ClientRequestDTO struct {
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	GrantTypes   []string `json:"grant_types"`
+	Scopes       []string `json:"scopes"`
+	IsFirstParty bool     `json:"is_first_party"`
+	IsActive     bool     `json:"is_active"`
+}
+
+type ClientResponseDTO struct {
+	ClientID     string    `json:"client_id"`
+	TenantID     uint      `json:"tenant_id"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	GrantTypes   []string  `json:"grant_types"`
+	Scopes       []string  `json:"scopes"`
+	IsPublic     bool      `json:"is_public"`
+	IsFirstParty bool      `json:"is_first_party"`
+	IsActive     bool      `json:"is_active"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type ClientCredentialsDTO struct {
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret,omitempty"`
+}
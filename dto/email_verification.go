@@ -0,0 +1,12 @@
+package dto
+
+// VerifyEmailDTO confirms a user's email address with the token from a
+// verification email
+type VerifyEmailDTO struct {
+	Token string `json:"token"`
+}
+
+// ResendVerificationDTO requests a new verification email
+type ResendVerificationDTO struct {
+	Email string `json:"email"`
+}
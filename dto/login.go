@@ -1,14 +1,42 @@
 package dto
 
+import "encoding/json"
+
 type LoginDTO struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
 }
 
+// LoginResponseDTO holds the issued tokens. When the user has MFA enabled the
+// tokens are omitted and MFAToken must be exchanged at /auth/mfa/verify. When
+// the tenant requires MFA and the user has no second factor, MFAToken must be
+// used to enrol one at /auth/mfa/enrol; that login also returns RecoveryCodes.
 type LoginResponseDTO struct {
-	TenantID uint   `json:"tenant_id"`
-	UserID   uint   `json:"user_id"`
-	Email    string `json:"email"`
-	Role     string `json:"role"`
+	TenantID             uint     `json:"tenant_id"`
+	UserID               uint     `json:"user_id"`
+	Email                string   `json:"email"`
+	Role                 string   `json:"role,omitempty"`
+	AccessToken          string   `json:"access_token,omitempty"`
+	TokenType            string   `json:"token_type,omitempty"`
+	ExpiresIn            int64    `json:"expires_in,omitempty"`
+	RefreshToken         string   `json:"refresh_token,omitempty"`
+	MFARequired          bool     `json:"mfa_required,omitempty"`
+	MFAEnrolmentRequired bool     `json:"mfa_enrolment_required,omitempty"`
+	MFAToken             string   `json:"mfa_token,omitempty"`
+	MFAMethods           []string `json:"mfa_methods,omitempty"`
+	RecoveryCodes        []string `json:"recovery_codes,omitempty"`
 }
 
+type RefreshTokenDTO struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// ReauthenticateDTO confirms the identity of a signed-in user with their
+// password, a TOTP or recovery code, or a security key assertion started at
+// /auth/webauthn/reauthenticate/begin
+type ReauthenticateDTO struct {
+	Password   string          `json:"password,omitempty"`
+	Code       string          `json:"code,omitempty"`
+	SessionID  string          `json:"session_id,omitempty"`
+	Credential json.RawMessage `json:"credential,omitempty"`
+}
@@ -0,0 +1,42 @@
+package dto
+
+import "encoding/json"
+
+// MFAVerifyDTO completes a login with a TOTP code, a recovery code or, after
+// /auth/webauthn/mfa/begin, the security key assertion in Credential
+type MFAVerifyDTO struct {
+	MFAToken   string          `json:"mfa_token"`
+	Code       string          `json:"code"`
+	Credential json.RawMessage `json:"credential,omitempty"`
+}
+
+// MFATokenDTO identifies a pending MFA login, to start a security key
+// assertion or enrolment for it
+type MFATokenDTO struct {
+	MFAToken string `json:"mfa_token"`
+}
+
+// MFACodeDTO carries a TOTP code confirming an MFA change
+type MFACodeDTO struct {
+	Code string `json:"code"`
+}
+
+// MFAStatusDTO describes the second factors a user has enrolled
+type MFAStatusDTO struct {
+	TOTPEnabled            bool  `json:"totp_enabled"`
+	WebAuthnCredentials    int64 `json:"webauthn_credentials"`
+	RecoveryCodesRemaining int64 `json:"recovery_codes_remaining"`
+}
+
+// TOTPEnrolmentDTO holds a new TOTP secret. OTPAuthURI is usually shown as a
+// QR code; Secret is for manual entry.
+type TOTPEnrolmentDTO struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+// RecoveryCodesDTO holds newly generated recovery codes. They are only
+// returned once; just their hashes are stored.
+type RecoveryCodesDTO struct {
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+}
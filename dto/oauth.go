@@ -0,0 +1,142 @@
+package dto
+
+import "time"
+
+// IntrospectionResponseDTO is the RFC 7662 token introspection response
+type IntrospectionResponseDTO struct {
+	Active    bool      `json:"active"`
+	Scope     string    `json:"scope,omitempty"`
+	ClientID  string    `json:"client_id,omitempty"`
+	Username  string    `json:"username,omitempty"`
+	TokenType string    `json:"token_type,omitempty"`
+	Exp       int64     `json:"exp,omitempty"`
+	Iat       int64     `json:"iat,omitempty"`
+	Nbf       int64     `json:"nbf,omitempty"`
+	Sub       string    `json:"sub,omitempty"`
+	Aud       string    `json:"aud,omitempty"`
+	Iss       string    `json:"iss,omitempty"`
+	Jti       string    `json:"jti,omitempty"`
+	TenantID  string    `json:"tenant_id,omitempty"`
+	Role      string    `json:"role,omitempty"`
+	Act       *ActorDTO `json:"act,omitempty"`
+}
+
+// OAuthErrorDTO is the RFC 6749 error response
+type OAuthErrorDTO struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// AuthorizationRequestDTO holds the /oauth/authorize query parameters
+type AuthorizationRequestDTO struct {
+	ResponseType        string `form:"response_type"`
+	ClientID            string `form:"client_id"`
+	RedirectURI         string `form:"redirect_uri"`
+	Scope               string `form:"scope"`
+	State               string `form:"state"`
+	Nonce               string `form:"nonce"`
+	Prompt              string `form:"prompt"`
+	MaxAge              string `form:"max_age"`
+	CodeChallenge       string `form:"code_challenge"`
+	CodeChallengeMethod string `form:"code_challenge_method"`
+
+	// Consent is the user's answer from the consent page, approve or deny.
+	// It is only accepted in a POST.
+	Consent string `form:"consent"`
+}
+
+// TokenRequestDTO holds the /oauth/token form parameters
+type TokenRequestDTO struct {
+	GrantType    string `form:"grant_type"`
+	Code         string `form:"code"`
+	RedirectURI  string `form:"redirect_uri"`
+	CodeVerifier string `form:"code_verifier"`
+	RefreshToken string `form:"refresh_token"`
+	DeviceCode   string `form:"device_code"`
+	Scope        string `form:"scope"`
+
+	// RFC 8693 token exchange parameters
+	SubjectToken       string   `form:"subject_token"`
+	SubjectTokenType   string   `form:"subject_token_type"`
+	ActorToken         string   `form:"actor_token"`
+	RequestedTokenType string   `form:"requested_token_type"`
+	Audience           []string `form:"audience"`
+}
+
+// TokenResponseDTO is the RFC 6749 access token response
+type TokenResponseDTO struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+
+	IssuedTokenType string `json:"issued_token_type,omitempty"`
+}
+
+// ActorDTO is the RFC 8693 "act" claim naming the client acting for the
+// subject. Act holds the previous actor when a delegated token is exchanged again.
+type ActorDTO struct {
+	Sub string    `json:"sub"`
+	Act *ActorDTO `json:"act,omitempty"`
+}
+
+// DeviceAuthorizationResponseDTO is the RFC 8628 device authorization response
+type DeviceAuthorizationResponseDTO struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+// DeviceAuthorizationInfoDTO describes a pending device authorization to the user approving it
+type DeviceAuthorizationInfoDTO struct {
+	UserCode   string    `json:"user_code"`
+	ClientID   string    `json:"client_id"`
+	ClientName string    `json:"client_name"`
+	Scope      string    `json:"scope"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// DeviceVerificationRequestDTO approves or denies a device authorization
+type DeviceVerificationRequestDTO struct {
+	UserCode string `json:"user_code" form:"user_code"`
+	Approve  bool   `json:"approve" form:"approve"`
+}
+
+// UserInfoDTO is the OpenID Connect UserInfo response
+type UserInfoDTO struct {
+	Sub           string `json:"sub"`
+	TenantID      string `json:"tenant_id"`
+	Name          string `json:"name,omitempty"`
+	GivenName     string `json:"given_name,omitempty"`
+	FamilyName    string `json:"family_name,omitempty"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+}
+
+// OpenIDConfigurationDTO is the OpenID Connect discovery document
+type OpenIDConfigurationDTO struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	RevocationEndpoint                string   `json:"revocation_endpoint"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	DeviceAuthorizationEndpoint       string   `json:"device_authorization_endpoint"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+	ACRValuesSupported                []string `json:"acr_values_supported"`
+	PromptValuesSupported             []string `json:"prompt_values_supported"`
+	AuthorizationResponseIssParameter bool     `json:"authorization_response_iss_parameter_supported"`
+}
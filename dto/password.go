@@ -0,0 +1,48 @@
+package dto
+
+// ForgotPasswordDTO requests a password reset email
+type ForgotPasswordDTO struct {
+	Email string `json:"email"`
+}
+
+// ResetPasswordDTO sets a new password with the token from a reset email
+type ResetPasswordDTO struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+// ChangePasswordDTO changes a signed-in user's password
+type ChangePasswordDTO struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// ExpiredPasswordChangeDTO replaces a password that has passed the policy's
+// maximum age, for users who cannot log in with it any more
+type ExpiredPasswordChangeDTO struct {
+	Email           string `json:"email"`
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// PasswordPolicyDTO describes the passwords a tenant's users may choose.
+// Lengths count characters. A zero MaxLength allows any length, a zero
+// HistoryDepth allows reusing passwords and a zero MaxAgeDays never expires
+// them. HistoryDepth counts the current password.
+type PasswordPolicyDTO struct {
+	MinLength            int  `json:"min_length"`
+	MaxLength            int  `json:"max_length"`
+	RequireUppercase     bool `json:"require_uppercase"`
+	RequireLowercase     bool `json:"require_lowercase"`
+	RequireDigit         bool `json:"require_digit"`
+	RequireSymbol        bool `json:"require_symbol"`
+	DisallowPersonalInfo bool `json:"disallow_personal_info"`
+	HistoryDepth         int  `json:"history_depth"`
+	MaxAgeDays           int  `json:"max_age_days"`
+}
+
+// PasswordViolationDTO is one way a password fails the password policy
+type PasswordViolationDTO struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
@@ -0,0 +1,21 @@
+package dto
+
+// PasswordlessStartDTO requests a sign-in code by email
+type PasswordlessStartDTO struct {
+	Email string `json:"email"`
+}
+
+// PasswordlessStartResponseDTO is returned whether or not the email belongs to
+// a user. PasswordlessToken is sent back with the emailed code.
+type PasswordlessStartResponseDTO struct {
+	PasswordlessToken string `json:"passwordless_token"`
+	ExpiresIn         int64  `json:"expires_in"`
+}
+
+// PasswordlessVerifyDTO completes an email sign-in with either the
+// passwordless token and emailed code, or the token from a magic link
+type PasswordlessVerifyDTO struct {
+	PasswordlessToken string `json:"passwordless_token"`
+	Code              string `json:"code"`
+	LinkToken         string `json:"link_token"`
+}
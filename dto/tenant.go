@@ -1,11 +1,12 @@
 package dto
 
 type TenantResponseDTO struct {
-	ID      uint   `json:"id"`
-	Name    string `json:"name"`
-	Email   string `json:"email"`
-	Phone   string `json:"phone"`
-	Address string `json:"address"`
+	ID      uint                `json:"id"`
+	Name    string              `json:"name"`
+	Email   string              `json:"email"`
+	Phone   string              `json:"phone"`
+	Address string              `json:"address"`
+	Clients []ClientResponseDTO `json:"clients,omitempty"`
 }
 
 type TenantRequestDTO struct {
@@ -0,0 +1,17 @@
+package dto
+
+// MFAPolicyDTO describes when a tenant's users must use a second factor. MFA
+// is required if RequireAll is set, if the user's role is in RequiredRoles, or
+// if TrustedNetworks is not empty and the login comes from outside them.
+// Networks are CIDR prefixes or single IP addresses.
+type MFAPolicyDTO struct {
+	RequireAll      bool     `json:"require_all"`
+	RequiredRoles   []string `json:"required_roles"`
+	TrustedNetworks []string `json:"trusted_networks"`
+}
+
+// EmailVerificationPolicyDTO controls whether a tenant's users must verify
+// their email address before they can log in
+type EmailVerificationPolicyDTO struct {
+	Required bool `json:"required"`
+}
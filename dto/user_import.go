@@ -0,0 +1,47 @@
+package dto
+
+// UserImportRequestDTO imports users exported from another identity provider
+// into the caller's tenant
+type UserImportRequestDTO struct {
+	Users []UserImportDTO `json:"users"`
+}
+
+// UserImportDTO is one exported user. Role defaults to tenant_user. Users
+// without a password can sign in by email or reset their password.
+type UserImportDTO struct {
+	FirstName       string               `json:"first_name"`
+	LastName        string               `json:"last_name"`
+	Email           string               `json:"email"`
+	Role            string               `json:"role"`
+	IsEmailVerified bool                 `json:"email_verified"`
+	Password        *ImportedPasswordDTO `json:"password"`
+}
+
+// ImportedPasswordDTO is a password hash in the exporting provider's format.
+// Algorithm is one of "bcrypt", "argon2", "scrypt", "pbkdf2-sha256" or
+// "salted-sha512". For bcrypt, argon2 and scrypt, Hash is the complete
+// encoded hash string, e.g. "$2b$10$..." or "$argon2id$v=19$...". For
+// pbkdf2-sha256 and salted-sha512, Hash and Salt are base64 encoded;
+// pbkdf2-sha256 also needs Iterations, and salted-sha512 takes SaltPosition,
+// "suffix" (the default, SHA-512 of password then salt) or "prefix".
+type ImportedPasswordDTO struct {
+	Algorithm    string `json:"algorithm"`
+	Hash         string `json:"hash"`
+	Salt         string `json:"salt"`
+	Iterations   int    `json:"iterations"`
+	SaltPosition string `json:"salt_position"`
+}
+
+// UserImportResultDTO reports which users were imported. Failed users were
+// skipped without affecting the others.
+type UserImportResultDTO struct {
+	Imported int                    `json:"imported"`
+	Failed   []UserImportFailureDTO `json:"failed"`
+}
+
+// UserImportFailureDTO explains why the user at Index of the request was not imported
+type UserImportFailureDTO struct {
+	Index int    `json:"index"`
+	Email string `json:"email"`
+	Error string `json:"error"`
+}
@@ -0,0 +1,46 @@
+package dto
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// WebAuthnOptionsDTO starts a WebAuthn ceremony. Options is passed to
+// navigator.credentials.create() or navigator.credentials.get(), and
+// SessionID is sent back with the result.
+type WebAuthnOptionsDTO struct {
+	SessionID string          `json:"session_id,omitempty"`
+	Options   json.RawMessage `json:"options"`
+}
+
+// WebAuthnRegistrationDTO finishes registering a security key or passkey.
+// Credential is the PublicKeyCredential returned by the browser. MFAToken is
+// only used when enrolling during login.
+type WebAuthnRegistrationDTO struct {
+	MFAToken   string          `json:"mfa_token,omitempty"`
+	SessionID  string          `json:"session_id"`
+	Name       string          `json:"name"`
+	Credential json.RawMessage `json:"credential"`
+}
+
+// WebAuthnLoginDTO finishes a passkey login
+type WebAuthnLoginDTO struct {
+	SessionID  string          `json:"session_id"`
+	Credential json.RawMessage `json:"credential"`
+}
+
+type WebAuthnCredentialDTO struct {
+	ID             uint       `json:"id"`
+	Name           string     `json:"name"`
+	Transports     []string   `json:"transports"`
+	BackupEligible bool       `json:"backup_eligible"`
+	LastUsedAt     *time.Time `json:"last_used_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// WebAuthnEnrolmentDTO describes a newly registered credential. RecoveryCodes
+// are only returned when it is the user's first second factor.
+type WebAuthnEnrolmentDTO struct {
+	Credential    WebAuthnCredentialDTO `json:"credential"`
+	RecoveryCodes []string              `json:"recovery_codes,omitempty"`
+}
@@ -27,7 +27,9 @@ func main() {
 	router := gin.Default()
 
 	// Register auth routes
-	authServer.RegisterRoutes(router)
+	if err := authServer.RegisterRoutes(router); err != nil {
+		log.Fatal(err)
+	}
 
 	// Add health check endpoint
 	router.GET("/health", func(c *gin.Context) {
@@ -0,0 +1,118 @@
+package hasher
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id parameters recommended by OWASP: 19 MiB of memory, 2 iterations
+// and 1 degree of parallelism
+const (
+	DefaultArgon2idMemory      = 19 * 1024
+	DefaultArgon2idIterations  = 2
+	DefaultArgon2idParallelism = 1
+)
+
+const (
+	argon2idSaltLength = 16
+	argon2idKeyLength  = 32
+)
+
+// Bounds on the parameters of a stored hash, so a hash cannot make
+// verification use unbounded memory or time. Memory is in KiB.
+const (
+	maxArgon2Memory     = 1024 * 1024
+	maxArgon2Iterations = 16
+	maxArgon2KeyLength  = 64
+)
+
+// Argon2idHasher hashes passwords with argon2id into
+// "$argon2id$v=19$m=<KiB>,t=<iterations>,p=<parallelism>$<salt>$<hash>"
+type Argon2idHasher struct {
+	// Memory is in KiB
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+}
+
+func NewArgon2idHasher(memory, iterations uint32, parallelism uint8) *Argon2idHasher {
+	return &Argon2idHasher{
+		Memory:      memory,
+		Iterations:  iterations,
+		Parallelism: parallelism,
+	}
+}
+
+func (h *Argon2idHasher) Handles(hash string) bool {
+	return phcID(hash) == "argon2id"
+}
+
+func (h *Argon2idHasher) Hash(password string) (string, error) {
+	salt, err := newSalt(argon2idSaltLength)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Iterations, h.Memory, h.Parallelism, argon2idKeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.Memory, h.Iterations, h.Parallelism, phcEncoding.EncodeToString(salt), phcEncoding.EncodeToString(key)), nil
+}
+
+func (h *Argon2idHasher) Verify(password, hash string) (bool, error) {
+	parsed, err := parseArgon2(hash, "argon2id")
+	if err != nil {
+		return false, err
+	}
+	key := argon2.IDKey([]byte(password), parsed.salt, parsed.iterations, parsed.memory, parsed.parallelism, uint32(len(parsed.key)))
+	return subtle.ConstantTimeCompare(key, parsed.key) == 1, nil
+}
+
+func (h *Argon2idHasher) Validate(hash string) error {
+	_, err := parseArgon2(hash, "argon2id")
+	return err
+}
+
+func (h *Argon2idHasher) NeedsRehash(hash string) bool {
+	parsed, err := parseArgon2(hash, "argon2id")
+	return err != nil || parsed.memory != h.Memory || parsed.iterations != h.Iterations || parsed.parallelism != h.Parallelism || len(parsed.key) != argon2idKeyLength
+}
+
+type argon2Hash struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+// parseArgon2 parses an argon2 PHC string of the variant and version 19
+func parseArgon2(hash, variant string) (argon2Hash, error) {
+	// "", variant, "v=19", params, salt, key
+	fields := strings.Split(hash, "$")
+	if len(fields) != 6 || fields[0] != "" || fields[1] != variant || fields[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return argon2Hash{}, ErrMalformedHash
+	}
+
+	params := phcParams(fields[3])
+	memory, errM := strconv.ParseUint(params["m"], 10, 32)
+	iterations, errT := strconv.ParseUint(params["t"], 10, 32)
+	parallelism, errP := strconv.ParseUint(params["p"], 10, 8)
+	salt, errS := phcEncoding.DecodeString(fields[4])
+	key, errK := phcEncoding.DecodeString(fields[5])
+	if errM != nil || errT != nil || errP != nil || errS != nil || errK != nil || iterations == 0 || parallelism == 0 || len(key) == 0 {
+		return argon2Hash{}, ErrMalformedHash
+	}
+	if memory > maxArgon2Memory || iterations > maxArgon2Iterations || len(key) > maxArgon2KeyLength {
+		return argon2Hash{}, ErrMalformedHash
+	}
+
+	return argon2Hash{
+		memory:      uint32(memory),
+		iterations:  uint32(iterations),
+		parallelism: uint8(parallelism),
+		salt:        salt,
+		key:         key,
+	}, nil
+}
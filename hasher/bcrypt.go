@@ -0,0 +1,63 @@
+package hasher
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// bcryptHashLength is the length of a bcrypt modular crypt string
+	bcryptHashLength = 60
+	// maxBcryptCost bounds the work a stored hash can make verification do
+	maxBcryptCost = 16
+)
+
+// BcryptHasher hashes passwords with bcrypt. bcrypt only uses the first 72
+// bytes of a password and refuses longer ones.
+type BcryptHasher struct {
+	Cost int
+}
+
+func NewBcryptHasher(cost int) *BcryptHasher {
+	return &BcryptHasher{Cost: cost}
+}
+
+func (h *BcryptHasher) Handles(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func (h *BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (h *BcryptHasher) Verify(password, hash string) (bool, error) {
+	if err := h.Validate(hash); err != nil {
+		return false, err
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) || errors.Is(err, bcrypt.ErrPasswordTooLong) {
+		return false, nil
+	} else if err != nil {
+		return false, ErrMalformedHash
+	}
+	return true, nil
+}
+
+func (h *BcryptHasher) Validate(hash string) error {
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil || len(hash) != bcryptHashLength || cost > maxBcryptCost {
+		return ErrMalformedHash
+	}
+	return nil
+}
+
+func (h *BcryptHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != h.Cost
+}
@@ -0,0 +1,76 @@
+// Package hasher defines how the auth server hashes and verifies passwords,
+// and provides bcrypt, argon2id and scrypt implementations. Hashes are
+// self-describing strings in the PHC string format (bcrypt keeps its own
+// modular crypt format), so a server can verify hashes made with earlier
+// algorithms or parameters and upgrade them when users log in.
+package hasher
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// ErrMalformedHash is returned when verifying a hash that cannot be parsed
+var ErrMalformedHash = errors.New("malformed password hash")
+
+// Verifier checks passwords against hashes in one format
+type Verifier interface {
+	// Handles reports whether hash is in the verifier's format
+	Handles(hash string) bool
+	// Verify reports whether password matches hash. It returns an error,
+	// rather than false, for a hash it cannot parse.
+	Verify(password, hash string) (bool, error)
+}
+
+// Validator is a verifier that can check a hash without a password, such as
+// when hashes are imported
+type Validator interface {
+	Verifier
+	// Validate returns ErrMalformedHash for a hash Verify would refuse,
+	// because it cannot be parsed or its parameters are beyond the limits
+	// the verifier will spend on a password
+	Validate(hash string) error
+}
+
+// Hasher hashes new passwords and verifies its own hashes
+type Hasher interface {
+	Verifier
+	Hash(password string) (string, error)
+	// NeedsRehash reports whether a hash the hasher handles was made with
+	// parameters other than its current ones
+	NeedsRehash(hash string) bool
+}
+
+// phcID returns the algorithm identifier of a "$id$..." hash string
+func phcID(hash string) string {
+	if !strings.HasPrefix(hash, "$") {
+		return ""
+	}
+	id, _, _ := strings.Cut(hash[1:], "$")
+	return id
+}
+
+// phcParams parses the "k=v,k=v" parameter section of a PHC string
+func phcParams(section string) map[string]string {
+	params := map[string]string{}
+	for _, pair := range strings.Split(section, ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		if ok {
+			params[key] = value
+		}
+	}
+	return params
+}
+
+func newSalt(length int) ([]byte, error) {
+	salt := make([]byte, length)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// PHC strings use standard base64 without padding
+var phcEncoding = base64.RawStdEncoding
@@ -0,0 +1,150 @@
+package hasher
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHashers(t *testing.T) {
+	tests := []struct {
+		name   string
+		hasher Hasher
+		// other uses the same algorithm with other parameters
+		other Hasher
+	}{
+		{name: "bcrypt", hasher: NewBcryptHasher(bcrypt.MinCost), other: NewBcryptHasher(bcrypt.MinCost + 1)},
+		{name: "argon2id", hasher: NewArgon2idHasher(64, 1, 1), other: NewArgon2idHasher(128, 1, 1)},
+		{name: "scrypt", hasher: NewScryptHasher(4, 8, 1), other: NewScryptHasher(5, 8, 1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hash, err := tt.hasher.Hash("Correct-Horse-7")
+			if err != nil {
+				t.Fatalf("Hash() error = %v", err)
+			}
+			if again, _ := tt.hasher.Hash("Correct-Horse-7"); again == hash {
+				t.Error("Hash() returned the same hash twice, want a new salt each time")
+			}
+			if !tt.hasher.Handles(hash) {
+				t.Errorf("Handles(%q) = false", hash)
+			}
+
+			for password, want := range map[string]bool{"Correct-Horse-7": true, "correct-horse-7": false, "": false} {
+				if match, err := tt.hasher.Verify(password, hash); match != want || err != nil {
+					t.Errorf("Verify(%q) = %v, %v, want %v", password, match, err, want)
+				}
+			}
+
+			// A hash made with other parameters still verifies, but is due
+			// for a rehash
+			if tt.hasher.NeedsRehash(hash) {
+				t.Error("NeedsRehash() of the hasher's own hash = true")
+			}
+			otherHash, err := tt.other.Hash("Correct-Horse-7")
+			if err != nil {
+				t.Fatalf("Hash() with other parameters error = %v", err)
+			}
+			if match, err := tt.hasher.Verify("Correct-Horse-7", otherHash); !match || err != nil {
+				t.Errorf("Verify() of a hash with other parameters = %v, %v, want true", match, err)
+			}
+			if !tt.hasher.NeedsRehash(otherHash) {
+				t.Error("NeedsRehash() of a hash with other parameters = false")
+			}
+		})
+	}
+}
+
+func TestHandles(t *testing.T) {
+	hashers := map[string]Hasher{
+		"bcrypt":   NewBcryptHasher(bcrypt.MinCost),
+		"argon2id": NewArgon2idHasher(64, 1, 1),
+		"scrypt":   NewScryptHasher(4, 8, 1),
+	}
+
+	tests := []struct {
+		hash string
+		want string
+	}{
+		{hash: "$2a$10$abcdefghijklmnopqrstuu", want: "bcrypt"},
+		{hash: "$2b$10$abcdefghijklmnopqrstuu", want: "bcrypt"},
+		{hash: "$2y$10$abcdefghijklmnopqrstuu", want: "bcrypt"},
+		{hash: "$argon2id$v=19$m=64,t=1,p=1$c2FsdA$a2V5", want: "argon2id"},
+		{hash: "$scrypt$ln=4,r=8,p=1$c2FsdA$a2V5", want: "scrypt"},
+		{hash: "$argon2i$v=19$m=64,t=1,p=1$c2FsdA$a2V5"},
+		{hash: "$pbkdf2-sha256$i=1000$c2FsdA$a2V5"},
+		{hash: "plaintext"},
+		{hash: ""},
+	}
+
+	for _, tt := range tests {
+		for name, h := range hashers {
+			if got := h.Handles(tt.hash); got != (name == tt.want) {
+				t.Errorf("%s Handles(%q) = %v, want %v", name, tt.hash, got, !got)
+			}
+		}
+	}
+}
+
+func TestMalformedHashes(t *testing.T) {
+	argon2id := NewArgon2idHasher(64, 1, 1)
+	scrypt := NewScryptHasher(4, 8, 1)
+	bcryptHasher := NewBcryptHasher(bcrypt.MinCost)
+
+	tests := []struct {
+		name   string
+		hasher Hasher
+		hash   string
+	}{
+		{name: "argon2id with too few fields", hasher: argon2id, hash: "$argon2id$v=19$m=64,t=1,p=1$c2FsdA"},
+		{name: "argon2id of another version", hasher: argon2id, hash: "$argon2id$v=16$m=64,t=1,p=1$c2FsdA$a2V5"},
+		{name: "argon2id with no iterations", hasher: argon2id, hash: "$argon2id$v=19$m=64,t=0,p=1$c2FsdA$a2V5"},
+		{name: "argon2id with no parallelism", hasher: argon2id, hash: "$argon2id$v=19$m=64,t=1,p=0$c2FsdA$a2V5"},
+		{name: "argon2id with a missing parameter", hasher: argon2id, hash: "$argon2id$v=19$t=1,p=1$c2FsdA$a2V5"},
+		{name: "argon2id with bad base64", hasher: argon2id, hash: "$argon2id$v=19$m=64,t=1,p=1$c2FsdA$!!!"},
+		{name: "argon2id with an empty key", hasher: argon2id, hash: "$argon2id$v=19$m=64,t=1,p=1$c2FsdA$"},
+		{name: "argon2id with too much memory", hasher: argon2id, hash: "$argon2id$v=19$m=1048577,t=1,p=1$c2FsdA$a2V5"},
+		{name: "argon2id with too many iterations", hasher: argon2id, hash: "$argon2id$v=19$m=64,t=17,p=1$c2FsdA$a2V5"},
+		{name: "argon2id with too long a key", hasher: argon2id, hash: "$argon2id$v=19$m=64,t=1,p=1$c2FsdA$" + strings.Repeat("a2V5", 22)},
+		{name: "argon2i given to the argon2id hasher", hasher: argon2id, hash: "$argon2i$v=19$m=64,t=1,p=1$c2FsdA$a2V5"},
+		{name: "scrypt with too large a cost", hasher: scrypt, hash: "$scrypt$ln=25,r=8,p=1$c2FsdA$a2V5"},
+		{name: "scrypt with too large a block size", hasher: scrypt, hash: "$scrypt$ln=4,r=33,p=1$c2FsdA$a2V5"},
+		{name: "scrypt with too much parallelism", hasher: scrypt, hash: "$scrypt$ln=4,r=8,p=17$c2FsdA$a2V5"},
+		{name: "scrypt with too much memory", hasher: scrypt, hash: "$scrypt$ln=24,r=8,p=1$c2FsdA$a2V5"},
+		{name: "scrypt with too long a key", hasher: scrypt, hash: "$scrypt$ln=4,r=8,p=1$c2FsdA$" + strings.Repeat("a2V5", 22)},
+		{name: "scrypt with no cost", hasher: scrypt, hash: "$scrypt$ln=0,r=8,p=1$c2FsdA$a2V5"},
+		{name: "scrypt with a non-numeric parameter", hasher: scrypt, hash: "$scrypt$ln=4,r=x,p=1$c2FsdA$a2V5"},
+		{name: "scrypt with padded base64", hasher: scrypt, hash: "$scrypt$ln=4,r=8,p=1$c2FsdA==$a2V5"},
+		{name: "truncated bcrypt", hasher: bcryptHasher, hash: "$2a$04$tooshort"},
+		{name: "bcrypt with too large a cost", hasher: bcryptHasher, hash: "$2a$17$" + strings.Repeat("a", 53)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match, err := tt.hasher.Verify("Correct-Horse-7", tt.hash)
+			if match || !errors.Is(err, ErrMalformedHash) {
+				t.Errorf("Verify() = %v, %v, want false, %v", match, err, ErrMalformedHash)
+			}
+			if err := tt.hasher.(Validator).Validate(tt.hash); !errors.Is(err, ErrMalformedHash) {
+				t.Errorf("Validate() error = %v, want %v", err, ErrMalformedHash)
+			}
+			// Hashes that cannot be parsed are always due for a rehash
+			if !tt.hasher.NeedsRehash(tt.hash) {
+				t.Error("NeedsRehash() = false, want true")
+			}
+		})
+	}
+}
+
+func TestBcryptRefusesLongPasswords(t *testing.T) {
+	h := NewBcryptHasher(bcrypt.MinCost)
+	if _, err := h.Hash(strings.Repeat("a", 72)); err != nil {
+		t.Errorf("Hash() of a 72-byte password error = %v", err)
+	}
+	if _, err := h.Hash(strings.Repeat("a", 73)); !errors.Is(err, bcrypt.ErrPasswordTooLong) {
+		t.Errorf("Hash() of a 73-byte password error = %v, want %v", err, bcrypt.ErrPasswordTooLong)
+	}
+}
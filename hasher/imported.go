@@ -0,0 +1,145 @@
+package hasher
+
+import (
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// The verifiers in this file check hashes imported from other identity
+// providers. The auth server never creates such hashes; they are replaced
+// with the configured hasher's when their users log in.
+
+// maxPBKDF2Iterations bounds the work an imported hash can make verification do
+const maxPBKDF2Iterations = 10_000_000
+
+// Where a salted SHA-512 hash put the salt relative to the password
+const (
+	SaltPositionPrefix = "prefix"
+	SaltPositionSuffix = "suffix"
+)
+
+// FormatPBKDF2SHA256 encodes a PBKDF2-HMAC-SHA256 hash, as exported by
+// Keycloak, as "$pbkdf2-sha256$i=<iterations>$<salt>$<hash>"
+func FormatPBKDF2SHA256(iterations int, salt, key []byte) string {
+	return fmt.Sprintf("$pbkdf2-sha256$i=%d$%s$%s", iterations, phcEncoding.EncodeToString(salt), phcEncoding.EncodeToString(key))
+}
+
+// PBKDF2SHA256Verifier checks hashes made by FormatPBKDF2SHA256
+type PBKDF2SHA256Verifier struct{}
+
+func (PBKDF2SHA256Verifier) Handles(hash string) bool {
+	return phcID(hash) == "pbkdf2-sha256"
+}
+
+func (PBKDF2SHA256Verifier) Verify(password, hash string) (bool, error) {
+	iterations, salt, key, err := parsePBKDF2SHA256(hash)
+	if err != nil {
+		return false, err
+	}
+	derived, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(key))
+	if err != nil {
+		return false, ErrMalformedHash
+	}
+	return subtle.ConstantTimeCompare(derived, key) == 1, nil
+}
+
+func (PBKDF2SHA256Verifier) Validate(hash string) error {
+	_, _, _, err := parsePBKDF2SHA256(hash)
+	return err
+}
+
+func parsePBKDF2SHA256(hash string) (int, []byte, []byte, error) {
+	// "", "pbkdf2-sha256", params, salt, key
+	fields := strings.Split(hash, "$")
+	if len(fields) != 5 || fields[0] != "" || fields[1] != "pbkdf2-sha256" {
+		return 0, nil, nil, ErrMalformedHash
+	}
+	iterations, errI := strconv.Atoi(phcParams(fields[2])["i"])
+	salt, errS := phcEncoding.DecodeString(fields[3])
+	key, errK := phcEncoding.DecodeString(fields[4])
+	if errI != nil || errS != nil || errK != nil || iterations < 1 || iterations > maxPBKDF2Iterations || len(key) == 0 {
+		return 0, nil, nil, ErrMalformedHash
+	}
+	return iterations, salt, key, nil
+}
+
+// FormatSaltedSHA512 encodes a single SHA-512 digest of the password with the
+// salt before (SaltPositionPrefix) or after it (SaltPositionSuffix) as
+// "$salted-sha512$pos=<position>$<salt>$<hash>"
+func FormatSaltedSHA512(saltPosition string, salt, digest []byte) string {
+	return fmt.Sprintf("$salted-sha512$pos=%s$%s$%s", saltPosition, phcEncoding.EncodeToString(salt), phcEncoding.EncodeToString(digest))
+}
+
+// SaltedSHA512Verifier checks hashes made by FormatSaltedSHA512. A single
+// SHA-512 is fast to brute-force, so these hashes should not be kept longer
+// than it takes their users to log in once.
+type SaltedSHA512Verifier struct{}
+
+func (SaltedSHA512Verifier) Handles(hash string) bool {
+	return phcID(hash) == "salted-sha512"
+}
+
+func (SaltedSHA512Verifier) Verify(password, hash string) (bool, error) {
+	saltPosition, salt, digest, err := parseSaltedSHA512(hash)
+	if err != nil {
+		return false, err
+	}
+
+	var input []byte
+	if saltPosition == SaltPositionPrefix {
+		input = append(append(input, salt...), password...)
+	} else {
+		input = append(append(input, password...), salt...)
+	}
+	sum := sha512.Sum512(input)
+	return subtle.ConstantTimeCompare(sum[:], digest) == 1, nil
+}
+
+func (SaltedSHA512Verifier) Validate(hash string) error {
+	_, _, _, err := parseSaltedSHA512(hash)
+	return err
+}
+
+func parseSaltedSHA512(hash string) (string, []byte, []byte, error) {
+	// "", "salted-sha512", params, salt, digest
+	fields := strings.Split(hash, "$")
+	if len(fields) != 5 || fields[0] != "" || fields[1] != "salted-sha512" {
+		return "", nil, nil, ErrMalformedHash
+	}
+	saltPosition := phcParams(fields[2])["pos"]
+	salt, errS := phcEncoding.DecodeString(fields[3])
+	digest, errD := phcEncoding.DecodeString(fields[4])
+	if errS != nil || errD != nil || len(digest) != sha512.Size || (saltPosition != SaltPositionPrefix && saltPosition != SaltPositionSuffix) {
+		return "", nil, nil, ErrMalformedHash
+	}
+	return saltPosition, salt, digest, nil
+}
+
+// Argon2iVerifier checks argon2i PHC strings, which some providers used
+// before argon2id was recommended. argon2id hashes are handled by Argon2idHasher.
+type Argon2iVerifier struct{}
+
+func (Argon2iVerifier) Handles(hash string) bool {
+	return phcID(hash) == "argon2i"
+}
+
+func (Argon2iVerifier) Verify(password, hash string) (bool, error) {
+	parsed, err := parseArgon2(hash, "argon2i")
+	if err != nil {
+		return false, err
+	}
+	key := argon2.Key([]byte(password), parsed.salt, parsed.iterations, parsed.memory, parsed.parallelism, uint32(len(parsed.key)))
+	return subtle.ConstantTimeCompare(key, parsed.key) == 1, nil
+}
+
+func (Argon2iVerifier) Validate(hash string) error {
+	_, err := parseArgon2(hash, "argon2i")
+	return err
+}
@@ -0,0 +1,69 @@
+package hasher
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestImportedVerifiers(t *testing.T) {
+	// PBKDF2-HMAC-SHA256 of "password" with salt "salt" and one iteration,
+	// and SHA-512 of "abc", from the published test vectors
+	pbkdf2Key := mustHex(t, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b")
+	sha512ABC := mustHex(t, "ddaf35a193617abacc417349ae20413112e6fa4e89a97ea20a9eeee64b55d39a2192992a274fc1a836ba3c23a3feebbd454d4423643ce80e2a9ac94fa54ca49f")
+	argon2iHash := "$argon2i$v=19$m=64,t=1,p=1$" + phcEncoding.EncodeToString([]byte("somesalt")) + "$" +
+		phcEncoding.EncodeToString(argon2.Key([]byte("password"), []byte("somesalt"), 1, 64, 1, 32))
+
+	tests := []struct {
+		name     string
+		verifier Validator
+		hash     string
+		password string
+		want     bool
+		wantErr  error
+	}{
+		{name: "pbkdf2-sha256 match", verifier: PBKDF2SHA256Verifier{}, hash: FormatPBKDF2SHA256(1, []byte("salt"), pbkdf2Key), password: "password", want: true},
+		{name: "pbkdf2-sha256 mismatch", verifier: PBKDF2SHA256Verifier{}, hash: FormatPBKDF2SHA256(1, []byte("salt"), pbkdf2Key), password: "Password"},
+		{name: "pbkdf2-sha256 with other iterations", verifier: PBKDF2SHA256Verifier{}, hash: FormatPBKDF2SHA256(2, []byte("salt"), pbkdf2Key), password: "password"},
+		{name: "pbkdf2-sha256 with no iterations", verifier: PBKDF2SHA256Verifier{}, hash: FormatPBKDF2SHA256(0, []byte("salt"), pbkdf2Key), password: "password", wantErr: ErrMalformedHash},
+		{name: "pbkdf2-sha256 with too many iterations", verifier: PBKDF2SHA256Verifier{}, hash: FormatPBKDF2SHA256(maxPBKDF2Iterations+1, []byte("salt"), pbkdf2Key), password: "password", wantErr: ErrMalformedHash},
+		{name: "pbkdf2-sha256 with an empty key", verifier: PBKDF2SHA256Verifier{}, hash: "$pbkdf2-sha256$i=1$c2FsdA$", password: "password", wantErr: ErrMalformedHash},
+		{name: "pbkdf2-sha256 with bad base64", verifier: PBKDF2SHA256Verifier{}, hash: "$pbkdf2-sha256$i=1$c2FsdA$!!!", password: "password", wantErr: ErrMalformedHash},
+		{name: "salt after the password", verifier: SaltedSHA512Verifier{}, hash: FormatSaltedSHA512(SaltPositionSuffix, []byte("c"), sha512ABC), password: "ab", want: true},
+		{name: "salt before the password", verifier: SaltedSHA512Verifier{}, hash: FormatSaltedSHA512(SaltPositionPrefix, []byte("a"), sha512ABC), password: "bc", want: true},
+		{name: "salt on the wrong side", verifier: SaltedSHA512Verifier{}, hash: FormatSaltedSHA512(SaltPositionPrefix, []byte("c"), sha512ABC), password: "ab"},
+		{name: "unknown salt position", verifier: SaltedSHA512Verifier{}, hash: FormatSaltedSHA512("middle", []byte("c"), sha512ABC), password: "ab", wantErr: ErrMalformedHash},
+		{name: "truncated SHA-512 digest", verifier: SaltedSHA512Verifier{}, hash: FormatSaltedSHA512(SaltPositionSuffix, []byte("c"), sha512ABC[:32]), password: "ab", wantErr: ErrMalformedHash},
+		{name: "argon2i match", verifier: Argon2iVerifier{}, hash: argon2iHash, password: "password", want: true},
+		{name: "argon2i mismatch", verifier: Argon2iVerifier{}, hash: argon2iHash, password: "passw0rd"},
+		{name: "argon2id given to the argon2i verifier", verifier: Argon2iVerifier{}, hash: "$argon2id" + argon2iHash[len("$argon2i"):], password: "password", wantErr: ErrMalformedHash},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !tt.verifier.Handles(tt.hash) && tt.wantErr == nil {
+				t.Fatalf("Handles(%q) = false", tt.hash)
+			}
+			match, err := tt.verifier.Verify(tt.password, tt.hash)
+			if match != tt.want || !errors.Is(err, tt.wantErr) {
+				t.Errorf("Verify() = %v, %v, want %v, %v", match, err, tt.want, tt.wantErr)
+			}
+			// Validate refuses exactly the hashes Verify cannot check
+			if err := tt.verifier.Validate(tt.hash); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Validate() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
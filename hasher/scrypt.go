@@ -0,0 +1,114 @@
+package hasher
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// scrypt parameters recommended by the scrypt package: N=32768 (2^15), r=8 and p=1
+const (
+	DefaultScryptLogN = 15
+	DefaultScryptR    = 8
+	DefaultScryptP    = 1
+)
+
+const (
+	scryptSaltLength = 16
+	scryptKeyLength  = 32
+	// The bounds on the parameters of a stored hash. scrypt uses 128*r*N bytes
+	// of memory and p times the work, so both are bounded too.
+	maxScryptLogN      = 24
+	maxScryptR         = 32
+	maxScryptP         = 16
+	maxScryptMemory    = 1 << 30
+	maxScryptKeyLength = 64
+)
+
+// ScryptHasher hashes passwords with scrypt into
+// "$scrypt$ln=<log2 N>,r=<r>,p=<p>$<salt>$<hash>"
+type ScryptHasher struct {
+	LogN int
+	R    int
+	P    int
+}
+
+func NewScryptHasher(logN, r, p int) *ScryptHasher {
+	return &ScryptHasher{
+		LogN: logN,
+		R:    r,
+		P:    p,
+	}
+}
+
+func (h *ScryptHasher) Handles(hash string) bool {
+	return phcID(hash) == "scrypt"
+}
+
+func (h *ScryptHasher) Hash(password string) (string, error) {
+	salt, err := newSalt(scryptSaltLength)
+	if err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key([]byte(password), salt, 1<<h.LogN, h.R, h.P, scryptKeyLength)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", h.LogN, h.R, h.P, phcEncoding.EncodeToString(salt), phcEncoding.EncodeToString(key)), nil
+}
+
+func (h *ScryptHasher) Verify(password, hash string) (bool, error) {
+	parsed, err := parseScrypt(hash)
+	if err != nil {
+		return false, err
+	}
+	key, err := scrypt.Key([]byte(password), parsed.salt, 1<<parsed.logN, parsed.r, parsed.p, len(parsed.key))
+	if err != nil {
+		return false, ErrMalformedHash
+	}
+	return subtle.ConstantTimeCompare(key, parsed.key) == 1, nil
+}
+
+func (h *ScryptHasher) Validate(hash string) error {
+	_, err := parseScrypt(hash)
+	return err
+}
+
+func (h *ScryptHasher) NeedsRehash(hash string) bool {
+	parsed, err := parseScrypt(hash)
+	return err != nil || parsed.logN != h.LogN || parsed.r != h.R || parsed.p != h.P || len(parsed.key) != scryptKeyLength
+}
+
+type scryptHash struct {
+	logN int
+	r    int
+	p    int
+	salt []byte
+	key  []byte
+}
+
+func parseScrypt(hash string) (scryptHash, error) {
+	// "", "scrypt", params, salt, key
+	fields := strings.Split(hash, "$")
+	if len(fields) != 5 || fields[0] != "" || fields[1] != "scrypt" {
+		return scryptHash{}, ErrMalformedHash
+	}
+
+	params := phcParams(fields[2])
+	logN, errN := strconv.Atoi(params["ln"])
+	r, errR := strconv.Atoi(params["r"])
+	p, errP := strconv.Atoi(params["p"])
+	salt, errS := phcEncoding.DecodeString(fields[3])
+	key, errK := phcEncoding.DecodeString(fields[4])
+	if errN != nil || errR != nil || errP != nil || errS != nil || errK != nil || logN < 1 || logN > maxScryptLogN || r < 1 || p < 1 || len(key) == 0 {
+		return scryptHash{}, ErrMalformedHash
+	}
+	if r > maxScryptR || p > maxScryptP || 128*r<<logN > maxScryptMemory || len(key) > maxScryptKeyLength {
+		return scryptHash{}, ErrMalformedHash
+	}
+
+	return scryptHash{logN: logN, r: r, p: p, salt: salt, key: key}, nil
+}
@@ -1,6 +1,9 @@
 package config
 
-import "errors"
+import (
+	"errors"
+	"time"
+)
 
 const (
 	UserRoleSuperAdmin  = "super_admin"
@@ -22,7 +25,243 @@ var (
 	ErrTenantLicenceExceeded       = errors.New("tenant licence exceeded")
 	ErrTenantLicenceExpired        = errors.New("tenant licence expired")
 	ErrFailedToCreateTenantLicence = errors.New("failed to create tenant licence")
+	ErrFailedToIssueToken          = errors.New("failed to issue token")
+	ErrInvalidToken                = errors.New("invalid token")
+	ErrInvalidRefreshToken         = errors.New("invalid refresh token")
+	ErrRefreshTokenExpired         = errors.New("refresh token expired")
+	ErrRefreshTokenReused          = errors.New("refresh token reused")
+	ErrUnsupportedSigningAlgorithm = errors.New("unsupported signing algorithm")
+	ErrSigningKeyNotFound          = errors.New("signing key not found")
+	ErrSigningKeyEncryptionKey     = errors.New("signing key encryption key must be 32 bytes")
+	ErrFailedToCreateClient        = errors.New("failed to create client")
+	ErrInvalidClient               = errors.New("invalid client")
+	ErrInvalidRedirectURI          = errors.New("invalid redirect uri")
+	ErrClientNotFound              = errors.New("client not found")
+	ErrInvalidGrantType            = errors.New("invalid grant type")
+	ErrInvalidScope                = errors.New("invalid scope")
+	ErrInvalidUserCode             = errors.New("invalid user code")
+	ErrInvalidMFAToken             = errors.New("invalid mfa token")
+	ErrInvalidMFACode              = errors.New("invalid mfa code")
+	ErrMFAAlreadyEnabled           = errors.New("mfa already enabled")
+	ErrMFANotEnabled               = errors.New("mfa not enabled")
+	ErrMFAEnrolmentNotStarted      = errors.New("mfa enrolment not started")
+	ErrWebAuthnNotConfigured       = errors.New("webauthn not configured")
+	ErrInvalidWebAuthnSession      = errors.New("invalid webauthn session")
+	ErrWebAuthnVerificationFailed  = errors.New("webauthn verification failed")
+	ErrWebAuthnCredentialNotFound  = errors.New("webauthn credential not found")
+	ErrMailerNotConfigured         = errors.New("mailer not configured")
+	ErrInvalidPasswordlessToken    = errors.New("invalid passwordless token")
+	ErrInvalidPasswordlessCode     = errors.New("invalid passwordless code")
+	ErrInvalidRole                 = errors.New("invalid role")
+	ErrInvalidNetwork              = errors.New("invalid network")
+	ErrInvalidResetToken           = errors.New("invalid reset token")
+	ErrPasswordPolicyViolation     = errors.New("password does not meet the password policy")
+	ErrInvalidPasswordPolicy       = errors.New("invalid password policy")
+	ErrPasswordExpired             = errors.New("password expired")
+	ErrPasswordNotExpired          = errors.New("password not expired")
+	ErrInvalidVerificationToken    = errors.New("invalid verification token")
+	ErrEmailNotVerified            = errors.New("email not verified")
+	ErrVerificationEmailNotSent    = errors.New("verification email not sent")
+	ErrEmailRequired               = errors.New("email is required")
+	ErrUnsupportedPasswordHash     = errors.New("unsupported password hash algorithm")
+	ErrMalformedPasswordHash       = errors.New("malformed password hash")
+	ErrTooManyUsersToImport        = errors.New("too many users to import")
+	ErrInvalidPasswordPepper       = errors.New("invalid password pepper")
+	ErrAccountLocked               = errors.New("account locked")
+	ErrUserInactive                = errors.New("user inactive")
+)
+
+const (
+	DefaultMaxFailedLoginAttempts = 3
+	DefaultLockoutDuration        = 5 * time.Minute
+	DefaultMaxLockoutDuration     = 24 * time.Hour
+	// Earlier versions deactivated users after this many failed logins
+	LegacyMaxFailedLoginAttempts = 3
+)
+
+const (
+	RevocationSubjectUser   = "user"
+	RevocationSubjectTenant = "tenant"
+)
+
+const (
+	DefaultTokenIssuer     = "auth-server"
+	DefaultTokenAudience   = "auth-server"
+	DefaultAccessTokenTTL  = 15 * time.Minute
+	DefaultRefreshTokenTTL = 30 * 24 * time.Hour
 )
 
-const MaxFailedLoginAttempts = 3
+const (
+	TokenTypeHintAccessToken  = "access_token"
+	TokenTypeHintRefreshToken = "refresh_token"
+)
+
+const (
+	SigningAlgorithmHS256 = "HS256"
+	SigningAlgorithmRS256 = "RS256"
+	SigningAlgorithmES256 = "ES256"
+	SigningAlgorithmEdDSA = "EdDSA"
+)
+
+const (
+	DefaultKeyRotationInterval = 30 * 24 * time.Hour
+	DefaultKeyRotationOverlap  = 24 * time.Hour
+	DefaultKeyRetention        = 7 * 24 * time.Hour
+	KeyRotationCheckInterval   = time.Hour
+)
+
+const (
+	ScopeOpenID        = "openid"
+	ScopeProfile       = "profile"
+	ScopeEmail         = "email"
+	ScopeOfflineAccess = "offline_access"
+)
+
+const (
+	GrantTypeAuthorizationCode = "authorization_code"
+	GrantTypeRefreshToken      = "refresh_token"
+	GrantTypeClientCredentials = "client_credentials"
+	GrantTypeDeviceCode        = "urn:ietf:params:oauth:grant-type:device_code"
+	GrantTypeTokenExchange     = "urn:ietf:params:oauth:grant-type:token-exchange"
+)
+
+// Token type identifiers from RFC 8693 section 3
+const (
+	TokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// JWT "typ" headers. Access tokens are typed as in RFC 9068 so they cannot be
+// confused with ID tokens, which are signed with the same keys.
+const (
+	JWTTypeAccessToken = "at+jwt"
+	JWTTypeGeneric     = "JWT"
+)
+
+const (
+	ResponseTypeCode        = "code"
+	CodeChallengeMethodS256 = "S256"
+)
+
+// Authorization request prompt values from OpenID Connect Core section 3.1.2.1,
+// and the answers a consent page sends back
+const (
+	PromptNone     = "none"
+	PromptLogin    = "login"
+	PromptConsent  = "consent"
+	ConsentApprove = "approve"
+	ConsentDeny    = "deny"
+)
+
+// OAuth error codes from RFC 6749 and OpenID Connect Core
+const (
+	OAuthErrorInvalidRequest          = "invalid_request"
+	OAuthErrorInvalidClient           = "invalid_client"
+	OAuthErrorInvalidGrant            = "invalid_grant"
+	OAuthErrorUnauthorizedClient      = "unauthorized_client"
+	OAuthErrorUnsupportedGrantType    = "unsupported_grant_type"
+	OAuthErrorUnsupportedResponseType = "unsupported_response_type"
+	OAuthErrorInvalidScope            = "invalid_scope"
+	OAuthErrorAccessDenied            = "access_denied"
+	OAuthErrorLoginRequired           = "login_required"
+	OAuthErrorConsentRequired         = "consent_required"
+	OAuthErrorInsufficientScope       = "insufficient_scope"
+	OAuthErrorServerError             = "server_error"
+	OAuthErrorAuthorizationPending    = "authorization_pending"
+	OAuthErrorSlowDown                = "slow_down"
+	OAuthErrorExpiredToken            = "expired_token"
+	OAuthErrorInvalidTarget           = "invalid_target"
+)
 
+const (
+	DefaultAuthorizationCodeTTL = 5 * time.Minute
+	SessionCookieName           = "auth_session"
+)
+
+const (
+	DeviceCodeStatusPending  = "pending"
+	DeviceCodeStatusApproved = "approved"
+	DeviceCodeStatusDenied   = "denied"
+)
+
+const (
+	DefaultDeviceCodeTTL      = 10 * time.Minute
+	DefaultDevicePollInterval = 5 * time.Second
+	DeviceSlowDownIncrement   = 5 * time.Second
+	ExpiryCleanupInterval     = 10 * time.Minute
+)
+
+const (
+	MFAMethodTOTP         = "totp"
+	MFAMethodRecoveryCode = "recovery_code"
+	MFAMethodWebAuthn     = "webauthn"
+)
+
+const (
+	DefaultMFAChallengeTTL = 5 * time.Minute
+	MaxMFAAttempts         = 5
+	TOTPPeriod             = 30 * time.Second
+	TOTPDigits             = 6
+	TOTPAllowedSkew        = 1
+	RecoveryCodeCount      = 10
+)
+
+const (
+	WebAuthnCeremonyRegistration     = "registration"
+	WebAuthnCeremonyLogin            = "login"
+	WebAuthnCeremonyReauthentication = "reauthentication"
+	DefaultWebAuthnSessionTTL        = 5 * time.Minute
+)
+
+const (
+	DefaultPasswordlessTTL  = 10 * time.Minute
+	MaxPasswordlessAttempts = 5
+	PasswordlessCodeDigits  = 6
+)
+
+// Authentication method references from RFC 8176, recorded in the amr claim.
+// Emailed sign-in codes and links count as one-time passwords.
+const (
+	AMRPassword    = "pwd"
+	AMROTP         = "otp"
+	AMRHardwareKey = "hwk"
+	AMRMultiFactor = "mfa"
+)
+
+// Authentication context classes recorded in the acr claim
+const (
+	ACRSingleFactor = "aal1"
+	ACRMultiFactor  = "aal2"
+)
+
+const DefaultStepUpMaxAge = 5 * time.Minute
+
+const (
+	DefaultPasswordMinLength = 8
+	DefaultPasswordMaxLength = 64
+	MaxPasswordHistoryDepth  = 24
+)
+
+// Password policy violation codes
+const (
+	PasswordViolationTooShort         = "too_short"
+	PasswordViolationTooLong          = "too_long"
+	PasswordViolationMissingUppercase = "missing_uppercase"
+	PasswordViolationMissingLowercase = "missing_lowercase"
+	PasswordViolationMissingDigit     = "missing_digit"
+	PasswordViolationMissingSymbol    = "missing_symbol"
+	PasswordViolationContainsEmail    = "contains_email"
+	PasswordViolationContainsName     = "contains_name"
+	PasswordViolationReused           = "reused"
+	PasswordViolationBreached         = "breached"
+)
+
+// MinPasswordPepperLength is the shortest pepper key accepted, in bytes
+const MinPasswordPepperLength = 32
+
+// MaxUsersPerImport limits how many users one import request may contain
+const MaxUsersPerImport = 1000
+
+const (
+	DefaultPasswordResetTTL     = time.Hour
+	DefaultEmailVerificationTTL = 24 * time.Hour
+)
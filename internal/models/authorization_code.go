@@ -0,0 +1,27 @@
+package models
+
+import "time"
+
+// AuthorizationCode is a single-use OAuth authorization code. FamilyID records
+// the session issued when the code was redeemed so it can be revoked on replay.
+type AuthorizationCode struct {
+	ID                  uint       `json:"id"`
+	CodeHash            string     `json:"code_hash" gorm:"uniqueIndex"`
+	ClientID            string     `json:"client_id" gorm:"index"`
+	UserID              uint       `json:"user_id" gorm:"index"`
+	TenantID            uint       `json:"tenant_id" gorm:"index"`
+	RedirectURI         string     `json:"redirect_uri"`
+	Scope               string     `json:"scope"`
+	Nonce               string     `json:"nonce"`
+	CodeChallenge       string     `json:"code_challenge"`
+	CodeChallengeMethod string     `json:"code_challenge_method"`
+	AuthTime            time.Time  `json:"auth_time"`
+	AMR                 []string   `json:"amr" gorm:"serializer:json"`
+	FamilyID            string     `json:"family_id"`
+	ExpiresAt           time.Time  `json:"expires_at"`
+	UsedAt              *time.Time `json:"used_at"`
+	CreatedAt           time.Time  `json:"created_at"`
+	UpdatedAt           time.Time  `json:"updated_at"`
+
+	User User `json:"user" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// Client is an OAuth client application registered against a tenant. It may
+// only use the grant types and request the scopes it was registered with.
+// Public clients have no secret and must use PKCE. Users are asked to consent
+// to every client except the tenant's own first-party applications.
+type Client struct {
+	ID               uint      `json:"id"`
+	TenantID         uint      `json:"tenant_id" gorm:"index"`
+	ClientID         string    `json:"client_id" gorm:"uniqueIndex"`
+	ClientSecretHash string    `json:"client_secret_hash"`
+	Name             string    `json:"name"`
+	RedirectURIs     []string  `json:"redirect_uris" gorm:"serializer:json"`
+	GrantTypes       []string  `json:"grant_types" gorm:"serializer:json"`
+	Scopes           []string  `json:"scopes" gorm:"serializer:json"`
+	IsPublic         bool      `json:"is_public"`
+	IsFirstParty     bool      `json:"is_first_party"`
+	IsActive         bool      `json:"is_active"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+
+	Tenant Tenant `json:"tenant" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
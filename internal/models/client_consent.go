@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// ClientConsent records the scopes a user has allowed a third-party client.
+// First-party clients do not ask for consent.
+type ClientConsent struct {
+	ID        uint      `json:"id"`
+	UserID    uint      `json:"user_id" gorm:"uniqueIndex:idx_client_consent_user_client"`
+	ClientID  string    `json:"client_id" gorm:"uniqueIndex:idx_client_consent_user_client"`
+	Scopes    []string  `json:"scopes" gorm:"serializer:json"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	User User `json:"user" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// DeviceCode is a pending RFC 8628 device authorization. The device polls with
+// the device code while the user approves the request by entering UserCode.
+type DeviceCode struct {
+	ID              uint       `json:"id"`
+	DeviceCodeHash  string     `json:"device_code_hash" gorm:"uniqueIndex"`
+	UserCode        string     `json:"user_code" gorm:"uniqueIndex"`
+	ClientID        string     `json:"client_id" gorm:"index"`
+	TenantID        uint       `json:"tenant_id" gorm:"index"`
+	Scope           string     `json:"scope"`
+	Status          string     `json:"status"`
+	UserID          *uint      `json:"user_id"`
+	AuthTime        *time.Time `json:"auth_time"`
+	AMR             []string   `json:"amr" gorm:"serializer:json"`
+	IntervalSeconds int        `json:"interval_seconds"`
+	LastPolledAt    *time.Time `json:"last_polled_at"`
+	ExpiresAt       time.Time  `json:"expires_at" gorm:"index"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
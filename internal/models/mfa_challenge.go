@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// MFAChallenge is the pending second step of a login whose password was
+// correct. The raw challenge token is returned to the client; only its hash is
+// stored. WebAuthnSession holds the pending assertion when a security key is used.
+// Enrolment challenges are issued to users whose tenant requires MFA before
+// they have a second factor; they can only be used to enrol one. AMR records
+// the first factor the user passed.
+type MFAChallenge struct {
+	ID              uint      `json:"id"`
+	ChallengeHash   string    `json:"challenge_hash" gorm:"uniqueIndex"`
+	UserID          uint      `json:"user_id" gorm:"index"`
+	TenantID        uint      `json:"tenant_id" gorm:"index"`
+	Attempts        int       `json:"attempts"`
+	Enrolment       bool      `json:"enrolment"`
+	AMR             []string  `json:"amr" gorm:"serializer:json"`
+	WebAuthnSession string    `json:"webauthn_session"`
+	ExpiresAt       time.Time `json:"expires_at" gorm:"index"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+
+	User User `json:"user" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// PasswordHistory keeps the hash of a password the user has since replaced,
+// so the password policy can stop them from reusing it
+type PasswordHistory struct {
+	ID           uint      `json:"id"`
+	UserID       uint      `json:"user_id" gorm:"index"`
+	PasswordHash string    `json:"password_hash"`
+	CreatedAt    time.Time `json:"created_at"`
+
+	User User `json:"user" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
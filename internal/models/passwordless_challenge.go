@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// PasswordlessChallenge is a pending email sign-in. The client keeps the raw
+// challenge token and the user receives a one-time code for it, plus a magic
+// link token when a link URL is configured. Only hashes are stored.
+type PasswordlessChallenge struct {
+	ID            uint      `json:"id"`
+	ChallengeHash string    `json:"challenge_hash" gorm:"uniqueIndex"`
+	CodeHash      string    `json:"code_hash"`
+	LinkHash      string    `json:"link_hash" gorm:"index"`
+	UserID        uint      `json:"user_id" gorm:"index"`
+	TenantID      uint      `json:"tenant_id" gorm:"index"`
+	Attempts      int       `json:"attempts"`
+	ExpiresAt     time.Time `json:"expires_at" gorm:"index"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+
+	User User `json:"user" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
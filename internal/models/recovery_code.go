@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// RecoveryCode is a hashed, one-time MFA recovery code
+type RecoveryCode struct {
+	ID        uint       `json:"id"`
+	UserID    uint       `json:"user_id" gorm:"index"`
+	CodeHash  string     `json:"code_hash" gorm:"index"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+
+	User User `json:"user" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// RefreshToken is a single-use refresh token. Tokens rotated from the same
+// login share a FamilyID so the whole chain can be revoked on replay. Tokens
+// issued to an OAuth client record its ClientID and can only be used by it.
+type RefreshToken struct {
+	ID        uint       `json:"id"`
+	UserID    uint       `json:"user_id" gorm:"index"`
+	TenantID  uint       `json:"tenant_id" gorm:"index"`
+	FamilyID  string     `json:"family_id" gorm:"index"`
+	TokenHash string     `json:"token_hash" gorm:"uniqueIndex"`
+	ClientID  string     `json:"client_id" gorm:"index"`
+	Scope     string     `json:"scope"`
+	AuthTime  time.Time  `json:"auth_time"`
+	AMR       []string   `json:"amr" gorm:"serializer:json"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	RevokedAt *time.Time `json:"revoked_at"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+
+	User User `json:"user" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// SigningKey is an asymmetric token signing key. A key signs tokens between
+// ActivatesAt and RetiresAt and is published for verification until ExpiresAt.
+// PrivateKeyPEM holds the private key encrypted with the key encryption key.
+type SigningKey struct {
+	ID            uint       `json:"id"`
+	KID           string     `json:"kid" gorm:"uniqueIndex"`
+	Algorithm     string     `json:"algorithm"`
+	PrivateKeyPEM string     `json:"private_key_pem"`
+	ActivatesAt   time.Time  `json:"activates_at"`
+	RetiresAt     *time.Time `json:"retires_at"`
+	ExpiresAt     *time.Time `json:"expires_at" gorm:"index"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
@@ -14,6 +14,7 @@ type Tenant struct {
 	DeletedAt time.Time `json:"deleted_at"`
 
 	Users         []User         `json:"users" gorm:"foreignKey:TenantID"`
+	Clients       []Client       `json:"clients" gorm:"foreignKey:TenantID"`
 	TenantLicence *TenantLicence `json:"tenant_licence,omitempty" gorm:"foreignKey:TenantID;constraint:OnUpdate:CASCADE,OnDelete:RESTRICT;"`
 }
 
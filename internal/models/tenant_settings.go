@@ -0,0 +1,33 @@
+package models
+
+import "time"
+
+// TenantSettings holds the security policies a tenant administrator has
+// configured. Tenants without a row use the defaults.
+type TenantSettings struct {
+	ID                        uint            `json:"id"`
+	TenantID                  uint            `json:"tenant_id" gorm:"uniqueIndex"`
+	MFARequired               bool            `json:"mfa_required"`
+	MFARequiredRoles          []string        `json:"mfa_required_roles" gorm:"serializer:json"`
+	MFATrustedNetworks        []string        `json:"mfa_trusted_networks" gorm:"serializer:json"`
+	EmailVerificationRequired bool            `json:"email_verification_required"`
+	PasswordPolicy            *PasswordPolicy `json:"password_policy" gorm:"serializer:json"`
+	CreatedAt                 time.Time       `json:"created_at"`
+	UpdatedAt                 time.Time       `json:"updated_at"`
+
+	Tenant Tenant `json:"tenant" gorm:"foreignKey:TenantID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
+
+// PasswordPolicy is a tenant's own password policy, replacing the server's
+// default. Zero MaxLength, HistoryDepth and MaxAgeDays disable those checks.
+type PasswordPolicy struct {
+	MinLength            int  `json:"min_length"`
+	MaxLength            int  `json:"max_length"`
+	RequireUppercase     bool `json:"require_uppercase"`
+	RequireLowercase     bool `json:"require_lowercase"`
+	RequireDigit         bool `json:"require_digit"`
+	RequireSymbol        bool `json:"require_symbol"`
+	DisallowPersonalInfo bool `json:"disallow_personal_info"`
+	HistoryDepth         int  `json:"history_depth"`
+	MaxAgeDays           int  `json:"max_age_days"`
+}
@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// RevokedToken records an individual access token revoked before its expiry
+type RevokedToken struct {
+	ID        uint      `json:"id"`
+	JTI       string    `json:"jti" gorm:"uniqueIndex"`
+	ExpiresAt time.Time `json:"expires_at" gorm:"index"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TokenRevocation invalidates every token issued to a user or tenant before
+// IssuedBefore, except those of the ExceptSessionID session when it is set
+type TokenRevocation struct {
+	ID              uint      `json:"id"`
+	SubjectType     string    `json:"subject_type" gorm:"uniqueIndex:idx_token_revocation_subject"`
+	SubjectID       uint      `json:"subject_id" gorm:"uniqueIndex:idx_token_revocation_subject"`
+	IssuedBefore    time.Time `json:"issued_before"`
+	ExceptSessionID string    `json:"except_session_id"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
@@ -9,16 +9,23 @@ type User struct {
 	LastName                        string     `json:"last_name"`
 	Email                           string     `json:"email"`
 	PasswordHash                    string     `json:"password_hash"`
+	PasswordChangedAt               *time.Time `json:"password_changed_at"`
 	FailedLoginAttempts             int        `json:"failed_login_attempts"`
+	LockedUntil                     *time.Time `json:"locked_until"`
+	LockoutCount                    int        `json:"lockout_count"`
 	IsActive                        bool       `json:"is_active"`
 	Role                            string     `json:"role"`
 	LastLoginAt                     *time.Time `json:"last_login_at"`
 	LastLoginIP                     string     `json:"last_login_ip"`
-	ResetPasswordToken              string     `json:"reset_password_token"`
+	ResetPasswordToken              string     `json:"reset_password_token" gorm:"index"`
 	ResetPasswordTokenExpiresAt     *time.Time `json:"reset_password_token_expires_at"`
 	IsEmailVerified                 bool       `json:"is_email_verified"`
-	EmailVerificationToken          string     `json:"email_verification_token"`
+	EmailVerificationToken          string     `json:"email_verification_token" gorm:"index"`
 	EmailVerificationTokenExpiresAt *time.Time `json:"email_verification_token_expires_at"`
+	TOTPSecret                      string     `json:"totp_secret"`
+	TOTPEnabled                     bool       `json:"totp_enabled"`
+	TOTPLastUsedStep                int64      `json:"totp_last_used_step"`
+	WebAuthnID                      string     `json:"webauthn_id" gorm:"index"`
 	CreatedAt                       time.Time  `json:"created_at"`
 	UpdatedAt                       time.Time  `json:"updated_at"`
 	DeletedAt                       *time.Time `json:"deleted_at"`
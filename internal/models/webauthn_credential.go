@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// WebAuthnCredential is a security key or passkey registered by a user.
+// CredentialID is the base64url credential ID chosen by the authenticator.
+type WebAuthnCredential struct {
+	ID              uint       `json:"id"`
+	UserID          uint       `json:"user_id" gorm:"index"`
+	TenantID        uint       `json:"tenant_id" gorm:"index"`
+	CredentialID    string     `json:"credential_id" gorm:"uniqueIndex"`
+	Name            string     `json:"name"`
+	PublicKey       []byte     `json:"public_key"`
+	AttestationType string     `json:"attestation_type"`
+	Transports      []string   `json:"transports" gorm:"serializer:json"`
+	AAGUID          []byte     `json:"aaguid"`
+	SignCount       uint32     `json:"sign_count"`
+	BackupEligible  bool       `json:"backup_eligible"`
+	BackupState     bool       `json:"backup_state"`
+	LastUsedAt      *time.Time `json:"last_used_at"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+
+	User User `json:"user" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// WebAuthnSession holds the server side state of a registration or passkey
+// login ceremony between its begin and finish calls. UserID is zero for
+// passkey logins, where the user is only known once the assertion arrives.
+type WebAuthnSession struct {
+	ID          uint      `json:"id"`
+	SessionHash string    `json:"session_hash" gorm:"uniqueIndex"`
+	UserID      uint      `json:"user_id" gorm:"index"`
+	Ceremony    string    `json:"ceremony"`
+	Data        string    `json:"data"`
+	ExpiresAt   time.Time `json:"expires_at" gorm:"index"`
+	CreatedAt   time.Time `json:"created_at"`
+}
@@ -0,0 +1,49 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"gorm.io/gorm"
+)
+
+type AuthorizationCodeRepository struct {
+	db *gorm.DB
+}
+
+func NewAuthorizationCodeRepository(db *gorm.DB) *AuthorizationCodeRepository {
+	return &AuthorizationCodeRepository{db: db}
+}
+
+func (r *AuthorizationCodeRepository) Create(authorizationCode *models.AuthorizationCode) error {
+	return r.db.Create(authorizationCode).Error
+}
+
+func (r *AuthorizationCodeRepository) GetByCodeHash(codeHash string) (*models.AuthorizationCode, error) {
+	var authorizationCode models.AuthorizationCode
+	if err := r.db.First(&authorizationCode, "code_hash = ?", codeHash).Error; err != nil {
+		return nil, err
+	}
+	return &authorizationCode, nil
+}
+
+// MarkUsed flags the code as redeemed, returning false if it had already been redeemed
+func (r *AuthorizationCodeRepository) MarkUsed(id uint, usedAt time.Time) (bool, error) {
+	result := r.db.Model(&models.AuthorizationCode{}).
+		Where("id = ? AND used_at IS NULL", id).
+		Updates(map[string]interface{}{"used_at": usedAt, "updated_at": usedAt})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+func (r *AuthorizationCodeRepository) SetFamilyID(id uint, familyID string) error {
+	return r.db.Model(&models.AuthorizationCode{}).
+		Where("id = ?", id).
+		Updates(map[string]interface{}{"family_id": familyID, "updated_at": time.Now()}).Error
+}
+
+func (r *AuthorizationCodeRepository) DeleteExpired(before time.Time) error {
+	return r.db.Where("expires_at < ?", before).Delete(&models.AuthorizationCode{}).Error
+}
@@ -0,0 +1,35 @@
+package repository
+
+import (
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type ClientConsentRepository struct {
+	db *gorm.DB
+}
+
+func NewClientConsentRepository(db *gorm.DB) *ClientConsentRepository {
+	return &ClientConsentRepository{db: db}
+}
+
+func (r *ClientConsentRepository) Get(userID uint, clientID string) (*models.ClientConsent, error) {
+	var consent models.ClientConsent
+	if err := r.db.First(&consent, "user_id = ? AND client_id = ?", userID, clientID).Error; err != nil {
+		return nil, err
+	}
+	return &consent, nil
+}
+
+// Upsert creates the user's consent for the client or replaces its scopes
+func (r *ClientConsentRepository) Upsert(consent *models.ClientConsent) error {
+	return r.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "client_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"scopes", "updated_at"}),
+	}).Create(consent).Error
+}
+
+func (r *ClientConsentRepository) DeleteForClient(clientID string) error {
+	return r.db.Where("client_id = ?", clientID).Delete(&models.ClientConsent{}).Error
+}
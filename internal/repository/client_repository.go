@@ -0,0 +1,42 @@
+package repository
+
+import (
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"gorm.io/gorm"
+)
+
+type ClientRepository struct {
+	db *gorm.DB
+}
+
+func NewClientRepository(db *gorm.DB) *ClientRepository {
+	return &ClientRepository{db: db}
+}
+
+func (r *ClientRepository) Create(client *models.Client) error {
+	return r.db.Create(client).Error
+}
+
+func (r *ClientRepository) GetByClientID(clientID string) (*models.Client, error) {
+	var client models.Client
+	if err := r.db.First(&client, "client_id = ?", clientID).Error; err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
+func (r *ClientRepository) GetByTenantID(tenantID uint) ([]models.Client, error) {
+	var clients []models.Client
+	if err := r.db.Find(&clients, "tenant_id = ?", tenantID).Error; err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+func (r *ClientRepository) Update(client *models.Client) error {
+	return r.db.Save(client).Error
+}
+
+func (r *ClientRepository) Delete(client *models.Client) error {
+	return r.db.Delete(client).Error
+}
@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"gorm.io/gorm"
+)
+
+type DeviceCodeRepository struct {
+	db *gorm.DB
+}
+
+func NewDeviceCodeRepository(db *gorm.DB) *DeviceCodeRepository {
+	return &DeviceCodeRepository{db: db}
+}
+
+func (r *DeviceCodeRepository) Create(deviceCode *models.DeviceCode) error {
+	return r.db.Create(deviceCode).Error
+}
+
+func (r *DeviceCodeRepository) GetByDeviceCodeHash(deviceCodeHash string) (*models.DeviceCode, error) {
+	var deviceCode models.DeviceCode
+	if err := r.db.First(&deviceCode, "device_code_hash = ?", deviceCodeHash).Error; err != nil {
+		return nil, err
+	}
+	return &deviceCode, nil
+}
+
+func (r *DeviceCodeRepository) GetByUserCode(userCode string) (*models.DeviceCode, error) {
+	var deviceCode models.DeviceCode
+	if err := r.db.First(&deviceCode, "user_code = ?", userCode).Error; err != nil {
+		return nil, err
+	}
+	return &deviceCode, nil
+}
+
+// RecordPoll stores when the device last polled and the interval it must keep to
+func (r *DeviceCodeRepository) RecordPoll(id uint, intervalSeconds int, polledAt time.Time) error {
+	return r.db.Model(&models.DeviceCode{}).
+		Where("id = ?", id).
+		Updates(map[string]interface{}{"interval_seconds": intervalSeconds, "last_polled_at": polledAt, "updated_at": polledAt}).Error
+}
+
+// Decide records the user's decision on a request still in pendingStatus,
+// returning false if it had already been decided
+func (r *DeviceCodeRepository) Decide(id uint, pendingStatus, status string, userID uint, authTime time.Time, amr []string) (bool, error) {
+	// Map updates bypass the json serializer of the amr column
+	encodedAMR, err := json.Marshal(amr)
+	if err != nil {
+		return false, err
+	}
+
+	result := r.db.Model(&models.DeviceCode{}).
+		Where("id = ? AND status = ?", id, pendingStatus).
+		Updates(map[string]interface{}{"status": status, "user_id": userID, "auth_time": authTime, "amr": string(encodedAMR), "updated_at": time.Now()})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// Consume deletes a device code once tokens are issued for it, returning false
+// if a concurrent poll consumed it first
+func (r *DeviceCodeRepository) Consume(id uint) (bool, error) {
+	result := r.db.Where("id = ?", id).Delete(&models.DeviceCode{})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+func (r *DeviceCodeRepository) DeleteExpired(before time.Time) error {
+	return r.db.Where("expires_at < ?", before).Delete(&models.DeviceCode{}).Error
+}
@@ -0,0 +1,61 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"gorm.io/gorm"
+)
+
+type MFAChallengeRepository struct {
+	db *gorm.DB
+}
+
+func NewMFAChallengeRepository(db *gorm.DB) *MFAChallengeRepository {
+	return &MFAChallengeRepository{db: db}
+}
+
+func (r *MFAChallengeRepository) Create(challenge *models.MFAChallenge) error {
+	return r.db.Create(challenge).Error
+}
+
+func (r *MFAChallengeRepository) GetByChallengeHash(challengeHash string) (*models.MFAChallenge, error) {
+	var challenge models.MFAChallenge
+	if err := r.db.First(&challenge, "challenge_hash = ?", challengeHash).Error; err != nil {
+		return nil, err
+	}
+	return &challenge, nil
+}
+
+// RecordAttempt counts a verification attempt, returning false once
+// maxAttempts have already been made
+func (r *MFAChallengeRepository) RecordAttempt(id uint, maxAttempts int) (bool, error) {
+	result := r.db.Model(&models.MFAChallenge{}).
+		Where("id = ? AND attempts < ?", id, maxAttempts).
+		Updates(map[string]interface{}{"attempts": gorm.Expr("attempts + 1"), "updated_at": time.Now()})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// Consume deletes a challenge once it is answered, returning false if a
+// concurrent request consumed it first
+func (r *MFAChallengeRepository) Consume(id uint) (bool, error) {
+	result := r.db.Where("id = ?", id).Delete(&models.MFAChallenge{})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+func (r *MFAChallengeRepository) DeleteExpired(before time.Time) error {
+	return r.db.Where("expires_at < ?", before).Delete(&models.MFAChallenge{}).Error
+}
+
+// SetWebAuthnSession stores the pending security key assertion of a challenge
+func (r *MFAChallengeRepository) SetWebAuthnSession(id uint, data string) error {
+	return r.db.Model(&models.MFAChallenge{}).
+		Where("id = ?", id).
+		Updates(map[string]interface{}{"web_authn_session": data, "updated_at": time.Now()}).Error
+}
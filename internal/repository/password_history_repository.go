@@ -0,0 +1,45 @@
+package repository
+
+import (
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"gorm.io/gorm"
+)
+
+type PasswordHistoryRepository struct {
+	db *gorm.DB
+}
+
+func NewPasswordHistoryRepository(db *gorm.DB) *PasswordHistoryRepository {
+	return &PasswordHistoryRepository{db: db}
+}
+
+func (r *PasswordHistoryRepository) Create(passwordHistory *models.PasswordHistory) error {
+	return r.db.Create(passwordHistory).Error
+}
+
+// GetRecent returns the user's most recently replaced passwords, newest first
+func (r *PasswordHistoryRepository) GetRecent(userID uint, limit int) ([]models.PasswordHistory, error) {
+	var passwordHistory []models.PasswordHistory
+	if err := r.db.Where("user_id = ?", userID).Order("created_at DESC, id DESC").Limit(limit).Find(&passwordHistory).Error; err != nil {
+		return nil, err
+	}
+	return passwordHistory, nil
+}
+
+// Prune deletes all but the user's keep most recently replaced passwords
+func (r *PasswordHistoryRepository) Prune(userID uint, keep int) error {
+	recent, err := r.GetRecent(userID, keep)
+	if err != nil {
+		return err
+	}
+
+	query := r.db.Where("user_id = ?", userID)
+	if len(recent) > 0 {
+		ids := make([]uint, 0, len(recent))
+		for _, entry := range recent {
+			ids = append(ids, entry.ID)
+		}
+		query = query.Where("id NOT IN ?", ids)
+	}
+	return query.Delete(&models.PasswordHistory{}).Error
+}
@@ -0,0 +1,66 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"gorm.io/gorm"
+)
+
+type PasswordlessChallengeRepository struct {
+	db *gorm.DB
+}
+
+func NewPasswordlessChallengeRepository(db *gorm.DB) *PasswordlessChallengeRepository {
+	return &PasswordlessChallengeRepository{db: db}
+}
+
+func (r *PasswordlessChallengeRepository) Create(challenge *models.PasswordlessChallenge) error {
+	return r.db.Create(challenge).Error
+}
+
+func (r *PasswordlessChallengeRepository) GetByChallengeHash(challengeHash string) (*models.PasswordlessChallenge, error) {
+	var challenge models.PasswordlessChallenge
+	if err := r.db.First(&challenge, "challenge_hash = ?", challengeHash).Error; err != nil {
+		return nil, err
+	}
+	return &challenge, nil
+}
+
+func (r *PasswordlessChallengeRepository) GetByLinkHash(linkHash string) (*models.PasswordlessChallenge, error) {
+	var challenge models.PasswordlessChallenge
+	if err := r.db.First(&challenge, "link_hash = ?", linkHash).Error; err != nil {
+		return nil, err
+	}
+	return &challenge, nil
+}
+
+// RecordAttempt counts a code attempt, returning false once maxAttempts have
+// already been made
+func (r *PasswordlessChallengeRepository) RecordAttempt(id uint, maxAttempts int) (bool, error) {
+	result := r.db.Model(&models.PasswordlessChallenge{}).
+		Where("id = ? AND attempts < ?", id, maxAttempts).
+		Updates(map[string]interface{}{"attempts": gorm.Expr("attempts + 1"), "updated_at": time.Now()})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// Consume deletes a challenge once it is used, returning false if a
+// concurrent request consumed it first
+func (r *PasswordlessChallengeRepository) Consume(id uint) (bool, error) {
+	result := r.db.Where("id = ?", id).Delete(&models.PasswordlessChallenge{})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+func (r *PasswordlessChallengeRepository) DeleteForUser(userID uint) error {
+	return r.db.Where("user_id = ?", userID).Delete(&models.PasswordlessChallenge{}).Error
+}
+
+func (r *PasswordlessChallengeRepository) DeleteExpired(before time.Time) error {
+	return r.db.Where("expires_at < ?", before).Delete(&models.PasswordlessChallenge{}).Error
+}
@@ -0,0 +1,83 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"gorm.io/gorm"
+)
+
+type RefreshTokenRepository struct {
+	db *gorm.DB
+}
+
+func NewRefreshTokenRepository(db *gorm.DB) *RefreshTokenRepository {
+	return &RefreshTokenRepository{db: db}
+}
+
+func (r *RefreshTokenRepository) Create(refreshToken *models.RefreshToken) error {
+	return r.db.Create(refreshToken).Error
+}
+
+func (r *RefreshTokenRepository) GetByTokenHash(tokenHash string) (*models.RefreshToken, error) {
+	var refreshToken models.RefreshToken
+	if err := r.db.First(&refreshToken, "token_hash = ?", tokenHash).Error; err != nil {
+		return nil, err
+	}
+	return &refreshToken, nil
+}
+
+// GetFamilyStart returns the first refresh token of a family, issued when the
+// session started
+func (r *RefreshTokenRepository) GetFamilyStart(familyID string) (*models.RefreshToken, error) {
+	var refreshToken models.RefreshToken
+	if err := r.db.Order("id").First(&refreshToken, "family_id = ?", familyID).Error; err != nil {
+		return nil, err
+	}
+	return &refreshToken, nil
+}
+
+// MarkUsed flags the token as used, returning false if it had already been used
+func (r *RefreshTokenRepository) MarkUsed(id uint, usedAt time.Time) (bool, error) {
+	result := r.db.Model(&models.RefreshToken{}).
+		Where("id = ? AND used_at IS NULL", id).
+		Updates(map[string]interface{}{"used_at": usedAt, "updated_at": usedAt})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+func (r *RefreshTokenRepository) RevokeFamily(familyID string, revokedAt time.Time) error {
+	return r.db.Model(&models.RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Updates(map[string]interface{}{"revoked_at": revokedAt, "updated_at": revokedAt}).Error
+}
+
+func (r *RefreshTokenRepository) RevokeAllForUser(userID uint, revokedAt time.Time) error {
+	return r.db.Model(&models.RefreshToken{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Updates(map[string]interface{}{"revoked_at": revokedAt, "updated_at": revokedAt}).Error
+}
+
+func (r *RefreshTokenRepository) RevokeAllForUserExceptFamily(userID uint, familyID string, revokedAt time.Time) error {
+	return r.db.Model(&models.RefreshToken{}).
+		Where("user_id = ? AND family_id <> ? AND revoked_at IS NULL", userID, familyID).
+		Updates(map[string]interface{}{"revoked_at": revokedAt, "updated_at": revokedAt}).Error
+}
+
+func (r *RefreshTokenRepository) RevokeAllForClient(clientID string, revokedAt time.Time) error {
+	return r.db.Model(&models.RefreshToken{}).
+		Where("client_id = ? AND revoked_at IS NULL", clientID).
+		Updates(map[string]interface{}{"revoked_at": revokedAt, "updated_at": revokedAt}).Error
+}
+
+func (r *RefreshTokenRepository) DeleteExpired(before time.Time) error {
+	return r.db.Where("expires_at < ?", before).Delete(&models.RefreshToken{}).Error
+}
+
+func (r *RefreshTokenRepository) RevokeAllForTenant(tenantID uint, revokedAt time.Time) error {
+	return r.db.Model(&models.RefreshToken{}).
+		Where("tenant_id = ? AND revoked_at IS NULL", tenantID).
+		Updates(map[string]interface{}{"revoked_at": revokedAt, "updated_at": revokedAt}).Error
+}
@@ -0,0 +1,49 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"gorm.io/gorm"
+)
+
+type SigningKeyRepository struct {
+	db *gorm.DB
+}
+
+func NewSigningKeyRepository(db *gorm.DB) *SigningKeyRepository {
+	return &SigningKeyRepository{db: db}
+}
+
+func (r *SigningKeyRepository) Create(signingKey *models.SigningKey) error {
+	return r.db.Create(signingKey).Error
+}
+
+func (r *SigningKeyRepository) Update(signingKey *models.SigningKey) error {
+	return r.db.Save(signingKey).Error
+}
+
+// ReplacePrivateKeyPEM swaps the stored private key of a signing key,
+// provided it still holds oldPEM
+func (r *SigningKeyRepository) ReplacePrivateKeyPEM(id uint, oldPEM, newPEM string) (bool, error) {
+	result := r.db.Model(&models.SigningKey{}).
+		Where("id = ? AND private_key_pem = ?", id, oldPEM).
+		Updates(map[string]interface{}{"private_key_pem": newPEM, "updated_at": time.Now()})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// GetUnexpired returns keys still usable for verification, oldest activation first
+func (r *SigningKeyRepository) GetUnexpired(now time.Time) ([]models.SigningKey, error) {
+	var signingKeys []models.SigningKey
+	if err := r.db.Where("expires_at IS NULL OR expires_at > ?", now).Order("activates_at").Find(&signingKeys).Error; err != nil {
+		return nil, err
+	}
+	return signingKeys, nil
+}
+
+func (r *SigningKeyRepository) DeleteExpired(now time.Time) error {
+	return r.db.Where("expires_at IS NOT NULL AND expires_at <= ?", now).Delete(&models.SigningKey{}).Error
+}
@@ -25,6 +25,14 @@ func (r *TenantRepository) GetByID(tenantId uint) (*models.Tenant, error) {
 	return &tenant, nil
 }
 
+func (r *TenantRepository) GetByIDWithClients(tenantId uint) (*models.Tenant, error) {
+	var tenant models.Tenant
+	if err := r.db.Preload("Clients").First(&tenant, "id = ?", tenantId).Error; err != nil {
+		return nil, err
+	}
+	return &tenant, nil
+}
+
 func (r *TenantRepository) Update(tenant *models.Tenant) error {
 	return r.db.Save(tenant).Error
 }
@@ -0,0 +1,27 @@
+package repository
+
+import (
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"gorm.io/gorm"
+)
+
+type TenantSettingsRepository struct {
+	db *gorm.DB
+}
+
+func NewTenantSettingsRepository(db *gorm.DB) *TenantSettingsRepository {
+	return &TenantSettingsRepository{db: db}
+}
+
+func (r *TenantSettingsRepository) GetByTenantID(tenantID uint) (*models.TenantSettings, error) {
+	var settings models.TenantSettings
+	if err := r.db.First(&settings, "tenant_id = ?", tenantID).Error; err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+// Save creates the tenant's settings or updates the existing row
+func (r *TenantSettingsRepository) Save(settings *models.TenantSettings) error {
+	return r.db.Save(settings).Error
+}
@@ -0,0 +1,49 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type TokenRevocationRepository struct {
+	db *gorm.DB
+}
+
+func NewTokenRevocationRepository(db *gorm.DB) *TokenRevocationRepository {
+	return &TokenRevocationRepository{db: db}
+}
+
+func (r *TokenRevocationRepository) CreateRevokedToken(revokedToken *models.RevokedToken) error {
+	return r.db.Clauses(clause.OnConflict{DoNothing: true}).Create(revokedToken).Error
+}
+
+func (r *TokenRevocationRepository) IsTokenRevoked(jti string) (bool, error) {
+	var count int64
+	if err := r.db.Model(&models.RevokedToken{}).Where("jti = ?", jti).Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (r *TokenRevocationRepository) DeleteExpiredRevokedTokens(before time.Time) error {
+	return r.db.Where("expires_at < ?", before).Delete(&models.RevokedToken{}).Error
+}
+
+// Upsert creates or moves forward the revocation cutoff for a subject
+func (r *TokenRevocationRepository) Upsert(revocation *models.TokenRevocation) error {
+	return r.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "subject_type"}, {Name: "subject_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"issued_before", "except_session_id", "updated_at"}),
+	}).Create(revocation).Error
+}
+
+func (r *TokenRevocationRepository) GetBySubject(subjectType string, subjectID uint) (*models.TokenRevocation, error) {
+	var revocation models.TokenRevocation
+	if err := r.db.First(&revocation, "subject_type = ? AND subject_id = ?", subjectType, subjectID).Error; err != nil {
+		return nil, err
+	}
+	return &revocation, nil
+}
@@ -1,6 +1,8 @@
 package repository
 
 import (
+	"time"
+
 	"github.com/geekible-ltd/auth-server/internal/models"
 	"gorm.io/gorm"
 )
@@ -17,9 +19,9 @@ func (r *UserRepository) Create(user *models.User) error {
 	return r.db.Create(user).Error
 }
 
-func (r *UserRepository) GetByID(userId, tenantId uint) (*models.User, error) {
+func (r *UserRepository) GetByID(tenantId, userId uint) (*models.User, error) {
 	var user models.User
-	if err := r.db.First(&user, "user_id = ? AND tenant_id = ?", userId, tenantId).Error; err != nil {
+	if err := r.db.First(&user, "id = ? AND tenant_id = ?", userId, tenantId).Error; err != nil {
 		return nil, err
 	}
 	return &user, nil
@@ -64,3 +66,161 @@ func (r *UserRepository) GetByEmail(email string) (*models.User, error) {
 	}
 	return &user, nil
 }
+
+// RecordTOTPStep stores the time step of an accepted TOTP code, returning
+// false if that step or a later one was already used
+func (r *UserRepository) RecordTOTPStep(userID uint, step int64) (bool, error) {
+	result := r.db.Model(&models.User{}).
+		Where("id = ? AND totp_last_used_step < ?", userID, step).
+		Update("totp_last_used_step", step)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+func (r *UserRepository) GetByResetPasswordToken(tokenHash string) (*models.User, error) {
+	var user models.User
+	if err := r.db.Where("reset_password_token = ?", tokenHash).First(&user).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// IncrementFailedLoginAttempts counts a failed login attempt and returns the
+// user's new number of failed attempts
+func (r *UserRepository) IncrementFailedLoginAttempts(userID uint) (int, error) {
+	result := r.db.Model(&models.User{}).
+		Where("id = ?", userID).
+		Updates(map[string]interface{}{
+			"failed_login_attempts": gorm.Expr("failed_login_attempts + 1"),
+			"updated_at":            time.Now(),
+		})
+	if result.Error != nil {
+		return 0, result.Error
+	}
+
+	var user models.User
+	if err := r.db.Select("failed_login_attempts").Where("id = ?", userID).First(&user).Error; err != nil {
+		return 0, err
+	}
+	return user.FailedLoginAttempts, nil
+}
+
+// Lock locks the user out until lockedUntil if they have at least
+// maxFailedAttempts failed login attempts, clearing the attempts and counting
+// the lockout. It returns false if a concurrent attempt locked the user first.
+func (r *UserRepository) Lock(userID uint, maxFailedAttempts int, lockedUntil time.Time) (bool, error) {
+	result := r.db.Model(&models.User{}).
+		Where("id = ? AND failed_login_attempts >= ?", userID, maxFailedAttempts).
+		Updates(map[string]interface{}{
+			"failed_login_attempts": 0,
+			"locked_until":          lockedUntil,
+			"lockout_count":         gorm.Expr("lockout_count + 1"),
+			"updated_at":            time.Now(),
+		})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+const lockedOutCondition = "is_active = ? AND deleted_at IS NULL AND failed_login_attempts >= ?"
+
+// GetLockedOut returns the users that are inactive but not deleted and have
+// at least maxFailedAttempts failed login attempts, as the lockout of earlier
+// versions left them
+func (r *UserRepository) GetLockedOut(maxFailedAttempts int) ([]models.User, error) {
+	var users []models.User
+	if err := r.db.Where(lockedOutCondition, false, maxFailedAttempts).Order("tenant_id, id").Find(&users).Error; err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// ReactivateLockedOut reactivates the users GetLockedOut returns and clears
+// their failed attempts. It returns the number of users reactivated.
+func (r *UserRepository) ReactivateLockedOut(maxFailedAttempts int) (int64, error) {
+	result := r.db.Model(&models.User{}).
+		Where(lockedOutCondition, false, maxFailedAttempts).
+		Updates(map[string]interface{}{
+			"is_active":             true,
+			"failed_login_attempts": 0,
+			"updated_at":            time.Now(),
+		})
+	return result.RowsAffected, result.Error
+}
+
+// ResetPassword sets a new password hash if the reset token is still the
+// user's current one, clearing the token, failed login attempts and any lock.
+// Receiving the token proves the user owns their email address. It returns
+// false if the token was already used or replaced.
+func (r *UserRepository) ResetPassword(userID uint, tokenHash, passwordHash string) (bool, error) {
+	result := r.db.Model(&models.User{}).
+		Where("id = ? AND reset_password_token = ?", userID, tokenHash).
+		Updates(map[string]interface{}{
+			"password_hash":                   passwordHash,
+			"password_changed_at":             time.Now(),
+			"reset_password_token":            "",
+			"reset_password_token_expires_at": nil,
+			"failed_login_attempts":           0,
+			"locked_until":                    nil,
+			"lockout_count":                   0,
+			"is_email_verified":               true,
+			"updated_at":                      time.Now(),
+		})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// UpdatePasswordHash replaces the user's password hash with an equivalent one,
+// such as after a rehash, if it is still oldHash. It returns false if the
+// password was changed in the meantime.
+func (r *UserRepository) UpdatePasswordHash(userID uint, oldHash, newHash string) (bool, error) {
+	result := r.db.Model(&models.User{}).
+		Where("id = ? AND password_hash = ?", userID, oldHash).
+		Updates(map[string]interface{}{
+			"password_hash": newHash,
+			"updated_at":    time.Now(),
+		})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+func (r *UserRepository) GetByEmailVerificationToken(tokenHash string) (*models.User, error) {
+	var user models.User
+	if err := r.db.Where("email_verification_token = ?", tokenHash).First(&user).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// VerifyEmail marks the user's email as verified if the verification token is
+// still the user's current one, and clears it. It returns false if the token
+// was already used or replaced.
+func (r *UserRepository) VerifyEmail(userID uint, tokenHash string) (bool, error) {
+	result := r.db.Model(&models.User{}).
+		Where("id = ? AND email_verification_token = ?", userID, tokenHash).
+		Updates(map[string]interface{}{
+			"is_email_verified":                   true,
+			"email_verification_token":            "",
+			"email_verification_token_expires_at": nil,
+			"updated_at":                          time.Now(),
+		})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+func (r *UserRepository) GetByWebAuthnID(webAuthnID string) (*models.User, error) {
+	var user models.User
+	if err := r.db.Where("web_authn_id = ?", webAuthnID).First(&user).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
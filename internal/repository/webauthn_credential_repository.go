@@ -0,0 +1,55 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"gorm.io/gorm"
+)
+
+type WebAuthnCredentialRepository struct {
+	db *gorm.DB
+}
+
+func NewWebAuthnCredentialRepository(db *gorm.DB) *WebAuthnCredentialRepository {
+	return &WebAuthnCredentialRepository{db: db}
+}
+
+func (r *WebAuthnCredentialRepository) Create(credential *models.WebAuthnCredential) error {
+	return r.db.Create(credential).Error
+}
+
+func (r *WebAuthnCredentialRepository) GetByUserID(userID uint) ([]models.WebAuthnCredential, error) {
+	var credentials []models.WebAuthnCredential
+	if err := r.db.Find(&credentials, "user_id = ?", userID).Error; err != nil {
+		return nil, err
+	}
+	return credentials, nil
+}
+
+func (r *WebAuthnCredentialRepository) GetByID(userID, id uint) (*models.WebAuthnCredential, error) {
+	var credential models.WebAuthnCredential
+	if err := r.db.First(&credential, "id = ? AND user_id = ?", id, userID).Error; err != nil {
+		return nil, err
+	}
+	return &credential, nil
+}
+
+func (r *WebAuthnCredentialRepository) CountByUserID(userID uint) (int64, error) {
+	var count int64
+	if err := r.db.Model(&models.WebAuthnCredential{}).Where("user_id = ?", userID).Count(&count).Error; err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// RecordUse stores the signature counter and backup state of a successful assertion
+func (r *WebAuthnCredentialRepository) RecordUse(id uint, signCount uint32, backupState bool, usedAt time.Time) error {
+	return r.db.Model(&models.WebAuthnCredential{}).
+		Where("id = ?", id).
+		Updates(map[string]interface{}{"sign_count": signCount, "backup_state": backupState, "last_used_at": usedAt, "updated_at": usedAt}).Error
+}
+
+func (r *WebAuthnCredentialRepository) Delete(credential *models.WebAuthnCredential) error {
+	return r.db.Delete(credential).Error
+}
@@ -0,0 +1,42 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"gorm.io/gorm"
+)
+
+type WebAuthnSessionRepository struct {
+	db *gorm.DB
+}
+
+func NewWebAuthnSessionRepository(db *gorm.DB) *WebAuthnSessionRepository {
+	return &WebAuthnSessionRepository{db: db}
+}
+
+func (r *WebAuthnSessionRepository) Create(session *models.WebAuthnSession) error {
+	return r.db.Create(session).Error
+}
+
+func (r *WebAuthnSessionRepository) GetBySessionHash(sessionHash string) (*models.WebAuthnSession, error) {
+	var session models.WebAuthnSession
+	if err := r.db.First(&session, "session_hash = ?", sessionHash).Error; err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// Consume deletes a session when its ceremony is finished, returning false if
+// a concurrent request consumed it first
+func (r *WebAuthnSessionRepository) Consume(id uint) (bool, error) {
+	result := r.db.Where("id = ?", id).Delete(&models.WebAuthnSession{})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+func (r *WebAuthnSessionRepository) DeleteExpired(before time.Time) error {
+	return r.db.Where("expires_at < ?", before).Delete(&models.WebAuthnSession{}).Error
+}
@@ -0,0 +1,332 @@
+package service
+
+import (
+	"crypto/subtle"
+	"net/url"
+	"time"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"github.com/geekible-ltd/auth-server/internal/repository"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// supportedGrantTypes are the grant types a client may be registered for
+var supportedGrantTypes = []string{
+	config.GrantTypeAuthorizationCode,
+	config.GrantTypeRefreshToken,
+	config.GrantTypeClientCredentials,
+	config.GrantTypeDeviceCode,
+	config.GrantTypeTokenExchange,
+}
+
+// SupportedGrantTypes returns the grant types advertised in discovery metadata
+func SupportedGrantTypes() []string {
+	return append([]string(nil), supportedGrantTypes...)
+}
+
+type ClientService struct {
+	clientRepository        *repository.ClientRepository
+	tenantRepository        *repository.TenantRepository
+	refreshTokenRepository  *repository.RefreshTokenRepository
+	clientConsentRepository *repository.ClientConsentRepository
+}
+
+func NewClientService(clientRepository *repository.ClientRepository, tenantRepository *repository.TenantRepository, refreshTokenRepository *repository.RefreshTokenRepository, clientConsentRepository *repository.ClientConsentRepository) *ClientService {
+	return &ClientService{
+		clientRepository:        clientRepository,
+		tenantRepository:        tenantRepository,
+		refreshTokenRepository:  refreshTokenRepository,
+		clientConsentRepository: clientConsentRepository,
+	}
+}
+
+// RegisterClient creates a client for the tenant. Confidential clients get a
+// secret that is only returned here; just its hash is stored. Grant types and
+// scopes default to everything the server supports.
+func (s *ClientService) RegisterClient(tenantID uint, clientDTO dto.ClientRegistrationDTO) (dto.ClientCredentialsDTO, error) {
+	_, err := s.tenantRepository.GetByID(tenantID)
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return dto.ClientCredentialsDTO{}, config.ErrTenantNotFound
+	} else if err != nil {
+		return dto.ClientCredentialsDTO{}, err
+	}
+
+	grantTypes, scopes, err := validateClientSettings(clientDTO.RedirectURIs, clientDTO.GrantTypes, clientDTO.Scopes, clientDTO.IsPublic)
+	if err != nil {
+		return dto.ClientCredentialsDTO{}, err
+	}
+
+	var clientSecret, clientSecretHash string
+	if !clientDTO.IsPublic {
+		clientSecret, err = generateSecureToken()
+		if err != nil {
+			return dto.ClientCredentialsDTO{}, config.ErrFailedToCreateClient
+		}
+		clientSecretHash = hashSecureToken(clientSecret)
+	}
+
+	client := &models.Client{
+		TenantID:         tenantID,
+		ClientID:         uuid.New().String(),
+		ClientSecretHash: clientSecretHash,
+		Name:             clientDTO.Name,
+		RedirectURIs:     clientDTO.RedirectURIs,
+		GrantTypes:       grantTypes,
+		Scopes:           scopes,
+		IsPublic:         clientDTO.IsPublic,
+		IsFirstParty:     clientDTO.IsFirstParty,
+		IsActive:         true,
+		CreatedAt:        time.Now(),
+		UpdatedAt:        time.Now(),
+	}
+	if err := s.clientRepository.Create(client); err != nil {
+		return dto.ClientCredentialsDTO{}, config.ErrFailedToCreateClient
+	}
+
+	return dto.ClientCredentialsDTO{
+		ClientID:     client.ClientID,
+		ClientSecret: clientSecret,
+	}, nil
+}
+
+func (s *ClientService) GetClients(tenantID uint) ([]dto.ClientResponseDTO, error) {
+	clientsDTO := []dto.ClientResponseDTO{}
+
+	clients, err := s.clientRepository.GetByTenantID(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	for _, client := range clients {
+		clientsDTO = append(clientsDTO, toClientResponseDTO(client))
+	}
+	return clientsDTO, nil
+}
+
+func (s *ClientService) GetClient(tenantID uint, clientID string) (dto.ClientResponseDTO, error) {
+	client, err := s.getTenantClient(tenantID, clientID)
+	if err != nil {
+		return dto.ClientResponseDTO{}, err
+	}
+	return toClientResponseDTO(*client), nil
+}
+
+// UpdateClient replaces the client's settings. Deactivating a client revokes
+// the refresh tokens issued to it.
+func (s *ClientService) UpdateClient(tenantID uint, clientID string, clientDTO dto.ClientRequestDTO) error {
+	client, err := s.getTenantClient(tenantID, clientID)
+	if err != nil {
+		return err
+	}
+
+	grantTypes, scopes, err := validateClientSettings(clientDTO.RedirectURIs, clientDTO.GrantTypes, clientDTO.Scopes, client.IsPublic)
+	if err != nil {
+		return err
+	}
+
+	client.Name = clientDTO.Name
+	client.RedirectURIs = clientDTO.RedirectURIs
+	client.GrantTypes = grantTypes
+	client.Scopes = scopes
+	client.IsFirstParty = clientDTO.IsFirstParty
+	client.IsActive = clientDTO.IsActive
+	client.UpdatedAt = time.Now()
+
+	if err := s.clientRepository.Update(client); err != nil {
+		return err
+	}
+
+	if !client.IsActive {
+		return s.refreshTokenRepository.RevokeAllForClient(client.ClientID, time.Now())
+	}
+	return nil
+}
+
+// RotateClientSecret replaces the secret of a confidential client. The old
+// secret stops working immediately.
+func (s *ClientService) RotateClientSecret(tenantID uint, clientID string) (dto.ClientCredentialsDTO, error) {
+	client, err := s.getTenantClient(tenantID, clientID)
+	if err != nil {
+		return dto.ClientCredentialsDTO{}, err
+	}
+	if client.IsPublic {
+		return dto.ClientCredentialsDTO{}, config.ErrInvalidClient
+	}
+
+	clientSecret, err := generateSecureToken()
+	if err != nil {
+		return dto.ClientCredentialsDTO{}, err
+	}
+
+	client.ClientSecretHash = hashSecureToken(clientSecret)
+	client.UpdatedAt = time.Now()
+	if err := s.clientRepository.Update(client); err != nil {
+		return dto.ClientCredentialsDTO{}, err
+	}
+
+	return dto.ClientCredentialsDTO{
+		ClientID:     client.ClientID,
+		ClientSecret: clientSecret,
+	}, nil
+}
+
+// DeleteClient removes the client and the consents users gave it, and revokes
+// the refresh tokens issued to it
+func (s *ClientService) DeleteClient(tenantID uint, clientID string) error {
+	client, err := s.getTenantClient(tenantID, clientID)
+	if err != nil {
+		return err
+	}
+
+	if err := s.refreshTokenRepository.RevokeAllForClient(client.ClientID, time.Now()); err != nil {
+		return err
+	}
+	if err := s.clientConsentRepository.DeleteForClient(client.ClientID); err != nil {
+		return err
+	}
+	return s.clientRepository.Delete(client)
+}
+
+// Authenticate verifies client credentials and returns the active client
+func (s *ClientService) Authenticate(clientID, clientSecret string) (*models.Client, error) {
+	client, err := s.clientRepository.GetByClientID(clientID)
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return nil, config.ErrInvalidClient
+	} else if err != nil {
+		return nil, err
+	}
+
+	if client.IsPublic || subtle.ConstantTimeCompare([]byte(client.ClientSecretHash), []byte(hashSecureToken(clientSecret))) != 1 {
+		return nil, config.ErrInvalidClient
+	}
+
+	if !client.IsActive {
+		return nil, config.ErrInvalidClient
+	}
+
+	return client, nil
+}
+
+// AuthenticatePublic identifies a public client, which has no secret to verify
+func (s *ClientService) AuthenticatePublic(clientID string) (*models.Client, error) {
+	client, err := s.GetActiveClient(clientID)
+	if err != nil {
+		return nil, err
+	}
+	if !client.IsPublic {
+		return nil, config.ErrInvalidClient
+	}
+	return client, nil
+}
+
+// GetActiveClient returns the active client with the given client ID
+func (s *ClientService) GetActiveClient(clientID string) (*models.Client, error) {
+	client, err := s.clientRepository.GetByClientID(clientID)
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return nil, config.ErrInvalidClient
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !client.IsActive {
+		return nil, config.ErrInvalidClient
+	}
+	return client, nil
+}
+
+// isValidRedirectURI requires an absolute URI without a fragment (RFC 6749
+// section 3.1.2). Private-use schemes of native apps have no host.
+func isValidRedirectURI(redirectURI string) bool {
+	u, err := url.Parse(redirectURI)
+	if err != nil || !u.IsAbs() || u.Fragment != "" {
+		return false
+	}
+	if u.Scheme == "http" || u.Scheme == "https" {
+		return u.Host != ""
+	}
+	return true
+}
+
+// getTenantClient returns the tenant's client, hiding clients of other tenants
+func (s *ClientService) getTenantClient(tenantID uint, clientID string) (*models.Client, error) {
+	client, err := s.clientRepository.GetByClientID(clientID)
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return nil, config.ErrClientNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	if client.TenantID != tenantID {
+		return nil, config.ErrClientNotFound
+	}
+	return client, nil
+}
+
+// validateClientSettings checks the redirect URIs, grant types and scopes of a
+// client and returns the grant types and scopes with defaults applied
+func validateClientSettings(redirectURIs, grantTypes, scopes []string, isPublic bool) ([]string, []string, error) {
+	for _, redirectURI := range redirectURIs {
+		if !isValidRedirectURI(redirectURI) {
+			return nil, nil, config.ErrInvalidRedirectURI
+		}
+	}
+
+	if len(grantTypes) == 0 {
+		grantTypes = []string{config.GrantTypeAuthorizationCode, config.GrantTypeRefreshToken}
+	}
+	for _, grantType := range grantTypes {
+		if !containsString(supportedGrantTypes, grantType) {
+			return nil, nil, config.ErrInvalidGrantType
+		}
+	}
+	if containsString(grantTypes, config.GrantTypeAuthorizationCode) && len(redirectURIs) == 0 {
+		return nil, nil, config.ErrInvalidRedirectURI
+	}
+	// Public clients cannot authenticate, so they cannot act on their own
+	// behalf or as the actor of a delegated token
+	if (containsString(grantTypes, config.GrantTypeClientCredentials) || containsString(grantTypes, config.GrantTypeTokenExchange)) && isPublic {
+		return nil, nil, config.ErrInvalidGrantType
+	}
+
+	if len(scopes) == 0 {
+		scopes = SupportedScopes()
+	}
+	for _, scope := range scopes {
+		if !isValidScopeToken(scope) {
+			return nil, nil, config.ErrInvalidScope
+		}
+	}
+
+	return grantTypes, scopes, nil
+}
+
+// clientAllowsGrantType reports whether the client was registered for the grant type
+func clientAllowsGrantType(client *models.Client, grantType string) bool {
+	return containsString(client.GrantTypes, grantType)
+}
+
+func toClientResponseDTO(client models.Client) dto.ClientResponseDTO {
+	return dto.ClientResponseDTO{
+		ClientID:     client.ClientID,
+		TenantID:     client.TenantID,
+		Name:         client.Name,
+		RedirectURIs: client.RedirectURIs,
+		GrantTypes:   client.GrantTypes,
+		Scopes:       client.Scopes,
+		IsPublic:     client.IsPublic,
+		IsFirstParty: client.IsFirstParty,
+		IsActive:     client.IsActive,
+		CreatedAt:    client.CreatedAt,
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+package service
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/internal/config"
+)
+
+func TestRegisterClient(t *testing.T) {
+	tests := []struct {
+		name       string
+		client     dto.ClientRegistrationDTO
+		wantErr    error
+		wantSecret bool
+	}{
+		{name: "confidential clients get a secret", client: dto.ClientRegistrationDTO{RedirectURIs: []string{testRedirectURI}}, wantSecret: true},
+		{name: "public clients get no secret", client: dto.ClientRegistrationDTO{RedirectURIs: []string{testRedirectURI}, IsPublic: true}},
+		{name: "native apps may use a private-use scheme", client: dto.ClientRegistrationDTO{RedirectURIs: []string{"com.example.app:/callback"}, IsPublic: true}},
+		{name: "rejects a relative redirect URI", client: dto.ClientRegistrationDTO{RedirectURIs: []string{"/callback"}}, wantErr: config.ErrInvalidRedirectURI},
+		{name: "rejects a redirect URI with a fragment", client: dto.ClientRegistrationDTO{RedirectURIs: []string{testRedirectURI + "#frag"}}, wantErr: config.ErrInvalidRedirectURI},
+		{name: "requires a redirect URI for the code grant", client: dto.ClientRegistrationDTO{}, wantErr: config.ErrInvalidRedirectURI},
+		{name: "machine clients need no redirect URI", client: dto.ClientRegistrationDTO{GrantTypes: []string{config.GrantTypeClientCredentials}}, wantSecret: true},
+		{name: "rejects an unknown grant type", client: dto.ClientRegistrationDTO{GrantTypes: []string{"password"}}, wantErr: config.ErrInvalidGrantType},
+		{name: "rejects client credentials for public clients", client: dto.ClientRegistrationDTO{GrantTypes: []string{config.GrantTypeClientCredentials}, IsPublic: true}, wantErr: config.ErrInvalidGrantType},
+		{name: "rejects token exchange for public clients", client: dto.ClientRegistrationDTO{GrantTypes: []string{config.GrantTypeTokenExchange}, IsPublic: true}, wantErr: config.ErrInvalidGrantType},
+		{name: "rejects an invalid scope", client: dto.ClientRegistrationDTO{RedirectURIs: []string{testRedirectURI}, Scopes: []string{"bad scope"}}, wantErr: config.ErrInvalidScope},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServices(t)
+			user := s.createUser(t, "user@example.com")
+
+			credentials, err := s.client.RegisterClient(user.TenantID, tt.client)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("RegisterClient() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if gotSecret := credentials.ClientSecret != ""; gotSecret != tt.wantSecret {
+				t.Errorf("RegisterClient() secret returned = %v, want %v", gotSecret, tt.wantSecret)
+			}
+		})
+	}
+
+	t.Run("rejects an unknown tenant", func(t *testing.T) {
+		s := newTestServices(t)
+		if _, err := s.client.RegisterClient(42, dto.ClientRegistrationDTO{RedirectURIs: []string{testRedirectURI}}); !errors.Is(err, config.ErrTenantNotFound) {
+			t.Errorf("RegisterClient() error = %v, want %v", err, config.ErrTenantNotFound)
+		}
+	})
+}
+
+func TestAuthenticateClient(t *testing.T) {
+	tests := []struct {
+		name string
+		// credentials returns the client ID and secret to authenticate with
+		credentials func(t *testing.T, s *testServices, tenantID uint, clientID, secret string) (string, string)
+		wantErr     error
+	}{
+		{
+			name: "accepts the client's secret",
+			credentials: func(t *testing.T, s *testServices, tenantID uint, clientID, secret string) (string, string) {
+				return clientID, secret
+			},
+		},
+		{
+			name: "rejects a wrong secret",
+			credentials: func(t *testing.T, s *testServices, tenantID uint, clientID, secret string) (string, string) {
+				return clientID, secret + "x"
+			},
+			wantErr: config.ErrInvalidClient,
+		},
+		{
+			name: "rejects an unknown client",
+			credentials: func(t *testing.T, s *testServices, tenantID uint, clientID, secret string) (string, string) {
+				return "unknown", secret
+			},
+			wantErr: config.ErrInvalidClient,
+		},
+		{
+			name: "rejects a deactivated client",
+			credentials: func(t *testing.T, s *testServices, tenantID uint, clientID, secret string) (string, string) {
+				check(t, s.client.UpdateClient(tenantID, clientID, dto.ClientRequestDTO{RedirectURIs: []string{testRedirectURI}}))
+				return clientID, secret
+			},
+			wantErr: config.ErrInvalidClient,
+		},
+		{
+			name: "rejects the secret a rotation replaced",
+			credentials: func(t *testing.T, s *testServices, tenantID uint, clientID, secret string) (string, string) {
+				_, err := s.client.RotateClientSecret(tenantID, clientID)
+				check(t, err)
+				return clientID, secret
+			},
+			wantErr: config.ErrInvalidClient,
+		},
+		{
+			name: "accepts the rotated secret",
+			credentials: func(t *testing.T, s *testServices, tenantID uint, clientID, secret string) (string, string) {
+				credentials, err := s.client.RotateClientSecret(tenantID, clientID)
+				check(t, err)
+				return clientID, credentials.ClientSecret
+			},
+		},
+		{
+			name: "rejects a public client without a secret",
+			credentials: func(t *testing.T, s *testServices, tenantID uint, clientID, secret string) (string, string) {
+				client, _ := s.registerClient(t, tenantID, dto.ClientRegistrationDTO{IsPublic: true})
+				return client.ClientID, ""
+			},
+			wantErr: config.ErrInvalidClient,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServices(t)
+			user := s.createUser(t, "user@example.com")
+			client, secret := s.registerClient(t, user.TenantID, dto.ClientRegistrationDTO{})
+
+			clientID, clientSecret := tt.credentials(t, s, user.TenantID, client.ClientID, secret)
+			authenticated, err := s.client.Authenticate(clientID, clientSecret)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Authenticate() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && authenticated.ClientID != clientID {
+				t.Errorf("Authenticate() client = %q, want %q", authenticated.ClientID, clientID)
+			}
+		})
+	}
+}
+
+func TestClientTenantIsolation(t *testing.T) {
+	s := newTestServices(t)
+	owner := s.createUser(t, "owner@example.com")
+	other := s.createUser(t, "other@example.com")
+	client, _ := s.registerClient(t, owner.TenantID, dto.ClientRegistrationDTO{})
+
+	tests := []struct {
+		name string
+		call func(tenantID uint) error
+	}{
+		{name: "get", call: func(tenantID uint) error {
+			_, err := s.client.GetClient(tenantID, client.ClientID)
+			return err
+		}},
+		{name: "update", call: func(tenantID uint) error {
+			return s.client.UpdateClient(tenantID, client.ClientID, dto.ClientRequestDTO{RedirectURIs: []string{testRedirectURI}, IsActive: true})
+		}},
+		{name: "rotate secret", call: func(tenantID uint) error {
+			_, err := s.client.RotateClientSecret(tenantID, client.ClientID)
+			return err
+		}},
+		{name: "delete", call: func(tenantID uint) error {
+			return s.client.DeleteClient(tenantID, client.ClientID)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.call(other.TenantID); !errors.Is(err, config.ErrClientNotFound) {
+				t.Errorf("error = %v, want %v", err, config.ErrClientNotFound)
+			}
+		})
+	}
+
+	clients, err := s.client.GetClients(other.TenantID)
+	check(t, err)
+	if len(clients) != 0 {
+		t.Errorf("GetClients() of another tenant = %d clients, want 0", len(clients))
+	}
+}
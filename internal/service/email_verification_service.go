@@ -0,0 +1,150 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"github.com/geekible-ltd/auth-server/internal/repository"
+	"github.com/geekible-ltd/auth-server/mailer"
+	"gorm.io/gorm"
+)
+
+type EmailVerificationService struct {
+	userRepository *repository.UserRepository
+	mailer         mailer.Mailer
+	linkURL        string
+	ttl            time.Duration
+}
+
+func NewEmailVerificationService(userRepository *repository.UserRepository, mailer mailer.Mailer, linkURL string, ttl time.Duration) *EmailVerificationService {
+	return &EmailVerificationService{
+		userRepository: userRepository,
+		mailer:         mailer,
+		linkURL:        linkURL,
+		ttl:            ttl,
+	}
+}
+
+// SendVerification emails the user a single-use verification token, as a
+// link when a link URL is configured, replacing any earlier token
+func (s *EmailVerificationService) SendVerification(user *models.User) error {
+	if s.mailer == nil {
+		return config.ErrMailerNotConfigured
+	}
+
+	rawToken, err := generateSecureToken()
+	if err != nil {
+		return err
+	}
+
+	var link string
+	if s.linkURL != "" {
+		link, err = magicLink(s.linkURL, rawToken)
+		if err != nil {
+			return err
+		}
+	}
+
+	expiresAt := time.Now().Add(s.ttl)
+	user.EmailVerificationToken = hashSecureToken(rawToken)
+	user.EmailVerificationTokenExpiresAt = &expiresAt
+	user.UpdatedAt = time.Now()
+	if err := s.userRepository.Update(user); err != nil {
+		return err
+	}
+
+	return s.mailer.Send(s.verificationMessage(user.Email, rawToken, link))
+}
+
+// Resend emails a new verification token to the user with the given email.
+// Unknown and already verified emails are sent nothing and return no error,
+// so callers cannot tell whether an account exists.
+func (s *EmailVerificationService) Resend(resendRequest dto.ResendVerificationDTO) error {
+	if s.mailer == nil {
+		return config.ErrMailerNotConfigured
+	}
+
+	user, err := s.userRepository.GetByEmail(resendRequest.Email)
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if user.IsEmailVerified {
+		return nil
+	}
+
+	return s.SendVerification(user)
+}
+
+// Verify marks the email address the token was sent to as verified. The
+// token works once.
+func (s *EmailVerificationService) Verify(verifyRequest dto.VerifyEmailDTO) error {
+	if verifyRequest.Token == "" {
+		return config.ErrInvalidVerificationToken
+	}
+
+	tokenHash := hashSecureToken(verifyRequest.Token)
+	user, err := s.userRepository.GetByEmailVerificationToken(tokenHash)
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return config.ErrInvalidVerificationToken
+	} else if err != nil {
+		return err
+	}
+	if user.EmailVerificationTokenExpiresAt == nil || user.EmailVerificationTokenExpiresAt.Before(time.Now()) {
+		return config.ErrInvalidVerificationToken
+	}
+
+	verified, err := s.userRepository.VerifyEmail(user.ID, tokenHash)
+	if err != nil {
+		return err
+	} else if !verified {
+		return config.ErrInvalidVerificationToken
+	}
+	return nil
+}
+
+// SendAlreadyRegistered tells the owner of an email address that someone
+// tried to register it again, or to register an organisation that already
+// exists, in place of a verification email
+func (s *EmailVerificationService) SendAlreadyRegistered(email string) error {
+	if s.mailer == nil {
+		return config.ErrMailerNotConfigured
+	}
+
+	body := "Someone tried to register with this email address, but it or its organisation already has an account.\n\n" +
+		"If it was you, log in or reset your password, or ask your organisation's administrator to add you. Otherwise you can ignore this email.\n"
+	return s.mailer.Send(mailer.Message{
+		To:      email,
+		Subject: "Your registration",
+		Body:    body,
+	})
+}
+
+func (s *EmailVerificationService) verificationMessage(email, token, link string) mailer.Message {
+	var body strings.Builder
+	if link != "" {
+		fmt.Fprintf(&body, "Verify your email address with this link:\n%s\n\n", link)
+	} else {
+		fmt.Fprintf(&body, "Your email verification token is:\n%s\n\n", token)
+	}
+	fmt.Fprintf(&body, "It expires in %s and can be used once. If you did not create an account, you can ignore this email.\n", describeTTL(s.ttl))
+
+	return mailer.Message{
+		To:      email,
+		Subject: "Verify your email address",
+		Body:    body.String(),
+	}
+}
+
+// describeTTL writes a token lifetime in whole hours, or minutes when shorter
+func describeTTL(ttl time.Duration) string {
+	if ttl >= time.Hour && ttl%time.Hour == 0 {
+		return fmt.Sprintf("%d hours", int(ttl.Hours()))
+	}
+	return fmt.Sprintf("%d minutes", int(ttl.Minutes()))
+}
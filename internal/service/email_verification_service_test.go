@@ -0,0 +1,111 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/models"
+)
+
+// createUnverifiedUser stores a user who has not verified their email, in a
+// tenant that requires verification, and emails them a verification token
+func (s *testServices) createUnverifiedUser(t *testing.T, email string) (*models.User, string) {
+	t.Helper()
+
+	user := s.createUser(t, email)
+	check(t, s.db.Model(user).Update("is_email_verified", false).Error)
+	check(t, s.tenantSettings.UpdateEmailVerificationPolicy(user.TenantID, dto.EmailVerificationPolicyDTO{Required: true}))
+	check(t, s.emailVerification.SendVerification(user))
+	return user, s.mailer.lastToken(t)
+}
+
+func TestVerifyEmail(t *testing.T) {
+	tests := []struct {
+		name string
+		// token prepares the user and returns the token to verify with
+		token   func(t *testing.T, s *testServices, user *models.User, token string) string
+		wantErr error
+	}{
+		{
+			name:  "verifies the emailed token",
+			token: func(t *testing.T, s *testServices, user *models.User, token string) string { return token },
+		},
+		{
+			name:    "rejects a missing token",
+			token:   func(t *testing.T, s *testServices, user *models.User, token string) string { return "" },
+			wantErr: config.ErrInvalidVerificationToken,
+		},
+		{
+			name:    "rejects an unknown token",
+			token:   func(t *testing.T, s *testServices, user *models.User, token string) string { return token + "x" },
+			wantErr: config.ErrInvalidVerificationToken,
+		},
+		{
+			name: "a token works only once",
+			token: func(t *testing.T, s *testServices, user *models.User, token string) string {
+				check(t, s.emailVerification.Verify(dto.VerifyEmailDTO{Token: token}))
+				return token
+			},
+			wantErr: config.ErrInvalidVerificationToken,
+		},
+		{
+			name: "resending replaces the earlier token",
+			token: func(t *testing.T, s *testServices, user *models.User, token string) string {
+				check(t, s.emailVerification.Resend(dto.ResendVerificationDTO{Email: user.Email}))
+				return token
+			},
+			wantErr: config.ErrInvalidVerificationToken,
+		},
+		{
+			name: "accepts the resent token",
+			token: func(t *testing.T, s *testServices, user *models.User, token string) string {
+				check(t, s.emailVerification.Resend(dto.ResendVerificationDTO{Email: user.Email}))
+				return s.mailer.lastToken(t)
+			},
+		},
+		{
+			name: "rejects an expired token",
+			token: func(t *testing.T, s *testServices, user *models.User, token string) string {
+				check(t, s.db.Model(user).Update("email_verification_token_expires_at", time.Now().Add(-time.Second)).Error)
+				return token
+			},
+			wantErr: config.ErrInvalidVerificationToken,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServices(t)
+			user, token := s.createUnverifiedUser(t, "user@example.com")
+			if _, err := s.login.Login(dto.LoginDTO{Email: user.Email, Password: testPassword}, "127.0.0.1"); !errors.Is(err, config.ErrEmailNotVerified) {
+				t.Fatalf("Login() before verifying error = %v, want %v", err, config.ErrEmailNotVerified)
+			}
+
+			err := s.emailVerification.Verify(dto.VerifyEmailDTO{Token: tt.token(t, s, user, token)})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			s.loginUser(t, user.Email)
+		})
+	}
+}
+
+func TestResendVerificationSendsNothing(t *testing.T) {
+	s := newTestServices(t)
+	user := s.createUser(t, "verified@example.com")
+
+	for _, email := range []string{"nobody@example.com", user.Email} {
+		if err := s.emailVerification.Resend(dto.ResendVerificationDTO{Email: email}); err != nil {
+			t.Errorf("Resend(%q) error = %v, want nil", email, err)
+		}
+	}
+	if len(s.mailer.messages) != 0 {
+		t.Errorf("sent %d emails, want none", len(s.mailer.messages))
+	}
+}
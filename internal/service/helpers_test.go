@@ -0,0 +1,200 @@
+package service
+
+import (
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/hasher"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"github.com/geekible-ltd/auth-server/internal/repository"
+	"github.com/geekible-ltd/auth-server/mailer"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const testPassword = "Correct-Horse-7"
+
+var emailTokenPattern = regexp.MustCompile(`token is:\n(\S+)`)
+
+// newTestDB opens an in-memory database holding the given models
+func newTestDB(t *testing.T, tables ...interface{}) *gorm.DB {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to :memory: is a separate database
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+
+	if err := db.AutoMigrate(append([]interface{}{&models.Tenant{}, &models.User{}}, tables...)...); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// createTestUser stores an active user in a new tenant
+func createTestUser(t *testing.T, db *gorm.DB, email string) *models.User {
+	t.Helper()
+
+	tenant := &models.Tenant{Name: "Tenant", Email: "admin@example.com", IsActive: true}
+	if err := db.Create(tenant).Error; err != nil {
+		t.Fatal(err)
+	}
+	user := &models.User{TenantID: tenant.ID, FirstName: "Test", LastName: "User", Email: email, IsActive: true, IsEmailVerified: true}
+	if err := db.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// testMailer keeps the messages sent through it
+type testMailer struct {
+	mu       sync.Mutex
+	messages []mailer.Message
+}
+
+func (m *testMailer) Send(message mailer.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, message)
+	return nil
+}
+
+func (m *testMailer) last() mailer.Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.messages) == 0 {
+		return mailer.Message{}
+	}
+	return m.messages[len(m.messages)-1]
+}
+
+// lastToken returns the token of the last email, which was sent without a link
+func (m *testMailer) lastToken(t *testing.T) string {
+	t.Helper()
+
+	body := m.last().Body
+	token := emailTokenPattern.FindStringSubmatch(body)
+	if token == nil {
+		t.Fatalf("email %q has no token", body)
+	}
+	return token[1]
+}
+
+// testServices wires the services together as NewAuthServer does, over an
+// in-memory database with every model migrated
+type testServices struct {
+	db     *gorm.DB
+	mailer *testMailer
+
+	key               *KeyService
+	token             *TokenService
+	refreshToken      *RefreshTokenService
+	revocation        *RevocationService
+	client            *ClientService
+	oauth             *OAuthService
+	passwordHash      *PasswordHashService
+	passwordPolicy    *PasswordPolicyService
+	tenantSettings    *TenantSettingsService
+	lockout           *LockoutService
+	passwordless      *PasswordlessService
+	emailVerification *EmailVerificationService
+	mfa               *MFAService
+	login             *LoginService
+	user              *UserService
+	passwordReset     *PasswordResetService
+}
+
+func newTestServices(t *testing.T) *testServices {
+	t.Helper()
+
+	db := newTestDB(t,
+		&models.TenantLicence{},
+		&models.RefreshToken{},
+		&models.RevokedToken{},
+		&models.TokenRevocation{},
+		&models.SigningKey{},
+		&models.Client{},
+		&models.ClientConsent{},
+		&models.AuthorizationCode{},
+		&models.DeviceCode{},
+		&models.MFAChallenge{},
+		&models.RecoveryCode{},
+		&models.WebAuthnCredential{},
+		&models.WebAuthnSession{},
+		&models.PasswordlessChallenge{},
+		&models.TenantSettings{},
+		&models.PasswordHistory{},
+	)
+
+	userRepo := repository.NewUserRepository(db)
+	tenantRepo := repository.NewTenantRepository(db)
+	refreshTokenRepo := repository.NewRefreshTokenRepository(db)
+	clientConsentRepo := repository.NewClientConsentRepository(db)
+
+	s := &testServices{db: db, mailer: &testMailer{}}
+	s.key, _ = NewKeyService(repository.NewSigningKeyRepository(db), "test-secret", config.SigningAlgorithmHS256, config.DefaultKeyRotationInterval, config.DefaultKeyRotationOverlap, config.DefaultKeyRetention, nil)
+	s.token = NewTokenService(s.key, config.DefaultTokenIssuer, config.DefaultTokenAudience, config.DefaultAccessTokenTTL)
+	s.refreshToken = NewRefreshTokenService(refreshTokenRepo, config.DefaultRefreshTokenTTL)
+	s.revocation = NewRevocationService(repository.NewTokenRevocationRepository(db), refreshTokenRepo)
+	s.client = NewClientService(repository.NewClientRepository(db), tenantRepo, refreshTokenRepo, clientConsentRepo)
+	s.oauth = NewOAuthService(userRepo, repository.NewAuthorizationCodeRepository(db), repository.NewDeviceCodeRepository(db), s.client, s.token, s.refreshToken, s.revocation, config.DefaultAuthorizationCodeTTL, config.DefaultDeviceCodeTTL, clientConsentRepo)
+	s.tenantSettings = NewTenantSettingsService(repository.NewTenantSettingsRepository(db), tenantRepo, dto.PasswordPolicyDTO{
+		MinLength:            config.DefaultPasswordMinLength,
+		MaxLength:            config.DefaultPasswordMaxLength,
+		DisallowPersonalInfo: true,
+	})
+	s.passwordHash, _ = NewPasswordHashService(userRepo, hasher.NewBcryptHasher(bcrypt.MinCost), 0, nil)
+	s.lockout = NewLockoutService(userRepo, config.DefaultMaxFailedLoginAttempts, config.DefaultLockoutDuration, config.DefaultMaxLockoutDuration)
+	s.passwordPolicy = NewPasswordPolicyService(repository.NewPasswordHistoryRepository(db), s.tenantSettings, s.passwordHash, nil)
+	s.passwordless = NewPasswordlessService(userRepo, repository.NewPasswordlessChallengeRepository(db), s.lockout, s.mailer, "", config.DefaultPasswordlessTTL)
+	s.emailVerification = NewEmailVerificationService(userRepo, s.mailer, "", config.DefaultEmailVerificationTTL)
+	webAuthnService, _ := NewWebAuthnService(userRepo, repository.NewWebAuthnCredentialRepository(db), repository.NewWebAuthnSessionRepository(db), "", "", nil, config.DefaultWebAuthnSessionTTL)
+	s.mfa = NewMFAService(userRepo, repository.NewMFAChallengeRepository(db), repository.NewRecoveryCodeRepository(db), webAuthnService, config.DefaultTokenIssuer, config.DefaultMFAChallengeTTL, s.lockout)
+	s.login = NewLoginService(userRepo, tenantRepo, s.token, s.refreshToken, s.revocation, s.mfa, webAuthnService, s.passwordless, s.tenantSettings, s.passwordPolicy, s.passwordHash, s.lockout)
+	s.user = NewUserService(userRepo, s.revocation, s.passwordPolicy, s.passwordHash, s.lockout, s.emailVerification)
+	s.passwordReset = NewPasswordResetService(userRepo, s.revocation, s.passwordPolicy, s.passwordHash, s.mailer, "", config.DefaultPasswordResetTTL)
+	return s
+}
+
+// createUser stores an active, verified user with testPassword in a new tenant
+func (s *testServices) createUser(t *testing.T, email string) *models.User {
+	t.Helper()
+
+	user := createTestUser(t, s.db, email)
+	passwordHash, err := s.passwordHash.Hash(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	user.PasswordHash = passwordHash
+	user.PasswordChangedAt = &now
+	user.Role = config.UserRoleTenantUser
+	if err := s.db.Save(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// loginUser signs the user in with testPassword and returns the response
+func (s *testServices) loginUser(t *testing.T, email string) dto.LoginResponseDTO {
+	t.Helper()
+
+	response, err := s.login.Login(dto.LoginDTO{Email: email, Password: testPassword}, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
@@ -0,0 +1,555 @@
+package service
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"github.com/geekible-ltd/auth-server/internal/repository"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	// keyCacheTTL bounds how stale the in-memory key set may be when several
+	// instances share one database
+	keyCacheTTL = time.Minute
+	// keyReloadBackoff limits reloads triggered by tokens with unknown kids
+	keyReloadBackoff = 10 * time.Second
+	rsaKeyBits       = 2048
+	// encryptedKeyPEMType marks a stored private key sealed with the key
+	// encryption key: the AES-GCM nonce followed by the sealed PKCS #8 key
+	encryptedKeyPEMType = "ENCRYPTED SIGNING KEY"
+	plainKeyPEMType     = "PRIVATE KEY"
+)
+
+// SigningKey is a parsed key ready for signing or verifying tokens
+type SigningKey struct {
+	KID        string
+	Algorithm  string
+	Method     jwt.SigningMethod
+	PrivateKey interface{}
+	PublicKey  interface{}
+}
+
+// KeyService supplies token signing and verification keys. With HS256 it
+// wraps the shared secret; with an asymmetric algorithm it manages a rotating
+// set of keys persisted in the database, with the private keys encrypted
+// under a key encryption key that is kept out of the database.
+type KeyService struct {
+	signingKeyRepository *repository.SigningKeyRepository
+	jwtSecret            []byte
+	algorithm            string
+	rotationInterval     time.Duration
+	rotationOverlap      time.Duration
+	retention            time.Duration
+	keyEncryption        cipher.AEAD
+	keyEncryptionErr     error
+
+	// rotateMu serialises key creation so concurrent requests on a fresh
+	// database do not each create a first key
+	rotateMu sync.Mutex
+	mu       sync.RWMutex
+	keys     []models.SigningKey
+	parsed   map[string]*SigningKey
+	loadedAt time.Time
+}
+
+// NewKeyService returns an error when an asymmetric algorithm is configured
+// without a valid 32 byte key encryption key. The service is still returned,
+// but refuses to load or store signing keys rather than keep them in plain text.
+func NewKeyService(signingKeyRepository *repository.SigningKeyRepository, jwtSecret, algorithm string, rotationInterval, rotationOverlap, retention time.Duration, keyEncryptionKey []byte) (*KeyService, error) {
+	s := &KeyService{
+		signingKeyRepository: signingKeyRepository,
+		jwtSecret:            []byte(jwtSecret),
+		algorithm:            algorithm,
+		rotationInterval:     rotationInterval,
+		rotationOverlap:      rotationOverlap,
+		retention:            retention,
+		parsed:               map[string]*SigningKey{},
+	}
+	if s.IsSymmetric() {
+		return s, nil
+	}
+
+	s.keyEncryption, s.keyEncryptionErr = newKeyEncryption(keyEncryptionKey)
+	return s, s.keyEncryptionErr
+}
+
+// IsSymmetric reports whether tokens are signed with the shared HS256 secret
+func (s *KeyService) IsSymmetric() bool {
+	return s.algorithm == config.SigningAlgorithmHS256
+}
+
+// Algorithm returns the configured token signing algorithm
+func (s *KeyService) Algorithm() string {
+	return s.algorithm
+}
+
+// SigningKey returns the key that should sign new tokens, creating the first
+// key if none exists yet
+func (s *KeyService) SigningKey() (*SigningKey, error) {
+	if s.IsSymmetric() {
+		return &SigningKey{
+			Algorithm:  config.SigningAlgorithmHS256,
+			Method:     jwt.SigningMethodHS256,
+			PrivateKey: s.jwtSecret,
+			PublicKey:  s.jwtSecret,
+		}, nil
+	}
+
+	if err := s.loadKeys(false); err != nil {
+		return nil, err
+	}
+	if key := s.activeKey(time.Now()); key != nil {
+		return key, nil
+	}
+
+	if err := s.ensureActiveKey(); err != nil {
+		return nil, err
+	}
+	if key := s.activeKey(time.Now()); key != nil {
+		return key, nil
+	}
+	return nil, config.ErrSigningKeyNotFound
+}
+
+// VerificationKey is a jwt.Keyfunc resolving the key named by the token's kid.
+// The token's alg header must match the algorithm the key was created for.
+func (s *KeyService) VerificationKey(token *jwt.Token) (interface{}, error) {
+	if s.IsSymmetric() {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return s.jwtSecret, nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return nil, config.ErrSigningKeyNotFound
+	}
+
+	key, err := s.keyByID(kid)
+	if err != nil {
+		return nil, err
+	}
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.PublicKey, nil
+}
+
+// JWKS returns the public keys that downstream services should trust,
+// including keys scheduled to activate and retired keys still within retention
+func (s *KeyService) JWKS() (dto.JWKSetDTO, error) {
+	jwks := dto.JWKSetDTO{Keys: []dto.JWKDTO{}}
+	if s.IsSymmetric() {
+		return jwks, nil
+	}
+
+	if err := s.loadKeys(false); err != nil {
+		return jwks, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, signingKey := range s.keys {
+		key, ok := s.parsed[signingKey.KID]
+		if !ok {
+			continue
+		}
+		jwk, err := publicJWK(key)
+		if err != nil {
+			return jwks, err
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return jwks, nil
+}
+
+// RotateIfDue creates the next signing key once the newest key is within the
+// overlap window of its rotation date, and purges keys past retention
+func (s *KeyService) RotateIfDue() error {
+	if s.IsSymmetric() {
+		return nil
+	}
+
+	now := time.Now()
+	if err := s.signingKeyRepository.DeleteExpired(now); err != nil {
+		return err
+	}
+	if err := s.loadKeys(true); err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	var newest *models.SigningKey
+	if len(s.keys) > 0 {
+		newest = &s.keys[len(s.keys)-1]
+	}
+	s.mu.RUnlock()
+
+	if newest == nil {
+		return s.createKey(now)
+	}
+	if now.Before(newest.ActivatesAt.Add(s.rotationInterval - s.rotationOverlap)) {
+		return nil
+	}
+	return s.Rotate()
+}
+
+// Rotate publishes a new signing key immediately and switches signing to it
+// once the overlap window has passed, giving verifiers time to fetch it
+func (s *KeyService) Rotate() error {
+	if s.IsSymmetric() {
+		return config.ErrUnsupportedSigningAlgorithm
+	}
+	return s.createKey(time.Now().Add(s.rotationOverlap))
+}
+
+// ImportKey stores an externally generated key and makes it the active
+// signing key after the overlap window. The algorithm is derived from the key type.
+func (s *KeyService) ImportKey(kid string, privateKey crypto.Signer) error {
+	algorithm, err := algorithmForKey(privateKey)
+	if err != nil {
+		return err
+	}
+	return s.storeKey(kid, algorithm, privateKey, time.Now().Add(s.rotationOverlap))
+}
+
+// ensureActiveKey creates a signing key unless another caller already has
+func (s *KeyService) ensureActiveKey() error {
+	s.rotateMu.Lock()
+	if err := s.loadKeys(true); err != nil {
+		s.rotateMu.Unlock()
+		return err
+	}
+	active := s.activeKey(time.Now())
+	s.rotateMu.Unlock()
+
+	if active != nil {
+		return nil
+	}
+	return s.createKey(time.Now())
+}
+
+func (s *KeyService) createKey(activatesAt time.Time) error {
+	privateKey, err := generatePrivateKey(s.algorithm)
+	if err != nil {
+		return err
+	}
+	return s.storeKey(uuid.New().String(), s.algorithm, privateKey, activatesAt)
+}
+
+func (s *KeyService) storeKey(kid, algorithm string, privateKey crypto.Signer, activatesAt time.Time) error {
+	if s.keyEncryptionErr != nil {
+		return s.keyEncryptionErr
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return err
+	}
+	privateKeyPEM, err := s.encryptPrivateKey(kid, der)
+	if err != nil {
+		return err
+	}
+
+	s.rotateMu.Lock()
+	defer s.rotateMu.Unlock()
+
+	now := time.Now()
+	if err := s.loadKeys(true); err != nil {
+		return err
+	}
+
+	// Without a key to cover the overlap window the new key must sign immediately
+	if s.activeKey(now) == nil {
+		activatesAt = now
+	}
+
+	// Retire the keys currently signing once the new key takes over
+	s.mu.RLock()
+	current := make([]models.SigningKey, 0, len(s.keys))
+	for _, signingKey := range s.keys {
+		if signingKey.RetiresAt == nil {
+			current = append(current, signingKey)
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, signingKey := range current {
+		retiresAt := activatesAt
+		expiresAt := retiresAt.Add(s.retention)
+		signingKey.RetiresAt = &retiresAt
+		signingKey.ExpiresAt = &expiresAt
+		signingKey.UpdatedAt = now
+		if err := s.signingKeyRepository.Update(&signingKey); err != nil {
+			return err
+		}
+	}
+
+	if err := s.signingKeyRepository.Create(&models.SigningKey{
+		KID:           kid,
+		Algorithm:     algorithm,
+		PrivateKeyPEM: privateKeyPEM,
+		ActivatesAt:   activatesAt,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}); err != nil {
+		return err
+	}
+
+	return s.loadKeys(true)
+}
+
+// loadKeys refreshes the cached key set from the database when forced or stale.
+// Keys stored in plain text before encryption was introduced are encrypted in
+// place as they are loaded.
+func (s *KeyService) loadKeys(force bool) error {
+	if s.keyEncryptionErr != nil {
+		return s.keyEncryptionErr
+	}
+
+	s.mu.RLock()
+	fresh := time.Since(s.loadedAt) < keyCacheTTL
+	s.mu.RUnlock()
+	if fresh && !force {
+		return nil
+	}
+
+	signingKeys, err := s.signingKeyRepository.GetUnexpired(time.Now())
+	if err != nil {
+		return err
+	}
+
+	parsed := make(map[string]*SigningKey, len(signingKeys))
+	for i, signingKey := range signingKeys {
+		der, encrypted, err := s.decryptPrivateKey(signingKey)
+		if err != nil {
+			return err
+		}
+		if !encrypted {
+			if err := s.encryptStoredKey(&signingKeys[i], der); err != nil {
+				return err
+			}
+		}
+
+		key, err := parseSigningKey(signingKey, der)
+		if err != nil {
+			return err
+		}
+		parsed[signingKey.KID] = key
+	}
+
+	s.mu.Lock()
+	s.keys = signingKeys
+	s.parsed = parsed
+	s.loadedAt = time.Now()
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *KeyService) activeKey(now time.Time) *SigningKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var active *SigningKey
+	for _, signingKey := range s.keys {
+		if signingKey.ActivatesAt.After(now) {
+			continue
+		}
+		if signingKey.RetiresAt != nil && !signingKey.RetiresAt.After(now) {
+			continue
+		}
+		active = s.parsed[signingKey.KID]
+	}
+	return active
+}
+
+func (s *KeyService) keyByID(kid string) (*SigningKey, error) {
+	if err := s.loadKeys(false); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	key, ok := s.parsed[kid]
+	stale := time.Since(s.loadedAt) >= keyReloadBackoff
+	s.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+
+	// The key may have been created by another instance since the last load
+	if stale {
+		if err := s.loadKeys(true); err != nil {
+			return nil, err
+		}
+		s.mu.RLock()
+		key, ok = s.parsed[kid]
+		s.mu.RUnlock()
+		if ok {
+			return key, nil
+		}
+	}
+	return nil, config.ErrSigningKeyNotFound
+}
+
+func generatePrivateKey(algorithm string) (crypto.Signer, error) {
+	switch algorithm {
+	case config.SigningAlgorithmRS256:
+		return rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	case config.SigningAlgorithmES256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case config.SigningAlgorithmEdDSA:
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		return privateKey, err
+	default:
+		return nil, config.ErrUnsupportedSigningAlgorithm
+	}
+}
+
+func algorithmForKey(privateKey crypto.Signer) (string, error) {
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		return config.SigningAlgorithmRS256, nil
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			return "", config.ErrUnsupportedSigningAlgorithm
+		}
+		return config.SigningAlgorithmES256, nil
+	case ed25519.PrivateKey:
+		return config.SigningAlgorithmEdDSA, nil
+	default:
+		return "", config.ErrUnsupportedSigningAlgorithm
+	}
+}
+
+// encryptStoredKey replaces a plain text key in the database with its
+// encrypted form, unless another instance already has
+func (s *KeyService) encryptStoredKey(signingKey *models.SigningKey, der []byte) error {
+	privateKeyPEM, err := s.encryptPrivateKey(signingKey.KID, der)
+	if err != nil {
+		return err
+	}
+	if _, err := s.signingKeyRepository.ReplacePrivateKeyPEM(signingKey.ID, signingKey.PrivateKeyPEM, privateKeyPEM); err != nil {
+		return err
+	}
+	signingKey.PrivateKeyPEM = privateKeyPEM
+	return nil
+}
+
+// encryptPrivateKey seals a PKCS #8 private key, bound to its kid so a sealed
+// key cannot be swapped onto another row
+func (s *KeyService) encryptPrivateKey(kid string, der []byte) (string, error) {
+	nonce := make([]byte, s.keyEncryption.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := s.keyEncryption.Seal(nonce, nonce, der, []byte(kid))
+	return string(pem.EncodeToMemory(&pem.Block{Type: encryptedKeyPEMType, Bytes: sealed})), nil
+}
+
+// decryptPrivateKey returns the PKCS #8 private key of a stored signing key,
+// and whether it was stored encrypted
+func (s *KeyService) decryptPrivateKey(signingKey models.SigningKey) ([]byte, bool, error) {
+	block, _ := pem.Decode([]byte(signingKey.PrivateKeyPEM))
+	if block == nil {
+		return nil, false, fmt.Errorf("signing key %s: invalid PEM", signingKey.KID)
+	}
+
+	switch block.Type {
+	case plainKeyPEMType:
+		return block.Bytes, false, nil
+	case encryptedKeyPEMType:
+		nonceSize := s.keyEncryption.NonceSize()
+		if len(block.Bytes) < nonceSize {
+			return nil, false, fmt.Errorf("signing key %s: invalid ciphertext", signingKey.KID)
+		}
+		der, err := s.keyEncryption.Open(nil, block.Bytes[:nonceSize], block.Bytes[nonceSize:], []byte(signingKey.KID))
+		if err != nil {
+			return nil, false, fmt.Errorf("signing key %s: cannot be decrypted with the configured key encryption key", signingKey.KID)
+		}
+		return der, true, nil
+	default:
+		return nil, false, fmt.Errorf("signing key %s: unexpected PEM type %q", signingKey.KID, block.Type)
+	}
+}
+
+func newKeyEncryption(keyEncryptionKey []byte) (cipher.AEAD, error) {
+	if len(keyEncryptionKey) != 32 {
+		return nil, config.ErrSigningKeyEncryptionKey
+	}
+	block, err := aes.NewCipher(keyEncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func parseSigningKey(signingKey models.SigningKey, der []byte) (*SigningKey, error) {
+	privateKey, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("signing key %s: %w", signingKey.KID, err)
+	}
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, config.ErrUnsupportedSigningAlgorithm
+	}
+
+	method := jwt.GetSigningMethod(signingKey.Algorithm)
+	if method == nil {
+		return nil, config.ErrUnsupportedSigningAlgorithm
+	}
+
+	return &SigningKey{
+		KID:        signingKey.KID,
+		Algorithm:  signingKey.Algorithm,
+		Method:     method,
+		PrivateKey: signer,
+		PublicKey:  signer.Public(),
+	}, nil
+}
+
+func publicJWK(key *SigningKey) (dto.JWKDTO, error) {
+	jwk := dto.JWKDTO{Kid: key.KID, Use: "sig", Alg: key.Algorithm}
+	switch publicKey := key.PublicKey.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes())
+	case *ecdsa.PublicKey:
+		ecdhKey, err := publicKey.ECDH()
+		if err != nil {
+			return dto.JWKDTO{}, err
+		}
+		// Uncompressed point encoding: 0x04 || X || Y
+		point := ecdhKey.Bytes()
+		size := (len(point) - 1) / 2
+		jwk.Kty = "EC"
+		jwk.Crv = publicKey.Curve.Params().Name
+		jwk.X = base64.RawURLEncoding.EncodeToString(point[1 : 1+size])
+		jwk.Y = base64.RawURLEncoding.EncodeToString(point[1+size:])
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(publicKey)
+	default:
+		return dto.JWKDTO{}, config.ErrUnsupportedSigningAlgorithm
+	}
+	return jwk, nil
+}
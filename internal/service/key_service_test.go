@@ -0,0 +1,199 @@
+package service
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"github.com/geekible-ltd/auth-server/internal/repository"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+var testKeyEncryptionKey = bytes.Repeat([]byte{1}, 32)
+
+func newTestKeyService(t *testing.T, db *gorm.DB, keyEncryptionKey []byte) (*KeyService, error) {
+	return NewKeyService(repository.NewSigningKeyRepository(db), "", config.SigningAlgorithmES256, 30*24*time.Hour, time.Hour, 24*time.Hour, keyEncryptionKey)
+}
+
+func plainSigningKey(t *testing.T, kid string) *models.SigningKey {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &models.SigningKey{
+		KID:           kid,
+		Algorithm:     config.SigningAlgorithmES256,
+		PrivateKeyPEM: string(pem.EncodeToMemory(&pem.Block{Type: plainKeyPEMType, Bytes: der})),
+		ActivatesAt:   time.Now().Add(-time.Hour),
+	}
+}
+
+func TestSigningKeyEncryption(t *testing.T) {
+	tests := []struct {
+		name             string
+		keyEncryptionKey []byte
+		// stored sets up the signing_keys table before the key set is loaded
+		stored  func(t *testing.T, db *gorm.DB)
+		wantErr string
+	}{
+		{name: "creates an encrypted key", keyEncryptionKey: testKeyEncryptionKey},
+		{
+			name:             "encrypts a key stored in plain text",
+			keyEncryptionKey: testKeyEncryptionKey,
+			stored: func(t *testing.T, db *gorm.DB) {
+				check(t, db.Create(plainSigningKey(t, "legacy")).Error)
+			},
+		},
+		{
+			name:             "rejects a key sealed under another key encryption key",
+			keyEncryptionKey: bytes.Repeat([]byte{2}, 32),
+			stored: func(t *testing.T, db *gorm.DB) {
+				other, _ := newTestKeyService(t, db, testKeyEncryptionKey)
+				_, err := other.SigningKey()
+				check(t, err)
+			},
+			wantErr: "cannot be decrypted",
+		},
+		{
+			name:             "rejects a sealed key moved to another kid",
+			keyEncryptionKey: testKeyEncryptionKey,
+			stored: func(t *testing.T, db *gorm.DB) {
+				other, _ := newTestKeyService(t, db, testKeyEncryptionKey)
+				_, err := other.SigningKey()
+				check(t, err)
+				check(t, db.Model(&models.SigningKey{}).Where("1 = 1").Update("KID", "moved").Error)
+			},
+			wantErr: "cannot be decrypted",
+		},
+		{name: "refuses to run without a key encryption key", wantErr: config.ErrSigningKeyEncryptionKey.Error()},
+		{name: "refuses a short key encryption key", keyEncryptionKey: []byte("short"), wantErr: config.ErrSigningKeyEncryptionKey.Error()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t, &models.SigningKey{})
+			if tt.stored != nil {
+				tt.stored(t, db)
+			}
+
+			keyService, _ := newTestKeyService(t, db, tt.keyEncryptionKey)
+			key, err := keyService.SigningKey()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("SigningKey() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key.KID == "" {
+				t.Error("SigningKey() returned a key without a kid")
+			}
+
+			var signingKeys []models.SigningKey
+			check(t, db.Find(&signingKeys).Error)
+			for _, signingKey := range signingKeys {
+				if !strings.Contains(signingKey.PrivateKeyPEM, encryptedKeyPEMType) {
+					t.Errorf("key %s stored as %q", signingKey.KID, signingKey.PrivateKeyPEM[:30])
+				}
+			}
+		})
+	}
+}
+
+func TestVerificationKey(t *testing.T) {
+	db := newTestDB(t, &models.SigningKey{})
+	keyService, err := newTestKeyService(t, db, testKeyEncryptionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := keyService.SigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		method  jwt.SigningMethod
+		kid     string
+		wantErr bool
+	}{
+		{name: "returns the public key named by kid", method: jwt.SigningMethodES256, kid: key.KID},
+		{name: "rejects an unknown kid", method: jwt.SigningMethodES256, kid: "unknown", wantErr: true},
+		{name: "rejects a token without kid", method: jwt.SigningMethodES256, wantErr: true},
+		{name: "rejects another algorithm than the key's", method: jwt.SigningMethodHS256, kid: key.KID, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := jwt.New(tt.method)
+			if tt.kid != "" {
+				token.Header["kid"] = tt.kid
+			}
+
+			publicKey, err := keyService.VerificationKey(token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("VerificationKey() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && publicKey != key.PublicKey {
+				t.Error("VerificationKey() returned another key")
+			}
+		})
+	}
+}
+
+func TestRotateIfDue(t *testing.T) {
+	tests := []struct {
+		name     string
+		age      time.Duration
+		wantKeys int
+	}{
+		{name: "keeps a recent key", age: time.Hour, wantKeys: 1},
+		{name: "publishes the next key within the overlap window", age: 30*24*time.Hour - 30*time.Minute, wantKeys: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t, &models.SigningKey{})
+			keyService, err := newTestKeyService(t, db, testKeyEncryptionKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			active, err := keyService.SigningKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			check(t, db.Model(&models.SigningKey{}).Where(&models.SigningKey{KID: active.KID}).Update("activates_at", time.Now().Add(-tt.age)).Error)
+
+			if err := keyService.RotateIfDue(); err != nil {
+				t.Fatal(err)
+			}
+
+			jwks, err := keyService.JWKS()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(jwks.Keys) != tt.wantKeys {
+				t.Errorf("JWKS() has %d keys, want %d", len(jwks.Keys), tt.wantKeys)
+			}
+			// The new key only signs once the overlap has passed
+			if key, err := keyService.SigningKey(); err != nil || key.KID != active.KID {
+				t.Errorf("SigningKey() = %v, %v; want the current key %s", key, err, active.KID)
+			}
+		})
+	}
+}
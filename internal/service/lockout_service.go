@@ -0,0 +1,112 @@
+package service
+
+import (
+	"time"
+
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"github.com/geekible-ltd/auth-server/internal/repository"
+)
+
+// AccountLockedError reports that a user is locked out until LockedUntil
+type AccountLockedError struct {
+	LockedUntil time.Time
+}
+
+func (e *AccountLockedError) Error() string {
+	return config.ErrAccountLocked.Error()
+}
+
+func (e *AccountLockedError) Unwrap() error {
+	return config.ErrAccountLocked
+}
+
+// LockoutService locks users out for a while after too many failed password
+// or code attempts in a row. Each further lockout lasts twice as long as the
+// one before, up to a maximum, until the user logs in, resets their password
+// or is unlocked by an administrator. Locks expire by themselves, unlike
+// deactivation.
+type LockoutService struct {
+	userRepository     *repository.UserRepository
+	maxFailedAttempts  int
+	lockoutDuration    time.Duration
+	maxLockoutDuration time.Duration
+}
+
+// NewLockoutService locks users out after maxFailedAttempts failures, first
+// for lockoutDuration. A maxFailedAttempts of zero turns lockout off.
+func NewLockoutService(userRepository *repository.UserRepository, maxFailedAttempts int, lockoutDuration, maxLockoutDuration time.Duration) *LockoutService {
+	return &LockoutService{
+		userRepository:     userRepository,
+		maxFailedAttempts:  maxFailedAttempts,
+		lockoutDuration:    lockoutDuration,
+		maxLockoutDuration: maxLockoutDuration,
+	}
+}
+
+// CheckLocked returns an *AccountLockedError while the user is locked out
+func (s *LockoutService) CheckLocked(user *models.User) error {
+	if lockedUntil := s.LockedUntil(user); lockedUntil != nil {
+		return &AccountLockedError{LockedUntil: *lockedUntil}
+	}
+	return nil
+}
+
+// LockedUntil returns when the user's lock expires, or nil if they are not
+// locked out
+func (s *LockoutService) LockedUntil(user *models.User) *time.Time {
+	if user.LockedUntil == nil || !user.LockedUntil.After(time.Now()) {
+		return nil
+	}
+	return user.LockedUntil
+}
+
+// RecordFailure counts a failed attempt and locks the user out once they
+// reach the maximum. The count is kept in the database, so concurrent
+// attempts cannot slip past it.
+func (s *LockoutService) RecordFailure(user *models.User) error {
+	if s.maxFailedAttempts <= 0 {
+		return nil
+	}
+
+	attempts, err := s.userRepository.IncrementFailedLoginAttempts(user.ID)
+	if err != nil {
+		return err
+	}
+	user.FailedLoginAttempts = attempts
+	if attempts < s.maxFailedAttempts {
+		return nil
+	}
+
+	lockedUntil := time.Now().Add(s.duration(user.LockoutCount + 1))
+	locked, err := s.userRepository.Lock(user.ID, s.maxFailedAttempts, lockedUntil)
+	if err != nil {
+		return err
+	} else if locked {
+		user.FailedLoginAttempts = 0
+		user.LockoutCount++
+		user.LockedUntil = &lockedUntil
+	}
+	return nil
+}
+
+// Reset clears the user's failed attempts, lock and backoff. The caller
+// saves the user.
+func (s *LockoutService) Reset(user *models.User) {
+	user.FailedLoginAttempts = 0
+	user.LockedUntil = nil
+	user.LockoutCount = 0
+}
+
+// duration doubles the lockout duration for each lockout in a row, capped at
+// the maximum lockout duration
+func (s *LockoutService) duration(lockoutCount int) time.Duration {
+	d := s.lockoutDuration
+	for i := 1; i < lockoutCount && d < s.maxLockoutDuration; i++ {
+		d *= 2
+	}
+	if d > s.maxLockoutDuration {
+		d = s.maxLockoutDuration
+	}
+	return d
+}
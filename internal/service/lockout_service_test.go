@@ -0,0 +1,200 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"github.com/geekible-ltd/auth-server/internal/repository"
+)
+
+func TestLockoutDuration(t *testing.T) {
+	tests := []struct {
+		name         string
+		duration     time.Duration
+		maxDuration  time.Duration
+		lockoutCount int
+		want         time.Duration
+	}{
+		{name: "first lockout", duration: 5 * time.Minute, maxDuration: 24 * time.Hour, lockoutCount: 1, want: 5 * time.Minute},
+		{name: "doubles for the second", duration: 5 * time.Minute, maxDuration: 24 * time.Hour, lockoutCount: 2, want: 10 * time.Minute},
+		{name: "doubles again for the third", duration: 5 * time.Minute, maxDuration: 24 * time.Hour, lockoutCount: 3, want: 20 * time.Minute},
+		{name: "caps at the maximum", duration: 5 * time.Minute, maxDuration: 24 * time.Hour, lockoutCount: 10, want: 24 * time.Hour},
+		{name: "does not overflow after many lockouts", duration: 5 * time.Minute, maxDuration: 24 * time.Hour, lockoutCount: 1000, want: 24 * time.Hour},
+		{name: "caps a first lockout above the maximum", duration: 2 * time.Hour, maxDuration: time.Hour, lockoutCount: 1, want: time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lockout := NewLockoutService(nil, config.DefaultMaxFailedLoginAttempts, tt.duration, tt.maxDuration)
+			if got := lockout.duration(tt.lockoutCount); got != tt.want {
+				t.Errorf("duration(%d) = %v, want %v", tt.lockoutCount, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordFailure(t *testing.T) {
+	tests := []struct {
+		name              string
+		maxFailedAttempts int
+		lockoutCount      int
+		failures          int
+		wantAttempts      int
+		wantLockoutCount  int
+		wantLockedFor     time.Duration
+	}{
+		{name: "counts failures below the threshold", maxFailedAttempts: 3, failures: 2, wantAttempts: 2},
+		{name: "locks out at the threshold", maxFailedAttempts: 3, failures: 3, wantLockoutCount: 1, wantLockedFor: config.DefaultLockoutDuration},
+		{name: "backs off after earlier lockouts", maxFailedAttempts: 3, lockoutCount: 2, failures: 3, wantLockoutCount: 3, wantLockedFor: 4 * config.DefaultLockoutDuration},
+		{name: "counts again after a lockout", maxFailedAttempts: 3, failures: 4, wantAttempts: 1, wantLockoutCount: 1, wantLockedFor: config.DefaultLockoutDuration},
+		{name: "a threshold of zero turns lockout off", maxFailedAttempts: 0, failures: 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			user := createTestUser(t, db, "user@example.com")
+			check(t, db.Model(user).Update("lockout_count", tt.lockoutCount).Error)
+			user.LockoutCount = tt.lockoutCount
+			lockout := NewLockoutService(repository.NewUserRepository(db), tt.maxFailedAttempts, config.DefaultLockoutDuration, config.DefaultMaxLockoutDuration)
+
+			start := time.Now()
+			for i := 0; i < tt.failures; i++ {
+				check(t, lockout.RecordFailure(user))
+			}
+
+			var got models.User
+			check(t, db.First(&got, user.ID).Error)
+			if got.FailedLoginAttempts != tt.wantAttempts || got.LockoutCount != tt.wantLockoutCount {
+				t.Errorf("failed attempts = %d lockouts = %d, want %d and %d", got.FailedLoginAttempts, got.LockoutCount, tt.wantAttempts, tt.wantLockoutCount)
+			}
+			lockedUntil := lockout.LockedUntil(&got)
+			if tt.wantLockedFor == 0 {
+				if lockedUntil != nil {
+					t.Errorf("LockedUntil() = %v, want nil", lockedUntil)
+				}
+				return
+			}
+			if lockedUntil == nil || lockedUntil.Before(start.Add(tt.wantLockedFor)) || lockedUntil.After(time.Now().Add(tt.wantLockedFor)) {
+				t.Errorf("LockedUntil() = %v, want %v from now", lockedUntil, tt.wantLockedFor)
+			}
+			var lockedErr *AccountLockedError
+			if err := lockout.CheckLocked(&got); !errors.As(err, &lockedErr) || !errors.Is(err, config.ErrAccountLocked) {
+				t.Errorf("CheckLocked() error = %v, want an *AccountLockedError", err)
+			}
+		})
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	tests := []struct {
+		name string
+		// setup locks the user out, or not
+		setup   func(t *testing.T, s *testServices, user *models.User)
+		wantErr error
+	}{
+		{
+			name: "wrong passwords lock the user out",
+			setup: func(t *testing.T, s *testServices, user *models.User) {
+				for i := 0; i < config.DefaultMaxFailedLoginAttempts; i++ {
+					s.login.Login(dto.LoginDTO{Email: user.Email, Password: "wrong-password"}, "127.0.0.1")
+				}
+			},
+			wantErr: config.ErrAccountLocked,
+		},
+		{
+			name: "fewer wrong passwords do not",
+			setup: func(t *testing.T, s *testServices, user *models.User) {
+				for i := 0; i < config.DefaultMaxFailedLoginAttempts-1; i++ {
+					s.login.Login(dto.LoginDTO{Email: user.Email, Password: "wrong-password"}, "127.0.0.1")
+				}
+			},
+		},
+		{
+			name: "the lock expires by itself",
+			setup: func(t *testing.T, s *testServices, user *models.User) {
+				check(t, s.db.Model(user).Updates(map[string]interface{}{"locked_until": time.Now().Add(-time.Second), "lockout_count": 3}).Error)
+			},
+		},
+		{
+			name: "an administrator unlocks the user",
+			setup: func(t *testing.T, s *testServices, user *models.User) {
+				check(t, s.db.Model(user).Updates(map[string]interface{}{"locked_until": time.Now().Add(time.Hour), "lockout_count": 3}).Error)
+				check(t, s.user.UnlockUser(user.TenantID, user.ID))
+			},
+		},
+		{
+			name: "unlocking does not reactivate a deactivated user",
+			setup: func(t *testing.T, s *testServices, user *models.User) {
+				check(t, s.db.Model(user).Updates(map[string]interface{}{"locked_until": time.Now().Add(time.Hour), "is_active": false}).Error)
+				check(t, s.user.UnlockUser(user.TenantID, user.ID))
+			},
+			wantErr: config.ErrUserInactive,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServices(t)
+			user := s.createUser(t, "user@example.com")
+			tt.setup(t, s, user)
+
+			_, err := s.login.Login(dto.LoginDTO{Email: user.Email, Password: testPassword}, "127.0.0.1")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Login() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			// Logging in clears the failed attempts and the backoff
+			var got models.User
+			check(t, s.db.First(&got, user.ID).Error)
+			if got.FailedLoginAttempts != 0 || got.LockoutCount != 0 || got.LockedUntil != nil {
+				t.Errorf("after login failed attempts = %d lockouts = %d locked until %v, want all cleared", got.FailedLoginAttempts, got.LockoutCount, got.LockedUntil)
+			}
+		})
+	}
+}
+
+func TestUnlockUser(t *testing.T) {
+	tests := []struct {
+		name     string
+		tenantID func(user *models.User) uint
+		userID   func(user *models.User) uint
+		wantErr  error
+	}{
+		{name: "unlocks a user of the tenant"},
+		{name: "rejects a user of another tenant", tenantID: func(user *models.User) uint { return user.TenantID + 1 }, wantErr: config.ErrUserNotFound},
+		{name: "rejects an unknown user", userID: func(user *models.User) uint { return user.ID + 100 }, wantErr: config.ErrUserNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServices(t)
+			user := s.createUser(t, "user@example.com")
+			check(t, s.db.Model(user).Updates(map[string]interface{}{"locked_until": time.Now().Add(time.Hour), "lockout_count": 2, "failed_login_attempts": 1}).Error)
+			tenantID, userID := user.TenantID, user.ID
+			if tt.tenantID != nil {
+				tenantID = tt.tenantID(user)
+			}
+			if tt.userID != nil {
+				userID = tt.userID(user)
+			}
+
+			if err := s.user.UnlockUser(tenantID, userID); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("UnlockUser() error = %v, want %v", err, tt.wantErr)
+			}
+
+			var got models.User
+			check(t, s.db.First(&got, user.ID).Error)
+			if locked := s.lockout.LockedUntil(&got) != nil; locked != (tt.wantErr != nil) {
+				t.Errorf("locked = %v after UnlockUser() error %v", locked, tt.wantErr)
+			}
+		})
+	}
+}
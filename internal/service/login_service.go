@@ -5,59 +5,406 @@ import (
 
 	"github.com/geekible-ltd/auth-server/dto"
 	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/models"
 	"github.com/geekible-ltd/auth-server/internal/repository"
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
 type LoginService struct {
-	userRepository   *repository.UserRepository
-	tenantRepository *repository.TenantRepository
+	userRepository        *repository.UserRepository
+	tenantRepository      *repository.TenantRepository
+	tokenService          *TokenService
+	refreshTokenService   *RefreshTokenService
+	revocationService     *RevocationService
+	mfaService            *MFAService
+	webAuthnService       *WebAuthnService
+	passwordlessService   *PasswordlessService
+	tenantSettingsService *TenantSettingsService
+	passwordPolicyService *PasswordPolicyService
+	passwordHashService   *PasswordHashService
+	lockoutService        *LockoutService
 }
 
-func NewLoginService(userRepository *repository.UserRepository, tenantRepository *repository.TenantRepository) *LoginService {
-	return &LoginService{userRepository: userRepository, tenantRepository: tenantRepository}
+func NewLoginService(userRepository *repository.UserRepository, tenantRepository *repository.TenantRepository, tokenService *TokenService, refreshTokenService *RefreshTokenService, revocationService *RevocationService, mfaService *MFAService, webAuthnService *WebAuthnService, passwordlessService *PasswordlessService, tenantSettingsService *TenantSettingsService, passwordPolicyService *PasswordPolicyService, passwordHashService *PasswordHashService, lockoutService *LockoutService) *LoginService {
+	return &LoginService{
+		userRepository:        userRepository,
+		tenantRepository:      tenantRepository,
+		tokenService:          tokenService,
+		refreshTokenService:   refreshTokenService,
+		revocationService:     revocationService,
+		mfaService:            mfaService,
+		webAuthnService:       webAuthnService,
+		passwordlessService:   passwordlessService,
+		tenantSettingsService: tenantSettingsService,
+		passwordPolicyService: passwordPolicyService,
+		passwordHashService:   passwordHashService,
+		lockoutService:        lockoutService,
+	}
 }
 
+// Login checks the user's password. Users with MFA enabled receive an MFA
+// token to complete the login with VerifyMFA instead of a session, and users
+// whose tenant requires MFA they have not set up receive one to enrol with.
+// Passwords older than the tenant's maximum age must be changed with
+// UserService.ChangeExpiredPassword first. Locked out users are turned away
+// without checking their password, and deactivated users after it. Unknown
+// and locked out users take as long as a wrong password.
 func (s *LoginService) Login(loginRequest dto.LoginDTO, ipAddress string) (dto.LoginResponseDTO, error) {
 	user, err := s.userRepository.GetByEmail(loginRequest.Email)
 	if err != nil && err == gorm.ErrRecordNotFound {
+		s.passwordHashService.VerifyDummy(loginRequest.Password)
 		return dto.LoginResponseDTO{}, config.ErrUserNotFound
 	} else if err != nil {
 		return dto.LoginResponseDTO{}, err
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(loginRequest.Password)); err != nil {
-		user.FailedLoginAttempts++
-		if user.FailedLoginAttempts >= config.MaxFailedLoginAttempts {
-			user.IsActive = false
-		}
+	if err := s.lockoutService.CheckLocked(user); err != nil {
+		s.passwordHashService.VerifyDummy(loginRequest.Password)
+		return dto.LoginResponseDTO{}, err
+	}
+	if err := s.checkPassword(user, loginRequest.Password); err != nil {
+		return dto.LoginResponseDTO{}, err
+	}
+	if !user.IsActive {
+		return dto.LoginResponseDTO{}, config.ErrUserInactive
+	}
+	expired, err := s.passwordPolicyService.Expired(user)
+	if err != nil {
+		return dto.LoginResponseDTO{}, err
+	} else if expired {
+		return dto.LoginResponseDTO{}, config.ErrPasswordExpired
+	}
+
+	return s.continueLogin(user, ipAddress, []string{config.AMRPassword})
+}
+
+// LoginWithPasswordless completes an email sign-in started with
+// PasswordlessService.Start. Users with MFA enabled receive an MFA token, as
+// with Login.
+func (s *LoginService) LoginWithPasswordless(verifyRequest dto.PasswordlessVerifyDTO, ipAddress string) (dto.LoginResponseDTO, error) {
+	user, err := s.passwordlessService.Verify(verifyRequest)
+	if err != nil {
+		return dto.LoginResponseDTO{}, err
+	}
+
+	// The code or link reached the user's inbox, which proves they own it
+	if !user.IsEmailVerified {
+		user.IsEmailVerified = true
 		if err := s.userRepository.Update(user); err != nil {
 			return dto.LoginResponseDTO{}, err
 		}
-		return dto.LoginResponseDTO{}, config.ErrInvalidPassword
 	}
 
-	tenant, err := s.tenantRepository.GetByID(user.TenantID)
+	return s.continueLogin(user, ipAddress, []string{config.AMROTP})
+}
+
+// VerifyMFA completes a login started by Login with the user's second factor
+func (s *LoginService) VerifyMFA(verifyRequest dto.MFAVerifyDTO, ipAddress string) (dto.LoginResponseDTO, error) {
+	user, amr, err := s.mfaService.VerifyChallenge(verifyRequest)
+	if err != nil {
+		return dto.LoginResponseDTO{}, err
+	}
+
+	return s.completeLogin(user, ipAddress, amr)
+}
+
+// CompleteTOTPEnrolment completes a login that returned MFAEnrolmentRequired
+// by enabling TOTP with the user's first code. Enrolment is started with
+// MFAService.EnrolTOTPForChallenge.
+func (s *LoginService) CompleteTOTPEnrolment(verifyRequest dto.MFAVerifyDTO, ipAddress string) (dto.LoginResponseDTO, error) {
+	user, amr, recoveryCodes, err := s.mfaService.ConfirmTOTPForChallenge(verifyRequest.MFAToken, verifyRequest.Code)
+	if err != nil {
+		return dto.LoginResponseDTO{}, err
+	}
+
+	loginResponse, err := s.completeLogin(user, ipAddress, amr)
+	if err != nil {
+		return dto.LoginResponseDTO{}, err
+	}
+	loginResponse.RecoveryCodes = recoveryCodes.RecoveryCodes
+	return loginResponse, nil
+}
+
+// CompleteWebAuthnEnrolment completes a login that returned
+// MFAEnrolmentRequired by registering a security key or passkey. Registration
+// is started with MFAService.BeginWebAuthnEnrolment.
+func (s *LoginService) CompleteWebAuthnEnrolment(registrationRequest dto.WebAuthnRegistrationDTO, ipAddress string) (dto.LoginResponseDTO, error) {
+	user, amr, enrolment, err := s.mfaService.FinishWebAuthnEnrolment(registrationRequest.MFAToken, registrationRequest)
+	if err != nil {
+		return dto.LoginResponseDTO{}, err
+	}
+
+	loginResponse, err := s.completeLogin(user, ipAddress, amr)
+	if err != nil {
+		return dto.LoginResponseDTO{}, err
+	}
+	loginResponse.RecoveryCodes = enrolment.RecoveryCodes
+	return loginResponse, nil
+}
+
+// LoginWithPasskey completes a passwordless login with a passkey. The
+// authenticator verified the user, so no further factor is asked for.
+func (s *LoginService) LoginWithPasskey(loginRequest dto.WebAuthnLoginDTO, ipAddress string) (dto.LoginResponseDTO, error) {
+	user, err := s.webAuthnService.FinishLogin(loginRequest)
+	if err != nil {
+		return dto.LoginResponseDTO{}, err
+	}
+	if !user.IsActive {
+		return dto.LoginResponseDTO{}, config.ErrWebAuthnVerificationFailed
+	}
+
+	_, err = s.tenantRepository.GetByID(user.TenantID)
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return dto.LoginResponseDTO{}, config.ErrTenantNotFound
+	} else if err != nil {
+		return dto.LoginResponseDTO{}, err
+	}
+	if err := s.checkEmailVerified(user); err != nil {
+		return dto.LoginResponseDTO{}, err
+	}
+
+	return s.completeLogin(user, ipAddress, []string{config.AMRHardwareKey, config.AMRMultiFactor})
+}
+
+// Reauthenticate confirms the identity of the user of a session with their
+// password, a second factor code or a security key, and returns a new access
+// token for the same session with a fresh auth_time. Step-up routes require
+// one when the user last authenticated too long ago. Failed password and code
+// attempts count towards the user's failed login attempts, and are refused
+// while the user is locked out.
+func (s *LoginService) Reauthenticate(claims *AccessTokenClaims, reauthRequest dto.ReauthenticateDTO) (dto.LoginResponseDTO, error) {
+	tenantID, err := claims.TenantID()
+	if err != nil {
+		return dto.LoginResponseDTO{}, err
+	}
+	userID, err := claims.UserID()
+	if err != nil {
+		return dto.LoginResponseDTO{}, err
+	}
+	user, err := s.userRepository.GetByID(tenantID, userID)
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return dto.LoginResponseDTO{}, config.ErrUserNotFound
+	} else if err != nil {
+		return dto.LoginResponseDTO{}, err
+	}
+	if !user.IsActive {
+		return dto.LoginResponseDTO{}, config.ErrUserNotFound
+	}
+
+	var amr []string
+	switch {
+	case reauthRequest.Password != "":
+		if err := s.lockoutService.CheckLocked(user); err != nil {
+			return dto.LoginResponseDTO{}, err
+		}
+		if err := s.checkPassword(user, reauthRequest.Password); err != nil {
+			return dto.LoginResponseDTO{}, err
+		}
+		amr = []string{config.AMRPassword}
+	case len(reauthRequest.Credential) > 0:
+		if err := s.webAuthnService.FinishReauthentication(user, reauthRequest.SessionID, reauthRequest.Credential); err != nil {
+			return dto.LoginResponseDTO{}, err
+		}
+		amr = []string{config.AMRHardwareKey}
+	default:
+		method, err := s.mfaService.checkCode(user, reauthRequest.Code)
+		if err != nil {
+			return dto.LoginResponseDTO{}, err
+		}
+		amr = []string{methodAMR(method)}
+	}
+
+	now := time.Now()
+	s.lockoutService.Reset(user)
+	if err := s.userRepository.Update(user); err != nil {
+		return dto.LoginResponseDTO{}, err
+	}
+
+	accessToken, err := s.tokenService.IssueAccessToken(user, TokenGrant{SessionID: claims.SessionID, AuthTime: now, AMR: amr})
+	if err != nil {
+		return dto.LoginResponseDTO{}, err
+	}
+
+	return dto.LoginResponseDTO{
+		TenantID:    user.TenantID,
+		UserID:      user.ID,
+		Email:       user.Email,
+		Role:        user.Role,
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(s.tokenService.AccessTokenTTL().Seconds()),
+	}, nil
+}
+
+// Refresh exchanges a refresh token for a new access token and a rotated
+// refresh token in the same session
+func (s *LoginService) Refresh(refreshRequest dto.RefreshTokenDTO) (dto.LoginResponseDTO, error) {
+	refreshToken, err := s.refreshTokenService.Consume(refreshRequest.RefreshToken, "")
+	if err != nil {
+		return dto.LoginResponseDTO{}, err
+	}
+
+	user, err := s.userRepository.GetByID(refreshToken.TenantID, refreshToken.UserID)
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return dto.LoginResponseDTO{}, config.ErrInvalidRefreshToken
+	} else if err != nil {
+		return dto.LoginResponseDTO{}, err
+	}
+
+	if !user.IsActive {
+		if err := s.refreshTokenService.RevokeFamily(refreshToken.FamilyID); err != nil {
+			return dto.LoginResponseDTO{}, err
+		}
+		return dto.LoginResponseDTO{}, config.ErrInvalidRefreshToken
+	}
+
+	return s.issueTokens(user, TokenGrant{SessionID: refreshToken.FamilyID, AuthTime: refreshToken.AuthTime, AMR: refreshToken.AMR})
+}
+
+// Logout revokes the presented access token and the refresh token family of its session
+func (s *LoginService) Logout(claims *AccessTokenClaims) error {
+	if err := s.revocationService.RevokeAccessToken(claims); err != nil {
+		return err
+	}
+	if claims.SessionID == "" {
+		return nil
+	}
+	return s.refreshTokenService.RevokeFamily(claims.SessionID)
+}
+
+// LogoutAll revokes every access and refresh token issued to the user
+func (s *LoginService) LogoutAll(claims *AccessTokenClaims) error {
+	userID, err := claims.UserID()
+	if err != nil {
+		return err
+	}
+	return s.revocationService.RevokeUserTokens(userID)
+}
+
+// continueLogin follows a successful first factor, described by amr. Users
+// with MFA enabled get an MFA challenge, users the tenant's MFA policy applies
+// to get an enrolment challenge, and everyone else is logged in. Tenants can
+// turn away users who have not verified their email first. Failed login
+// attempts are kept until the second factor succeeds, so wrong MFA codes
+// count towards the same lockout as wrong passwords.
+func (s *LoginService) continueLogin(user *models.User, ipAddress string, amr []string) (dto.LoginResponseDTO, error) {
+	_, err := s.tenantRepository.GetByID(user.TenantID)
 	if err != nil && err == gorm.ErrRecordNotFound {
 		return dto.LoginResponseDTO{}, config.ErrTenantNotFound
 	} else if err != nil {
 		return dto.LoginResponseDTO{}, err
 	}
+	if err := s.checkEmailVerified(user); err != nil {
+		return dto.LoginResponseDTO{}, err
+	}
+
+	mfaMethods, err := s.mfaService.Methods(user)
+	if err != nil {
+		return dto.LoginResponseDTO{}, err
+	}
+	if len(mfaMethods) > 0 {
+		mfaToken, err := s.mfaService.StartChallenge(user, amr)
+		if err != nil {
+			return dto.LoginResponseDTO{}, err
+		}
+		return dto.LoginResponseDTO{
+			TenantID:    user.TenantID,
+			UserID:      user.ID,
+			Email:       user.Email,
+			MFARequired: true,
+			MFAToken:    mfaToken,
+			MFAMethods:  mfaMethods,
+		}, nil
+	}
+
+	mfaRequired, err := s.tenantSettingsService.MFARequired(user, ipAddress)
+	if err != nil {
+		return dto.LoginResponseDTO{}, err
+	}
+	if mfaRequired {
+		mfaToken, err := s.mfaService.StartEnrolment(user, amr)
+		if err != nil {
+			return dto.LoginResponseDTO{}, err
+		}
+		return dto.LoginResponseDTO{
+			TenantID:             user.TenantID,
+			UserID:               user.ID,
+			Email:                user.Email,
+			MFAEnrolmentRequired: true,
+			MFAToken:             mfaToken,
+		}, nil
+	}
+
+	return s.completeLogin(user, ipAddress, amr)
+}
 
+// completeLogin records a successful login, which ends any lockout, and starts
+// a session for the authentication methods in amr
+func (s *LoginService) completeLogin(user *models.User, ipAddress string, amr []string) (dto.LoginResponseDTO, error) {
 	now := time.Now()
 	user.LastLoginAt = &now
 	user.LastLoginIP = ipAddress
-	user.FailedLoginAttempts = 0
+	s.lockoutService.Reset(user)
 
 	if err := s.userRepository.Update(user); err != nil {
 		return dto.LoginResponseDTO{}, err
 	}
 
+	return s.issueTokens(user, TokenGrant{AuthTime: now, AMR: amr})
+}
+
+// checkEmailVerified returns config.ErrEmailNotVerified if the user's tenant
+// requires a verified email and the user has not verified theirs
+func (s *LoginService) checkEmailVerified(user *models.User) error {
+	if user.IsEmailVerified {
+		return nil
+	}
+	required, err := s.tenantSettingsService.EmailVerificationRequired(user.TenantID)
+	if err != nil {
+		return err
+	} else if required {
+		return config.ErrEmailNotVerified
+	}
+	return nil
+}
+
+// checkPassword compares the password with the user's hash. Wrong passwords
+// count towards the user's failed login attempts, and a correct password
+// stored with an outdated algorithm or parameters is rehashed.
+func (s *LoginService) checkPassword(user *models.User, password string) error {
+	match, needsRehash := s.passwordHashService.Verify(password, user.PasswordHash)
+	if !match {
+		if err := s.lockoutService.RecordFailure(user); err != nil {
+			return err
+		}
+		return config.ErrInvalidPassword
+	}
+	if needsRehash {
+		return s.passwordHashService.Rehash(user, password)
+	}
+	return nil
+}
+
+func (s *LoginService) issueTokens(user *models.User, grant TokenGrant) (dto.LoginResponseDTO, error) {
+	rawRefreshToken, refreshToken, err := s.refreshTokenService.Issue(user, grant)
+	if err != nil {
+		return dto.LoginResponseDTO{}, err
+	}
+
+	grant.SessionID = refreshToken.FamilyID
+	accessToken, err := s.tokenService.IssueAccessToken(user, grant)
+	if err != nil {
+		return dto.LoginResponseDTO{}, err
+	}
+
 	return dto.LoginResponseDTO{
-		TenantID: tenant.ID,
-		UserID:   user.ID,
-		Email:    user.Email,
-		Role:     user.Role,
+		TenantID:     user.TenantID,
+		UserID:       user.ID,
+		Email:        user.Email,
+		Role:         user.Role,
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(s.tokenService.AccessTokenTTL().Seconds()),
+		RefreshToken: rawRefreshToken,
 	}, nil
 }
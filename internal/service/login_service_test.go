@@ -0,0 +1,312 @@
+package service
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/hasher"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"github.com/geekible-ltd/auth-server/internal/repository"
+)
+
+func TestLogin(t *testing.T) {
+	tests := []struct {
+		name     string
+		email    string
+		password string
+		setup    func(s *testServices, user *models.User)
+		wantErr  error
+	}{
+		{name: "issues tokens for the right password", email: "user@example.com", password: testPassword},
+		{name: "rejects a wrong password", email: "user@example.com", password: "wrong-password", wantErr: config.ErrInvalidPassword},
+		{name: "rejects an unknown email", email: "nobody@example.com", password: testPassword, wantErr: config.ErrUserNotFound},
+		{
+			name:     "rejects a deactivated user",
+			email:    "user@example.com",
+			password: testPassword,
+			setup: func(s *testServices, user *models.User) {
+				s.db.Model(user).Update("is_active", false)
+			},
+			wantErr: config.ErrUserInactive,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServices(t)
+			user := s.createUser(t, "user@example.com")
+			if tt.setup != nil {
+				tt.setup(s, user)
+			}
+
+			response, err := s.login.Login(dto.LoginDTO{Email: tt.email, Password: tt.password}, "127.0.0.1")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Login() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			claims, err := s.token.ParseAccessToken(response.AccessToken)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if userID, _ := claims.UserID(); userID != user.ID || response.RefreshToken == "" {
+				t.Errorf("Login() = %+v for user %d", response, userID)
+			}
+		})
+	}
+}
+
+func TestReauthenticate(t *testing.T) {
+	tests := []struct {
+		name    string
+		totp    bool
+		setup   func(t *testing.T, s *testServices, user totpUser)
+		request func(t *testing.T, user totpUser) dto.ReauthenticateDTO
+		wantErr error
+		wantAMR string
+	}{
+		{
+			name: "accepts the password",
+			request: func(t *testing.T, user totpUser) dto.ReauthenticateDTO {
+				return dto.ReauthenticateDTO{Password: testPassword}
+			},
+			wantAMR: config.AMRPassword,
+		},
+		{
+			name: "rejects a wrong password",
+			request: func(t *testing.T, user totpUser) dto.ReauthenticateDTO {
+				return dto.ReauthenticateDTO{Password: "wrong-password"}
+			},
+			wantErr: config.ErrInvalidPassword,
+		},
+		{
+			name: "refuses a locked out user",
+			setup: func(t *testing.T, s *testServices, user totpUser) {
+				for i := 0; i < config.DefaultMaxFailedLoginAttempts; i++ {
+					s.login.Login(dto.LoginDTO{Email: user.Email, Password: "wrong-password"}, "127.0.0.1")
+				}
+			},
+			request: func(t *testing.T, user totpUser) dto.ReauthenticateDTO {
+				return dto.ReauthenticateDTO{Password: testPassword}
+			},
+			wantErr: config.ErrAccountLocked,
+		},
+		{
+			name: "refuses a deactivated user",
+			setup: func(t *testing.T, s *testServices, user totpUser) {
+				check(t, s.db.Model(user.User).Update("is_active", false).Error)
+			},
+			request: func(t *testing.T, user totpUser) dto.ReauthenticateDTO {
+				return dto.ReauthenticateDTO{Password: testPassword}
+			},
+			wantErr: config.ErrUserNotFound,
+		},
+		{
+			name: "accepts a TOTP code",
+			totp: true,
+			request: func(t *testing.T, user totpUser) dto.ReauthenticateDTO {
+				return dto.ReauthenticateDTO{Code: totpCode(t, user.secret, 1)}
+			},
+			wantAMR: config.AMROTP,
+		},
+		{
+			name: "rejects a replayed TOTP code",
+			totp: true,
+			request: func(t *testing.T, user totpUser) dto.ReauthenticateDTO {
+				return dto.ReauthenticateDTO{Code: user.confirmCode}
+			},
+			wantErr: config.ErrInvalidMFACode,
+		},
+		{
+			name: "accepts a recovery code",
+			totp: true,
+			request: func(t *testing.T, user totpUser) dto.ReauthenticateDTO {
+				return dto.ReauthenticateDTO{Code: user.recoveryCodes[0]}
+			},
+			wantAMR: config.AMROTP,
+		},
+		{
+			name: "rejects a code from a user without MFA",
+			request: func(t *testing.T, user totpUser) dto.ReauthenticateDTO {
+				return dto.ReauthenticateDTO{Code: "123456"}
+			},
+			wantErr: config.ErrInvalidMFACode,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServices(t)
+			user := totpUser{User: s.createUser(t, "user@example.com")}
+			session := s.session(t, user.Email)
+			session.AuthTime = time.Now().Add(-time.Hour).Unix()
+			if tt.totp {
+				user = s.enableTOTP(t, user.User)
+			}
+			if tt.setup != nil {
+				tt.setup(t, s, user)
+			}
+
+			start := time.Now().Unix()
+			response, err := s.login.Reauthenticate(session, tt.request(t, user))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Reauthenticate() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			claims, err := s.token.ParseAccessToken(response.AccessToken)
+			check(t, err)
+			if claims.AuthTime < start {
+				t.Errorf("auth_time = %d, want at least %d", claims.AuthTime, start)
+			}
+			if claims.SessionID != session.SessionID {
+				t.Errorf("sid = %q, want the session's %q", claims.SessionID, session.SessionID)
+			}
+			if !reflect.DeepEqual(claims.AMR, []string{tt.wantAMR}) {
+				t.Errorf("amr = %v, want [%s]", claims.AMR, tt.wantAMR)
+			}
+		})
+	}
+}
+
+// countingHasher counts the passwords it hashes and verifies
+type countingHasher struct {
+	hasher.Hasher
+	calls int
+}
+
+func (h *countingHasher) Hash(password string) (string, error) {
+	h.calls++
+	return h.Hasher.Hash(password)
+}
+
+func (h *countingHasher) Verify(password, hash string) (bool, error) {
+	h.calls++
+	return h.Hasher.Verify(password, hash)
+}
+
+func TestEnumerationResistance(t *testing.T) {
+	registration := func(s *testServices) *UserRegistrationService {
+		return NewUserRegistrationService(repository.NewUserRepository(s.db), repository.NewTenantRepository(s.db), repository.NewTenantLicenceRepository(s.db), s.revocation, s.emailVerification, s.passwordPolicy, s.passwordHash)
+	}
+
+	tests := []struct {
+		name string
+		// setup prepares the existing account
+		setup func(t *testing.T, s *testServices, user *models.User)
+		// attempt is what an attacker tries with an email address
+		attempt        func(t *testing.T, s *testServices, email string) error
+		wantErr        error
+		wantUnknownErr error
+		// wantHashes is how many passwords each attempt hashes or verifies,
+		// whether the account exists or not
+		wantHashes int
+	}{
+		{
+			name: "login with a wrong password",
+			attempt: func(t *testing.T, s *testServices, email string) error {
+				_, err := s.login.Login(dto.LoginDTO{Email: email, Password: "wrong-password"}, "127.0.0.1")
+				return err
+			},
+			wantErr:        config.ErrInvalidPassword,
+			wantUnknownErr: config.ErrUserNotFound,
+			wantHashes:     1,
+		},
+		{
+			name: "login to a locked out account",
+			setup: func(t *testing.T, s *testServices, user *models.User) {
+				check(t, s.db.Model(user).Update("locked_until", time.Now().Add(time.Hour)).Error)
+			},
+			attempt: func(t *testing.T, s *testServices, email string) error {
+				_, err := s.login.Login(dto.LoginDTO{Email: email, Password: testPassword}, "127.0.0.1")
+				return err
+			},
+			wantErr:        config.ErrAccountLocked,
+			wantUnknownErr: config.ErrUserNotFound,
+			wantHashes:     1,
+		},
+		{
+			name: "changing an expired password",
+			attempt: func(t *testing.T, s *testServices, email string) error {
+				return s.user.ChangeExpiredPassword(dto.ExpiredPasswordChangeDTO{Email: email, CurrentPassword: "wrong-password", NewPassword: newTestPassword})
+			},
+			wantErr:        config.ErrInvalidPassword,
+			wantUnknownErr: config.ErrUserNotFound,
+			wantHashes:     1,
+		},
+		{
+			name: "changing the expired password of a deactivated account",
+			setup: func(t *testing.T, s *testServices, user *models.User) {
+				check(t, s.db.Model(user).Update("is_active", false).Error)
+			},
+			attempt: func(t *testing.T, s *testServices, email string) error {
+				return s.user.ChangeExpiredPassword(dto.ExpiredPasswordChangeDTO{Email: email, CurrentPassword: testPassword, NewPassword: newTestPassword})
+			},
+			wantErr:        config.ErrUserNotFound,
+			wantUnknownErr: config.ErrUserNotFound,
+			wantHashes:     1,
+		},
+		{
+			name: "requesting a password reset",
+			attempt: func(t *testing.T, s *testServices, email string) error {
+				return s.passwordReset.RequestReset(dto.ForgotPasswordDTO{Email: email})
+			},
+		},
+		{
+			name: "starting a passwordless login",
+			attempt: func(t *testing.T, s *testServices, email string) error {
+				response, err := s.passwordless.Start(dto.PasswordlessStartDTO{Email: email})
+				if err == nil && response.PasswordlessToken == "" {
+					t.Errorf("Start(%q) returned no token", email)
+				}
+				return err
+			},
+		},
+		{
+			name: "registering a tenant",
+			attempt: func(t *testing.T, s *testServices, email string) error {
+				tenant := dto.TenantRegistrationDTO{Name: "New", Email: "info@" + strings.Split(email, "@")[0] + ".test"}
+				tenant.User.FirstName, tenant.User.LastName, tenant.User.Email, tenant.User.Password = "New", "Person", email, newTestPassword
+				return registration(s).RegisterTenant(tenant)
+			},
+			wantHashes: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServices(t)
+			user := s.createUser(t, "user@example.com")
+			if tt.setup != nil {
+				tt.setup(t, s, user)
+			}
+			counter := &countingHasher{Hasher: s.passwordHash.hasher}
+			s.passwordHash.hasher = counter
+
+			for _, attempt := range []struct {
+				email   string
+				wantErr error
+			}{
+				{email: user.Email, wantErr: tt.wantErr},
+				{email: "nobody@example.com", wantErr: tt.wantUnknownErr},
+			} {
+				counter.calls = 0
+				if err := tt.attempt(t, s, attempt.email); !errors.Is(err, attempt.wantErr) {
+					t.Errorf("attempt with %q error = %v, want %v", attempt.email, err, attempt.wantErr)
+				}
+				if counter.calls != tt.wantHashes {
+					t.Errorf("attempt with %q hashed %d passwords, want %d", attempt.email, counter.calls, tt.wantHashes)
+				}
+			}
+		})
+	}
+}
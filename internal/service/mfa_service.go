@@ -0,0 +1,593 @@
+package service
+
+import (
+	"time"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"github.com/geekible-ltd/auth-server/internal/repository"
+	"gorm.io/gorm"
+)
+
+type MFAService struct {
+	userRepository         *repository.UserRepository
+	mfaChallengeRepository *repository.MFAChallengeRepository
+	recoveryCodeRepository *repository.RecoveryCodeRepository
+	webAuthnService        *WebAuthnService
+	lockoutService         *LockoutService
+	issuer                 string
+	challengeTTL           time.Duration
+}
+
+func NewMFAService(userRepository *repository.UserRepository, mfaChallengeRepository *repository.MFAChallengeRepository, recoveryCodeRepository *repository.RecoveryCodeRepository, webAuthnService *WebAuthnService, issuer string, challengeTTL time.Duration, lockoutService *LockoutService) *MFAService {
+	return &MFAService{
+		userRepository:         userRepository,
+		mfaChallengeRepository: mfaChallengeRepository,
+		recoveryCodeRepository: recoveryCodeRepository,
+		webAuthnService:        webAuthnService,
+		lockoutService:         lockoutService,
+		issuer:                 issuer,
+		challengeTTL:           challengeTTL,
+	}
+}
+
+// Status reports which second factors the user has enrolled
+func (s *MFAService) Status(tenantID, userID uint) (dto.MFAStatusDTO, error) {
+	user, err := s.getUser(tenantID, userID)
+	if err != nil {
+		return dto.MFAStatusDTO{}, err
+	}
+
+	credentials, err := s.webAuthnService.CountCredentials(user.ID)
+	if err != nil {
+		return dto.MFAStatusDTO{}, err
+	}
+
+	remaining, err := s.recoveryCodeRepository.CountUnused(user.ID)
+	if err != nil {
+		return dto.MFAStatusDTO{}, err
+	}
+
+	return dto.MFAStatusDTO{
+		TOTPEnabled:            user.TOTPEnabled,
+		WebAuthnCredentials:    credentials,
+		RecoveryCodesRemaining: remaining,
+	}, nil
+}
+
+// EnrolTOTP starts TOTP enrolment with a new secret. MFA is not enabled until
+// the user proves they can generate codes with ConfirmTOTP.
+func (s *MFAService) EnrolTOTP(tenantID, userID uint) (dto.TOTPEnrolmentDTO, error) {
+	user, err := s.getUser(tenantID, userID)
+	if err != nil {
+		return dto.TOTPEnrolmentDTO{}, err
+	}
+	if user.TOTPEnabled {
+		return dto.TOTPEnrolmentDTO{}, config.ErrMFAAlreadyEnabled
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return dto.TOTPEnrolmentDTO{}, err
+	}
+
+	user.TOTPSecret = secret
+	user.TOTPLastUsedStep = 0
+	if err := s.userRepository.Update(user); err != nil {
+		return dto.TOTPEnrolmentDTO{}, err
+	}
+
+	return dto.TOTPEnrolmentDTO{
+		Secret:     secret,
+		OTPAuthURI: totpURI(s.issuer, user.Email, secret),
+	}, nil
+}
+
+// ConfirmTOTP enables TOTP once the user enters a valid code for the enrolled
+// secret. Recovery codes are returned when TOTP is the user's first second factor.
+func (s *MFAService) ConfirmTOTP(tenantID, userID uint, code string) (dto.RecoveryCodesDTO, error) {
+	user, err := s.getUser(tenantID, userID)
+	if err != nil {
+		return dto.RecoveryCodesDTO{}, err
+	}
+	if user.TOTPEnabled {
+		return dto.RecoveryCodesDTO{}, config.ErrMFAAlreadyEnabled
+	}
+	if user.TOTPSecret == "" {
+		return dto.RecoveryCodesDTO{}, config.ErrMFAEnrolmentNotStarted
+	}
+
+	step, ok := validateTOTP(user.TOTPSecret, code, time.Now())
+	if !ok {
+		return dto.RecoveryCodesDTO{}, config.ErrInvalidMFACode
+	}
+
+	credentials, err := s.webAuthnService.CountCredentials(user.ID)
+	if err != nil {
+		return dto.RecoveryCodesDTO{}, err
+	}
+
+	user.TOTPEnabled = true
+	user.TOTPLastUsedStep = step
+	if err := s.userRepository.Update(user); err != nil {
+		return dto.RecoveryCodesDTO{}, err
+	}
+
+	if credentials > 0 {
+		return dto.RecoveryCodesDTO{}, nil
+	}
+	return s.replaceRecoveryCodes(user.ID)
+}
+
+// DisableTOTP turns TOTP off after checking a current code or recovery code.
+// The user's recovery codes are discarded unless a security key remains.
+// Wrong codes count towards the user's failed login attempts.
+func (s *MFAService) DisableTOTP(tenantID, userID uint, code string) error {
+	user, err := s.getUser(tenantID, userID)
+	if err != nil {
+		return err
+	}
+	if !user.TOTPEnabled {
+		return config.ErrMFANotEnabled
+	}
+	if _, err := s.checkCode(user, code); err != nil {
+		return err
+	}
+
+	s.lockoutService.Reset(user)
+	user.TOTPEnabled = false
+	user.TOTPSecret = ""
+	user.TOTPLastUsedStep = 0
+	if err := s.userRepository.Update(user); err != nil {
+		return err
+	}
+	return s.discardUnusedRecoveryCodes(user)
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes after checking a
+// current TOTP code or recovery code. Unused codes from the previous set stop
+// working. Wrong codes count towards the user's failed login attempts.
+func (s *MFAService) RegenerateRecoveryCodes(tenantID, userID uint, code string) (dto.RecoveryCodesDTO, error) {
+	user, err := s.getUser(tenantID, userID)
+	if err != nil {
+		return dto.RecoveryCodesDTO{}, err
+	}
+
+	methods, err := s.Methods(user)
+	if err != nil {
+		return dto.RecoveryCodesDTO{}, err
+	} else if len(methods) == 0 {
+		return dto.RecoveryCodesDTO{}, config.ErrMFANotEnabled
+	}
+	if _, err := s.checkCode(user, code); err != nil {
+		return dto.RecoveryCodesDTO{}, err
+	}
+
+	s.lockoutService.Reset(user)
+	if err := s.userRepository.Update(user); err != nil {
+		return dto.RecoveryCodesDTO{}, err
+	}
+	return s.replaceRecoveryCodes(user.ID)
+}
+
+// EnrolWebAuthn finishes registering a security key or passkey. Recovery codes
+// are returned when it is the user's first second factor.
+func (s *MFAService) EnrolWebAuthn(tenantID, userID uint, registrationRequest dto.WebAuthnRegistrationDTO) (dto.WebAuthnEnrolmentDTO, error) {
+	user, err := s.getUser(tenantID, userID)
+	if err != nil {
+		return dto.WebAuthnEnrolmentDTO{}, err
+	}
+
+	methods, err := s.Methods(user)
+	if err != nil {
+		return dto.WebAuthnEnrolmentDTO{}, err
+	}
+
+	credential, err := s.webAuthnService.FinishRegistration(tenantID, userID, registrationRequest)
+	if err != nil {
+		return dto.WebAuthnEnrolmentDTO{}, err
+	}
+
+	enrolment := dto.WebAuthnEnrolmentDTO{Credential: credential}
+	if len(methods) == 0 {
+		recoveryCodes, err := s.replaceRecoveryCodes(user.ID)
+		if err != nil {
+			return dto.WebAuthnEnrolmentDTO{}, err
+		}
+		enrolment.RecoveryCodes = recoveryCodes.RecoveryCodes
+	}
+	return enrolment, nil
+}
+
+// RemoveWebAuthnCredential deletes a security key or passkey and discards the
+// user's recovery codes when no second factor remains
+func (s *MFAService) RemoveWebAuthnCredential(tenantID, userID, credentialID uint) error {
+	user, err := s.getUser(tenantID, userID)
+	if err != nil {
+		return err
+	}
+
+	if err := s.webAuthnService.DeleteCredential(tenantID, userID, credentialID); err != nil {
+		return err
+	}
+	return s.discardUnusedRecoveryCodes(user)
+}
+
+// Methods lists the second factors the user can answer a challenge with. An
+// empty list means the user has not enabled MFA.
+func (s *MFAService) Methods(user *models.User) ([]string, error) {
+	methods := []string{}
+	if user.TOTPEnabled {
+		methods = append(methods, config.MFAMethodTOTP)
+	}
+
+	credentials, err := s.webAuthnService.CountCredentials(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if credentials > 0 {
+		methods = append(methods, config.MFAMethodWebAuthn)
+	}
+
+	if len(methods) > 0 {
+		methods = append(methods, config.MFAMethodRecoveryCode)
+	}
+	return methods, nil
+}
+
+// StartChallenge records that the user passed the first factor, described by
+// amr, and returns the raw MFA token that must accompany the second factor
+func (s *MFAService) StartChallenge(user *models.User, amr []string) (string, error) {
+	return s.createChallenge(user, false, amr)
+}
+
+// StartEnrolment records that a user without a second factor passed the
+// first factor, described by amr, and returns the raw MFA token they must
+// enrol one with before the login completes
+func (s *MFAService) StartEnrolment(user *models.User, amr []string) (string, error) {
+	return s.createChallenge(user, true, amr)
+}
+
+// EnrolTOTPForChallenge starts TOTP enrolment for the user of an enrolment challenge
+func (s *MFAService) EnrolTOTPForChallenge(mfaToken string) (dto.TOTPEnrolmentDTO, error) {
+	challenge, err := s.getChallenge(mfaToken, true)
+	if err != nil {
+		return dto.TOTPEnrolmentDTO{}, err
+	}
+	return s.EnrolTOTP(challenge.TenantID, challenge.UserID)
+}
+
+// ConfirmTOTPForChallenge enables TOTP for the user of an enrolment challenge
+// and answers the challenge, returning the user, the authentication methods
+// of the login and the user's recovery codes
+func (s *MFAService) ConfirmTOTPForChallenge(mfaToken, code string) (*models.User, []string, dto.RecoveryCodesDTO, error) {
+	var recoveryCodes dto.RecoveryCodesDTO
+	user, amr, err := s.answerEnrolment(mfaToken, config.MFAMethodTOTP, func(challenge *models.MFAChallenge) error {
+		var err error
+		recoveryCodes, err = s.ConfirmTOTP(challenge.TenantID, challenge.UserID, code)
+		return err
+	})
+	if err != nil {
+		return nil, nil, dto.RecoveryCodesDTO{}, err
+	}
+	return user, amr, recoveryCodes, nil
+}
+
+// BeginWebAuthnEnrolment starts registering a security key or passkey for the
+// user of an enrolment challenge
+func (s *MFAService) BeginWebAuthnEnrolment(mfaToken string) (dto.WebAuthnOptionsDTO, error) {
+	challenge, err := s.getChallenge(mfaToken, true)
+	if err != nil {
+		return dto.WebAuthnOptionsDTO{}, err
+	}
+	return s.webAuthnService.BeginRegistration(challenge.TenantID, challenge.UserID)
+}
+
+// FinishWebAuthnEnrolment stores the security key or passkey of the user of an
+// enrolment challenge and answers the challenge, returning the user and the
+// authentication methods of the login
+func (s *MFAService) FinishWebAuthnEnrolment(mfaToken string, registrationRequest dto.WebAuthnRegistrationDTO) (*models.User, []string, dto.WebAuthnEnrolmentDTO, error) {
+	var enrolment dto.WebAuthnEnrolmentDTO
+	user, amr, err := s.answerEnrolment(mfaToken, config.MFAMethodWebAuthn, func(challenge *models.MFAChallenge) error {
+		var err error
+		enrolment, err = s.EnrolWebAuthn(challenge.TenantID, challenge.UserID, registrationRequest)
+		return err
+	})
+	if err != nil {
+		return nil, nil, dto.WebAuthnEnrolmentDTO{}, err
+	}
+	return user, amr, enrolment, nil
+}
+
+func (s *MFAService) createChallenge(user *models.User, enrolment bool, amr []string) (string, error) {
+	rawToken, err := generateSecureToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	challenge := &models.MFAChallenge{
+		ChallengeHash: hashSecureToken(rawToken),
+		UserID:        user.ID,
+		TenantID:      user.TenantID,
+		Enrolment:     enrolment,
+		AMR:           amr,
+		ExpiresAt:     now.Add(s.challengeTTL),
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	if err := s.mfaChallengeRepository.Create(challenge); err != nil {
+		return "", err
+	}
+	return rawToken, nil
+}
+
+// BeginWebAuthnChallenge starts a security key assertion for a pending MFA
+// challenge. The result is sent to VerifyChallenge with the same MFA token.
+func (s *MFAService) BeginWebAuthnChallenge(mfaToken string) (dto.WebAuthnOptionsDTO, error) {
+	challenge, err := s.getChallenge(mfaToken, false)
+	if err != nil {
+		return dto.WebAuthnOptionsDTO{}, err
+	}
+
+	user, err := s.getUser(challenge.TenantID, challenge.UserID)
+	if err == config.ErrUserNotFound {
+		return dto.WebAuthnOptionsDTO{}, config.ErrInvalidMFAToken
+	} else if err != nil {
+		return dto.WebAuthnOptionsDTO{}, err
+	}
+
+	options, sessionData, err := s.webAuthnService.beginAssertion(user)
+	if err != nil {
+		return dto.WebAuthnOptionsDTO{}, err
+	}
+	if err := s.mfaChallengeRepository.SetWebAuthnSession(challenge.ID, sessionData); err != nil {
+		return dto.WebAuthnOptionsDTO{}, err
+	}
+	return dto.WebAuthnOptionsDTO{Options: options}, nil
+}
+
+// VerifyChallenge answers an MFA challenge with a TOTP code, a recovery code or
+// a security key assertion and returns the user it was issued for and the
+// authentication methods of the login. A challenge can be answered once and
+// allows config.MaxMFAAttempts attempts before the login must start over.
+// Wrong codes also count towards the user's failed login attempts, so logging
+// in again for a new challenge does not allow more guesses, and codes are
+// refused while the user is locked out. Security keys cannot be guessed and
+// are accepted during a lockout, as with passkey logins.
+func (s *MFAService) VerifyChallenge(verifyRequest dto.MFAVerifyDTO) (*models.User, []string, error) {
+	challenge, err := s.getChallenge(verifyRequest.MFAToken, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	allowed, err := s.mfaChallengeRepository.RecordAttempt(challenge.ID, config.MaxMFAAttempts)
+	if err != nil {
+		return nil, nil, err
+	} else if !allowed {
+		if _, err := s.mfaChallengeRepository.Consume(challenge.ID); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, config.ErrInvalidMFAToken
+	}
+
+	user, err := s.getUser(challenge.TenantID, challenge.UserID)
+	if err == config.ErrUserNotFound {
+		return nil, nil, config.ErrInvalidMFAToken
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	var method string
+	if len(verifyRequest.Credential) > 0 {
+		if err := s.webAuthnService.finishAssertion(user, challenge.WebAuthnSession, verifyRequest.Credential); err != nil {
+			return nil, nil, err
+		}
+		method = config.MFAMethodWebAuthn
+	} else {
+		method, err = s.checkCode(user, verifyRequest.Code)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	consumed, err := s.mfaChallengeRepository.Consume(challenge.ID)
+	if err != nil {
+		return nil, nil, err
+	} else if !consumed {
+		return nil, nil, config.ErrInvalidMFAToken
+	}
+	return user, challengeAMR(challenge, method), nil
+}
+
+// PurgeExpired removes MFA challenges that were never answered
+func (s *MFAService) PurgeExpired() error {
+	return s.mfaChallengeRepository.DeleteExpired(time.Now())
+}
+
+// answerEnrolment runs enrol against an enrolment challenge and consumes the
+// challenge once it succeeds, returning the user and the authentication
+// methods of the login. Failed attempts count towards config.MaxMFAAttempts,
+// as with VerifyChallenge.
+func (s *MFAService) answerEnrolment(mfaToken, method string, enrol func(challenge *models.MFAChallenge) error) (*models.User, []string, error) {
+	challenge, err := s.getChallenge(mfaToken, true)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	allowed, err := s.mfaChallengeRepository.RecordAttempt(challenge.ID, config.MaxMFAAttempts)
+	if err != nil {
+		return nil, nil, err
+	} else if !allowed {
+		if _, err := s.mfaChallengeRepository.Consume(challenge.ID); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, config.ErrInvalidMFAToken
+	}
+
+	if err := enrol(challenge); err == config.ErrUserNotFound {
+		return nil, nil, config.ErrInvalidMFAToken
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	consumed, err := s.mfaChallengeRepository.Consume(challenge.ID)
+	if err != nil {
+		return nil, nil, err
+	} else if !consumed {
+		return nil, nil, config.ErrInvalidMFAToken
+	}
+
+	user, err := s.getUser(challenge.TenantID, challenge.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, challengeAMR(challenge, method), nil
+}
+
+// getChallenge looks up an unexpired MFA challenge by its raw token. Enrolment
+// challenges and second factor challenges cannot be used for each other.
+func (s *MFAService) getChallenge(mfaToken string, enrolment bool) (*models.MFAChallenge, error) {
+	challenge, err := s.mfaChallengeRepository.GetByChallengeHash(hashSecureToken(mfaToken))
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return nil, config.ErrInvalidMFAToken
+	} else if err != nil {
+		return nil, err
+	}
+
+	if challenge.ExpiresAt.Before(time.Now()) {
+		if _, err := s.mfaChallengeRepository.Consume(challenge.ID); err != nil {
+			return nil, err
+		}
+		return nil, config.ErrInvalidMFAToken
+	}
+	if challenge.Enrolment != enrolment {
+		return nil, config.ErrInvalidMFAToken
+	}
+	return challenge, nil
+}
+
+// challengeAMR adds the second factor answering an MFA challenge to the first
+// factor recorded on it
+func challengeAMR(challenge *models.MFAChallenge, method string) []string {
+	amr := append([]string{}, challenge.AMR...)
+	if factor := methodAMR(method); !containsString(amr, factor) {
+		amr = append(amr, factor)
+	}
+	return append(amr, config.AMRMultiFactor)
+}
+
+// methodAMR returns the amr value of a second factor method
+func methodAMR(method string) string {
+	if method == config.MFAMethodWebAuthn {
+		return config.AMRHardwareKey
+	}
+	return config.AMROTP
+}
+
+// discardUnusedRecoveryCodes deletes the user's recovery codes once they have
+// no second factor left for the codes to stand in for
+func (s *MFAService) discardUnusedRecoveryCodes(user *models.User) error {
+	methods, err := s.Methods(user)
+	if err != nil {
+		return err
+	}
+	if len(methods) > 0 {
+		return nil
+	}
+	return s.recoveryCodeRepository.DeleteForUser(user.ID)
+}
+
+// checkCode verifies a TOTP code or recovery code with verifyCode, but turns
+// the user away while they are locked out and counts wrong codes towards
+// their failed login attempts
+func (s *MFAService) checkCode(user *models.User, code string) (string, error) {
+	if err := s.lockoutService.CheckLocked(user); err != nil {
+		return "", err
+	}
+
+	method, err := s.verifyCode(user, code)
+	if err == config.ErrInvalidMFACode {
+		if err := s.lockoutService.RecordFailure(user); err != nil {
+			return "", err
+		}
+		return "", config.ErrInvalidMFACode
+	} else if err != nil {
+		return "", err
+	}
+	return method, nil
+}
+
+// verifyCode accepts a TOTP code or, failing that, an unused recovery code and
+// returns the method that matched
+func (s *MFAService) verifyCode(user *models.User, code string) (string, error) {
+	if len(code) == config.TOTPDigits {
+		if err := s.verifyTOTP(user, code); err != nil {
+			return "", err
+		}
+		return config.MFAMethodTOTP, nil
+	}
+
+	used, err := s.recoveryCodeRepository.MarkUsed(user.ID, hashSecureToken(normalizeRecoveryCode(code)), time.Now())
+	if err != nil {
+		return "", err
+	} else if !used {
+		return "", config.ErrInvalidMFACode
+	}
+	return config.MFAMethodRecoveryCode, nil
+}
+
+// verifyTOTP checks a TOTP code and rejects codes whose time step was already used
+func (s *MFAService) verifyTOTP(user *models.User, code string) error {
+	if !user.TOTPEnabled {
+		return config.ErrInvalidMFACode
+	}
+
+	step, ok := validateTOTP(user.TOTPSecret, code, time.Now())
+	if !ok {
+		return config.ErrInvalidMFACode
+	}
+
+	recorded, err := s.userRepository.RecordTOTPStep(user.ID, step)
+	if err != nil {
+		return err
+	} else if !recorded {
+		return config.ErrInvalidMFACode
+	}
+	user.TOTPLastUsedStep = step
+	return nil
+}
+
+func (s *MFAService) replaceRecoveryCodes(userID uint) (dto.RecoveryCodesDTO, error) {
+	now := time.Now()
+	codes := make([]string, 0, config.RecoveryCodeCount)
+	recoveryCodes := make([]models.RecoveryCode, 0, config.RecoveryCodeCount)
+	for i := 0; i < config.RecoveryCodeCount; i++ {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return dto.RecoveryCodesDTO{}, err
+		}
+		codes = append(codes, code)
+		recoveryCodes = append(recoveryCodes, models.RecoveryCode{
+			UserID:    userID,
+			CodeHash:  hashSecureToken(normalizeRecoveryCode(code)),
+			CreatedAt: now,
+		})
+	}
+
+	if err := s.recoveryCodeRepository.ReplaceForUser(userID, recoveryCodes); err != nil {
+		return dto.RecoveryCodesDTO{}, err
+	}
+	return dto.RecoveryCodesDTO{RecoveryCodes: codes}, nil
+}
+
+func (s *MFAService) getUser(tenantID, userID uint) (*models.User, error) {
+	user, err := s.userRepository.GetByID(tenantID, userID)
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return nil, config.ErrUserNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
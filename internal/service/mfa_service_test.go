@@ -0,0 +1,223 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/models"
+)
+
+// totpCode returns the code for the time step offset steps from now
+func totpCode(t *testing.T, secret string, offset int) string {
+	t.Helper()
+
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hotp(key, time.Now().Unix()/int64(config.TOTPPeriod.Seconds())+int64(offset))
+}
+
+// totpUser is a user with TOTP enabled, the code that confirmed it and their
+// recovery codes
+type totpUser struct {
+	*models.User
+	secret        string
+	confirmCode   string
+	recoveryCodes []string
+}
+
+func (s *testServices) enableTOTP(t *testing.T, user *models.User) totpUser {
+	t.Helper()
+
+	enrolment, err := s.mfa.EnrolTOTP(user.TenantID, user.ID)
+	check(t, err)
+	code := totpCode(t, enrolment.Secret, 0)
+	recoveryCodes, err := s.mfa.ConfirmTOTP(user.TenantID, user.ID, code)
+	check(t, err)
+	return totpUser{User: user, secret: enrolment.Secret, confirmCode: code, recoveryCodes: recoveryCodes.RecoveryCodes}
+}
+
+// verifyMFA logs the user in with their password and answers the MFA
+// challenge with code
+func (s *testServices) verifyMFA(t *testing.T, email, code string) (dto.LoginResponseDTO, error) {
+	t.Helper()
+
+	challenge := s.loginUser(t, email)
+	if !challenge.MFARequired {
+		t.Fatalf("Login() = %+v, want an MFA challenge", challenge)
+	}
+	return s.login.VerifyMFA(dto.MFAVerifyDTO{MFAToken: challenge.MFAToken, Code: code}, "127.0.0.1")
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	check(t, err)
+
+	tests := []struct {
+		name   string
+		offset int
+		code   func(code string) string
+		wantOK bool
+	}{
+		{name: "accepts the current code", wantOK: true},
+		{name: "accepts the previous code", offset: -config.TOTPAllowedSkew, wantOK: true},
+		{name: "accepts the next code", offset: config.TOTPAllowedSkew, wantOK: true},
+		{name: "rejects an older code", offset: -config.TOTPAllowedSkew - 1},
+		{name: "rejects a later code", offset: config.TOTPAllowedSkew + 1},
+		{name: "rejects a short code", code: func(code string) string { return code[1:] }},
+		{name: "rejects a wrong code", code: func(code string) string {
+			if code[0] == '9' {
+				return "0" + code[1:]
+			}
+			return string(code[0]+1) + code[1:]
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			key, err := totpEncoding.DecodeString(secret)
+			check(t, err)
+			step := now.Unix()/int64(config.TOTPPeriod.Seconds()) + int64(tt.offset)
+			code := hotp(key, step)
+			if tt.code != nil {
+				code = tt.code(code)
+			}
+
+			gotStep, ok := validateTOTP(secret, code, now)
+			if ok != tt.wantOK {
+				t.Fatalf("validateTOTP() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && gotStep != step {
+				t.Errorf("validateTOTP() step = %d, want %d", gotStep, step)
+			}
+		})
+	}
+}
+
+func TestVerifyMFAChallenge(t *testing.T) {
+	tests := []struct {
+		name string
+		// code prepares the user and returns the code to answer their pending
+		// challenge with
+		code       func(t *testing.T, s *testServices, user totpUser, mfaToken string) string
+		wantErr    error
+		wantMethod string
+	}{
+		{
+			name: "accepts a TOTP code",
+			code: func(t *testing.T, s *testServices, user totpUser, mfaToken string) string {
+				return totpCode(t, user.secret, 1)
+			},
+			wantMethod: config.MFAMethodTOTP,
+		},
+		{
+			name:    "rejects a replayed TOTP code",
+			code:    func(t *testing.T, s *testServices, user totpUser, mfaToken string) string { return user.confirmCode },
+			wantErr: config.ErrInvalidMFACode,
+		},
+		{
+			name: "rejects a code outside the window",
+			code: func(t *testing.T, s *testServices, user totpUser, mfaToken string) string {
+				return totpCode(t, user.secret, config.TOTPAllowedSkew+1)
+			},
+			wantErr: config.ErrInvalidMFACode,
+		},
+		{
+			name: "accepts a recovery code",
+			code: func(t *testing.T, s *testServices, user totpUser, mfaToken string) string {
+				return user.recoveryCodes[0]
+			},
+			wantMethod: config.MFAMethodRecoveryCode,
+		},
+		{
+			name: "recovery codes work only once",
+			code: func(t *testing.T, s *testServices, user totpUser, mfaToken string) string {
+				_, err := s.verifyMFA(t, user.Email, user.recoveryCodes[0])
+				check(t, err)
+				return user.recoveryCodes[0]
+			},
+			wantErr: config.ErrInvalidMFACode,
+		},
+		{
+			name: "regenerating recovery codes replaces the old ones",
+			code: func(t *testing.T, s *testServices, user totpUser, mfaToken string) string {
+				_, err := s.mfa.RegenerateRecoveryCodes(user.TenantID, user.ID, user.recoveryCodes[1])
+				check(t, err)
+				return user.recoveryCodes[0]
+			},
+			wantErr: config.ErrInvalidMFACode,
+		},
+		{
+			name: "wrong codes lock the user out",
+			code: func(t *testing.T, s *testServices, user totpUser, mfaToken string) string {
+				for i := 0; i < config.DefaultMaxFailedLoginAttempts; i++ {
+					_, err := s.login.VerifyMFA(dto.MFAVerifyDTO{MFAToken: mfaToken, Code: "000000"}, "127.0.0.1")
+					if !errors.Is(err, config.ErrInvalidMFACode) {
+						t.Fatalf("VerifyMFA() error = %v, want %v", err, config.ErrInvalidMFACode)
+					}
+				}
+				return totpCode(t, user.secret, 1)
+			},
+			wantErr: config.ErrAccountLocked,
+		},
+		{
+			name: "a successful login clears earlier wrong codes",
+			code: func(t *testing.T, s *testServices, user totpUser, mfaToken string) string {
+				for i := 0; i < config.DefaultMaxFailedLoginAttempts-1; i++ {
+					s.verifyMFA(t, user.Email, "000000")
+				}
+				_, err := s.verifyMFA(t, user.Email, user.recoveryCodes[0])
+				check(t, err)
+				s.verifyMFA(t, user.Email, "000000")
+				return totpCode(t, user.secret, 1)
+			},
+			wantMethod: config.MFAMethodTOTP,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServices(t)
+			user := s.enableTOTP(t, s.createUser(t, "user@example.com"))
+			if len(user.recoveryCodes) != config.RecoveryCodeCount {
+				t.Fatalf("ConfirmTOTP() returned %d recovery codes, want %d", len(user.recoveryCodes), config.RecoveryCodeCount)
+			}
+
+			challenge := s.loginUser(t, user.Email)
+			code := tt.code(t, s, user, challenge.MFAToken)
+			response, err := s.login.VerifyMFA(dto.MFAVerifyDTO{MFAToken: challenge.MFAToken, Code: code}, "127.0.0.1")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("VerifyMFA() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			claims, err := s.token.ParseAccessToken(response.AccessToken)
+			check(t, err)
+			if !containsString(claims.AMR, methodAMR(tt.wantMethod)) {
+				t.Errorf("amr = %v, want it to include %q", claims.AMR, methodAMR(tt.wantMethod))
+			}
+		})
+	}
+}
+
+func TestMFATokenSingleUse(t *testing.T) {
+	s := newTestServices(t)
+	user := s.enableTOTP(t, s.createUser(t, "user@example.com"))
+
+	challenge := s.loginUser(t, user.Email)
+	request := dto.MFAVerifyDTO{MFAToken: challenge.MFAToken, Code: user.recoveryCodes[0]}
+	_, err := s.login.VerifyMFA(request, "127.0.0.1")
+	check(t, err)
+
+	request.Code = user.recoveryCodes[1]
+	if _, err := s.login.VerifyMFA(request, "127.0.0.1"); !errors.Is(err, config.ErrInvalidMFAToken) {
+		t.Errorf("VerifyMFA() with a used token error = %v, want %v", err, config.ErrInvalidMFAToken)
+	}
+}
@@ -0,0 +1,1021 @@
+package service
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"github.com/geekible-ltd/auth-server/internal/repository"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// OAuthError is an RFC 6749 error returned by the authorization and token endpoints
+type OAuthError struct {
+	Code        string
+	Description string
+}
+
+func (e *OAuthError) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Description
+}
+
+func newOAuthError(code, description string) *OAuthError {
+	return &OAuthError{Code: code, Description: description}
+}
+
+type OAuthService struct {
+	userRepository              *repository.UserRepository
+	authorizationCodeRepository *repository.AuthorizationCodeRepository
+	deviceCodeRepository        *repository.DeviceCodeRepository
+	clientService               *ClientService
+	tokenService                *TokenService
+	refreshTokenService         *RefreshTokenService
+	revocationService           *RevocationService
+	clientConsentRepository     *repository.ClientConsentRepository
+	authorizationCodeTTL        time.Duration
+	deviceCodeTTL               time.Duration
+}
+
+func NewOAuthService(userRepository *repository.UserRepository, authorizationCodeRepository *repository.AuthorizationCodeRepository, deviceCodeRepository *repository.DeviceCodeRepository, clientService *ClientService, tokenService *TokenService, refreshTokenService *RefreshTokenService, revocationService *RevocationService, authorizationCodeTTL, deviceCodeTTL time.Duration, clientConsentRepository *repository.ClientConsentRepository) *OAuthService {
+	return &OAuthService{
+		userRepository:              userRepository,
+		authorizationCodeRepository: authorizationCodeRepository,
+		deviceCodeRepository:        deviceCodeRepository,
+		clientService:               clientService,
+		tokenService:                tokenService,
+		refreshTokenService:         refreshTokenService,
+		revocationService:           revocationService,
+		clientConsentRepository:     clientConsentRepository,
+		authorizationCodeTTL:        authorizationCodeTTL,
+		deviceCodeTTL:               deviceCodeTTL,
+	}
+}
+
+// ValidateAuthorizationRequest checks an authorization request and returns the
+// client and the redirect URI to respond to. The redirect URI is empty when
+// the client or redirect URI itself is invalid, in which case the error must
+// be shown to the user rather than redirected.
+func (s *OAuthService) ValidateAuthorizationRequest(request dto.AuthorizationRequestDTO) (*models.Client, string, error) {
+	client, err := s.clientService.GetActiveClient(request.ClientID)
+	if err == config.ErrInvalidClient {
+		return nil, "", newOAuthError(config.OAuthErrorInvalidClient, "Unknown client")
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	redirectURI, ok := resolveRedirectURI(client, request.RedirectURI)
+	if !ok {
+		return nil, "", newOAuthError(config.OAuthErrorInvalidRequest, "redirect_uri is not registered for this client")
+	}
+
+	if request.ResponseType != config.ResponseTypeCode {
+		return client, redirectURI, newOAuthError(config.OAuthErrorUnsupportedResponseType, "Only the code response type is supported")
+	}
+
+	if !clientAllowsGrantType(client, config.GrantTypeAuthorizationCode) {
+		return client, redirectURI, newOAuthError(config.OAuthErrorUnauthorizedClient, "Client is not registered for the authorization code grant")
+	}
+
+	if !isScopeSubset(request.Scope, strings.Join(client.Scopes, " ")) {
+		return client, redirectURI, newOAuthError(config.OAuthErrorInvalidScope, "Scope not allowed for this client")
+	}
+
+	if hasScope(request.Prompt, config.PromptNone) && len(strings.Fields(request.Prompt)) > 1 {
+		return client, redirectURI, newOAuthError(config.OAuthErrorInvalidRequest, "prompt=none cannot be combined with other values")
+	}
+
+	if request.MaxAge != "" {
+		if maxAge, err := strconv.Atoi(request.MaxAge); err != nil || maxAge < 0 {
+			return client, redirectURI, newOAuthError(config.OAuthErrorInvalidRequest, "Invalid max_age")
+		}
+	}
+
+	if request.CodeChallenge == "" {
+		if client.IsPublic {
+			return client, redirectURI, newOAuthError(config.OAuthErrorInvalidRequest, "code_challenge is required for public clients")
+		}
+	} else if request.CodeChallengeMethod != config.CodeChallengeMethodS256 {
+		return client, redirectURI, newOAuthError(config.OAuthErrorInvalidRequest, "code_challenge_method must be S256")
+	} else if len(request.CodeChallenge) != 43 {
+		return client, redirectURI, newOAuthError(config.OAuthErrorInvalidRequest, "Invalid code_challenge")
+	}
+
+	return client, redirectURI, nil
+}
+
+// LoginRequired reports whether the user must authenticate again before the
+// request can be authorised, because it asks for prompt=login or the session
+// is older than max_age
+func (s *OAuthService) LoginRequired(request dto.AuthorizationRequestDTO, session *AccessTokenClaims) bool {
+	if hasScope(request.Prompt, config.PromptLogin) {
+		return true
+	}
+	if request.MaxAge == "" {
+		return false
+	}
+	maxAge, err := strconv.Atoi(request.MaxAge)
+	if err != nil {
+		return true
+	}
+	return time.Since(sessionAuthTime(session)) > time.Duration(maxAge)*time.Second
+}
+
+// ConsentRequired reports whether the user must consent before the client is
+// given the requested scopes. First-party clients never ask; others ask when
+// the request has prompt=consent or wants scopes the user has not allowed yet.
+func (s *OAuthService) ConsentRequired(client *models.Client, request dto.AuthorizationRequestDTO, session *AccessTokenClaims) (bool, error) {
+	if client.IsFirstParty {
+		return false, nil
+	}
+	if hasScope(request.Prompt, config.PromptConsent) {
+		return true, nil
+	}
+
+	userID, err := session.UserID()
+	if err != nil {
+		return false, err
+	}
+	consent, err := s.clientConsentRepository.Get(userID, client.ClientID)
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return !isScopeSubset(request.Scope, strings.Join(consent.Scopes, " ")), nil
+}
+
+// GrantConsent records that the user allows the client the requested scopes,
+// in addition to any they allowed before
+func (s *OAuthService) GrantConsent(client *models.Client, request dto.AuthorizationRequestDTO, session *AccessTokenClaims) error {
+	tenantID, err := session.TenantID()
+	if err != nil {
+		return err
+	}
+	userID, err := session.UserID()
+	if err != nil {
+		return err
+	}
+	if tenantID != client.TenantID {
+		return newOAuthError(config.OAuthErrorAccessDenied, "User does not belong to the client's tenant")
+	}
+
+	scope := request.Scope
+	consent, err := s.clientConsentRepository.Get(userID, client.ClientID)
+	if err == nil {
+		scope = strings.Join(consent.Scopes, " ") + " " + scope
+	} else if err != gorm.ErrRecordNotFound {
+		return err
+	}
+
+	return s.clientConsentRepository.Upsert(&models.ClientConsent{
+		UserID:   userID,
+		ClientID: client.ClientID,
+		Scopes:   strings.Fields(normalizeScope(scope)),
+	})
+}
+
+// Authorize issues an authorization code to the client for the user
+// authenticated by the session claims. The user must have authenticated
+// recently enough for the request and consented to the client.
+func (s *OAuthService) Authorize(client *models.Client, redirectURI string, request dto.AuthorizationRequestDTO, session *AccessTokenClaims) (string, error) {
+	tenantID, err := session.TenantID()
+	if err != nil {
+		return "", err
+	}
+	userID, err := session.UserID()
+	if err != nil {
+		return "", err
+	}
+
+	// Clients are tenant scoped, so users of other tenants cannot authorise them
+	if tenantID != client.TenantID {
+		return "", newOAuthError(config.OAuthErrorAccessDenied, "User does not belong to the client's tenant")
+	}
+
+	user, err := s.userRepository.GetByID(tenantID, userID)
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return "", newOAuthError(config.OAuthErrorAccessDenied, "")
+	} else if err != nil {
+		return "", err
+	}
+	if !user.IsActive {
+		return "", newOAuthError(config.OAuthErrorAccessDenied, "")
+	}
+
+	if s.LoginRequired(request, session) {
+		return "", newOAuthError(config.OAuthErrorLoginRequired, "")
+	}
+	consentRequired, err := s.ConsentRequired(client, request, session)
+	if err != nil {
+		return "", err
+	} else if consentRequired {
+		return "", newOAuthError(config.OAuthErrorConsentRequired, "")
+	}
+
+	rawCode, err := generateSecureToken()
+	if err != nil {
+		return "", err
+	}
+
+	authTime := sessionAuthTime(session)
+
+	now := time.Now()
+	authorizationCode := &models.AuthorizationCode{
+		CodeHash:            hashSecureToken(rawCode),
+		ClientID:            client.ClientID,
+		UserID:              user.ID,
+		TenantID:            user.TenantID,
+		RedirectURI:         redirectURI,
+		Scope:               normalizeScope(request.Scope),
+		Nonce:               request.Nonce,
+		CodeChallenge:       request.CodeChallenge,
+		CodeChallengeMethod: request.CodeChallengeMethod,
+		AuthTime:            authTime,
+		AMR:                 session.AMR,
+		ExpiresAt:           now.Add(s.authorizationCodeTTL),
+		CreatedAt:           now,
+		UpdatedAt:           now,
+	}
+	if err := s.authorizationCodeRepository.Create(authorizationCode); err != nil {
+		return "", err
+	}
+
+	return rawCode, nil
+}
+
+// Token implements the token endpoint for the grant types the client is registered for
+func (s *OAuthService) Token(client *models.Client, request dto.TokenRequestDTO) (dto.TokenResponseDTO, error) {
+	if !containsString(supportedGrantTypes, request.GrantType) {
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorUnsupportedGrantType, "")
+	}
+	if !clientAllowsGrantType(client, request.GrantType) {
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorUnauthorizedClient, "Client is not registered for this grant type")
+	}
+
+	switch request.GrantType {
+	case config.GrantTypeAuthorizationCode:
+		return s.exchangeAuthorizationCode(client, request)
+	case config.GrantTypeRefreshToken:
+		return s.exchangeRefreshToken(client, request)
+	case config.GrantTypeClientCredentials:
+		return s.clientCredentialsGrant(client, request)
+	case config.GrantTypeDeviceCode:
+		return s.exchangeDeviceCode(client, request)
+	case config.GrantTypeTokenExchange:
+		return s.exchangeToken(client, request)
+	default:
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorUnsupportedGrantType, "")
+	}
+}
+
+// UserInfo returns the claims about the user the access token was issued for,
+// limited to the granted scopes
+func (s *OAuthService) UserInfo(claims *AccessTokenClaims) (dto.UserInfoDTO, error) {
+	if !hasScope(claims.Scope, config.ScopeOpenID) {
+		return dto.UserInfoDTO{}, newOAuthError(config.OAuthErrorInsufficientScope, "The openid scope is required")
+	}
+
+	tenantID, err := claims.TenantID()
+	if err != nil {
+		return dto.UserInfoDTO{}, err
+	}
+	userID, err := claims.UserID()
+	if err != nil {
+		return dto.UserInfoDTO{}, err
+	}
+
+	user, err := s.userRepository.GetByID(tenantID, userID)
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return dto.UserInfoDTO{}, config.ErrInvalidToken
+	} else if err != nil {
+		return dto.UserInfoDTO{}, err
+	}
+
+	userInfo := dto.UserInfoDTO{
+		Sub:      claims.Subject,
+		TenantID: claims.CompanyID,
+	}
+	if hasScope(claims.Scope, config.ScopeProfile) {
+		userInfo.Name = strings.TrimSpace(user.FirstName + " " + user.LastName)
+		userInfo.GivenName = user.FirstName
+		userInfo.FamilyName = user.LastName
+	}
+	if hasScope(claims.Scope, config.ScopeEmail) {
+		userInfo.Email = user.Email
+		userInfo.EmailVerified = &user.IsEmailVerified
+	}
+	return userInfo, nil
+}
+
+// StartDeviceAuthorization issues a device code and a user code to the client
+// (RFC 8628 section 3.2). The user approves the request by entering the user
+// code at verificationURI.
+func (s *OAuthService) StartDeviceAuthorization(client *models.Client, scope, verificationURI string) (dto.DeviceAuthorizationResponseDTO, error) {
+	if !clientAllowsGrantType(client, config.GrantTypeDeviceCode) {
+		return dto.DeviceAuthorizationResponseDTO{}, newOAuthError(config.OAuthErrorUnauthorizedClient, "Client is not registered for the device code grant")
+	}
+	if !isScopeSubset(scope, strings.Join(client.Scopes, " ")) {
+		return dto.DeviceAuthorizationResponseDTO{}, newOAuthError(config.OAuthErrorInvalidScope, "Scope not allowed for this client")
+	}
+
+	rawDeviceCode, err := generateSecureToken()
+	if err != nil {
+		return dto.DeviceAuthorizationResponseDTO{}, err
+	}
+	userCode, err := generateUserCode()
+	if err != nil {
+		return dto.DeviceAuthorizationResponseDTO{}, err
+	}
+
+	now := time.Now()
+	deviceCode := &models.DeviceCode{
+		DeviceCodeHash:  hashSecureToken(rawDeviceCode),
+		UserCode:        userCode,
+		ClientID:        client.ClientID,
+		TenantID:        client.TenantID,
+		Scope:           normalizeScope(scope),
+		Status:          config.DeviceCodeStatusPending,
+		IntervalSeconds: int(config.DefaultDevicePollInterval.Seconds()),
+		ExpiresAt:       now.Add(s.deviceCodeTTL),
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+	if err := s.deviceCodeRepository.Create(deviceCode); err != nil {
+		return dto.DeviceAuthorizationResponseDTO{}, err
+	}
+
+	verificationURIComplete, err := url.Parse(verificationURI)
+	if err != nil {
+		return dto.DeviceAuthorizationResponseDTO{}, err
+	}
+	query := verificationURIComplete.Query()
+	query.Set("user_code", formatUserCode(userCode))
+	verificationURIComplete.RawQuery = query.Encode()
+
+	return dto.DeviceAuthorizationResponseDTO{
+		DeviceCode:              rawDeviceCode,
+		UserCode:                formatUserCode(userCode),
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: verificationURIComplete.String(),
+		ExpiresIn:               int64(s.deviceCodeTTL.Seconds()),
+		Interval:                int64(deviceCode.IntervalSeconds),
+	}, nil
+}
+
+// GetDeviceAuthorization describes the pending request behind a user code so
+// the logged-in user can decide whether to approve it
+func (s *OAuthService) GetDeviceAuthorization(userCode string, session *AccessTokenClaims) (dto.DeviceAuthorizationInfoDTO, error) {
+	deviceCode, err := s.pendingDeviceCode(userCode, session)
+	if err != nil {
+		return dto.DeviceAuthorizationInfoDTO{}, err
+	}
+
+	client, err := s.clientService.GetActiveClient(deviceCode.ClientID)
+	if err == config.ErrInvalidClient {
+		return dto.DeviceAuthorizationInfoDTO{}, config.ErrInvalidUserCode
+	} else if err != nil {
+		return dto.DeviceAuthorizationInfoDTO{}, err
+	}
+
+	return dto.DeviceAuthorizationInfoDTO{
+		UserCode:   formatUserCode(deviceCode.UserCode),
+		ClientID:   client.ClientID,
+		ClientName: client.Name,
+		Scope:      deviceCode.Scope,
+		ExpiresAt:  deviceCode.ExpiresAt,
+	}, nil
+}
+
+// VerifyDeviceAuthorization records the logged-in user's approval or denial of
+// the request behind a user code
+func (s *OAuthService) VerifyDeviceAuthorization(userCode string, approve bool, session *AccessTokenClaims) error {
+	deviceCode, err := s.pendingDeviceCode(userCode, session)
+	if err != nil {
+		return err
+	}
+
+	userID, err := session.UserID()
+	if err != nil {
+		return err
+	}
+	user, err := s.userRepository.GetByID(deviceCode.TenantID, userID)
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return config.ErrUserNotFound
+	} else if err != nil {
+		return err
+	}
+	if !user.IsActive {
+		return config.ErrUserNotFound
+	}
+
+	status := config.DeviceCodeStatusDenied
+	if approve {
+		status = config.DeviceCodeStatusApproved
+	}
+
+	decided, err := s.deviceCodeRepository.Decide(deviceCode.ID, config.DeviceCodeStatusPending, status, user.ID, sessionAuthTime(session), session.AMR)
+	if err != nil {
+		return err
+	}
+	if !decided {
+		return config.ErrInvalidUserCode
+	}
+	return nil
+}
+
+// PurgeExpired removes authorization and device codes that can no longer be redeemed
+func (s *OAuthService) PurgeExpired() error {
+	if err := s.authorizationCodeRepository.DeleteExpired(time.Now()); err != nil {
+		return err
+	}
+	return s.deviceCodeRepository.DeleteExpired(time.Now())
+}
+
+// Introspect implements RFC 7662. Tokens that are invalid, revoked or belong
+// to another tenant than the calling client are reported as inactive.
+func (s *OAuthService) Introspect(client *models.Client, token, tokenTypeHint string) (dto.IntrospectionResponseDTO, error) {
+	if tokenTypeHint == config.TokenTypeHintRefreshToken {
+		if response, ok, err := s.introspectRefreshToken(client, token); ok || err != nil {
+			return response, err
+		}
+		return s.introspectAccessToken(client, token)
+	}
+
+	if response, err := s.introspectAccessToken(client, token); err != nil || response.Active {
+		return response, err
+	}
+	response, _, err := s.introspectRefreshToken(client, token)
+	return response, err
+}
+
+// Revoke implements RFC 7009. A client can only revoke tokens issued to it;
+// unknown tokens and tokens issued to other clients or to first-party
+// sessions are ignored so the response never reveals whether a token exists.
+func (s *OAuthService) Revoke(client *models.Client, token, tokenTypeHint string) error {
+	if tokenTypeHint != config.TokenTypeHintRefreshToken {
+		if claims, err := s.parseAccessToken(client, token); err == nil {
+			if !belongsToClientTenant(client, claims.CompanyID) || claims.ClientID != client.ClientID {
+				return nil
+			}
+			return s.revocationService.RevokeAccessToken(claims)
+		}
+	}
+
+	refreshToken, err := s.refreshTokenService.Lookup(token)
+	if err != nil {
+		return nil
+	}
+	if refreshToken.TenantID != client.TenantID || refreshToken.ClientID != client.ClientID {
+		return nil
+	}
+	return s.refreshTokenService.RevokeFamily(refreshToken.FamilyID)
+}
+
+func (s *OAuthService) introspectAccessToken(client *models.Client, token string) (dto.IntrospectionResponseDTO, error) {
+	claims, err := s.parseAccessToken(client, token)
+	if err != nil {
+		return dto.IntrospectionResponseDTO{Active: false}, nil
+	}
+
+	if !belongsToClientTenant(client, claims.CompanyID) {
+		return dto.IntrospectionResponseDTO{Active: false}, nil
+	}
+
+	revoked, err := s.revocationService.IsRevoked(claims)
+	if err != nil {
+		return dto.IntrospectionResponseDTO{}, err
+	} else if revoked {
+		return dto.IntrospectionResponseDTO{Active: false}, nil
+	}
+
+	response := dto.IntrospectionResponseDTO{
+		Active:    true,
+		Scope:     claims.Scope,
+		Username:  claims.Email,
+		TokenType: "Bearer",
+		Sub:       claims.Subject,
+		Aud:       strings.Join(claims.Audience, " "),
+		Iss:       claims.Issuer,
+		Jti:       claims.ID,
+		TenantID:  claims.CompanyID,
+		Role:      claims.Role,
+		ClientID:  claims.ClientID,
+		Act:       claims.Actor,
+	}
+	if claims.ExpiresAt != nil {
+		response.Exp = claims.ExpiresAt.Unix()
+	}
+	if claims.IssuedAt != nil {
+		response.Iat = claims.IssuedAt.Unix()
+	}
+	if claims.NotBefore != nil {
+		response.Nbf = claims.NotBefore.Unix()
+	}
+	return response, nil
+}
+
+func (s *OAuthService) introspectRefreshToken(client *models.Client, token string) (dto.IntrospectionResponseDTO, bool, error) {
+	refreshToken, err := s.refreshTokenService.Lookup(token)
+	if err == config.ErrInvalidRefreshToken {
+		return dto.IntrospectionResponseDTO{Active: false}, false, nil
+	} else if err != nil {
+		return dto.IntrospectionResponseDTO{}, false, err
+	}
+
+	if refreshToken.TenantID != client.TenantID {
+		return dto.IntrospectionResponseDTO{Active: false}, false, nil
+	}
+
+	return dto.IntrospectionResponseDTO{
+		Active:    true,
+		TokenType: config.TokenTypeHintRefreshToken,
+		Scope:     refreshToken.Scope,
+		ClientID:  refreshToken.ClientID,
+		Exp:       refreshToken.ExpiresAt.Unix(),
+		Iat:       refreshToken.CreatedAt.Unix(),
+		Sub:       strconv.FormatUint(uint64(refreshToken.UserID), 10),
+		TenantID:  strconv.FormatUint(uint64(refreshToken.TenantID), 10),
+	}, true, nil
+}
+
+func (s *OAuthService) exchangeAuthorizationCode(client *models.Client, request dto.TokenRequestDTO) (dto.TokenResponseDTO, error) {
+	if request.Code == "" {
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidRequest, "code is required")
+	}
+
+	authorizationCode, err := s.authorizationCodeRepository.GetByCodeHash(hashSecureToken(request.Code))
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidGrant, "Invalid authorization code")
+	} else if err != nil {
+		return dto.TokenResponseDTO{}, err
+	}
+
+	if authorizationCode.ClientID != client.ClientID {
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidGrant, "Invalid authorization code")
+	}
+
+	if authorizationCode.UsedAt != nil {
+		return dto.TokenResponseDTO{}, s.revokeReplayedCode(authorizationCode)
+	}
+
+	if authorizationCode.ExpiresAt.Before(time.Now()) {
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidGrant, "Authorization code expired")
+	}
+
+	if request.RedirectURI != "" && request.RedirectURI != authorizationCode.RedirectURI {
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidGrant, "redirect_uri does not match the authorization request")
+	}
+
+	// A verifier without a challenge is rejected to prevent PKCE downgrade
+	if authorizationCode.CodeChallenge != "" || request.CodeVerifier != "" {
+		if !verifyCodeChallenge(request.CodeVerifier, authorizationCode.CodeChallenge) {
+			return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidGrant, "PKCE verification failed")
+		}
+	}
+
+	// A concurrent request may have redeemed the code since it was read
+	marked, err := s.authorizationCodeRepository.MarkUsed(authorizationCode.ID, time.Now())
+	if err != nil {
+		return dto.TokenResponseDTO{}, err
+	}
+	if !marked {
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidGrant, "Invalid authorization code")
+	}
+
+	user, err := s.userRepository.GetByID(authorizationCode.TenantID, authorizationCode.UserID)
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidGrant, "Invalid authorization code")
+	} else if err != nil {
+		return dto.TokenResponseDTO{}, err
+	}
+	if !user.IsActive {
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidGrant, "Invalid authorization code")
+	}
+
+	grant := TokenGrant{
+		ClientID: client.ClientID,
+		Scope:    authorizationCode.Scope,
+		AuthTime: authorizationCode.AuthTime,
+		AMR:      authorizationCode.AMR,
+	}
+
+	rawRefreshToken, err := s.startSession(client, user, &grant)
+	if err != nil {
+		return dto.TokenResponseDTO{}, err
+	}
+
+	if err := s.authorizationCodeRepository.SetFamilyID(authorizationCode.ID, grant.SessionID); err != nil {
+		return dto.TokenResponseDTO{}, err
+	}
+
+	return s.completeTokenResponse(user, grant, authorizationCode.Nonce, dto.TokenResponseDTO{RefreshToken: rawRefreshToken})
+}
+
+// exchangeDeviceCode answers a device's poll (RFC 8628 section 3.4), issuing
+// tokens once the user has approved the request
+func (s *OAuthService) exchangeDeviceCode(client *models.Client, request dto.TokenRequestDTO) (dto.TokenResponseDTO, error) {
+	if request.DeviceCode == "" {
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidRequest, "device_code is required")
+	}
+
+	deviceCode, err := s.deviceCodeRepository.GetByDeviceCodeHash(hashSecureToken(request.DeviceCode))
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidGrant, "Invalid device code")
+	} else if err != nil {
+		return dto.TokenResponseDTO{}, err
+	}
+
+	if deviceCode.ClientID != client.ClientID {
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidGrant, "Invalid device code")
+	}
+
+	now := time.Now()
+	if deviceCode.ExpiresAt.Before(now) {
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorExpiredToken, "")
+	}
+
+	switch deviceCode.Status {
+	case config.DeviceCodeStatusPending:
+		interval := deviceCode.IntervalSeconds
+		code := config.OAuthErrorAuthorizationPending
+		if deviceCode.LastPolledAt != nil && now.Sub(*deviceCode.LastPolledAt) < time.Duration(interval)*time.Second {
+			interval += int(config.DeviceSlowDownIncrement.Seconds())
+			code = config.OAuthErrorSlowDown
+		}
+		if err := s.deviceCodeRepository.RecordPoll(deviceCode.ID, interval, now); err != nil {
+			return dto.TokenResponseDTO{}, err
+		}
+		return dto.TokenResponseDTO{}, newOAuthError(code, "")
+	case config.DeviceCodeStatusDenied:
+		if _, err := s.deviceCodeRepository.Consume(deviceCode.ID); err != nil {
+			return dto.TokenResponseDTO{}, err
+		}
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorAccessDenied, "")
+	}
+
+	// Approved codes are deleted as tokens are issued, so they work only once
+	consumed, err := s.deviceCodeRepository.Consume(deviceCode.ID)
+	if err != nil {
+		return dto.TokenResponseDTO{}, err
+	}
+	if !consumed || deviceCode.UserID == nil || deviceCode.AuthTime == nil {
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidGrant, "Invalid device code")
+	}
+
+	user, err := s.userRepository.GetByID(deviceCode.TenantID, *deviceCode.UserID)
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidGrant, "Invalid device code")
+	} else if err != nil {
+		return dto.TokenResponseDTO{}, err
+	}
+	if !user.IsActive {
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidGrant, "Invalid device code")
+	}
+
+	grant := TokenGrant{
+		ClientID: client.ClientID,
+		Scope:    deviceCode.Scope,
+		AuthTime: *deviceCode.AuthTime,
+		AMR:      deviceCode.AMR,
+	}
+
+	rawRefreshToken, err := s.startSession(client, user, &grant)
+	if err != nil {
+		return dto.TokenResponseDTO{}, err
+	}
+
+	return s.completeTokenResponse(user, grant, "", dto.TokenResponseDTO{RefreshToken: rawRefreshToken})
+}
+
+func (s *OAuthService) exchangeRefreshToken(client *models.Client, request dto.TokenRequestDTO) (dto.TokenResponseDTO, error) {
+	if request.RefreshToken == "" {
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidRequest, "refresh_token is required")
+	}
+
+	refreshToken, err := s.refreshTokenService.Consume(request.RefreshToken, client.ClientID)
+	if err == config.ErrInvalidRefreshToken || err == config.ErrRefreshTokenExpired || err == config.ErrRefreshTokenReused {
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidGrant, "Invalid refresh token")
+	} else if err != nil {
+		return dto.TokenResponseDTO{}, err
+	}
+
+	// The refresh token keeps the original grant; the access token may be narrowed
+	scope := refreshToken.Scope
+	if request.Scope != "" {
+		if !isScopeSubset(request.Scope, refreshToken.Scope) {
+			return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidScope, "Requested scope exceeds the original grant")
+		}
+		scope = normalizeScope(request.Scope)
+	}
+	if !isScopeSubset(scope, strings.Join(client.Scopes, " ")) {
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidScope, "Scope not allowed for this client")
+	}
+
+	user, err := s.userRepository.GetByID(refreshToken.TenantID, refreshToken.UserID)
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidGrant, "Invalid refresh token")
+	} else if err != nil {
+		return dto.TokenResponseDTO{}, err
+	}
+	if !user.IsActive {
+		if err := s.refreshTokenService.RevokeFamily(refreshToken.FamilyID); err != nil {
+			return dto.TokenResponseDTO{}, err
+		}
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidGrant, "Invalid refresh token")
+	}
+
+	grant := TokenGrant{
+		SessionID: refreshToken.FamilyID,
+		ClientID:  client.ClientID,
+		Scope:     refreshToken.Scope,
+		AuthTime:  refreshToken.AuthTime,
+		AMR:       refreshToken.AMR,
+	}
+	rawRefreshToken, _, err := s.refreshTokenService.Issue(user, grant)
+	if err != nil {
+		return dto.TokenResponseDTO{}, err
+	}
+
+	grant.Scope = scope
+	return s.completeTokenResponse(user, grant, "", dto.TokenResponseDTO{RefreshToken: rawRefreshToken})
+}
+
+// clientCredentialsGrant issues a token to the client acting on its own behalf
+// (RFC 6749 section 4.4). Scopes about a user cannot be requested and no
+// refresh token is issued.
+func (s *OAuthService) clientCredentialsGrant(client *models.Client, request dto.TokenRequestDTO) (dto.TokenResponseDTO, error) {
+	var scopes []string
+	if request.Scope == "" {
+		for _, scope := range client.Scopes {
+			if !containsString(supportedScopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+	} else {
+		for _, scope := range strings.Fields(request.Scope) {
+			if containsString(supportedScopes, scope) || !containsString(client.Scopes, scope) {
+				return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidScope, "Scope not allowed for this client")
+			}
+			scopes = append(scopes, scope)
+		}
+	}
+	scope := normalizeScope(strings.Join(scopes, " "))
+
+	accessToken, err := s.tokenService.IssueClientAccessToken(client, scope)
+	if err != nil {
+		return dto.TokenResponseDTO{}, err
+	}
+
+	return dto.TokenResponseDTO{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(s.tokenService.AccessTokenTTL().Seconds()),
+		Scope:       scope,
+	}, nil
+}
+
+// exchangeToken implements RFC 8693 token exchange. The client presents a
+// user's access token and receives a token for the same user restricted to
+// the audience, which must name active clients of its tenant, and to a subset
+// of the subject token's scope. The client is recorded as the actor.
+func (s *OAuthService) exchangeToken(client *models.Client, request dto.TokenRequestDTO) (dto.TokenResponseDTO, error) {
+	if request.SubjectToken == "" {
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidRequest, "subject_token is required")
+	}
+	if request.SubjectTokenType != config.TokenTypeAccessToken {
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidRequest, "subject_token_type must be "+config.TokenTypeAccessToken)
+	}
+	if request.ActorToken != "" {
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidRequest, "actor_token is not supported; the authenticated client is the actor")
+	}
+	if request.RequestedTokenType != "" && request.RequestedTokenType != config.TokenTypeAccessToken {
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidRequest, "Only access tokens can be requested")
+	}
+	if len(request.Audience) == 0 {
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidRequest, "audience is required")
+	}
+
+	subject, err := s.parseAccessToken(client, request.SubjectToken)
+	if err != nil || subject.IsClientToken() || !belongsToClientTenant(client, subject.CompanyID) {
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidGrant, "Invalid subject token")
+	}
+	revoked, err := s.revocationService.IsRevoked(subject)
+	if err != nil {
+		return dto.TokenResponseDTO{}, err
+	} else if revoked {
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidGrant, "Invalid subject token")
+	}
+
+	var audience []string
+	for _, clientID := range request.Audience {
+		if containsString(audience, clientID) {
+			continue
+		}
+		target, err := s.clientService.GetActiveClient(clientID)
+		if err == config.ErrInvalidClient || (err == nil && target.TenantID != client.TenantID) {
+			return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidTarget, "Unknown audience "+clientID)
+		} else if err != nil {
+			return dto.TokenResponseDTO{}, err
+		}
+		audience = append(audience, clientID)
+	}
+
+	// First-party login tokens carry no scope, so any scope of the client may
+	// be requested for them; otherwise the exchanged token can only narrow
+	scope := subject.Scope
+	if request.Scope != "" {
+		if subject.ClientID != "" && !isScopeSubset(request.Scope, subject.Scope) {
+			return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidScope, "Requested scope exceeds the subject token")
+		}
+		scope = normalizeScope(request.Scope)
+	}
+	if !isScopeSubset(scope, strings.Join(client.Scopes, " ")) {
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidScope, "Scope not allowed for this client")
+	}
+
+	tenantID, err := subject.TenantID()
+	if err != nil {
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidGrant, "Invalid subject token")
+	}
+	userID, err := subject.UserID()
+	if err != nil {
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidGrant, "Invalid subject token")
+	}
+	user, err := s.userRepository.GetByID(tenantID, userID)
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidGrant, "Invalid subject token")
+	} else if err != nil {
+		return dto.TokenResponseDTO{}, err
+	}
+	if !user.IsActive {
+		return dto.TokenResponseDTO{}, newOAuthError(config.OAuthErrorInvalidGrant, "Invalid subject token")
+	}
+
+	grant := TokenGrant{
+		SessionID: subject.SessionID,
+		ClientID:  client.ClientID,
+		Scope:     scope,
+		AMR:       subject.AMR,
+	}
+	if authTime, ok := subject.AuthenticatedAt(); ok {
+		grant.AuthTime = authTime
+	}
+	actor := &dto.ActorDTO{Sub: client.ClientID, Act: subject.Actor}
+	accessToken, expiresAt, err := s.tokenService.IssueDelegatedAccessToken(user, grant, audience, actor, subject.ExpiresAt.Time)
+	if err != nil {
+		return dto.TokenResponseDTO{}, err
+	}
+
+	return dto.TokenResponseDTO{
+		AccessToken:     accessToken,
+		IssuedTokenType: config.TokenTypeAccessToken,
+		TokenType:       "Bearer",
+		ExpiresIn:       int64(time.Until(expiresAt).Seconds()),
+		Scope:           scope,
+	}, nil
+}
+
+// startSession sets the session of a user grant. When offline access was
+// granted and the client may refresh, the session is a new refresh token
+// family and the raw refresh token is returned.
+func (s *OAuthService) startSession(client *models.Client, user *models.User, grant *TokenGrant) (string, error) {
+	if !hasScope(grant.Scope, config.ScopeOfflineAccess) || !clientAllowsGrantType(client, config.GrantTypeRefreshToken) {
+		grant.SessionID = uuid.New().String()
+		return "", nil
+	}
+
+	rawRefreshToken, refreshToken, err := s.refreshTokenService.Issue(user, *grant)
+	if err != nil {
+		return "", err
+	}
+	grant.SessionID = refreshToken.FamilyID
+	return rawRefreshToken, nil
+}
+
+// pendingDeviceCode returns the undecided, unexpired device authorization for
+// a user code entered by a user of the client's tenant
+func (s *OAuthService) pendingDeviceCode(userCode string, session *AccessTokenClaims) (*models.DeviceCode, error) {
+	deviceCode, err := s.deviceCodeRepository.GetByUserCode(normalizeUserCode(userCode))
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return nil, config.ErrInvalidUserCode
+	} else if err != nil {
+		return nil, err
+	}
+
+	if deviceCode.Status != config.DeviceCodeStatusPending || deviceCode.ExpiresAt.Before(time.Now()) {
+		return nil, config.ErrInvalidUserCode
+	}
+
+	tenantID, err := session.TenantID()
+	if err != nil || tenantID != deviceCode.TenantID {
+		return nil, config.ErrInvalidUserCode
+	}
+	return deviceCode, nil
+}
+
+// sessionAuthTime returns when the user of a login session authenticated.
+// Tokens from before auth_time was recorded were issued at login, so their
+// iat is the authentication time.
+func sessionAuthTime(session *AccessTokenClaims) time.Time {
+	if authTime, ok := session.AuthenticatedAt(); ok {
+		return authTime
+	}
+	if session.IssuedAt != nil {
+		return session.IssuedAt.Time
+	}
+	return time.Now()
+}
+
+// parseAccessToken verifies an access token issued for this server or, after
+// token exchange, for the calling client. Tokens for the client are only
+// accepted if token exchange issued them, so an ID token, whose audience is
+// also the client, is never taken for an access token.
+func (s *OAuthService) parseAccessToken(client *models.Client, token string) (*AccessTokenClaims, error) {
+	claims, err := s.tokenService.ParseAccessToken(token)
+	if err == nil {
+		return claims, nil
+	}
+
+	claims, err = s.tokenService.ParseAccessTokenForAudience(token, client.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Actor == nil {
+		return nil, config.ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// completeTokenResponse adds the access token, and an ID token for openid grants
+func (s *OAuthService) completeTokenResponse(user *models.User, grant TokenGrant, nonce string, response dto.TokenResponseDTO) (dto.TokenResponseDTO, error) {
+	accessToken, err := s.tokenService.IssueAccessToken(user, grant)
+	if err != nil {
+		return dto.TokenResponseDTO{}, err
+	}
+
+	response.AccessToken = accessToken
+	response.TokenType = "Bearer"
+	response.ExpiresIn = int64(s.tokenService.AccessTokenTTL().Seconds())
+	response.Scope = grant.Scope
+
+	if hasScope(grant.Scope, config.ScopeOpenID) {
+		idToken, err := s.tokenService.IssueIDToken(user, grant, nonce)
+		if err != nil {
+			return dto.TokenResponseDTO{}, err
+		}
+		response.IDToken = idToken
+	}
+	return response, nil
+}
+
+// revokeReplayedCode revokes the session issued for an authorization code
+// that is presented a second time (RFC 6749 section 4.1.2)
+func (s *OAuthService) revokeReplayedCode(authorizationCode *models.AuthorizationCode) error {
+	if authorizationCode.FamilyID != "" {
+		if err := s.refreshTokenService.RevokeFamily(authorizationCode.FamilyID); err != nil {
+			return err
+		}
+	}
+	return newOAuthError(config.OAuthErrorInvalidGrant, "Authorization code already used")
+}
+
+// resolveRedirectURI returns the registered redirect URI matching the request
+// exactly. It may be omitted when the client registered a single one.
+func resolveRedirectURI(client *models.Client, redirectURI string) (string, bool) {
+	if redirectURI == "" {
+		if len(client.RedirectURIs) == 1 {
+			return client.RedirectURIs[0], true
+		}
+		return "", false
+	}
+	for _, registered := range client.RedirectURIs {
+		if registered == redirectURI {
+			return redirectURI, true
+		}
+	}
+	return "", false
+}
+
+// verifyCodeChallenge checks a PKCE code verifier against an S256 challenge
+func verifyCodeChallenge(codeVerifier, codeChallenge string) bool {
+	if len(codeVerifier) < 43 || len(codeVerifier) > 128 || codeChallenge == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(codeVerifier))
+	return subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(codeChallenge)) == 1
+}
+
+func belongsToClientTenant(client *models.Client, companyID string) bool {
+	return companyID == strconv.FormatUint(uint64(client.TenantID), 10)
+}
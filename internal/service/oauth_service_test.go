@@ -0,0 +1,782 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/models"
+)
+
+const testRedirectURI = "https://client.example.com/callback"
+
+// registerClient registers a client for the tenant and returns it with its secret
+func (s *testServices) registerClient(t *testing.T, tenantID uint, clientDTO dto.ClientRegistrationDTO) (*models.Client, string) {
+	t.Helper()
+
+	if clientDTO.Name == "" {
+		clientDTO.Name = "Client"
+	}
+	if clientDTO.RedirectURIs == nil {
+		clientDTO.RedirectURIs = []string{testRedirectURI}
+	}
+	credentials, err := s.client.RegisterClient(tenantID, clientDTO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := s.client.GetActiveClient(credentials.ClientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, credentials.ClientSecret
+}
+
+func TestRevoke(t *testing.T) {
+	tests := []struct {
+		name string
+		// token returns the token to revoke and reports whether it is still valid
+		token       func(t *testing.T, s *testServices, client, other *models.Client, user *models.User) (string, func() bool)
+		wantRevoked bool
+	}{
+		{
+			name:        "revokes the client's own access token",
+			token:       clientAccessToken(func(client, other *models.Client) *models.Client { return client }),
+			wantRevoked: true,
+		},
+		{
+			name:  "ignores another client's access token",
+			token: clientAccessToken(func(client, other *models.Client) *models.Client { return other }),
+		},
+		{
+			name: "ignores a first-party login session",
+			token: func(t *testing.T, s *testServices, client, other *models.Client, user *models.User) (string, func() bool) {
+				accessToken := s.loginUser(t, user.Email).AccessToken
+				return accessToken, func() bool {
+					claims, err := s.token.ParseAccessToken(accessToken)
+					check(t, err)
+					revoked, err := s.revocation.IsRevoked(claims)
+					check(t, err)
+					return !revoked
+				}
+			},
+		},
+		{
+			name:        "revokes the client's own refresh token",
+			token:       clientRefreshToken(func(client, other *models.Client) *models.Client { return client }),
+			wantRevoked: true,
+		},
+		{
+			name:  "ignores another client's refresh token",
+			token: clientRefreshToken(func(client, other *models.Client) *models.Client { return other }),
+		},
+		{
+			name: "ignores an unknown token",
+			token: func(t *testing.T, s *testServices, client, other *models.Client, user *models.User) (string, func() bool) {
+				return "unknown", func() bool { return true }
+			},
+		},
+		{
+			name: "ignores an ID token issued to the client",
+			token: func(t *testing.T, s *testServices, client, other *models.Client, user *models.User) (string, func() bool) {
+				idToken, err := s.token.IssueIDToken(user, TokenGrant{ClientID: client.ClientID, Scope: config.ScopeOpenID}, "")
+				check(t, err)
+				return idToken, func() bool {
+					var revoked int64
+					check(t, s.db.Model(&models.RevokedToken{}).Count(&revoked).Error)
+					return revoked == 0
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServices(t)
+			user := s.createUser(t, "user@example.com")
+			client, _ := s.registerClient(t, user.TenantID, dto.ClientRegistrationDTO{})
+			other, _ := s.registerClient(t, user.TenantID, dto.ClientRegistrationDTO{})
+			token, valid := tt.token(t, s, client, other, user)
+
+			if err := s.oauth.Revoke(client, token, ""); err != nil {
+				t.Fatalf("Revoke() error = %v", err)
+			}
+			if revoked := !valid(); revoked != tt.wantRevoked {
+				t.Errorf("revoked = %v, want %v", revoked, tt.wantRevoked)
+			}
+		})
+	}
+}
+
+func clientAccessToken(owner func(client, other *models.Client) *models.Client) func(*testing.T, *testServices, *models.Client, *models.Client, *models.User) (string, func() bool) {
+	return func(t *testing.T, s *testServices, client, other *models.Client, _ *models.User) (string, func() bool) {
+		accessToken, err := s.token.IssueClientAccessToken(owner(client, other), "")
+		check(t, err)
+		return accessToken, func() bool {
+			response, err := s.oauth.Introspect(owner(client, other), accessToken, "")
+			check(t, err)
+			return response.Active
+		}
+	}
+}
+
+func clientRefreshToken(owner func(client, other *models.Client) *models.Client) func(*testing.T, *testServices, *models.Client, *models.Client, *models.User) (string, func() bool) {
+	return func(t *testing.T, s *testServices, client, other *models.Client, user *models.User) (string, func() bool) {
+		refreshToken, _, err := s.refreshToken.Issue(user, TokenGrant{ClientID: owner(client, other).ClientID})
+		check(t, err)
+		return refreshToken, func() bool {
+			_, err := s.refreshToken.Lookup(refreshToken)
+			return err == nil
+		}
+	}
+}
+
+func TestIntrospect(t *testing.T) {
+	tests := []struct {
+		name       string
+		token      func(t *testing.T, s *testServices, client *models.Client, user *models.User) string
+		wantActive bool
+	}{
+		{
+			name: "reports a valid token of the client's tenant",
+			token: func(t *testing.T, s *testServices, client *models.Client, user *models.User) string {
+				return s.loginUser(t, user.Email).AccessToken
+			},
+			wantActive: true,
+		},
+		{
+			name: "reports a valid refresh token of the client's tenant",
+			token: func(t *testing.T, s *testServices, client *models.Client, user *models.User) string {
+				return s.loginUser(t, user.Email).RefreshToken
+			},
+			wantActive: true,
+		},
+		{
+			name: "hides tokens of other tenants",
+			token: func(t *testing.T, s *testServices, client *models.Client, user *models.User) string {
+				s.createUser(t, "other@example.com")
+				return s.loginUser(t, "other@example.com").AccessToken
+			},
+		},
+		{
+			name: "reports a revoked token as inactive",
+			token: func(t *testing.T, s *testServices, client *models.Client, user *models.User) string {
+				accessToken := s.loginUser(t, user.Email).AccessToken
+				claims, err := s.token.ParseAccessToken(accessToken)
+				check(t, err)
+				check(t, s.login.Logout(claims))
+				return accessToken
+			},
+		},
+		{
+			name: "reports an ID token issued to the client as inactive",
+			token: func(t *testing.T, s *testServices, client *models.Client, user *models.User) string {
+				idToken, err := s.token.IssueIDToken(user, TokenGrant{ClientID: client.ClientID, Scope: config.ScopeOpenID}, "")
+				check(t, err)
+				return idToken
+			},
+		},
+		{
+			name: "reports garbage as inactive",
+			token: func(t *testing.T, s *testServices, client *models.Client, user *models.User) string {
+				return "not-a-token"
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServices(t)
+			user := s.createUser(t, "user@example.com")
+			client, _ := s.registerClient(t, user.TenantID, dto.ClientRegistrationDTO{})
+			token := tt.token(t, s, client, user)
+
+			response, err := s.oauth.Introspect(client, token, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.Active != tt.wantActive {
+				t.Errorf("Introspect() active = %v, want %v", response.Active, tt.wantActive)
+			}
+		})
+	}
+}
+
+// session returns the claims of a fresh first-party login
+func (s *testServices) session(t *testing.T, email string) *AccessTokenClaims {
+	t.Helper()
+
+	claims, err := s.token.ParseAccessToken(s.loginUser(t, email).AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return claims
+}
+
+func oauthErrorCode(err error) string {
+	var oauthErr *OAuthError
+	if errors.As(err, &oauthErr) {
+		return oauthErr.Code
+	} else if err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func TestValidateAuthorizationRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		public   bool
+		request  dto.AuthorizationRequestDTO
+		wantCode string
+	}{
+		{name: "accepts a code request", request: dto.AuthorizationRequestDTO{ResponseType: "code", Scope: "openid"}},
+		{name: "rejects another response type", request: dto.AuthorizationRequestDTO{ResponseType: "token"}, wantCode: config.OAuthErrorUnsupportedResponseType},
+		{name: "rejects a scope the client was not registered for", request: dto.AuthorizationRequestDTO{ResponseType: "code", Scope: "openid admin"}, wantCode: config.OAuthErrorInvalidScope},
+		{name: "requires PKCE from public clients", public: true, request: dto.AuthorizationRequestDTO{ResponseType: "code"}, wantCode: config.OAuthErrorInvalidRequest},
+		{name: "rejects the plain PKCE method", request: dto.AuthorizationRequestDTO{ResponseType: "code", CodeChallenge: codeChallenge("verifier"), CodeChallengeMethod: "plain"}, wantCode: config.OAuthErrorInvalidRequest},
+		{name: "rejects prompt=none with other prompts", request: dto.AuthorizationRequestDTO{ResponseType: "code", Prompt: "none login"}, wantCode: config.OAuthErrorInvalidRequest},
+		{name: "rejects a negative max_age", request: dto.AuthorizationRequestDTO{ResponseType: "code", MaxAge: "-1"}, wantCode: config.OAuthErrorInvalidRequest},
+		{name: "rejects a non-numeric max_age", request: dto.AuthorizationRequestDTO{ResponseType: "code", MaxAge: "soon"}, wantCode: config.OAuthErrorInvalidRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServices(t)
+			user := s.createUser(t, "user@example.com")
+			client, _ := s.registerClient(t, user.TenantID, dto.ClientRegistrationDTO{IsPublic: tt.public})
+			tt.request.ClientID = client.ClientID
+
+			_, redirectURI, err := s.oauth.ValidateAuthorizationRequest(tt.request)
+			if code := oauthErrorCode(err); code != tt.wantCode {
+				t.Fatalf("ValidateAuthorizationRequest() error = %v, want %q", err, tt.wantCode)
+			}
+			if redirectURI != testRedirectURI {
+				t.Errorf("redirect URI = %q, want %q", redirectURI, testRedirectURI)
+			}
+		})
+	}
+}
+
+func TestAuthorizeConsentAndLogin(t *testing.T) {
+	tests := []struct {
+		name       string
+		firstParty bool
+		consented  string
+		request    dto.AuthorizationRequestDTO
+		authAge    time.Duration
+		wantCode   string
+	}{
+		{name: "first-party clients need no consent", firstParty: true, request: dto.AuthorizationRequestDTO{Scope: "openid email"}},
+		{name: "third-party clients need consent", request: dto.AuthorizationRequestDTO{Scope: "openid"}, wantCode: config.OAuthErrorConsentRequired},
+		{name: "consented scopes are remembered", consented: "openid email", request: dto.AuthorizationRequestDTO{Scope: "openid"}},
+		{name: "new scopes need consent again", consented: "openid", request: dto.AuthorizationRequestDTO{Scope: "openid email"}, wantCode: config.OAuthErrorConsentRequired},
+		{name: "prompt=consent asks again", consented: "openid", request: dto.AuthorizationRequestDTO{Scope: "openid", Prompt: "consent"}, wantCode: config.OAuthErrorConsentRequired},
+		{name: "prompt=login requires a new login", firstParty: true, request: dto.AuthorizationRequestDTO{Prompt: "login"}, wantCode: config.OAuthErrorLoginRequired},
+		{name: "a login older than max_age requires a new login", firstParty: true, request: dto.AuthorizationRequestDTO{MaxAge: "60"}, authAge: 2 * time.Minute, wantCode: config.OAuthErrorLoginRequired},
+		{name: "a login within max_age is accepted", firstParty: true, request: dto.AuthorizationRequestDTO{MaxAge: "600"}, authAge: 2 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServices(t)
+			user := s.createUser(t, "user@example.com")
+			client, _ := s.registerClient(t, user.TenantID, dto.ClientRegistrationDTO{IsFirstParty: tt.firstParty})
+			session := s.session(t, user.Email)
+			session.AuthTime = time.Now().Add(-tt.authAge).Unix()
+
+			tt.request.ResponseType = config.ResponseTypeCode
+			tt.request.ClientID = client.ClientID
+			if tt.consented != "" {
+				check(t, s.oauth.GrantConsent(client, dto.AuthorizationRequestDTO{Scope: tt.consented}, session))
+			}
+
+			code, err := s.oauth.Authorize(client, testRedirectURI, tt.request, session)
+			if got := oauthErrorCode(err); got != tt.wantCode {
+				t.Fatalf("Authorize() error = %v, want %q", err, tt.wantCode)
+			}
+			if tt.wantCode == "" && code == "" {
+				t.Error("Authorize() returned no code")
+			}
+		})
+	}
+}
+
+func TestExchangeAuthorizationCode(t *testing.T) {
+	const verifier = "a-code-verifier-that-is-at-least-forty-three-characters-long"
+
+	tests := []struct {
+		name      string
+		challenge string
+		request   func(client *models.Client) (*models.Client, dto.TokenRequestDTO)
+		replay    bool
+		wantCode  string
+	}{
+		{
+			name:      "issues tokens for the right verifier",
+			challenge: codeChallenge(verifier),
+			request: func(client *models.Client) (*models.Client, dto.TokenRequestDTO) {
+				return client, dto.TokenRequestDTO{CodeVerifier: verifier, RedirectURI: testRedirectURI}
+			},
+		},
+		{
+			name:      "rejects a wrong verifier",
+			challenge: codeChallenge(verifier),
+			request: func(client *models.Client) (*models.Client, dto.TokenRequestDTO) {
+				return client, dto.TokenRequestDTO{CodeVerifier: verifier + "x"}
+			},
+			wantCode: config.OAuthErrorInvalidGrant,
+		},
+		{
+			name:      "rejects a missing verifier",
+			challenge: codeChallenge(verifier),
+			request: func(client *models.Client) (*models.Client, dto.TokenRequestDTO) {
+				return client, dto.TokenRequestDTO{}
+			},
+			wantCode: config.OAuthErrorInvalidGrant,
+		},
+		{
+			name: "rejects a verifier for a code issued without a challenge",
+			request: func(client *models.Client) (*models.Client, dto.TokenRequestDTO) {
+				return client, dto.TokenRequestDTO{CodeVerifier: verifier}
+			},
+			wantCode: config.OAuthErrorInvalidGrant,
+		},
+		{
+			name:      "rejects another redirect URI",
+			challenge: codeChallenge(verifier),
+			request: func(client *models.Client) (*models.Client, dto.TokenRequestDTO) {
+				return client, dto.TokenRequestDTO{CodeVerifier: verifier, RedirectURI: "https://evil.example/callback"}
+			},
+			wantCode: config.OAuthErrorInvalidGrant,
+		},
+		{
+			name:      "rejects a code issued to another client",
+			challenge: codeChallenge(verifier),
+			request: func(client *models.Client) (*models.Client, dto.TokenRequestDTO) {
+				return &models.Client{ClientID: "other", TenantID: client.TenantID, GrantTypes: client.GrantTypes}, dto.TokenRequestDTO{CodeVerifier: verifier}
+			},
+			wantCode: config.OAuthErrorInvalidGrant,
+		},
+		{
+			name:      "rejects a replayed code",
+			challenge: codeChallenge(verifier),
+			request: func(client *models.Client) (*models.Client, dto.TokenRequestDTO) {
+				return client, dto.TokenRequestDTO{CodeVerifier: verifier}
+			},
+			replay:   true,
+			wantCode: config.OAuthErrorInvalidGrant,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServices(t)
+			user := s.createUser(t, "user@example.com")
+			client, _ := s.registerClient(t, user.TenantID, dto.ClientRegistrationDTO{IsFirstParty: true})
+			code, err := s.oauth.Authorize(client, testRedirectURI, dto.AuthorizationRequestDTO{
+				ResponseType:        config.ResponseTypeCode,
+				ClientID:            client.ClientID,
+				Scope:               "openid offline_access",
+				CodeChallenge:       tt.challenge,
+				CodeChallengeMethod: config.CodeChallengeMethodS256,
+			}, s.session(t, user.Email))
+			check(t, err)
+
+			redeemingClient, request := tt.request(client)
+			request.GrantType = config.GrantTypeAuthorizationCode
+			request.Code = code
+
+			var first dto.TokenResponseDTO
+			if tt.replay {
+				first, err = s.oauth.Token(redeemingClient, request)
+				check(t, err)
+			}
+
+			response, err := s.oauth.Token(redeemingClient, request)
+			if got := oauthErrorCode(err); got != tt.wantCode {
+				t.Fatalf("Token() error = %v, want %q", err, tt.wantCode)
+			}
+			if tt.wantCode == "" && (response.AccessToken == "" || response.IDToken == "" || response.RefreshToken == "") {
+				t.Errorf("Token() = %+v, want access, ID and refresh tokens", response)
+			}
+			// Replaying a code revokes the tokens issued for it
+			if tt.replay {
+				if _, err := s.refreshToken.Lookup(first.RefreshToken); err == nil {
+					t.Error("refresh token issued for a replayed code is still valid")
+				}
+			}
+		})
+	}
+}
+
+func TestClientCredentialsGrant(t *testing.T) {
+	tests := []struct {
+		name       string
+		grantTypes []string
+		scope      string
+		wantScope  string
+		wantCode   string
+	}{
+		{name: "defaults to the client's API scopes", wantScope: "orders:read orders:write"},
+		{name: "issues a requested subset", scope: "orders:read", wantScope: "orders:read"},
+		{name: "rejects a scope about a user", scope: "openid", wantCode: config.OAuthErrorInvalidScope},
+		{name: "rejects a scope the client was not registered for", scope: "orders:delete", wantCode: config.OAuthErrorInvalidScope},
+		{name: "rejects clients not registered for the grant", grantTypes: []string{config.GrantTypeAuthorizationCode}, wantCode: config.OAuthErrorUnauthorizedClient},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServices(t)
+			user := s.createUser(t, "user@example.com")
+			if tt.grantTypes == nil {
+				tt.grantTypes = []string{config.GrantTypeClientCredentials}
+			}
+			client, _ := s.registerClient(t, user.TenantID, dto.ClientRegistrationDTO{
+				GrantTypes: tt.grantTypes,
+				Scopes:     []string{config.ScopeOpenID, "orders:read", "orders:write"},
+			})
+
+			response, err := s.oauth.Token(client, dto.TokenRequestDTO{GrantType: config.GrantTypeClientCredentials, Scope: tt.scope})
+			if got := oauthErrorCode(err); got != tt.wantCode {
+				t.Fatalf("Token() error = %v, want %q", err, tt.wantCode)
+			}
+			if err != nil {
+				return
+			}
+			if response.Scope != tt.wantScope {
+				t.Errorf("scope = %q, want %q", response.Scope, tt.wantScope)
+			}
+			if response.RefreshToken != "" || response.IDToken != "" {
+				t.Error("client credentials grant issued a refresh or ID token")
+			}
+
+			claims, err := s.token.ParseAccessToken(response.AccessToken)
+			check(t, err)
+			if !claims.IsClientToken() || claims.Subject != client.ClientID {
+				t.Errorf("subject = %q, want client token for %q", claims.Subject, client.ClientID)
+			}
+			if tenantID, _ := claims.TenantID(); tenantID != client.TenantID {
+				t.Errorf("tenant = %d, want %d", tenantID, client.TenantID)
+			}
+		})
+	}
+}
+
+func TestDeviceAuthorizationGrant(t *testing.T) {
+	const verificationURI = "https://auth.example.com/device"
+
+	tests := []struct {
+		name string
+		// decide acts on the pending request before the device polls
+		decide        func(t *testing.T, s *testServices, userCode string, session *AccessTokenClaims) error
+		wantDecideErr error
+		pollEarly     bool
+		otherClient   bool
+		wantCode      string
+	}{
+		{
+			name:     "a pending request asks the device to keep polling",
+			decide:   func(t *testing.T, s *testServices, userCode string, session *AccessTokenClaims) error { return nil },
+			wantCode: config.OAuthErrorAuthorizationPending,
+		},
+		{
+			name:      "polling too fast slows the device down",
+			decide:    func(t *testing.T, s *testServices, userCode string, session *AccessTokenClaims) error { return nil },
+			pollEarly: true,
+			wantCode:  config.OAuthErrorSlowDown,
+		},
+		{
+			name: "an approved request issues tokens",
+			decide: func(t *testing.T, s *testServices, userCode string, session *AccessTokenClaims) error {
+				return s.oauth.VerifyDeviceAuthorization(userCode, true, session)
+			},
+		},
+		{
+			name: "accepts the user code in any case and without separators",
+			decide: func(t *testing.T, s *testServices, userCode string, session *AccessTokenClaims) error {
+				return s.oauth.VerifyDeviceAuthorization(strings.ToLower(strings.ReplaceAll(userCode, "-", "")), true, session)
+			},
+		},
+		{
+			name: "a denied request is refused",
+			decide: func(t *testing.T, s *testServices, userCode string, session *AccessTokenClaims) error {
+				return s.oauth.VerifyDeviceAuthorization(userCode, false, session)
+			},
+			wantCode: config.OAuthErrorAccessDenied,
+		},
+		{
+			name: "a request can only be decided once",
+			decide: func(t *testing.T, s *testServices, userCode string, session *AccessTokenClaims) error {
+				check(t, s.oauth.VerifyDeviceAuthorization(userCode, false, session))
+				return s.oauth.VerifyDeviceAuthorization(userCode, true, session)
+			},
+			wantDecideErr: config.ErrInvalidUserCode,
+			wantCode:      config.OAuthErrorAccessDenied,
+		},
+		{
+			name: "users of another tenant cannot approve",
+			decide: func(t *testing.T, s *testServices, userCode string, session *AccessTokenClaims) error {
+				return s.oauth.VerifyDeviceAuthorization(userCode, true, s.session(t, s.createUser(t, "other@example.com").Email))
+			},
+			wantDecideErr: config.ErrInvalidUserCode,
+			wantCode:      config.OAuthErrorAuthorizationPending,
+		},
+		{
+			name: "an expired request cannot be approved or redeemed",
+			decide: func(t *testing.T, s *testServices, userCode string, session *AccessTokenClaims) error {
+				check(t, s.db.Model(&models.DeviceCode{}).Where("1 = 1").Update("expires_at", time.Now().Add(-time.Minute)).Error)
+				return s.oauth.VerifyDeviceAuthorization(userCode, true, session)
+			},
+			wantDecideErr: config.ErrInvalidUserCode,
+			wantCode:      config.OAuthErrorExpiredToken,
+		},
+		{
+			name: "another client cannot redeem the device code",
+			decide: func(t *testing.T, s *testServices, userCode string, session *AccessTokenClaims) error {
+				return s.oauth.VerifyDeviceAuthorization(userCode, true, session)
+			},
+			otherClient: true,
+			wantCode:    config.OAuthErrorInvalidGrant,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServices(t)
+			user := s.createUser(t, "user@example.com")
+			registration := dto.ClientRegistrationDTO{GrantTypes: []string{config.GrantTypeDeviceCode}, IsPublic: true}
+			client, _ := s.registerClient(t, user.TenantID, registration)
+
+			start, err := s.oauth.StartDeviceAuthorization(client, "openid", verificationURI)
+			check(t, err)
+			request := dto.TokenRequestDTO{GrantType: config.GrantTypeDeviceCode, DeviceCode: start.DeviceCode}
+			if tt.pollEarly {
+				s.oauth.Token(client, request)
+			}
+
+			if err := tt.decide(t, s, start.UserCode, s.session(t, user.Email)); !errors.Is(err, tt.wantDecideErr) {
+				t.Fatalf("decide error = %v, want %v", err, tt.wantDecideErr)
+			}
+
+			pollingClient := client
+			if tt.otherClient {
+				pollingClient, _ = s.registerClient(t, user.TenantID, registration)
+			}
+			response, err := s.oauth.Token(pollingClient, request)
+			if got := oauthErrorCode(err); got != tt.wantCode {
+				t.Fatalf("Token() error = %v, want %q", err, tt.wantCode)
+			}
+			if err != nil {
+				return
+			}
+			if response.AccessToken == "" || response.IDToken == "" {
+				t.Errorf("Token() = %+v, want access and ID tokens", response)
+			}
+			// The device code works only once
+			if _, err := s.oauth.Token(client, request); oauthErrorCode(err) != config.OAuthErrorInvalidGrant {
+				t.Errorf("second Token() error = %v, want %q", err, config.OAuthErrorInvalidGrant)
+			}
+		})
+	}
+
+	t.Run("rejects clients not registered for the grant", func(t *testing.T) {
+		s := newTestServices(t)
+		user := s.createUser(t, "user@example.com")
+		client, _ := s.registerClient(t, user.TenantID, dto.ClientRegistrationDTO{})
+
+		_, err := s.oauth.StartDeviceAuthorization(client, "openid", verificationURI)
+		if got := oauthErrorCode(err); got != config.OAuthErrorUnauthorizedClient {
+			t.Errorf("StartDeviceAuthorization() error = %v, want %q", err, config.OAuthErrorUnauthorizedClient)
+		}
+	})
+}
+
+// exchangeClients are the clients taking part in a token exchange test: the
+// service exchanging tokens, the API it calls and a client of another tenant
+type exchangeClients struct {
+	service, api, foreign *models.Client
+}
+
+func TestExchangeToken(t *testing.T) {
+	tests := []struct {
+		name string
+		// request builds the exchange request for the user's login token
+		request   func(t *testing.T, s *testServices, c exchangeClients, loginToken string) dto.TokenRequestDTO
+		wantCode  string
+		wantActor []string
+	}{
+		{
+			name: "delegates a login token to the audience",
+			request: func(t *testing.T, s *testServices, c exchangeClients, loginToken string) dto.TokenRequestDTO {
+				return exchangeRequest(loginToken, c.api.ClientID)
+			},
+			wantActor: []string{"service"},
+		},
+		{
+			name: "nests the actors of a delegation chain",
+			request: func(t *testing.T, s *testServices, c exchangeClients, loginToken string) dto.TokenRequestDTO {
+				// The API exchanges the token it was given for one to the service
+				response, err := s.oauth.Token(c.api, exchangeRequest(loginToken, c.service.ClientID))
+				check(t, err)
+				return exchangeRequest(response.AccessToken, c.api.ClientID)
+			},
+			wantActor: []string{"service", "api"},
+		},
+		{
+			name: "requires an audience",
+			request: func(t *testing.T, s *testServices, c exchangeClients, loginToken string) dto.TokenRequestDTO {
+				return exchangeRequest(loginToken)
+			},
+			wantCode: config.OAuthErrorInvalidRequest,
+		},
+		{
+			name: "rejects another subject token type",
+			request: func(t *testing.T, s *testServices, c exchangeClients, loginToken string) dto.TokenRequestDTO {
+				request := exchangeRequest(loginToken, c.api.ClientID)
+				request.SubjectTokenType = "urn:ietf:params:oauth:token-type:id_token"
+				return request
+			},
+			wantCode: config.OAuthErrorInvalidRequest,
+		},
+		{
+			name: "rejects an actor token",
+			request: func(t *testing.T, s *testServices, c exchangeClients, loginToken string) dto.TokenRequestDTO {
+				request := exchangeRequest(loginToken, c.api.ClientID)
+				request.ActorToken = loginToken
+				return request
+			},
+			wantCode: config.OAuthErrorInvalidRequest,
+		},
+		{
+			name: "rejects an unknown audience",
+			request: func(t *testing.T, s *testServices, c exchangeClients, loginToken string) dto.TokenRequestDTO {
+				return exchangeRequest(loginToken, "unknown")
+			},
+			wantCode: config.OAuthErrorInvalidTarget,
+		},
+		{
+			name: "rejects an audience in another tenant",
+			request: func(t *testing.T, s *testServices, c exchangeClients, loginToken string) dto.TokenRequestDTO {
+				return exchangeRequest(loginToken, c.foreign.ClientID)
+			},
+			wantCode: config.OAuthErrorInvalidTarget,
+		},
+		{
+			name: "rejects a client token as the subject",
+			request: func(t *testing.T, s *testServices, c exchangeClients, loginToken string) dto.TokenRequestDTO {
+				clientToken, err := s.token.IssueClientAccessToken(c.api, "")
+				check(t, err)
+				return exchangeRequest(clientToken, c.api.ClientID)
+			},
+			wantCode: config.OAuthErrorInvalidGrant,
+		},
+		{
+			name: "rejects an ID token issued to the client as the subject",
+			request: func(t *testing.T, s *testServices, c exchangeClients, loginToken string) dto.TokenRequestDTO {
+				var user models.User
+				check(t, s.db.First(&user, "email = ?", "user@example.com").Error)
+				idToken, err := s.token.IssueIDToken(&user, TokenGrant{ClientID: c.service.ClientID, Scope: config.ScopeOpenID}, "")
+				check(t, err)
+				return exchangeRequest(idToken, c.api.ClientID)
+			},
+			wantCode: config.OAuthErrorInvalidGrant,
+		},
+		{
+			name: "rejects a revoked subject token",
+			request: func(t *testing.T, s *testServices, c exchangeClients, loginToken string) dto.TokenRequestDTO {
+				claims, err := s.token.ParseAccessToken(loginToken)
+				check(t, err)
+				check(t, s.login.Logout(claims))
+				return exchangeRequest(loginToken, c.api.ClientID)
+			},
+			wantCode: config.OAuthErrorInvalidGrant,
+		},
+		{
+			name: "rejects a scope the client was not registered for",
+			request: func(t *testing.T, s *testServices, c exchangeClients, loginToken string) dto.TokenRequestDTO {
+				request := exchangeRequest(loginToken, c.api.ClientID)
+				request.Scope = "openid email"
+				return request
+			},
+			wantCode: config.OAuthErrorInvalidScope,
+		},
+		{
+			name: "rejects widening the scope of a delegated token",
+			request: func(t *testing.T, s *testServices, c exchangeClients, loginToken string) dto.TokenRequestDTO {
+				narrowed := exchangeRequest(loginToken, c.service.ClientID)
+				narrowed.Scope = "openid"
+				response, err := s.oauth.Token(c.api, narrowed)
+				check(t, err)
+
+				request := exchangeRequest(response.AccessToken, c.api.ClientID)
+				request.Scope = "openid profile"
+				return request
+			},
+			wantCode: config.OAuthErrorInvalidScope,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServices(t)
+			user := s.createUser(t, "user@example.com")
+			other := s.createUser(t, "other@example.com")
+			registration := func(name string) dto.ClientRegistrationDTO {
+				return dto.ClientRegistrationDTO{
+					Name:       name,
+					GrantTypes: []string{config.GrantTypeTokenExchange},
+					Scopes:     []string{config.ScopeOpenID, config.ScopeProfile},
+				}
+			}
+			var c exchangeClients
+			c.service, _ = s.registerClient(t, user.TenantID, registration("service"))
+			c.api, _ = s.registerClient(t, user.TenantID, registration("api"))
+			c.foreign, _ = s.registerClient(t, other.TenantID, registration("foreign"))
+			names := map[string]string{c.service.ClientID: "service", c.api.ClientID: "api"}
+
+			request := tt.request(t, s, c, s.loginUser(t, user.Email).AccessToken)
+			response, err := s.oauth.Token(c.service, request)
+			if got := oauthErrorCode(err); got != tt.wantCode {
+				t.Fatalf("Token() error = %v, want %q", err, tt.wantCode)
+			}
+			if err != nil {
+				return
+			}
+			if response.IssuedTokenType != config.TokenTypeAccessToken || response.RefreshToken != "" {
+				t.Errorf("Token() = %+v, want a single access token", response)
+			}
+
+			claims, err := s.token.ParseAccessTokenForAudience(response.AccessToken, c.api.ClientID)
+			check(t, err)
+			if userID, _ := claims.UserID(); userID != user.ID {
+				t.Errorf("subject = %q, want user %d", claims.Subject, user.ID)
+			}
+			var actors []string
+			for actor := claims.Actor; actor != nil; actor = actor.Act {
+				actors = append(actors, names[actor.Sub])
+			}
+			if strings.Join(actors, " ") != strings.Join(tt.wantActor, " ") {
+				t.Errorf("actors = %v, want %v", actors, tt.wantActor)
+			}
+		})
+	}
+}
+
+func exchangeRequest(subjectToken string, audience ...string) dto.TokenRequestDTO {
+	return dto.TokenRequestDTO{
+		GrantType:        config.GrantTypeTokenExchange,
+		SubjectToken:     subjectToken,
+		SubjectTokenType: config.TokenTypeAccessToken,
+		Audience:         audience,
+	}
+}
@@ -0,0 +1,172 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/geekible-ltd/auth-server/hasher"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"github.com/geekible-ltd/auth-server/internal/repository"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// pepperPrefix starts the hashes of peppered passwords, followed by the pepper
+// version and the hasher's own hash string: "$pepper$v=2$argon2id$v=19$..."
+const pepperPrefix = "$pepper$v="
+
+// PasswordHashService hashes new passwords with the configured hasher and
+// verifies stored hashes in any supported format, so the hasher can be
+// changed without invalidating existing passwords. With a pepper configured,
+// passwords are HMACed with a secret key kept outside the database before
+// hashing, so a leaked database alone is not enough to crack them.
+type PasswordHashService struct {
+	userRepository *repository.UserRepository
+	hasher         hasher.Hasher
+	verifiers      []hasher.Verifier
+	pepperVersion  int
+	peppers        map[int][]byte
+	pepperErr      error
+	dummyHash      string
+}
+
+// NewPasswordHashService returns an error for an invalid pepper configuration.
+// The service still verifies passwords then, but refuses to hash new ones
+// rather than store them unpeppered.
+func NewPasswordHashService(userRepository *repository.UserRepository, passwordHasher hasher.Hasher, pepperVersion int, peppers map[int][]byte) (*PasswordHashService, error) {
+	s := &PasswordHashService{
+		userRepository: userRepository,
+		hasher:         passwordHasher,
+		pepperVersion:  pepperVersion,
+		peppers:        peppers,
+		// Hashes made by the built-in hashers with any parameters, and
+		// those imported from other identity providers
+		verifiers: []hasher.Verifier{
+			hasher.NewBcryptHasher(bcrypt.DefaultCost),
+			hasher.NewArgon2idHasher(hasher.DefaultArgon2idMemory, hasher.DefaultArgon2idIterations, hasher.DefaultArgon2idParallelism),
+			hasher.NewScryptHasher(hasher.DefaultScryptLogN, hasher.DefaultScryptR, hasher.DefaultScryptP),
+			hasher.Argon2iVerifier{},
+			hasher.PBKDF2SHA256Verifier{},
+			hasher.SaltedSHA512Verifier{},
+		},
+	}
+	// Peppering costs next to nothing beside the hash, so the dummy hash
+	// works without a valid pepper
+	if dummyPassword, err := generateSecureToken(); err == nil {
+		s.dummyHash, _ = passwordHasher.Hash(dummyPassword)
+	}
+	s.pepperErr = validatePeppers(pepperVersion, peppers)
+	return s, s.pepperErr
+}
+
+// Hash hashes a new password with the configured hasher, peppered with the
+// current pepper if one is configured
+func (s *PasswordHashService) Hash(password string) (string, error) {
+	if s.pepperErr != nil {
+		return "", s.pepperErr
+	}
+	if s.pepperVersion == 0 {
+		return s.hasher.Hash(password)
+	}
+
+	hash, err := s.hasher.Hash(pepperPassword(password, s.peppers[s.pepperVersion]))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%d%s", pepperPrefix, s.pepperVersion, hash), nil
+}
+
+// Verify reports whether password matches hash, and whether a matching hash
+// should be replaced because it was made with another algorithm, other
+// parameters than the configured hasher's or another pepper than the current
+// one. Hashes in an unknown format, that cannot be parsed or whose pepper is
+// no longer configured never match.
+func (s *PasswordHashService) Verify(password, hash string) (match bool, needsRehash bool) {
+	version := 0
+	if strings.HasPrefix(hash, pepperPrefix) {
+		versionString, innerHash, _ := strings.Cut(strings.TrimPrefix(hash, pepperPrefix), "$")
+		version, _ = strconv.Atoi(versionString)
+		pepper, ok := s.peppers[version]
+		if !ok || version < 1 {
+			return false, false
+		}
+		password = pepperPassword(password, pepper)
+		hash = "$" + innerHash
+	}
+
+	match, needsRehash = s.verifyHash(password, hash)
+	if s.pepperErr != nil {
+		// Rehashing would fail, and must not stop users logging in
+		return match, false
+	}
+	return match, needsRehash || (match && version != s.pepperVersion)
+}
+
+// VerifyDummy checks password against a throwaway hash made by the configured
+// hasher and discards the result. Requests for unknown or locked out users
+// call it so they take as long as a real password check and do not reveal
+// which emails have accounts.
+func (s *PasswordHashService) VerifyDummy(password string) {
+	s.verifyHash(password, s.dummyHash)
+}
+
+func (s *PasswordHashService) verifyHash(password, hash string) (match bool, needsRehash bool) {
+	if s.hasher.Handles(hash) {
+		match, err := s.hasher.Verify(password, hash)
+		return match && err == nil, match && err == nil && s.hasher.NeedsRehash(hash)
+	}
+	for _, verifier := range s.verifiers {
+		if verifier.Handles(hash) {
+			match, err := verifier.Verify(password, hash)
+			return match && err == nil, match && err == nil
+		}
+	}
+	return false, false
+}
+
+// Rehash replaces the user's password hash with one made by the configured
+// hasher, after the password was verified against an outdated hash. It does
+// not count as a password change. A concurrent change of the password wins.
+func (s *PasswordHashService) Rehash(user *models.User, password string) error {
+	passwordHash, err := s.Hash(password)
+	if err != nil {
+		return config.ErrFailedToHashPassword
+	}
+
+	updated, err := s.userRepository.UpdatePasswordHash(user.ID, user.PasswordHash, passwordHash)
+	if err != nil {
+		return err
+	} else if updated {
+		user.PasswordHash = passwordHash
+	}
+	return nil
+}
+
+// pepperPassword HMACs the password with a pepper key. The MAC is encoded so
+// hashers that stop at a NUL byte or limit the length, like bcrypt, see all of it.
+func pepperPassword(password string, pepper []byte) string {
+	mac := hmac.New(sha256.New, pepper)
+	mac.Write([]byte(password))
+	return base64.RawStdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// validatePeppers checks that the current pepper version, if any, has a key
+// and that every key is long enough
+func validatePeppers(pepperVersion int, peppers map[int][]byte) error {
+	if pepperVersion == 0 && len(peppers) == 0 {
+		return nil
+	}
+	if _, ok := peppers[pepperVersion]; !ok || pepperVersion < 1 {
+		return config.ErrInvalidPasswordPepper
+	}
+	for version, pepper := range peppers {
+		if version < 1 || len(pepper) < config.MinPasswordPepperLength {
+			return config.ErrInvalidPasswordPepper
+		}
+	}
+	return nil
+}
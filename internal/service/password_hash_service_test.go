@@ -0,0 +1,213 @@
+package service
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/hasher"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"github.com/geekible-ltd/auth-server/internal/repository"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestRehashOnLogin(t *testing.T) {
+	// The test services hash with bcrypt at its minimum cost
+	tests := []struct {
+		name       string
+		hasher     hasher.Hasher
+		password   string
+		wantErr    error
+		wantRehash bool
+	}{
+		{name: "keeps a current hash", hasher: hasher.NewBcryptHasher(bcrypt.MinCost), password: testPassword},
+		{name: "rehashes a bcrypt hash of another cost", hasher: hasher.NewBcryptHasher(bcrypt.MinCost + 1), password: testPassword, wantRehash: true},
+		{name: "rehashes an argon2id hash", hasher: hasher.NewArgon2idHasher(64, 1, 1), password: testPassword, wantRehash: true},
+		{name: "rehashes a scrypt hash", hasher: hasher.NewScryptHasher(4, 8, 1), password: testPassword, wantRehash: true},
+		{name: "keeps an outdated hash after a wrong password", hasher: hasher.NewArgon2idHasher(64, 1, 1), password: "wrong-password", wantErr: config.ErrInvalidPassword},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServices(t)
+			user := s.createUser(t, "user@example.com")
+			oldHash, err := tt.hasher.Hash(testPassword)
+			check(t, err)
+			check(t, s.db.Model(user).Update("password_hash", oldHash).Error)
+			var before models.User
+			check(t, s.db.First(&before, user.ID).Error)
+
+			_, err = s.login.Login(dto.LoginDTO{Email: user.Email, Password: tt.password}, "127.0.0.1")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Login() error = %v, want %v", err, tt.wantErr)
+			}
+
+			var got models.User
+			check(t, s.db.First(&got, user.ID).Error)
+			if rehashed := got.PasswordHash != oldHash; rehashed != tt.wantRehash {
+				t.Fatalf("rehashed = %v, want %v", rehashed, tt.wantRehash)
+			}
+			if match, needsRehash := s.passwordHash.Verify(testPassword, got.PasswordHash); tt.wantRehash && (!match || needsRehash) {
+				t.Errorf("Verify() of the new hash = %v, %v, want a current match", match, needsRehash)
+			}
+			// Rehashing is not a password change
+			if !got.PasswordChangedAt.Equal(*before.PasswordChangedAt) {
+				t.Errorf("PasswordChangedAt = %v, want %v", got.PasswordChangedAt, before.PasswordChangedAt)
+			}
+		})
+	}
+}
+
+func TestPepperRollover(t *testing.T) {
+	pepper1 := []byte(strings.Repeat("1", config.MinPasswordPepperLength))
+	pepper2 := []byte(strings.Repeat("2", config.MinPasswordPepperLength))
+	// hashWith returns testPassword hashed with the given pepper configuration
+	hashWith := func(t *testing.T, version int, peppers map[int][]byte) string {
+		t.Helper()
+
+		service, err := NewPasswordHashService(nil, hasher.NewBcryptHasher(bcrypt.MinCost), version, peppers)
+		check(t, err)
+		hash, err := service.Hash(testPassword)
+		check(t, err)
+		return hash
+	}
+
+	tests := []struct {
+		name string
+		// hash returns the stored hash, checked by a service whose current
+		// pepper is version 2 of pepper1 and pepper2
+		hash            func(t *testing.T) string
+		password        string
+		wantMatch       bool
+		wantNeedsRehash bool
+	}{
+		{
+			name:      "matches a hash with the current pepper",
+			hash:      func(t *testing.T) string { return hashWith(t, 2, map[int][]byte{2: pepper2}) },
+			password:  testPassword,
+			wantMatch: true,
+		},
+		{
+			name:            "re-peppers a hash with an earlier pepper",
+			hash:            func(t *testing.T) string { return hashWith(t, 1, map[int][]byte{1: pepper1}) },
+			password:        testPassword,
+			wantMatch:       true,
+			wantNeedsRehash: true,
+		},
+		{
+			name:            "peppers an unpeppered hash",
+			hash:            func(t *testing.T) string { return hashWith(t, 0, nil) },
+			password:        testPassword,
+			wantMatch:       true,
+			wantNeedsRehash: true,
+		},
+		{
+			name:     "rejects a wrong password",
+			hash:     func(t *testing.T) string { return hashWith(t, 1, map[int][]byte{1: pepper1}) },
+			password: "wrong-password",
+		},
+		{
+			name:     "rejects a hash whose pepper is not configured",
+			hash:     func(t *testing.T) string { return hashWith(t, 3, map[int][]byte{3: pepper1}) },
+			password: testPassword,
+		},
+		{
+			name:     "rejects a hash with another key under the same version",
+			hash:     func(t *testing.T) string { return hashWith(t, 2, map[int][]byte{2: pepper1}) },
+			password: testPassword,
+		},
+		{
+			name: "rejects a malformed pepper version",
+			hash: func(t *testing.T) string {
+				return strings.Replace(hashWith(t, 2, map[int][]byte{2: pepper2}), "v=2", "v=x", 1)
+			},
+			password: testPassword,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, err := NewPasswordHashService(nil, hasher.NewBcryptHasher(bcrypt.MinCost), 2, map[int][]byte{1: pepper1, 2: pepper2})
+			check(t, err)
+
+			match, needsRehash := service.Verify(tt.password, tt.hash(t))
+			if match != tt.wantMatch || needsRehash != tt.wantNeedsRehash {
+				t.Errorf("Verify() = %v, %v, want %v, %v", match, needsRehash, tt.wantMatch, tt.wantNeedsRehash)
+			}
+		})
+	}
+}
+
+func TestRehashWithCurrentPepper(t *testing.T) {
+	db := newTestDB(t)
+	user := createTestUser(t, db, "user@example.com")
+	unpeppered, err := NewPasswordHashService(nil, hasher.NewBcryptHasher(bcrypt.MinCost), 0, nil)
+	check(t, err)
+	user.PasswordHash, err = unpeppered.Hash(testPassword)
+	check(t, err)
+	check(t, db.Save(user).Error)
+	pepper := []byte(strings.Repeat("p", config.MinPasswordPepperLength))
+	peppered, err := NewPasswordHashService(repository.NewUserRepository(db), hasher.NewBcryptHasher(bcrypt.MinCost), 1, map[int][]byte{1: pepper})
+	check(t, err)
+
+	if match, needsRehash := peppered.Verify(testPassword, user.PasswordHash); !match || !needsRehash {
+		t.Fatalf("Verify() of an unpeppered hash = %v, %v, want a match that needs a rehash", match, needsRehash)
+	}
+	check(t, peppered.Rehash(user, testPassword))
+
+	var got models.User
+	check(t, db.First(&got, user.ID).Error)
+	if !strings.HasPrefix(got.PasswordHash, pepperPrefix+"1$") {
+		t.Errorf("stored hash = %q, want one peppered with version 1", got.PasswordHash)
+	}
+	if match, needsRehash := peppered.Verify(testPassword, got.PasswordHash); !match || needsRehash {
+		t.Errorf("Verify() of the rehashed password = %v, %v, want a current match", match, needsRehash)
+	}
+	// The pepper is needed to check the password
+	if match, _ := unpeppered.Verify(testPassword, got.PasswordHash); match {
+		t.Error("Verify() without the pepper matched")
+	}
+}
+
+func TestPepperConfiguration(t *testing.T) {
+	key := []byte(strings.Repeat("k", config.MinPasswordPepperLength))
+
+	tests := []struct {
+		name    string
+		version int
+		peppers map[int][]byte
+		wantErr error
+	}{
+		{name: "accepts no pepper"},
+		{name: "accepts a current pepper and an earlier one", version: 2, peppers: map[int][]byte{1: key, 2: key}},
+		{name: "rejects a current version without a key", version: 2, peppers: map[int][]byte{1: key}, wantErr: config.ErrInvalidPasswordPepper},
+		{name: "rejects keys without a current version", peppers: map[int][]byte{1: key}, wantErr: config.ErrInvalidPasswordPepper},
+		{name: "rejects a short key", version: 1, peppers: map[int][]byte{1: key[1:]}, wantErr: config.ErrInvalidPasswordPepper},
+		{name: "rejects a short earlier key", version: 2, peppers: map[int][]byte{1: key[1:], 2: key}, wantErr: config.ErrInvalidPasswordPepper},
+		{name: "rejects a negative version", version: 1, peppers: map[int][]byte{-1: key, 1: key}, wantErr: config.ErrInvalidPasswordPepper},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, err := NewPasswordHashService(nil, hasher.NewBcryptHasher(bcrypt.MinCost), tt.version, tt.peppers)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("NewPasswordHashService() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil {
+				return
+			}
+
+			// An invalid pepper stops new hashes being stored unpeppered, but
+			// users can still log in with their existing ones
+			if _, err := service.Hash(testPassword); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Hash() error = %v, want %v", err, tt.wantErr)
+			}
+			hash, _ := hasher.NewBcryptHasher(bcrypt.MinCost + 1).Hash(testPassword)
+			if match, needsRehash := service.Verify(testPassword, hash); !match || needsRehash {
+				t.Errorf("Verify() = %v, %v, want a match without a rehash", match, needsRehash)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/geekible-ltd/auth-server/breached"
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"github.com/geekible-ltd/auth-server/internal/repository"
+)
+
+// minPersonalInfoLength stops short names like "Al" from ruling out most passwords
+const minPersonalInfoLength = 3
+
+// PasswordPolicyError lists every way a password fails the password policy
+type PasswordPolicyError struct {
+	Violations []dto.PasswordViolationDTO
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return config.ErrPasswordPolicyViolation.Error()
+}
+
+func (e *PasswordPolicyError) Unwrap() error {
+	return config.ErrPasswordPolicyViolation
+}
+
+type PasswordPolicyService struct {
+	passwordHistoryRepository *repository.PasswordHistoryRepository
+	tenantSettingsService     *TenantSettingsService
+	passwordHashService       *PasswordHashService
+	breachedPasswordChecker   breached.Checker
+}
+
+func NewPasswordPolicyService(passwordHistoryRepository *repository.PasswordHistoryRepository, tenantSettingsService *TenantSettingsService, passwordHashService *PasswordHashService, breachedPasswordChecker breached.Checker) *PasswordPolicyService {
+	return &PasswordPolicyService{
+		passwordHistoryRepository: passwordHistoryRepository,
+		tenantSettingsService:     tenantSettingsService,
+		passwordHashService:       passwordHashService,
+		breachedPasswordChecker:   breachedPasswordChecker,
+	}
+}
+
+// Validate checks a new password for the user against their tenant's policy,
+// or the server's default for a tenant that is still being registered
+// (TenantID 0), and against known breaches when a checker is configured. It
+// returns a *PasswordPolicyError listing every violation.
+func (s *PasswordPolicyService) Validate(user *models.User, password string) error {
+	policy, err := s.policy(user.TenantID)
+	if err != nil {
+		return err
+	}
+
+	violations := checkPasswordPolicy(policy, user, password)
+	if user.ID != 0 && policy.HistoryDepth > 0 {
+		reused, err := s.reused(user, password, policy.HistoryDepth)
+		if err != nil {
+			return err
+		} else if reused {
+			violations = append(violations, violation(config.PasswordViolationReused, "must not match any of your last %d passwords", policy.HistoryDepth))
+		}
+	}
+	if s.breachedPasswordChecker != nil {
+		isBreached, err := s.breachedPasswordChecker.IsBreached(password)
+		if err != nil {
+			return err
+		} else if isBreached {
+			violations = append(violations, violation(config.PasswordViolationBreached, "has appeared in a known data breach and must not be used"))
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// RecordChange stores the password hash the user is replacing so it cannot be
+// reused, keeping as many as the tenant's history depth requires
+func (s *PasswordPolicyService) RecordChange(user *models.User, previousHash string) error {
+	policy, err := s.policy(user.TenantID)
+	if err != nil {
+		return err
+	}
+
+	// The current password is checked separately, so the history holds one fewer
+	keep := policy.HistoryDepth - 1
+	if keep > 0 && previousHash != "" {
+		if err := s.passwordHistoryRepository.Create(&models.PasswordHistory{
+			UserID:       user.ID,
+			PasswordHash: previousHash,
+			CreatedAt:    time.Now(),
+		}); err != nil {
+			return err
+		}
+	}
+	if keep < 0 {
+		keep = 0
+	}
+	return s.passwordHistoryRepository.Prune(user.ID, keep)
+}
+
+// Expired reports whether the user's password is older than their tenant's
+// maximum password age
+func (s *PasswordPolicyService) Expired(user *models.User) (bool, error) {
+	policy, err := s.policy(user.TenantID)
+	if err != nil {
+		return false, err
+	}
+	if policy.MaxAgeDays <= 0 {
+		return false, nil
+	}
+
+	changedAt := user.CreatedAt
+	if user.PasswordChangedAt != nil {
+		changedAt = *user.PasswordChangedAt
+	}
+	return time.Since(changedAt) > time.Duration(policy.MaxAgeDays)*24*time.Hour, nil
+}
+
+func (s *PasswordPolicyService) policy(tenantID uint) (dto.PasswordPolicyDTO, error) {
+	if tenantID == 0 {
+		return s.tenantSettingsService.DefaultPasswordPolicy(), nil
+	}
+	return s.tenantSettingsService.GetPasswordPolicy(tenantID)
+}
+
+// reused reports whether the password matches the user's current password or
+// one of the depth-1 passwords before it
+func (s *PasswordPolicyService) reused(user *models.User, password string, depth int) (bool, error) {
+	hashes := []string{}
+	if user.PasswordHash != "" {
+		hashes = append(hashes, user.PasswordHash)
+	}
+	if depth > 1 {
+		passwordHistory, err := s.passwordHistoryRepository.GetRecent(user.ID, depth-1)
+		if err != nil {
+			return false, err
+		}
+		for _, entry := range passwordHistory {
+			hashes = append(hashes, entry.PasswordHash)
+		}
+	}
+
+	for _, hash := range hashes {
+		if match, _ := s.passwordHashService.Verify(password, hash); match {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkPasswordPolicy applies the checks that need nothing but the password
+// and the user's profile
+func checkPasswordPolicy(policy dto.PasswordPolicyDTO, user *models.User, password string) []dto.PasswordViolationDTO {
+	violations := []dto.PasswordViolationDTO{}
+
+	length := utf8.RuneCountInString(password)
+	if length < policy.MinLength {
+		violations = append(violations, violation(config.PasswordViolationTooShort, "must be at least %d characters", policy.MinLength))
+	}
+	if policy.MaxLength > 0 && length > policy.MaxLength {
+		violations = append(violations, violation(config.PasswordViolationTooLong, "must be at most %d characters", policy.MaxLength))
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			hasSymbol = true
+		}
+	}
+	if policy.RequireUppercase && !hasUpper {
+		violations = append(violations, violation(config.PasswordViolationMissingUppercase, "must contain an uppercase letter"))
+	}
+	if policy.RequireLowercase && !hasLower {
+		violations = append(violations, violation(config.PasswordViolationMissingLowercase, "must contain a lowercase letter"))
+	}
+	if policy.RequireDigit && !hasDigit {
+		violations = append(violations, violation(config.PasswordViolationMissingDigit, "must contain a digit"))
+	}
+	if policy.RequireSymbol && !hasSymbol {
+		violations = append(violations, violation(config.PasswordViolationMissingSymbol, "must contain a symbol"))
+	}
+
+	if policy.DisallowPersonalInfo {
+		lowerPassword := strings.ToLower(password)
+		localPart, _, _ := strings.Cut(strings.ToLower(user.Email), "@")
+		if containsPersonalInfo(lowerPassword, localPart) {
+			violations = append(violations, violation(config.PasswordViolationContainsEmail, "must not contain your email address"))
+		}
+		if containsPersonalInfo(lowerPassword, strings.ToLower(user.FirstName)) || containsPersonalInfo(lowerPassword, strings.ToLower(user.LastName)) {
+			violations = append(violations, violation(config.PasswordViolationContainsName, "must not contain your name"))
+		}
+	}
+
+	return violations
+}
+
+func containsPersonalInfo(password, value string) bool {
+	value = strings.TrimSpace(value)
+	return utf8.RuneCountInString(value) >= minPersonalInfoLength && strings.Contains(password, value)
+}
+
+func violation(code, format string, args ...interface{}) dto.PasswordViolationDTO {
+	return dto.PasswordViolationDTO{
+		Code:    code,
+		Message: "Password " + fmt.Sprintf(format, args...),
+	}
+}
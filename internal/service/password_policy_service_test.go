@@ -0,0 +1,198 @@
+package service
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/geekible-ltd/auth-server/breached"
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"github.com/geekible-ltd/auth-server/internal/repository"
+)
+
+func TestCheckPasswordPolicy(t *testing.T) {
+	strict := dto.PasswordPolicyDTO{
+		MinLength:            8,
+		MaxLength:            16,
+		RequireUppercase:     true,
+		RequireLowercase:     true,
+		RequireDigit:         true,
+		RequireSymbol:        true,
+		DisallowPersonalInfo: true,
+	}
+
+	tests := []struct {
+		name      string
+		policy    dto.PasswordPolicyDTO
+		firstName string
+		password  string
+		wantCodes []string
+	}{
+		{name: "accepts a compliant password", policy: strict, password: "Correct-Horse-7"},
+		{name: "counts characters rather than bytes", policy: dto.PasswordPolicyDTO{MinLength: 4, MaxLength: 4}, password: "ñøüé"},
+		{name: "rejects a short password", policy: strict, password: "Ab-1", wantCodes: []string{config.PasswordViolationTooShort}},
+		{name: "rejects a long password", policy: strict, password: "Correct-Horse-Battery-7", wantCodes: []string{config.PasswordViolationTooLong}},
+		{name: "allows any length without a maximum", policy: dto.PasswordPolicyDTO{MinLength: 1}, password: "correct horse battery staple, and then some more words"},
+		{
+			name:      "lists every missing character class",
+			policy:    strict,
+			password:  "                ",
+			wantCodes: []string{config.PasswordViolationMissingUppercase, config.PasswordViolationMissingLowercase, config.PasswordViolationMissingDigit},
+		},
+		{name: "counts a space as a symbol", policy: strict, password: "Correct Horse 7"},
+		{name: "rejects the local part of the email", policy: strict, password: "My-COUNTESS-pw-7", wantCodes: []string{config.PasswordViolationContainsEmail}},
+		{name: "rejects the user's name", policy: strict, password: "Lovelace-Rules-7", wantCodes: []string{config.PasswordViolationContainsName}},
+		{name: "ignores names shorter than three characters", policy: strict, firstName: "Ed", password: "Ed-Horse-Rule-7"},
+		{name: "allows personal information when the policy does", policy: dto.PasswordPolicyDTO{MinLength: 8}, password: "lovelace"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := &models.User{FirstName: "Ada", LastName: "Lovelace", Email: "countess@example.com"}
+			if tt.firstName != "" {
+				user.FirstName = tt.firstName
+			}
+
+			codes := []string{}
+			for _, violation := range checkPasswordPolicy(tt.policy, user, tt.password) {
+				codes = append(codes, violation.Code)
+			}
+			if tt.wantCodes == nil {
+				tt.wantCodes = []string{}
+			}
+			if !reflect.DeepEqual(codes, tt.wantCodes) {
+				t.Errorf("checkPasswordPolicy() = %v, want %v", codes, tt.wantCodes)
+			}
+		})
+	}
+}
+
+func TestPasswordHistory(t *testing.T) {
+	// The user's passwords, oldest first; the last is their current one
+	passwords := []string{testPassword, "Second-Staple-1", "Third-Staple-2", "Fourth-Staple-3"}
+
+	tests := []struct {
+		name       string
+		depth      int
+		password   string
+		wantReused bool
+	}{
+		{name: "no history allows the current password", depth: 0, password: passwords[3]},
+		{name: "a depth of one rejects the current password", depth: 1, password: passwords[3], wantReused: true},
+		{name: "a depth of one allows the previous password", depth: 1, password: passwords[2]},
+		{name: "rejects a password within the depth", depth: 3, password: passwords[1], wantReused: true},
+		{name: "allows a password beyond the depth", depth: 3, password: passwords[0]},
+		{name: "allows a new password", depth: 3, password: newTestPassword},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServices(t)
+			user := s.createUser(t, "user@example.com")
+			policy := s.tenantSettings.DefaultPasswordPolicy()
+			policy.HistoryDepth = tt.depth
+			check(t, s.tenantSettings.UpdatePasswordPolicy(user.TenantID, policy))
+			for i := 1; i < len(passwords); i++ {
+				check(t, s.user.ChangePassword(user.TenantID, user.ID, "", dto.ChangePasswordDTO{CurrentPassword: passwords[i-1], NewPassword: passwords[i]}))
+			}
+
+			err := s.user.ChangePassword(user.TenantID, user.ID, "", dto.ChangePasswordDTO{CurrentPassword: passwords[len(passwords)-1], NewPassword: tt.password})
+			var policyErr *PasswordPolicyError
+			reused := errors.As(err, &policyErr) && len(policyErr.Violations) == 1 && policyErr.Violations[0].Code == config.PasswordViolationReused
+			if reused != tt.wantReused || (!reused && err != nil) {
+				t.Errorf("ChangePassword() error = %v, want reused %v", err, tt.wantReused)
+			}
+		})
+	}
+}
+
+func TestUpdatePasswordPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  dto.PasswordPolicyDTO
+		wantErr error
+	}{
+		{name: "accepts a valid policy", policy: dto.PasswordPolicyDTO{MinLength: 12, MaxLength: 128, RequireDigit: true, HistoryDepth: 5, MaxAgeDays: 90}},
+		{name: "rejects a zero minimum length", policy: dto.PasswordPolicyDTO{}, wantErr: config.ErrInvalidPasswordPolicy},
+		{name: "rejects a maximum below the minimum", policy: dto.PasswordPolicyDTO{MinLength: 12, MaxLength: 8}, wantErr: config.ErrInvalidPasswordPolicy},
+		{name: "rejects a negative maximum age", policy: dto.PasswordPolicyDTO{MinLength: 8, MaxAgeDays: -1}, wantErr: config.ErrInvalidPasswordPolicy},
+		{name: "rejects too deep a history", policy: dto.PasswordPolicyDTO{MinLength: 8, HistoryDepth: config.MaxPasswordHistoryDepth + 1}, wantErr: config.ErrInvalidPasswordPolicy},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServices(t)
+			user := s.createUser(t, "user@example.com")
+
+			if err := s.tenantSettings.UpdatePasswordPolicy(user.TenantID, tt.policy); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("UpdatePasswordPolicy() error = %v, want %v", err, tt.wantErr)
+			}
+
+			want := tt.policy
+			if tt.wantErr != nil {
+				want = s.tenantSettings.DefaultPasswordPolicy()
+			}
+			policy, err := s.tenantSettings.GetPasswordPolicy(user.TenantID)
+			check(t, err)
+			if policy != want {
+				t.Errorf("GetPasswordPolicy() = %+v, want %+v", policy, want)
+			}
+
+			check(t, s.tenantSettings.ResetPasswordPolicy(user.TenantID))
+			if policy, _ := s.tenantSettings.GetPasswordPolicy(user.TenantID); policy != s.tenantSettings.DefaultPasswordPolicy() {
+				t.Errorf("GetPasswordPolicy() after reset = %+v, want the default", policy)
+			}
+		})
+	}
+}
+
+// stubChecker reports every password as breached, or fails
+type stubChecker struct {
+	breached bool
+	err      error
+}
+
+func (c stubChecker) IsBreached(password string) (bool, error) {
+	return c.breached, c.err
+}
+
+func TestValidateBreachedPassword(t *testing.T) {
+	unavailable := errors.New("corpus unavailable")
+
+	tests := []struct {
+		name      string
+		checker   breached.Checker
+		wantErr   error
+		wantCodes []string
+	}{
+		{name: "accepts a password without a checker"},
+		{name: "accepts a password not in a breach", checker: stubChecker{}},
+		{name: "rejects a breached password", checker: stubChecker{breached: true}, wantErr: config.ErrPasswordPolicyViolation, wantCodes: []string{config.PasswordViolationBreached}},
+		{name: "fails closed when the checker fails", checker: stubChecker{err: unavailable}, wantErr: unavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServices(t)
+			user := s.createUser(t, "user@example.com")
+			policy := NewPasswordPolicyService(repository.NewPasswordHistoryRepository(s.db), s.tenantSettings, s.passwordHash, tt.checker)
+
+			err := policy.Validate(user, newTestPassword)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Validate() error = %v, want %v", err, tt.wantErr)
+			}
+			var policyErr *PasswordPolicyError
+			if errors.As(err, &policyErr) {
+				codes := []string{}
+				for _, violation := range policyErr.Violations {
+					codes = append(codes, violation.Code)
+				}
+				if !reflect.DeepEqual(codes, tt.wantCodes) {
+					t.Errorf("violations = %v, want %v", codes, tt.wantCodes)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/repository"
+	"github.com/geekible-ltd/auth-server/mailer"
+	"gorm.io/gorm"
+)
+
+type PasswordResetService struct {
+	userRepository        *repository.UserRepository
+	revocationService     *RevocationService
+	passwordPolicyService *PasswordPolicyService
+	passwordHashService   *PasswordHashService
+	mailer                mailer.Mailer
+	linkURL               string
+	ttl                   time.Duration
+}
+
+func NewPasswordResetService(userRepository *repository.UserRepository, revocationService *RevocationService, passwordPolicyService *PasswordPolicyService, passwordHashService *PasswordHashService, mailer mailer.Mailer, linkURL string, ttl time.Duration) *PasswordResetService {
+	return &PasswordResetService{
+		userRepository:        userRepository,
+		revocationService:     revocationService,
+		passwordPolicyService: passwordPolicyService,
+		passwordHashService:   passwordHashService,
+		mailer:                mailer,
+		linkURL:               linkURL,
+		ttl:                   ttl,
+	}
+}
+
+// RequestReset emails a single-use reset token, as a link when a link URL is
+// configured, to the user with the given email. Unknown emails are sent
+// nothing and return no error, so callers cannot tell whether an account
+// exists, and so are deactivated users. Locked out users can reset their
+// password to unlock their account. Requesting again replaces the user's
+// earlier token.
+func (s *PasswordResetService) RequestReset(forgotRequest dto.ForgotPasswordDTO) error {
+	if s.mailer == nil {
+		return config.ErrMailerNotConfigured
+	}
+
+	user, err := s.userRepository.GetByEmail(forgotRequest.Email)
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !user.IsActive {
+		return nil
+	}
+
+	rawToken, err := generateSecureToken()
+	if err != nil {
+		return err
+	}
+
+	var link string
+	if s.linkURL != "" {
+		link, err = magicLink(s.linkURL, rawToken)
+		if err != nil {
+			return err
+		}
+	}
+
+	expiresAt := time.Now().Add(s.ttl)
+	user.ResetPasswordToken = hashSecureToken(rawToken)
+	user.ResetPasswordTokenExpiresAt = &expiresAt
+	user.UpdatedAt = time.Now()
+	if err := s.userRepository.Update(user); err != nil {
+		return err
+	}
+
+	return s.mailer.Send(s.resetMessage(user.Email, rawToken, link))
+}
+
+// ResetPassword sets a new password with an emailed reset token. The token
+// works once and stays valid if the password fails the policy. Resetting
+// clears the user's failed login attempts, unlocks a locked out account and
+// revokes every existing session.
+func (s *PasswordResetService) ResetPassword(resetRequest dto.ResetPasswordDTO) error {
+	if resetRequest.Token == "" {
+		return config.ErrInvalidResetToken
+	}
+
+	tokenHash := hashSecureToken(resetRequest.Token)
+	user, err := s.userRepository.GetByResetPasswordToken(tokenHash)
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return config.ErrInvalidResetToken
+	} else if err != nil {
+		return err
+	}
+	if user.ResetPasswordTokenExpiresAt == nil || user.ResetPasswordTokenExpiresAt.Before(time.Now()) {
+		return config.ErrInvalidResetToken
+	}
+	if err := s.passwordPolicyService.Validate(user, resetRequest.NewPassword); err != nil {
+		return err
+	}
+
+	passwordHash, err := s.passwordHashService.Hash(resetRequest.NewPassword)
+	if err != nil {
+		return config.ErrFailedToHashPassword
+	}
+
+	reset, err := s.userRepository.ResetPassword(user.ID, tokenHash, passwordHash)
+	if err != nil {
+		return err
+	} else if !reset {
+		return config.ErrInvalidResetToken
+	}
+
+	if err := s.passwordPolicyService.RecordChange(user, user.PasswordHash); err != nil {
+		return err
+	}
+	return s.revocationService.RevokeUserTokens(user.ID)
+}
+
+func (s *PasswordResetService) resetMessage(email, token, link string) mailer.Message {
+	var body strings.Builder
+	if link != "" {
+		fmt.Fprintf(&body, "Reset your password with this link:\n%s\n\n", link)
+	} else {
+		fmt.Fprintf(&body, "Your password reset token is:\n%s\n\n", token)
+	}
+	fmt.Fprintf(&body, "It expires in %d minutes and can be used once. If you did not ask to reset your password, you can ignore this email.\n", int(s.ttl.Minutes()))
+
+	return mailer.Message{
+		To:      email,
+		Subject: "Reset your password",
+		Body:    body.String(),
+	}
+}
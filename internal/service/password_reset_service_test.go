@@ -0,0 +1,137 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/models"
+)
+
+const newTestPassword = "Battery-Staple-9"
+
+// requestReset asks for a reset email and returns the token sent in it
+func (s *testServices) requestReset(t *testing.T, email string) string {
+	t.Helper()
+
+	check(t, s.passwordReset.RequestReset(dto.ForgotPasswordDTO{Email: email}))
+	return s.mailer.lastToken(t)
+}
+
+func TestResetPassword(t *testing.T) {
+	tests := []struct {
+		name string
+		// request returns the reset to send for the user's emailed token
+		request func(t *testing.T, s *testServices, user *models.User, token string) dto.ResetPasswordDTO
+		wantErr error
+	}{
+		{
+			name: "sets the new password",
+			request: func(t *testing.T, s *testServices, user *models.User, token string) dto.ResetPasswordDTO {
+				return dto.ResetPasswordDTO{Token: token, NewPassword: newTestPassword}
+			},
+		},
+		{
+			name: "unlocks a locked out user",
+			request: func(t *testing.T, s *testServices, user *models.User, token string) dto.ResetPasswordDTO {
+				for i := 0; i < config.DefaultMaxFailedLoginAttempts; i++ {
+					s.login.Login(dto.LoginDTO{Email: user.Email, Password: "wrong-password"}, "127.0.0.1")
+				}
+				return dto.ResetPasswordDTO{Token: token, NewPassword: newTestPassword}
+			},
+		},
+		{
+			name: "rejects a missing token",
+			request: func(t *testing.T, s *testServices, user *models.User, token string) dto.ResetPasswordDTO {
+				return dto.ResetPasswordDTO{NewPassword: newTestPassword}
+			},
+			wantErr: config.ErrInvalidResetToken,
+		},
+		{
+			name: "rejects an unknown token",
+			request: func(t *testing.T, s *testServices, user *models.User, token string) dto.ResetPasswordDTO {
+				return dto.ResetPasswordDTO{Token: token + "x", NewPassword: newTestPassword}
+			},
+			wantErr: config.ErrInvalidResetToken,
+		},
+		{
+			name: "a token works only once",
+			request: func(t *testing.T, s *testServices, user *models.User, token string) dto.ResetPasswordDTO {
+				check(t, s.passwordReset.ResetPassword(dto.ResetPasswordDTO{Token: token, NewPassword: "Another-Staple-10"}))
+				return dto.ResetPasswordDTO{Token: token, NewPassword: newTestPassword}
+			},
+			wantErr: config.ErrInvalidResetToken,
+		},
+		{
+			name: "requesting again replaces the earlier token",
+			request: func(t *testing.T, s *testServices, user *models.User, token string) dto.ResetPasswordDTO {
+				s.requestReset(t, user.Email)
+				return dto.ResetPasswordDTO{Token: token, NewPassword: newTestPassword}
+			},
+			wantErr: config.ErrInvalidResetToken,
+		},
+		{
+			name: "rejects an expired token",
+			request: func(t *testing.T, s *testServices, user *models.User, token string) dto.ResetPasswordDTO {
+				check(t, s.db.Model(user).Update("reset_password_token_expires_at", time.Now().Add(-time.Second)).Error)
+				return dto.ResetPasswordDTO{Token: token, NewPassword: newTestPassword}
+			},
+			wantErr: config.ErrInvalidResetToken,
+		},
+		{
+			name: "a password failing the policy leaves the token valid",
+			request: func(t *testing.T, s *testServices, user *models.User, token string) dto.ResetPasswordDTO {
+				err := s.passwordReset.ResetPassword(dto.ResetPasswordDTO{Token: token, NewPassword: "short"})
+				if !errors.Is(err, config.ErrPasswordPolicyViolation) {
+					t.Fatalf("ResetPassword() error = %v, want %v", err, config.ErrPasswordPolicyViolation)
+				}
+				return dto.ResetPasswordDTO{Token: token, NewPassword: newTestPassword}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServices(t)
+			user := s.createUser(t, "user@example.com")
+			session := s.loginUser(t, user.Email)
+			token := s.requestReset(t, user.Email)
+
+			err := s.passwordReset.ResetPassword(tt.request(t, s, user, token))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ResetPassword() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if _, err := s.login.Login(dto.LoginDTO{Email: user.Email, Password: testPassword}, "127.0.0.1"); !errors.Is(err, config.ErrInvalidPassword) {
+				t.Errorf("Login() with the old password error = %v, want %v", err, config.ErrInvalidPassword)
+			}
+			if _, err := s.login.Login(dto.LoginDTO{Email: user.Email, Password: newTestPassword}, "127.0.0.1"); err != nil {
+				t.Errorf("Login() with the new password error = %v", err)
+			}
+			// Sessions from before the reset are revoked
+			if _, err := s.login.Refresh(dto.RefreshTokenDTO{RefreshToken: session.RefreshToken}); err == nil {
+				t.Error("Refresh() with a session from before the reset succeeded")
+			}
+		})
+	}
+}
+
+func TestRequestResetUnknownUser(t *testing.T) {
+	s := newTestServices(t)
+	user := s.createUser(t, "inactive@example.com")
+	check(t, s.db.Model(user).Update("is_active", false).Error)
+
+	for _, email := range []string{"nobody@example.com", user.Email} {
+		if err := s.passwordReset.RequestReset(dto.ForgotPasswordDTO{Email: email}); err != nil {
+			t.Errorf("RequestReset(%q) error = %v, want nil", email, err)
+		}
+	}
+	if len(s.mailer.messages) != 0 {
+		t.Errorf("sent %d emails, want none", len(s.mailer.messages))
+	}
+}
@@ -0,0 +1,218 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"github.com/geekible-ltd/auth-server/internal/repository"
+	"github.com/geekible-ltd/auth-server/mailer"
+	"gorm.io/gorm"
+)
+
+type PasswordlessService struct {
+	userRepository                  *repository.UserRepository
+	passwordlessChallengeRepository *repository.PasswordlessChallengeRepository
+	lockoutService                  *LockoutService
+	mailer                          mailer.Mailer
+	linkURL                         string
+	ttl                             time.Duration
+}
+
+func NewPasswordlessService(userRepository *repository.UserRepository, passwordlessChallengeRepository *repository.PasswordlessChallengeRepository, lockoutService *LockoutService, mailer mailer.Mailer, linkURL string, ttl time.Duration) *PasswordlessService {
+	return &PasswordlessService{
+		userRepository:                  userRepository,
+		passwordlessChallengeRepository: passwordlessChallengeRepository,
+		lockoutService:                  lockoutService,
+		mailer:                          mailer,
+		linkURL:                         linkURL,
+		ttl:                             ttl,
+	}
+}
+
+// Start emails a one-time code, and a magic link when a link URL is
+// configured, to the user with the given email. The response looks the same
+// for unknown and inactive users, who are sent nothing. Starting again
+// invalidates the user's earlier codes and links.
+func (s *PasswordlessService) Start(startRequest dto.PasswordlessStartDTO) (dto.PasswordlessStartResponseDTO, error) {
+	if s.mailer == nil {
+		return dto.PasswordlessStartResponseDTO{}, config.ErrMailerNotConfigured
+	}
+
+	rawToken, err := generateSecureToken()
+	if err != nil {
+		return dto.PasswordlessStartResponseDTO{}, err
+	}
+	response := dto.PasswordlessStartResponseDTO{
+		PasswordlessToken: rawToken,
+		ExpiresIn:         int64(s.ttl.Seconds()),
+	}
+
+	user, err := s.userRepository.GetByEmail(startRequest.Email)
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return response, nil
+	} else if err != nil {
+		return dto.PasswordlessStartResponseDTO{}, err
+	}
+	if !user.IsActive {
+		return response, nil
+	}
+
+	code, err := generateNumericCode(config.PasswordlessCodeDigits)
+	if err != nil {
+		return dto.PasswordlessStartResponseDTO{}, err
+	}
+
+	var link, linkHash string
+	if s.linkURL != "" {
+		linkToken, err := generateSecureToken()
+		if err != nil {
+			return dto.PasswordlessStartResponseDTO{}, err
+		}
+		link, err = magicLink(s.linkURL, linkToken)
+		if err != nil {
+			return dto.PasswordlessStartResponseDTO{}, err
+		}
+		linkHash = hashSecureToken(linkToken)
+	}
+
+	if err := s.passwordlessChallengeRepository.DeleteForUser(user.ID); err != nil {
+		return dto.PasswordlessStartResponseDTO{}, err
+	}
+
+	now := time.Now()
+	challenge := &models.PasswordlessChallenge{
+		ChallengeHash: hashSecureToken(rawToken),
+		CodeHash:      hashSecureToken(code),
+		LinkHash:      linkHash,
+		UserID:        user.ID,
+		TenantID:      user.TenantID,
+		ExpiresAt:     now.Add(s.ttl),
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	if err := s.passwordlessChallengeRepository.Create(challenge); err != nil {
+		return dto.PasswordlessStartResponseDTO{}, err
+	}
+
+	if err := s.mailer.Send(s.signInMessage(user.Email, code, link)); err != nil {
+		return dto.PasswordlessStartResponseDTO{}, err
+	}
+	return response, nil
+}
+
+// Verify checks an emailed code or magic link token and returns the user it
+// was sent to. Each challenge works once and allows
+// config.MaxPasswordlessAttempts code attempts. Wrong codes also count
+// towards the user's failed login attempts, like wrong passwords, and locked
+// out users cannot sign in by email until their lock expires.
+func (s *PasswordlessService) Verify(verifyRequest dto.PasswordlessVerifyDTO) (*models.User, error) {
+	var challenge *models.PasswordlessChallenge
+	var err error
+	if verifyRequest.LinkToken != "" {
+		challenge, err = s.passwordlessChallengeRepository.GetByLinkHash(hashSecureToken(verifyRequest.LinkToken))
+	} else {
+		challenge, err = s.passwordlessChallengeRepository.GetByChallengeHash(hashSecureToken(verifyRequest.PasswordlessToken))
+	}
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return nil, config.ErrInvalidPasswordlessToken
+	} else if err != nil {
+		return nil, err
+	}
+
+	if challenge.ExpiresAt.Before(time.Now()) {
+		if _, err := s.passwordlessChallengeRepository.Consume(challenge.ID); err != nil {
+			return nil, err
+		}
+		return nil, config.ErrInvalidPasswordlessToken
+	}
+
+	user, err := s.userRepository.GetByID(challenge.TenantID, challenge.UserID)
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return nil, config.ErrInvalidPasswordlessToken
+	} else if err != nil {
+		return nil, err
+	}
+	if !user.IsActive {
+		return nil, config.ErrInvalidPasswordlessToken
+	}
+	if err := s.lockoutService.CheckLocked(user); err != nil {
+		return nil, err
+	}
+
+	if verifyRequest.LinkToken == "" {
+		allowed, err := s.passwordlessChallengeRepository.RecordAttempt(challenge.ID, config.MaxPasswordlessAttempts)
+		if err != nil {
+			return nil, err
+		} else if !allowed {
+			if _, err := s.passwordlessChallengeRepository.Consume(challenge.ID); err != nil {
+				return nil, err
+			}
+			return nil, config.ErrInvalidPasswordlessToken
+		}
+
+		if subtle.ConstantTimeCompare([]byte(hashSecureToken(strings.TrimSpace(verifyRequest.Code))), []byte(challenge.CodeHash)) != 1 {
+			if err := s.lockoutService.RecordFailure(user); err != nil {
+				return nil, err
+			}
+			return nil, config.ErrInvalidPasswordlessCode
+		}
+	}
+
+	consumed, err := s.passwordlessChallengeRepository.Consume(challenge.ID)
+	if err != nil {
+		return nil, err
+	} else if !consumed {
+		return nil, config.ErrInvalidPasswordlessToken
+	}
+	return user, nil
+}
+
+// PurgeExpired removes email sign-ins that were never completed
+func (s *PasswordlessService) PurgeExpired() error {
+	return s.passwordlessChallengeRepository.DeleteExpired(time.Now())
+}
+
+func (s *PasswordlessService) signInMessage(email, code, link string) mailer.Message {
+	var body strings.Builder
+	fmt.Fprintf(&body, "Your sign-in code is %s.\n\n", code)
+	if link != "" {
+		fmt.Fprintf(&body, "Or sign in with this link:\n%s\n\n", link)
+	}
+	fmt.Fprintf(&body, "It expires in %d minutes and can be used once. If you did not try to sign in, you can ignore this email.\n", int(s.ttl.Minutes()))
+
+	return mailer.Message{
+		To:      email,
+		Subject: "Your sign-in code",
+		Body:    body.String(),
+	}
+}
+
+// magicLink adds the link token to the configured sign-in page URL
+func magicLink(linkURL, linkToken string) (string, error) {
+	u, err := url.Parse(linkURL)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set("token", linkToken)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// generateNumericCode returns a uniformly random code of the given number of digits
+func generateNumericCode(digits int) (string, error) {
+	max := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(digits)), nil)
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", digits, n), nil
+}
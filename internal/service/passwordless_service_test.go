@@ -0,0 +1,163 @@
+package service
+
+import (
+	"errors"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"github.com/geekible-ltd/auth-server/internal/repository"
+)
+
+var (
+	signInCodePattern = regexp.MustCompile(`code is (\d+)`)
+	signInLinkPattern = regexp.MustCompile(`https://\S+`)
+)
+
+// emailSignIn is a started email sign-in with the code and link token that
+// were emailed for it
+type emailSignIn struct {
+	token, code, linkToken string
+}
+
+func startEmailSignIn(t *testing.T, s *testServices, passwordless *PasswordlessService, email string) emailSignIn {
+	t.Helper()
+
+	response, err := passwordless.Start(dto.PasswordlessStartDTO{Email: email})
+	check(t, err)
+
+	body := s.mailer.last().Body
+	code := signInCodePattern.FindStringSubmatch(body)
+	link := signInLinkPattern.FindString(body)
+	if code == nil || link == "" {
+		t.Fatalf("sign-in email %q has no code or link", body)
+	}
+	u, err := url.Parse(link)
+	check(t, err)
+	return emailSignIn{token: response.PasswordlessToken, code: code[1], linkToken: u.Query().Get("token")}
+}
+
+func TestPasswordlessVerify(t *testing.T) {
+	tests := []struct {
+		name string
+		// request returns the verification to send for the started sign-in
+		request func(t *testing.T, s *testServices, passwordless *PasswordlessService, signIn emailSignIn) dto.PasswordlessVerifyDTO
+		wantErr error
+	}{
+		{
+			name: "accepts the emailed code",
+			request: func(t *testing.T, s *testServices, passwordless *PasswordlessService, signIn emailSignIn) dto.PasswordlessVerifyDTO {
+				return dto.PasswordlessVerifyDTO{PasswordlessToken: signIn.token, Code: " " + signIn.code + " "}
+			},
+		},
+		{
+			name: "accepts the magic link",
+			request: func(t *testing.T, s *testServices, passwordless *PasswordlessService, signIn emailSignIn) dto.PasswordlessVerifyDTO {
+				return dto.PasswordlessVerifyDTO{LinkToken: signIn.linkToken}
+			},
+		},
+		{
+			name: "rejects a wrong code",
+			request: func(t *testing.T, s *testServices, passwordless *PasswordlessService, signIn emailSignIn) dto.PasswordlessVerifyDTO {
+				return dto.PasswordlessVerifyDTO{PasswordlessToken: signIn.token, Code: "x" + signIn.code}
+			},
+			wantErr: config.ErrInvalidPasswordlessCode,
+		},
+		{
+			name: "rejects a code for another sign-in",
+			request: func(t *testing.T, s *testServices, passwordless *PasswordlessService, signIn emailSignIn) dto.PasswordlessVerifyDTO {
+				return dto.PasswordlessVerifyDTO{PasswordlessToken: "unknown", Code: signIn.code}
+			},
+			wantErr: config.ErrInvalidPasswordlessToken,
+		},
+		{
+			name: "a code works only once",
+			request: func(t *testing.T, s *testServices, passwordless *PasswordlessService, signIn emailSignIn) dto.PasswordlessVerifyDTO {
+				request := dto.PasswordlessVerifyDTO{PasswordlessToken: signIn.token, Code: signIn.code}
+				_, err := passwordless.Verify(request)
+				check(t, err)
+				return request
+			},
+			wantErr: config.ErrInvalidPasswordlessToken,
+		},
+		{
+			name: "the link stops working once the code is used",
+			request: func(t *testing.T, s *testServices, passwordless *PasswordlessService, signIn emailSignIn) dto.PasswordlessVerifyDTO {
+				_, err := passwordless.Verify(dto.PasswordlessVerifyDTO{PasswordlessToken: signIn.token, Code: signIn.code})
+				check(t, err)
+				return dto.PasswordlessVerifyDTO{LinkToken: signIn.linkToken}
+			},
+			wantErr: config.ErrInvalidPasswordlessToken,
+		},
+		{
+			name: "starting again invalidates the earlier email",
+			request: func(t *testing.T, s *testServices, passwordless *PasswordlessService, signIn emailSignIn) dto.PasswordlessVerifyDTO {
+				startEmailSignIn(t, s, passwordless, "user@example.com")
+				return dto.PasswordlessVerifyDTO{PasswordlessToken: signIn.token, Code: signIn.code}
+			},
+			wantErr: config.ErrInvalidPasswordlessToken,
+		},
+		{
+			name: "rejects an expired code",
+			request: func(t *testing.T, s *testServices, passwordless *PasswordlessService, signIn emailSignIn) dto.PasswordlessVerifyDTO {
+				check(t, s.db.Model(&models.PasswordlessChallenge{}).Where("1 = 1").Update("expires_at", time.Now().Add(-time.Second)).Error)
+				return dto.PasswordlessVerifyDTO{PasswordlessToken: signIn.token, Code: signIn.code}
+			},
+			wantErr: config.ErrInvalidPasswordlessToken,
+		},
+		{
+			name: "wrong codes lock the user out",
+			request: func(t *testing.T, s *testServices, passwordless *PasswordlessService, signIn emailSignIn) dto.PasswordlessVerifyDTO {
+				for i := 0; i < config.DefaultMaxFailedLoginAttempts; i++ {
+					_, err := passwordless.Verify(dto.PasswordlessVerifyDTO{PasswordlessToken: signIn.token, Code: "wrong"})
+					if !errors.Is(err, config.ErrInvalidPasswordlessCode) {
+						t.Fatalf("Verify() error = %v, want %v", err, config.ErrInvalidPasswordlessCode)
+					}
+				}
+				return dto.PasswordlessVerifyDTO{LinkToken: signIn.linkToken}
+			},
+			wantErr: config.ErrAccountLocked,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServices(t)
+			user := s.createUser(t, "user@example.com")
+			passwordless := NewPasswordlessService(repository.NewUserRepository(s.db), repository.NewPasswordlessChallengeRepository(s.db), s.lockout, s.mailer, "https://app.example.com/sign-in", config.DefaultPasswordlessTTL)
+			signIn := startEmailSignIn(t, s, passwordless, user.Email)
+
+			verified, err := passwordless.Verify(tt.request(t, s, passwordless, signIn))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && verified.ID != user.ID {
+				t.Errorf("Verify() user = %d, want %d", verified.ID, user.ID)
+			}
+		})
+	}
+}
+
+func TestPasswordlessStartUnknownUser(t *testing.T) {
+	s := newTestServices(t)
+	user := s.createUser(t, "user@example.com")
+	check(t, s.db.Model(user).Update("is_active", false).Error)
+
+	for _, email := range []string{"nobody@example.com", user.Email} {
+		response, err := s.passwordless.Start(dto.PasswordlessStartDTO{Email: email})
+		check(t, err)
+		if response.PasswordlessToken == "" || response.ExpiresIn == 0 {
+			t.Errorf("Start(%q) = %+v, want the same response as for active users", email, response)
+		}
+		if _, err := s.passwordless.Verify(dto.PasswordlessVerifyDTO{PasswordlessToken: response.PasswordlessToken, Code: "000000"}); !errors.Is(err, config.ErrInvalidPasswordlessToken) {
+			t.Errorf("Verify() error = %v, want %v", err, config.ErrInvalidPasswordlessToken)
+		}
+	}
+	if len(s.mailer.messages) != 0 {
+		t.Errorf("sent %d emails, want none", len(s.mailer.messages))
+	}
+}
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"time"
+
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"github.com/geekible-ltd/auth-server/internal/repository"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type RefreshTokenService struct {
+	refreshTokenRepository *repository.RefreshTokenRepository
+	refreshTokenTTL        time.Duration
+}
+
+func NewRefreshTokenService(refreshTokenRepository *repository.RefreshTokenRepository, refreshTokenTTL time.Duration) *RefreshTokenService {
+	return &RefreshTokenService{
+		refreshTokenRepository: refreshTokenRepository,
+		refreshTokenTTL:        refreshTokenTTL,
+	}
+}
+
+// Issue creates a refresh token for the user under the grant. An empty
+// SessionID starts a new token family, i.e. a new session.
+func (s *RefreshTokenService) Issue(user *models.User, grant TokenGrant) (string, *models.RefreshToken, error) {
+	rawToken, err := generateSecureToken()
+	if err != nil {
+		return "", nil, config.ErrFailedToIssueToken
+	}
+
+	familyID := grant.SessionID
+	if familyID == "" {
+		familyID = uuid.New().String()
+	}
+
+	refreshToken := &models.RefreshToken{
+		UserID:    user.ID,
+		TenantID:  user.TenantID,
+		FamilyID:  familyID,
+		TokenHash: hashSecureToken(rawToken),
+		ClientID:  grant.ClientID,
+		Scope:     grant.Scope,
+		AuthTime:  grant.AuthTime,
+		AMR:       grant.AMR,
+		ExpiresAt: time.Now().Add(s.refreshTokenTTL),
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	if err := s.refreshTokenRepository.Create(refreshToken); err != nil {
+		return "", nil, err
+	}
+
+	return rawToken, refreshToken, nil
+}
+
+// Consume validates a refresh token issued to clientID (empty for first-party
+// logins) and marks it as used so it cannot be presented again. Replaying a
+// used token revokes its whole family.
+func (s *RefreshTokenService) Consume(rawToken, clientID string) (*models.RefreshToken, error) {
+	refreshToken, err := s.refreshTokenRepository.GetByTokenHash(hashSecureToken(rawToken))
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return nil, config.ErrInvalidRefreshToken
+	} else if err != nil {
+		return nil, err
+	}
+
+	if refreshToken.RevokedAt != nil || refreshToken.ClientID != clientID {
+		return nil, config.ErrInvalidRefreshToken
+	}
+
+	if refreshToken.UsedAt != nil {
+		return nil, s.revokeReusedFamily(refreshToken.FamilyID)
+	}
+
+	if refreshToken.ExpiresAt.Before(time.Now()) {
+		return nil, config.ErrRefreshTokenExpired
+	}
+
+	// A concurrent request may have consumed the token since it was read
+	marked, err := s.refreshTokenRepository.MarkUsed(refreshToken.ID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if !marked {
+		return nil, s.revokeReusedFamily(refreshToken.FamilyID)
+	}
+
+	return refreshToken, nil
+}
+
+// Lookup returns a refresh token that is still usable without consuming it
+func (s *RefreshTokenService) Lookup(rawToken string) (*models.RefreshToken, error) {
+	refreshToken, err := s.refreshTokenRepository.GetByTokenHash(hashSecureToken(rawToken))
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return nil, config.ErrInvalidRefreshToken
+	} else if err != nil {
+		return nil, err
+	}
+
+	if refreshToken.RevokedAt != nil || refreshToken.UsedAt != nil || refreshToken.ExpiresAt.Before(time.Now()) {
+		return nil, config.ErrInvalidRefreshToken
+	}
+	return refreshToken, nil
+}
+
+func (s *RefreshTokenService) RevokeFamily(familyID string) error {
+	return s.refreshTokenRepository.RevokeFamily(familyID, time.Now())
+}
+
+func (s *RefreshTokenService) RevokeAllForUser(userID uint) error {
+	return s.refreshTokenRepository.RevokeAllForUser(userID, time.Now())
+}
+
+// PurgeExpired removes refresh tokens that have expired, used or not
+func (s *RefreshTokenService) PurgeExpired() error {
+	return s.refreshTokenRepository.DeleteExpired(time.Now())
+}
+
+func (s *RefreshTokenService) revokeReusedFamily(familyID string) error {
+	if err := s.refreshTokenRepository.RevokeFamily(familyID, time.Now()); err != nil {
+		return err
+	}
+	return config.ErrRefreshTokenReused
+}
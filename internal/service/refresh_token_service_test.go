@@ -0,0 +1,126 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/models"
+)
+
+func TestConsumeRefreshToken(t *testing.T) {
+	tests := []struct {
+		name     string
+		clientID string
+		setup    func(t *testing.T, s *testServices, rawToken string)
+		wantErr  error
+	}{
+		{name: "consumes an unused token"},
+		{
+			name: "detects reuse of a consumed token",
+			setup: func(t *testing.T, s *testServices, rawToken string) {
+				if _, err := s.refreshToken.Consume(rawToken, ""); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: config.ErrRefreshTokenReused,
+		},
+		{name: "rejects a token presented by another client", clientID: "other-client", wantErr: config.ErrInvalidRefreshToken},
+		{
+			name: "rejects an expired token",
+			setup: func(t *testing.T, s *testServices, rawToken string) {
+				s.db.Model(&models.RefreshToken{}).Where("token_hash = ?", hashSecureToken(rawToken)).Update("expires_at", time.Now().Add(-time.Minute))
+			},
+			wantErr: config.ErrRefreshTokenExpired,
+		},
+		{
+			name: "rejects a revoked token",
+			setup: func(t *testing.T, s *testServices, rawToken string) {
+				token, _ := s.refreshToken.Lookup(rawToken)
+				if err := s.refreshToken.RevokeFamily(token.FamilyID); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: config.ErrInvalidRefreshToken,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServices(t)
+			user := s.createUser(t, "user@example.com")
+			rawToken, _, err := s.refreshToken.Issue(user, TokenGrant{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.setup != nil {
+				tt.setup(t, s, rawToken)
+			}
+
+			token, err := s.refreshToken.Consume(rawToken, tt.clientID)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Consume() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && token.UserID != user.ID {
+				t.Errorf("Consume() user = %d, want %d", token.UserID, user.ID)
+			}
+		})
+	}
+}
+
+func TestRefreshRotation(t *testing.T) {
+	tests := []struct {
+		name        string
+		replayFirst bool
+		wantErr     error
+	}{
+		{name: "rotated token keeps the session going"},
+		{name: "replaying a rotated token revokes the session", replayFirst: true, wantErr: config.ErrInvalidRefreshToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServices(t)
+			s.createUser(t, "user@example.com")
+			first := s.loginUser(t, "user@example.com").RefreshToken
+
+			second, err := s.login.Refresh(dto.RefreshTokenDTO{RefreshToken: first})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.replayFirst {
+				if _, err := s.login.Refresh(dto.RefreshTokenDTO{RefreshToken: first}); !errors.Is(err, config.ErrRefreshTokenReused) {
+					t.Fatalf("replay error = %v, want %v", err, config.ErrRefreshTokenReused)
+				}
+			}
+
+			_, err = s.login.Refresh(dto.RefreshTokenDTO{RefreshToken: second.RefreshToken})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Refresh() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPurgeExpiredRefreshTokens(t *testing.T) {
+	s := newTestServices(t)
+	user := s.createUser(t, "user@example.com")
+	expired, _, _ := s.refreshToken.Issue(user, TokenGrant{})
+	valid, _, _ := s.refreshToken.Issue(user, TokenGrant{})
+	s.db.Model(&models.RefreshToken{}).Where("token_hash = ?", hashSecureToken(expired)).Update("expires_at", time.Now().Add(-time.Minute))
+
+	if err := s.refreshToken.PurgeExpired(); err != nil {
+		t.Fatal(err)
+	}
+
+	var count int64
+	s.db.Model(&models.RefreshToken{}).Count(&count)
+	if count != 1 {
+		t.Errorf("refresh tokens = %d, want 1", count)
+	}
+	if _, err := s.refreshToken.Lookup(valid); err != nil {
+		t.Errorf("Lookup() of unexpired token error = %v", err)
+	}
+}
@@ -9,31 +9,62 @@ import (
 	"github.com/geekible-ltd/auth-server/internal/models"
 	"github.com/geekible-ltd/auth-server/internal/repository"
 	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
 type UserRegistrationService struct {
-	userRepository          *repository.UserRepository
-	tenantRepository        *repository.TenantRepository
-	tenantLicenceRepository *repository.TenantLicenceRepository
+	userRepository           *repository.UserRepository
+	tenantRepository         *repository.TenantRepository
+	tenantLicenceRepository  *repository.TenantLicenceRepository
+	revocationService        *RevocationService
+	emailVerificationService *EmailVerificationService
+	passwordPolicyService    *PasswordPolicyService
+	passwordHashService      *PasswordHashService
 }
 
-func NewUserRegistrationService(userRepository *repository.UserRepository, tenantRepository *repository.TenantRepository, tenantLicenceRepository *repository.TenantLicenceRepository) *UserRegistrationService {
+func NewUserRegistrationService(userRepository *repository.UserRepository, tenantRepository *repository.TenantRepository, tenantLicenceRepository *repository.TenantLicenceRepository, revocationService *RevocationService, emailVerificationService *EmailVerificationService, passwordPolicyService *PasswordPolicyService, passwordHashService *PasswordHashService) *UserRegistrationService {
 	return &UserRegistrationService{
-		userRepository:          userRepository,
-		tenantRepository:        tenantRepository,
-		tenantLicenceRepository: tenantLicenceRepository,
+		userRepository:           userRepository,
+		tenantRepository:         tenantRepository,
+		tenantLicenceRepository:  tenantLicenceRepository,
+		revocationService:        revocationService,
+		emailVerificationService: emailVerificationService,
+		passwordPolicyService:    passwordPolicyService,
+		passwordHashService:      passwordHashService,
 	}
 }
 
+// RegisterTenant creates a tenant with its licence and administrator. When
+// the tenant's email domain or the administrator's email is already
+// registered, nothing is created and the administrator's address is emailed
+// instead, after the same password checks and hashing, so callers cannot
+// tell whether the tenant or email exists.
 func (s *UserRegistrationService) RegisterTenant(tenantDTO dto.TenantRegistrationDTO) error {
-	emailDomain := strings.Split(tenantDTO.Email, "@")[1]
-	_, err := s.tenantRepository.GetByEmailDomain(emailDomain)
+	// The new tenant has no policy of its own yet, so the server's default applies
+	if err := s.passwordPolicyService.Validate(&models.User{
+		FirstName: tenantDTO.User.FirstName,
+		LastName:  tenantDTO.User.LastName,
+		Email:     tenantDTO.User.Email,
+	}, tenantDTO.User.Password); err != nil {
+		return err
+	}
 
-	if err != nil && err == gorm.ErrRecordNotFound {
-		return config.ErrTenantAlreadyExists
-	} else if err != nil {
+	passwordHash, err := s.passwordHashService.Hash(tenantDTO.User.Password)
+	if err != nil {
+		return config.ErrFailedToHashPassword
+	}
+
+	emailDomain := strings.Split(tenantDTO.Email, "@")[1]
+	_, err = s.tenantRepository.GetByEmailDomain(emailDomain)
+	if err == nil {
+		return s.sendAlreadyRegistered(tenantDTO.User.Email)
+	} else if err != gorm.ErrRecordNotFound {
+		return err
+	}
+	_, err = s.userRepository.GetByEmail(tenantDTO.User.Email)
+	if err == nil {
+		return s.sendAlreadyRegistered(tenantDTO.User.Email)
+	} else if err != gorm.ErrRecordNotFound {
 		return err
 	}
 
@@ -42,6 +73,7 @@ func (s *UserRegistrationService) RegisterTenant(tenantDTO dto.TenantRegistratio
 		Email:     tenantDTO.Email,
 		Phone:     tenantDTO.Phone,
 		Address:   tenantDTO.Address,
+		IsActive:  true,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 	}
@@ -63,17 +95,12 @@ func (s *UserRegistrationService) RegisterTenant(tenantDTO dto.TenantRegistratio
 		return config.ErrFailedToCreateTenantLicence
 	}
 
-	passwordHash, err := bcrypt.GenerateFromPassword([]byte(tenantDTO.User.Password), bcrypt.DefaultCost)
-	if err != nil {
-		return config.ErrFailedToHashPassword
-	}
-
 	user := &models.User{
 		TenantID:                        tenant.ID,
 		FirstName:                       tenantDTO.User.FirstName,
 		LastName:                        tenantDTO.User.LastName,
 		Email:                           tenantDTO.User.Email,
-		PasswordHash:                    string(passwordHash),
+		PasswordHash:                    passwordHash,
 		FailedLoginAttempts:             0,
 		IsActive:                        true,
 		Role:                            config.UserRoleTenantAdmin,
@@ -91,16 +118,20 @@ func (s *UserRegistrationService) RegisterTenant(tenantDTO dto.TenantRegistratio
 		return config.ErrFailedToCreateUser
 	}
 
-	return nil
+	return s.sendVerification(user)
 }
 
+// RegisterUser adds a user to the tenant. An email that is already registered
+// returns config.ErrUserAlreadyExists whichever tenant it belongs to, so
+// tenants cannot discover each other's users. The owner of an email in
+// another tenant is told of the attempt, as RegisterTenant does.
 func (s *UserRegistrationService) RegisterUser(tenantId uint, userDTO dto.UserRegistrationDTO) error {
-	emailDomain := strings.Split(userDTO.Email, "@")[1]
-	_, err := s.userRepository.GetByEmailDomain(emailDomain)
-
-	if err != nil && err == gorm.ErrRecordNotFound {
-		return config.ErrUserAlreadyExists
-	} else if err != nil {
+	if err := s.passwordPolicyService.Validate(&models.User{
+		TenantID:  tenantId,
+		FirstName: userDTO.FirstName,
+		LastName:  userDTO.LastName,
+		Email:     userDTO.Email,
+	}, userDTO.Password); err != nil {
 		return err
 	}
 
@@ -119,14 +150,26 @@ func (s *UserRegistrationService) RegisterUser(tenantId uint, userDTO dto.UserRe
 		return config.ErrTenantLicenceExpired
 	}
 
-	tenantLicence.UsedSeats++
-	if err := s.tenantLicenceRepository.Update(tenantLicence); err != nil {
+	passwordHash, err := s.passwordHashService.Hash(userDTO.Password)
+	if err != nil {
+		return config.ErrFailedToHashPassword
+	}
+
+	existingUser, err := s.userRepository.GetByEmail(userDTO.Email)
+	if err == nil {
+		if existingUser.TenantID != tenantId {
+			// The administrator gets the same answer either way, so a
+			// failure to send is not reported
+			_ = s.sendAlreadyRegistered(userDTO.Email)
+		}
+		return config.ErrUserAlreadyExists
+	} else if err != gorm.ErrRecordNotFound {
 		return err
 	}
 
-	passwordHash, err := bcrypt.GenerateFromPassword([]byte(userDTO.Password), bcrypt.DefaultCost)
-	if err != nil {
-		return config.ErrFailedToHashPassword
+	tenantLicence.UsedSeats++
+	if err := s.tenantLicenceRepository.Update(tenantLicence); err != nil {
+		return err
 	}
 
 	user := &models.User{
@@ -134,7 +177,7 @@ func (s *UserRegistrationService) RegisterUser(tenantId uint, userDTO dto.UserRe
 		FirstName:                       userDTO.FirstName,
 		LastName:                        userDTO.LastName,
 		Email:                           userDTO.Email,
-		PasswordHash:                    string(passwordHash),
+		PasswordHash:                    passwordHash,
 		FailedLoginAttempts:             0,
 		IsActive:                        true,
 		Role:                            config.UserRoleTenantUser,
@@ -152,7 +195,7 @@ func (s *UserRegistrationService) RegisterUser(tenantId uint, userDTO dto.UserRe
 		return config.ErrFailedToCreateUser
 	}
 
-	return nil
+	return s.sendVerification(user)
 }
 
 func (s *UserRegistrationService) DeleteUser(tenantId uint, userId uint) error {
@@ -180,5 +223,31 @@ func (s *UserRegistrationService) DeleteUser(tenantId uint, userId uint) error {
 		return err
 	}
 
-	return s.userRepository.Update(user)
+	if err := s.userRepository.Update(user); err != nil {
+		return err
+	}
+
+	return s.revocationService.RevokeUserTokens(user.ID)
+}
+
+// sendVerification emails a new user their verification token. Without a
+// mailer users stay unverified. The user already exists when sending fails,
+// so ErrVerificationEmailNotSent tells the caller to resend rather than
+// register again.
+func (s *UserRegistrationService) sendVerification(user *models.User) error {
+	err := s.emailVerificationService.SendVerification(user)
+	if err == nil || err == config.ErrMailerNotConfigured {
+		return nil
+	}
+	return config.ErrVerificationEmailNotSent
+}
+
+// sendAlreadyRegistered emails the owner of an already registered address in
+// place of a verification email, and fails the same way sendVerification does
+func (s *UserRegistrationService) sendAlreadyRegistered(email string) error {
+	err := s.emailVerificationService.SendAlreadyRegistered(email)
+	if err == nil || err == config.ErrMailerNotConfigured {
+		return nil
+	}
+	return config.ErrVerificationEmailNotSent
 }
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"github.com/geekible-ltd/auth-server/internal/repository"
+)
+
+func TestRegisterUserWithRegisteredEmail(t *testing.T) {
+	tests := []struct {
+		name string
+		// owner returns the tenant of the user already registered with the email
+		owner func(t *testing.T, s *testServices, admin *models.User) uint
+		// wantNotified is whether the email's owner is told of the attempt
+		wantNotified bool
+	}{
+		{
+			name:  "email in the tenant",
+			owner: func(t *testing.T, s *testServices, admin *models.User) uint { return admin.TenantID },
+		},
+		{
+			name: "email in another tenant",
+			owner: func(t *testing.T, s *testServices, admin *models.User) uint {
+				return createTestUser(t, s.db, "other-admin@example.com").TenantID
+			},
+			wantNotified: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServices(t)
+			admin := s.createUser(t, "admin@example.com")
+			check(t, s.db.Create(&models.TenantLicence{TenantID: admin.TenantID, LicenceKey: "licence", LicencedSeats: 5, UsedSeats: 1}).Error)
+			existing := s.createUser(t, "existing@example.com")
+			check(t, s.db.Model(existing).Update("tenant_id", tt.owner(t, s, admin)).Error)
+			sent := len(s.mailer.messages)
+			registration := NewUserRegistrationService(repository.NewUserRepository(s.db), repository.NewTenantRepository(s.db), repository.NewTenantLicenceRepository(s.db), s.revocation, s.emailVerification, s.passwordPolicy, s.passwordHash)
+
+			// The administrator gets the same error whichever tenant has the email
+			err := registration.RegisterUser(admin.TenantID, dto.UserRegistrationDTO{FirstName: "New", LastName: "Person", Email: existing.Email, Password: newTestPassword})
+			if !errors.Is(err, config.ErrUserAlreadyExists) {
+				t.Fatalf("RegisterUser() error = %v, want %v", err, config.ErrUserAlreadyExists)
+			}
+
+			var licence models.TenantLicence
+			check(t, s.db.First(&licence, "tenant_id = ?", admin.TenantID).Error)
+			if licence.UsedSeats != 1 {
+				t.Errorf("UsedSeats = %d, want 1", licence.UsedSeats)
+			}
+			notified := len(s.mailer.messages) > sent && s.mailer.last().To == existing.Email
+			if notified != tt.wantNotified {
+				t.Errorf("owner notified = %v, want %v", notified, tt.wantNotified)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"github.com/geekible-ltd/auth-server/internal/repository"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestIsRevoked(t *testing.T) {
+	const userID, tenantID = 7, 3
+	earlier := time.Now().Add(-2 * time.Second)
+
+	tests := []struct {
+		name   string
+		revoke func(t *testing.T, s *RevocationService, claims *AccessTokenClaims)
+		// issuedAt is when the token was issued; zero issues it in the same
+		// second as the revocation
+		issuedAt time.Time
+		noIAT    bool
+		session  string
+		// sessionAfter starts the token's session after the revocation
+		// rather than before it
+		sessionAfter bool
+		want         bool
+	}{
+		{name: "accepts a token nothing revoked", issuedAt: earlier},
+		{
+			name: "rejects an individually revoked token",
+			revoke: func(t *testing.T, s *RevocationService, claims *AccessTokenClaims) {
+				check(t, s.RevokeAccessToken(claims))
+			},
+			issuedAt: time.Now(),
+			want:     true,
+		},
+		{
+			name:     "rejects a token issued before the user cutoff",
+			revoke:   func(t *testing.T, s *RevocationService, _ *AccessTokenClaims) { check(t, s.RevokeUserTokens(userID)) },
+			issuedAt: earlier,
+			want:     true,
+		},
+		{
+			name:   "rejects a token issued in the same second as the user cutoff",
+			revoke: func(t *testing.T, s *RevocationService, _ *AccessTokenClaims) { check(t, s.RevokeUserTokens(userID)) },
+			want:   true,
+		},
+		{
+			name:    "rejects a token of an earlier session issued in the same second as the user cutoff",
+			revoke:  func(t *testing.T, s *RevocationService, _ *AccessTokenClaims) { check(t, s.RevokeUserTokens(userID)) },
+			session: "earlier",
+			want:    true,
+		},
+		{
+			name:         "accepts a token of a session started after the user cutoff in the same second",
+			revoke:       func(t *testing.T, s *RevocationService, _ *AccessTokenClaims) { check(t, s.RevokeUserTokens(userID)) },
+			session:      "later",
+			sessionAfter: true,
+		},
+		{
+			name: "rejects a token issued before the tenant cutoff",
+			revoke: func(t *testing.T, s *RevocationService, _ *AccessTokenClaims) {
+				check(t, s.RevokeTenantTokens(tenantID))
+			},
+			issuedAt: earlier,
+			want:     true,
+		},
+		{
+			name: "accepts the session kept by a revocation of other sessions",
+			revoke: func(t *testing.T, s *RevocationService, _ *AccessTokenClaims) {
+				check(t, s.RevokeOtherUserSessions(userID, "kept"))
+			},
+			issuedAt: earlier,
+			session:  "kept",
+		},
+		{
+			name: "rejects other sessions",
+			revoke: func(t *testing.T, s *RevocationService, _ *AccessTokenClaims) {
+				check(t, s.RevokeOtherUserSessions(userID, "kept"))
+			},
+			issuedAt: earlier,
+			session:  "other",
+			want:     true,
+		},
+		{name: "rejects a token without iat", noIAT: true, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t, &models.RefreshToken{}, &models.RevokedToken{}, &models.TokenRevocation{})
+			refreshTokenRepo := repository.NewRefreshTokenRepository(db)
+			s := NewRevocationService(repository.NewTokenRevocationRepository(db), refreshTokenRepo)
+			startSession := func() {
+				check(t, refreshTokenRepo.Create(&models.RefreshToken{UserID: userID, TenantID: tenantID, FamilyID: tt.session, TokenHash: tt.session, CreatedAt: time.Now()}))
+			}
+
+			claims := &AccessTokenClaims{
+				CompanyID: "3",
+				SessionID: tt.session,
+				RegisteredClaims: jwt.RegisteredClaims{
+					ID:        "jti",
+					Subject:   "7",
+					ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+				},
+			}
+			if tt.session != "" && !tt.sessionAfter {
+				startSession()
+			}
+			// iat is whole seconds, as in a signed token
+			issuedAt := tt.issuedAt
+			if issuedAt.IsZero() && !tt.sessionAfter {
+				issuedAt = time.Now()
+			}
+			if !tt.noIAT {
+				claims.IssuedAt = jwt.NewNumericDate(issuedAt.Truncate(time.Second))
+			}
+			if tt.revoke != nil {
+				tt.revoke(t, s, claims)
+			}
+			if tt.sessionAfter {
+				startSession()
+				claims.IssuedAt = jwt.NewNumericDate(time.Now().Truncate(time.Second))
+			}
+
+			revoked, err := s.IsRevoked(claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if revoked != tt.want {
+				t.Errorf("IsRevoked() = %v, want %v", revoked, tt.want)
+			}
+		})
+	}
+}
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"strings"
+
+	"github.com/geekible-ltd/auth-server/internal/config"
+)
+
+// supportedScopes are the standard scopes about the user. Clients may also be
+// registered with custom scopes for the APIs they call.
+var supportedScopes = []string{
+	config.ScopeOpenID,
+	config.ScopeProfile,
+	config.ScopeEmail,
+	config.ScopeOfflineAccess,
+}
+
+// SupportedScopes returns the scopes advertised in discovery metadata
+func SupportedScopes() []string {
+	return append([]string(nil), supportedScopes...)
+}
+
+// hasScope reports whether the space-delimited scope string contains scope
+func hasScope(scope, want string) bool {
+	for _, s := range strings.Fields(scope) {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
+
+// isScopeSubset reports whether every scope requested is contained in granted
+func isScopeSubset(requested, granted string) bool {
+	for _, s := range strings.Fields(requested) {
+		if !hasScope(granted, s) {
+			return false
+		}
+	}
+	return true
+}
+
+// isValidScopeToken checks the scope-token syntax of RFC 6749 section 3.3
+func isValidScopeToken(scope string) bool {
+	if scope == "" {
+		return false
+	}
+	for _, c := range scope {
+		if c < 0x21 || c > 0x7e || c == '"' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeScope removes duplicate scopes and extra whitespace
+func normalizeScope(scope string) string {
+	var scopes []string
+	for _, s := range strings.Fields(scope) {
+		if !hasScope(strings.Join(scopes, " "), s) {
+			scopes = append(scopes, s)
+		}
+	}
+	return strings.Join(scopes, " ")
+}
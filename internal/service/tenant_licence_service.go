@@ -70,7 +70,7 @@ func (s *TenantLicenceService) GetTenantLicenceByTenantID(tenantID uint) (*dto.T
 }
 
 func (s *TenantLicenceService) UpdateTenantLicence(tenantID uint, tenantLicence *dto.TenantLicenceUpdateRequestDTO) error {
-	existingTenantLicence, err := s.tenantLicenceRepository.GetByID(tenantID)
+	existingTenantLicence, err := s.tenantLicenceRepository.GetByTenantID(tenantID)
 	if err != nil && err == gorm.ErrRecordNotFound {
 		return config.ErrTenantLicenceNotFound
 	} else if err != nil {
@@ -10,29 +10,47 @@ import (
 )
 
 type TenantService struct {
-	tenantRepository *repository.TenantRepository
+	tenantRepository  *repository.TenantRepository
+	revocationService *RevocationService
 }
 
-func NewTenantService(tenantRepository *repository.TenantRepository) *TenantService {
-	return &TenantService{tenantRepository: tenantRepository}
+func NewTenantService(tenantRepository *repository.TenantRepository, revocationService *RevocationService) *TenantService {
+	return &TenantService{tenantRepository: tenantRepository, revocationService: revocationService}
 }
 
+// GetTenantByID returns the tenant together with its registered OAuth clients
 func (s *TenantService) GetTenantByID(tenantId uint) (dto.TenantResponseDTO, error) {
-	tenant, err := s.tenantRepository.GetByID(tenantId)
+	tenant, err := s.tenantRepository.GetByIDWithClients(tenantId)
 	if err != nil && err == gorm.ErrRecordNotFound {
 		return dto.TenantResponseDTO{}, config.ErrTenantNotFound
 	} else if err != nil {
 		return dto.TenantResponseDTO{}, err
 	}
+
+	clientsDTO := []dto.ClientResponseDTO{}
+	for _, client := range tenant.Clients {
+		clientsDTO = append(clientsDTO, toClientResponseDTO(client))
+	}
+
 	return dto.TenantResponseDTO{
 		ID:      tenant.ID,
 		Name:    tenant.Name,
 		Email:   tenant.Email,
 		Phone:   tenant.Phone,
 		Address: tenant.Address,
+		Clients: clientsDTO,
 	}, nil
 }
 
+// GetTenantClients returns the OAuth clients registered against the tenant
+func (s *TenantService) GetTenantClients(tenantId uint) ([]dto.ClientResponseDTO, error) {
+	tenant, err := s.GetTenantByID(tenantId)
+	if err != nil {
+		return nil, err
+	}
+	return tenant.Clients, nil
+}
+
 func (s *TenantService) GetAllTenants() ([]dto.TenantResponseDTO, error) {
 	tenantsDTO := []dto.TenantResponseDTO{}
 
@@ -81,5 +99,9 @@ func (s *TenantService) DeleteTenant(tenantId uint) error {
 	tenant.UpdatedAt = time.Now()
 	tenant.DeletedAt = time.Now()
 
-	return s.tenantRepository.Delete(tenant)
+	if err := s.tenantRepository.Delete(tenant); err != nil {
+		return err
+	}
+
+	return s.revocationService.RevokeTenantTokens(tenant.ID)
 }
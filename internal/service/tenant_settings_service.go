@@ -0,0 +1,281 @@
+package service
+
+import (
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"github.com/geekible-ltd/auth-server/internal/repository"
+	"gorm.io/gorm"
+)
+
+var userRoles = []string{
+	config.UserRoleSuperAdmin,
+	config.UserRoleAdmin,
+	config.UserRoleTenantAdmin,
+	config.UserRoleTenantUser,
+}
+
+type TenantSettingsService struct {
+	tenantSettingsRepository *repository.TenantSettingsRepository
+	tenantRepository         *repository.TenantRepository
+	defaultPasswordPolicy    dto.PasswordPolicyDTO
+}
+
+func NewTenantSettingsService(tenantSettingsRepository *repository.TenantSettingsRepository, tenantRepository *repository.TenantRepository, defaultPasswordPolicy dto.PasswordPolicyDTO) *TenantSettingsService {
+	return &TenantSettingsService{
+		tenantSettingsRepository: tenantSettingsRepository,
+		tenantRepository:         tenantRepository,
+		defaultPasswordPolicy:    defaultPasswordPolicy,
+	}
+}
+
+// GetMFAPolicy returns the tenant's MFA policy. By default MFA is optional.
+func (s *TenantSettingsService) GetMFAPolicy(tenantID uint) (dto.MFAPolicyDTO, error) {
+	settings, err := s.getSettings(tenantID)
+	if err != nil {
+		return dto.MFAPolicyDTO{}, err
+	}
+
+	return dto.MFAPolicyDTO{
+		RequireAll:      settings.MFARequired,
+		RequiredRoles:   nonNil(settings.MFARequiredRoles),
+		TrustedNetworks: nonNil(settings.MFATrustedNetworks),
+	}, nil
+}
+
+// UpdateMFAPolicy replaces the tenant's MFA policy. The new policy applies
+// from each user's next login.
+func (s *TenantSettingsService) UpdateMFAPolicy(tenantID uint, policyDTO dto.MFAPolicyDTO) error {
+	roles := []string{}
+	for _, role := range policyDTO.RequiredRoles {
+		if !containsString(userRoles, role) {
+			return config.ErrInvalidRole
+		}
+		if !containsString(roles, role) {
+			roles = append(roles, role)
+		}
+	}
+
+	networks := []string{}
+	for _, network := range policyDTO.TrustedNetworks {
+		prefix, err := ParseNetwork(network)
+		if err != nil {
+			return config.ErrInvalidNetwork
+		}
+		networks = append(networks, prefix.String())
+	}
+
+	settings, err := s.getSettings(tenantID)
+	if err != nil {
+		return err
+	}
+
+	settings.MFARequired = policyDTO.RequireAll
+	settings.MFARequiredRoles = roles
+	settings.MFATrustedNetworks = networks
+	settings.UpdatedAt = time.Now()
+	return s.tenantSettingsRepository.Save(settings)
+}
+
+// MFARequired reports whether the tenant's policy requires the user to
+// complete a second factor when logging in from ipAddress
+func (s *TenantSettingsService) MFARequired(user *models.User, ipAddress string) (bool, error) {
+	settings, err := s.getSettings(user.TenantID)
+	if err != nil {
+		return false, err
+	}
+
+	if settings.MFARequired || containsString(settings.MFARequiredRoles, user.Role) {
+		return true, nil
+	}
+	if len(settings.MFATrustedNetworks) == 0 {
+		return false, nil
+	}
+
+	addr, err := netip.ParseAddr(ipAddress)
+	if err != nil {
+		return true, nil
+	}
+	addr = addr.Unmap()
+	for _, network := range settings.MFATrustedNetworks {
+		prefix, err := netip.ParsePrefix(network)
+		if err == nil && prefix.Contains(addr) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// GetEmailVerificationPolicy returns whether the tenant's users must verify
+// their email before logging in. By default they need not.
+func (s *TenantSettingsService) GetEmailVerificationPolicy(tenantID uint) (dto.EmailVerificationPolicyDTO, error) {
+	settings, err := s.getSettings(tenantID)
+	if err != nil {
+		return dto.EmailVerificationPolicyDTO{}, err
+	}
+
+	return dto.EmailVerificationPolicyDTO{Required: settings.EmailVerificationRequired}, nil
+}
+
+// UpdateEmailVerificationPolicy sets whether the tenant's users must verify
+// their email before logging in. Existing sessions are not affected.
+func (s *TenantSettingsService) UpdateEmailVerificationPolicy(tenantID uint, policyDTO dto.EmailVerificationPolicyDTO) error {
+	settings, err := s.getSettings(tenantID)
+	if err != nil {
+		return err
+	}
+
+	settings.EmailVerificationRequired = policyDTO.Required
+	settings.UpdatedAt = time.Now()
+	return s.tenantSettingsRepository.Save(settings)
+}
+
+// EmailVerificationRequired reports whether the tenant blocks logins by users
+// who have not verified their email
+func (s *TenantSettingsService) EmailVerificationRequired(tenantID uint) (bool, error) {
+	settings, err := s.getSettings(tenantID)
+	if err != nil {
+		return false, err
+	}
+	return settings.EmailVerificationRequired, nil
+}
+
+// DefaultPasswordPolicy returns the server's password policy, used by tenants
+// without their own
+func (s *TenantSettingsService) DefaultPasswordPolicy() dto.PasswordPolicyDTO {
+	return s.defaultPasswordPolicy
+}
+
+// GetPasswordPolicy returns the tenant's password policy, or the server's
+// default if the tenant has not set one
+func (s *TenantSettingsService) GetPasswordPolicy(tenantID uint) (dto.PasswordPolicyDTO, error) {
+	settings, err := s.getSettings(tenantID)
+	if err != nil {
+		return dto.PasswordPolicyDTO{}, err
+	}
+	if settings.PasswordPolicy == nil {
+		return s.defaultPasswordPolicy, nil
+	}
+
+	policy := settings.PasswordPolicy
+	return dto.PasswordPolicyDTO{
+		MinLength:            policy.MinLength,
+		MaxLength:            policy.MaxLength,
+		RequireUppercase:     policy.RequireUppercase,
+		RequireLowercase:     policy.RequireLowercase,
+		RequireDigit:         policy.RequireDigit,
+		RequireSymbol:        policy.RequireSymbol,
+		DisallowPersonalInfo: policy.DisallowPersonalInfo,
+		HistoryDepth:         policy.HistoryDepth,
+		MaxAgeDays:           policy.MaxAgeDays,
+	}, nil
+}
+
+// UpdatePasswordPolicy replaces the tenant's password policy. It applies to
+// passwords set from now on, and a shorter maximum age to existing ones.
+func (s *TenantSettingsService) UpdatePasswordPolicy(tenantID uint, policyDTO dto.PasswordPolicyDTO) error {
+	if err := validatePasswordPolicy(policyDTO); err != nil {
+		return err
+	}
+
+	settings, err := s.getSettings(tenantID)
+	if err != nil {
+		return err
+	}
+
+	settings.PasswordPolicy = &models.PasswordPolicy{
+		MinLength:            policyDTO.MinLength,
+		MaxLength:            policyDTO.MaxLength,
+		RequireUppercase:     policyDTO.RequireUppercase,
+		RequireLowercase:     policyDTO.RequireLowercase,
+		RequireDigit:         policyDTO.RequireDigit,
+		RequireSymbol:        policyDTO.RequireSymbol,
+		DisallowPersonalInfo: policyDTO.DisallowPersonalInfo,
+		HistoryDepth:         policyDTO.HistoryDepth,
+		MaxAgeDays:           policyDTO.MaxAgeDays,
+	}
+	settings.UpdatedAt = time.Now()
+	return s.tenantSettingsRepository.Save(settings)
+}
+
+// ResetPasswordPolicy removes the tenant's own password policy so the
+// server's default applies again
+func (s *TenantSettingsService) ResetPasswordPolicy(tenantID uint) error {
+	settings, err := s.getSettings(tenantID)
+	if err != nil {
+		return err
+	}
+
+	settings.PasswordPolicy = nil
+	settings.UpdatedAt = time.Now()
+	return s.tenantSettingsRepository.Save(settings)
+}
+
+// getSettings returns the tenant's settings, or unsaved defaults when the
+// tenant has none yet
+func (s *TenantSettingsService) getSettings(tenantID uint) (*models.TenantSettings, error) {
+	settings, err := s.tenantSettingsRepository.GetByTenantID(tenantID)
+	if err == nil {
+		return settings, nil
+	} else if err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+
+	_, err = s.tenantRepository.GetByID(tenantID)
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return nil, config.ErrTenantNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return &models.TenantSettings{
+		TenantID:  tenantID,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}, nil
+}
+
+// ParseNetwork accepts a CIDR prefix or a single IP address, such as a trusted
+// network or proxy
+func ParseNetwork(network string) (netip.Prefix, error) {
+	network = strings.TrimSpace(network)
+	if strings.Contains(network, "/") {
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(network)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
+
+func validatePasswordPolicy(policyDTO dto.PasswordPolicyDTO) error {
+	if policyDTO.MinLength < 1 || policyDTO.MaxLength < 0 || policyDTO.MaxAgeDays < 0 {
+		return config.ErrInvalidPasswordPolicy
+	}
+	if policyDTO.MaxLength > 0 && policyDTO.MaxLength < policyDTO.MinLength {
+		return config.ErrInvalidPasswordPolicy
+	}
+	if policyDTO.HistoryDepth < 0 || policyDTO.HistoryDepth > config.MaxPasswordHistoryDepth {
+		return config.ErrInvalidPasswordPolicy
+	}
+	return nil
+}
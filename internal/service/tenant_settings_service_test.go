@@ -0,0 +1,114 @@
+package service
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/internal/config"
+)
+
+func TestUpdateMFAPolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     dto.MFAPolicyDTO
+		wantErr    error
+		wantPolicy dto.MFAPolicyDTO
+	}{
+		{name: "defaults to optional MFA", wantPolicy: dto.MFAPolicyDTO{RequiredRoles: []string{}, TrustedNetworks: []string{}}},
+		{
+			name:       "removes duplicate roles",
+			policy:     dto.MFAPolicyDTO{RequiredRoles: []string{config.UserRoleTenantAdmin, config.UserRoleTenantAdmin}},
+			wantPolicy: dto.MFAPolicyDTO{RequiredRoles: []string{config.UserRoleTenantAdmin}, TrustedNetworks: []string{}},
+		},
+		{
+			name:       "normalises networks",
+			policy:     dto.MFAPolicyDTO{RequireAll: true, TrustedNetworks: []string{"10.1.2.3/8", " 192.0.2.1 ", "::ffff:198.51.100.7", "2001:db8::1/32"}},
+			wantPolicy: dto.MFAPolicyDTO{RequireAll: true, RequiredRoles: []string{}, TrustedNetworks: []string{"10.0.0.0/8", "192.0.2.1/32", "198.51.100.7/32", "2001:db8::/32"}},
+		},
+		{name: "rejects an unknown role", policy: dto.MFAPolicyDTO{RequiredRoles: []string{"owner"}}, wantErr: config.ErrInvalidRole},
+		{name: "rejects an invalid network", policy: dto.MFAPolicyDTO{TrustedNetworks: []string{"10.0.0.0/33"}}, wantErr: config.ErrInvalidNetwork},
+		{name: "rejects a host name", policy: dto.MFAPolicyDTO{TrustedNetworks: []string{"office.example.com"}}, wantErr: config.ErrInvalidNetwork},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServices(t)
+			user := s.createUser(t, "user@example.com")
+
+			if err := s.tenantSettings.UpdateMFAPolicy(user.TenantID, tt.policy); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("UpdateMFAPolicy() error = %v, want %v", err, tt.wantErr)
+			} else if err != nil {
+				return
+			}
+
+			policy, err := s.tenantSettings.GetMFAPolicy(user.TenantID)
+			check(t, err)
+			if !reflect.DeepEqual(policy, tt.wantPolicy) {
+				t.Errorf("GetMFAPolicy() = %+v, want %+v", policy, tt.wantPolicy)
+			}
+		})
+	}
+}
+
+func TestMFARequired(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    dto.MFAPolicyDTO
+		role      string
+		ipAddress string
+		want      bool
+	}{
+		{name: "optional by default", ipAddress: "203.0.113.5"},
+		{name: "required for everyone", policy: dto.MFAPolicyDTO{RequireAll: true}, ipAddress: "10.0.0.1", want: true},
+		{name: "required for a listed role", policy: dto.MFAPolicyDTO{RequiredRoles: []string{config.UserRoleTenantAdmin}}, role: config.UserRoleTenantAdmin, want: true},
+		{name: "optional for other roles", policy: dto.MFAPolicyDTO{RequiredRoles: []string{config.UserRoleTenantAdmin}}, ipAddress: "203.0.113.5"},
+		{name: "optional inside a trusted network", policy: dto.MFAPolicyDTO{TrustedNetworks: []string{"10.0.0.0/8"}}, ipAddress: "10.20.30.40"},
+		{name: "accepts IPv4-mapped addresses", policy: dto.MFAPolicyDTO{TrustedNetworks: []string{"10.0.0.0/8"}}, ipAddress: "::ffff:10.20.30.40"},
+		{name: "required outside the trusted networks", policy: dto.MFAPolicyDTO{TrustedNetworks: []string{"10.0.0.0/8"}}, ipAddress: "203.0.113.5", want: true},
+		{name: "required for an unparseable address", policy: dto.MFAPolicyDTO{TrustedNetworks: []string{"10.0.0.0/8"}}, ipAddress: "unknown", want: true},
+		{name: "a trusted network does not exempt a listed role", policy: dto.MFAPolicyDTO{RequiredRoles: []string{config.UserRoleTenantUser}, TrustedNetworks: []string{"10.0.0.0/8"}}, ipAddress: "10.0.0.1", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServices(t)
+			user := s.createUser(t, "user@example.com")
+			if tt.role != "" {
+				user.Role = tt.role
+			}
+			check(t, s.tenantSettings.UpdateMFAPolicy(user.TenantID, tt.policy))
+
+			got, err := s.tenantSettings.MFARequired(user, tt.ipAddress)
+			check(t, err)
+			if got != tt.want {
+				t.Errorf("MFARequired() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoginEnforcesMFAPolicy(t *testing.T) {
+	s := newTestServices(t)
+	user := s.createUser(t, "user@example.com")
+	check(t, s.tenantSettings.UpdateMFAPolicy(user.TenantID, dto.MFAPolicyDTO{RequireAll: true}))
+
+	response := s.loginUser(t, user.Email)
+	if !response.MFAEnrolmentRequired || response.AccessToken != "" {
+		t.Fatalf("Login() = %+v, want MFA enrolment to be required", response)
+	}
+
+	enrolment, err := s.mfa.EnrolTOTPForChallenge(response.MFAToken)
+	check(t, err)
+	response, err = s.login.CompleteTOTPEnrolment(dto.MFAVerifyDTO{MFAToken: response.MFAToken, Code: totpCode(t, enrolment.Secret, 0)}, "127.0.0.1")
+	check(t, err)
+	if response.AccessToken == "" || len(response.RecoveryCodes) != config.RecoveryCodeCount {
+		t.Errorf("CompleteTOTPEnrolment() = %+v, want tokens and recovery codes", response)
+	}
+
+	// Once enrolled, the user is challenged like any other MFA user
+	if response := s.loginUser(t, user.Email); !response.MFARequired {
+		t.Errorf("Login() after enrolment = %+v, want an MFA challenge", response)
+	}
+}
@@ -0,0 +1,314 @@
+package service
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// AccessTokenClaims are the claims carried by access tokens. The custom claims
+// mirror authmodels.TokenDTO so tokens remain readable by gin-middleware.
+type AccessTokenClaims struct {
+	CompanyID string        `json:"company_id"`
+	Email     string        `json:"email"`
+	FirstName string        `json:"first_name"`
+	LastName  string        `json:"last_name"`
+	Role      string        `json:"role"`
+	SessionID string        `json:"sid,omitempty"`
+	Scope     string        `json:"scope,omitempty"`
+	ClientID  string        `json:"client_id,omitempty"`
+	Actor     *dto.ActorDTO `json:"act,omitempty"`
+	AuthTime  int64         `json:"auth_time,omitempty"`
+	ACR       string        `json:"acr,omitempty"`
+	AMR       []string      `json:"amr,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// IDTokenClaims are the OpenID Connect ID token claims. Profile and email
+// claims are only included when the matching scope was granted.
+type IDTokenClaims struct {
+	AuthTime        int64    `json:"auth_time,omitempty"`
+	ACR             string   `json:"acr,omitempty"`
+	AMR             []string `json:"amr,omitempty"`
+	Nonce           string   `json:"nonce,omitempty"`
+	AuthorizedParty string   `json:"azp,omitempty"`
+	CompanyID       string   `json:"company_id"`
+	Name            string   `json:"name,omitempty"`
+	GivenName       string   `json:"given_name,omitempty"`
+	FamilyName      string   `json:"family_name,omitempty"`
+	Email           string   `json:"email,omitempty"`
+	EmailVerified   *bool    `json:"email_verified,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// TokenGrant describes the session and authorisation a token is issued under.
+// SessionID ties tokens to the refresh token family they were issued with;
+// ClientID and Scope are set for tokens issued to OAuth clients. AuthTime and
+// AMR record when and how the user last authenticated in the session.
+type TokenGrant struct {
+	SessionID string
+	ClientID  string
+	Scope     string
+	AuthTime  time.Time
+	AMR       []string
+}
+
+type TokenService struct {
+	keyService     *KeyService
+	issuer         string
+	audience       string
+	accessTokenTTL time.Duration
+}
+
+func NewTokenService(keyService *KeyService, issuer, audience string, accessTokenTTL time.Duration) *TokenService {
+	return &TokenService{
+		keyService:     keyService,
+		issuer:         issuer,
+		audience:       audience,
+		accessTokenTTL: accessTokenTTL,
+	}
+}
+
+// AccessTokenTTL returns the lifetime of issued access tokens
+func (s *TokenService) AccessTokenTTL() time.Duration {
+	return s.accessTokenTTL
+}
+
+// Issuer returns the "iss" claim of issued tokens
+func (s *TokenService) Issuer() string {
+	return s.issuer
+}
+
+// IssueAccessToken signs a new access token for the given user under the grant
+func (s *TokenService) IssueAccessToken(user *models.User, grant TokenGrant) (string, error) {
+	now := time.Now()
+	claims := AccessTokenClaims{
+		CompanyID: strconv.FormatUint(uint64(user.TenantID), 10),
+		Email:     user.Email,
+		FirstName: user.FirstName,
+		LastName:  user.LastName,
+		Role:      user.Role,
+		SessionID: grant.SessionID,
+		Scope:     grant.Scope,
+		ClientID:  grant.ClientID,
+		AMR:       grant.AMR,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			Issuer:    s.issuer,
+			Subject:   strconv.FormatUint(uint64(user.ID), 10),
+			Audience:  jwt.ClaimStrings{s.audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(s.accessTokenTTL)),
+		},
+	}
+	if !grant.AuthTime.IsZero() {
+		claims.AuthTime = grant.AuthTime.Unix()
+		claims.ACR = authenticationContext(grant.AMR)
+	}
+
+	return s.sign(claims, config.JWTTypeAccessToken)
+}
+
+// IssueClientAccessToken signs an access token for a client acting on its own
+// behalf. The subject is the client ID and the token carries the client's tenant.
+func (s *TokenService) IssueClientAccessToken(client *models.Client, scope string) (string, error) {
+	now := time.Now()
+	claims := AccessTokenClaims{
+		CompanyID: strconv.FormatUint(uint64(client.TenantID), 10),
+		Scope:     scope,
+		ClientID:  client.ClientID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			Issuer:    s.issuer,
+			Subject:   client.ClientID,
+			Audience:  jwt.ClaimStrings{s.audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(s.accessTokenTTL)),
+		},
+	}
+
+	return s.sign(claims, config.JWTTypeAccessToken)
+}
+
+// IssueDelegatedAccessToken signs an access token for the user of an exchanged
+// subject token (RFC 8693). The token is restricted to the audience, names the
+// acting client in the act claim and never outlives the subject token.
+func (s *TokenService) IssueDelegatedAccessToken(user *models.User, grant TokenGrant, audience []string, actor *dto.ActorDTO, notAfter time.Time) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(s.accessTokenTTL)
+	if notAfter.Before(expiresAt) {
+		expiresAt = notAfter
+	}
+
+	claims := AccessTokenClaims{
+		CompanyID: strconv.FormatUint(uint64(user.TenantID), 10),
+		Email:     user.Email,
+		FirstName: user.FirstName,
+		LastName:  user.LastName,
+		Role:      user.Role,
+		SessionID: grant.SessionID,
+		Scope:     grant.Scope,
+		ClientID:  grant.ClientID,
+		Actor:     actor,
+		AMR:       grant.AMR,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			Issuer:    s.issuer,
+			Subject:   strconv.FormatUint(uint64(user.ID), 10),
+			Audience:  jwt.ClaimStrings(audience),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+	if !grant.AuthTime.IsZero() {
+		claims.AuthTime = grant.AuthTime.Unix()
+		claims.ACR = authenticationContext(grant.AMR)
+	}
+
+	signedToken, err := s.sign(claims, config.JWTTypeAccessToken)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return signedToken, expiresAt, nil
+}
+
+// IssueIDToken signs an OpenID Connect ID token for the client named in the grant
+func (s *TokenService) IssueIDToken(user *models.User, grant TokenGrant, nonce string) (string, error) {
+	now := time.Now()
+	claims := IDTokenClaims{
+		Nonce:           nonce,
+		AuthorizedParty: grant.ClientID,
+		CompanyID:       strconv.FormatUint(uint64(user.TenantID), 10),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.issuer,
+			Subject:   strconv.FormatUint(uint64(user.ID), 10),
+			Audience:  jwt.ClaimStrings{grant.ClientID},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(s.accessTokenTTL)),
+		},
+	}
+	if !grant.AuthTime.IsZero() {
+		claims.AuthTime = grant.AuthTime.Unix()
+		claims.ACR = authenticationContext(grant.AMR)
+		claims.AMR = grant.AMR
+	}
+	if hasScope(grant.Scope, config.ScopeProfile) {
+		claims.Name = strings.TrimSpace(user.FirstName + " " + user.LastName)
+		claims.GivenName = user.FirstName
+		claims.FamilyName = user.LastName
+	}
+	if hasScope(grant.Scope, config.ScopeEmail) {
+		claims.Email = user.Email
+		claims.EmailVerified = &user.IsEmailVerified
+	}
+
+	return s.sign(claims, config.JWTTypeGeneric)
+}
+
+// AuthenticatedAt returns the time of the user's last authentication in the
+// session, or false for tokens without an auth_time claim
+func (c *AccessTokenClaims) AuthenticatedAt() (time.Time, bool) {
+	if c.AuthTime == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(c.AuthTime, 0), true
+}
+
+// UserID returns the numeric user ID held in the subject claim
+func (c *AccessTokenClaims) UserID() (uint, error) {
+	return parseIDClaim(c.Subject)
+}
+
+// IsClientToken reports whether the token was issued to a client acting on its
+// own behalf rather than for a user
+func (c *AccessTokenClaims) IsClientToken() bool {
+	return c.ClientID != "" && c.Subject == c.ClientID
+}
+
+// TenantID returns the numeric tenant ID held in the company_id claim
+func (c *AccessTokenClaims) TenantID() (uint, error) {
+	return parseIDClaim(c.CompanyID)
+}
+
+// ParseAccessToken verifies the signature, expiry, issuer and audience of an
+// access token. Tokens issued before access tokens were typed carry the
+// generic JWT type and are still accepted if they have a jti, which ID tokens
+// never have.
+func (s *TokenService) ParseAccessToken(tokenString string) (*AccessTokenClaims, error) {
+	return s.parseAccessToken(tokenString, s.audience, true)
+}
+
+// ParseAccessTokenForAudience verifies an access token like ParseAccessToken
+// but requires the given audience, such as a client ID named by token exchange.
+// Only tokens typed as access tokens are accepted, since ID tokens are issued
+// to client audiences too.
+func (s *TokenService) ParseAccessTokenForAudience(tokenString, audience string) (*AccessTokenClaims, error) {
+	return s.parseAccessToken(tokenString, audience, false)
+}
+
+func (s *TokenService) parseAccessToken(tokenString, audience string, allowUntyped bool) (*AccessTokenClaims, error) {
+	claims := &AccessTokenClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, s.keyService.VerificationKey,
+		jwt.WithIssuer(s.issuer),
+		jwt.WithAudience(audience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil || !token.Valid {
+		return nil, config.ErrInvalidToken
+	}
+
+	typ, _ := token.Header["typ"].(string)
+	typ = strings.TrimPrefix(strings.ToLower(typ), "application/")
+	untyped := typ == "" || typ == strings.ToLower(config.JWTTypeGeneric)
+	if typ != config.JWTTypeAccessToken && !(allowUntyped && untyped && claims.ID != "") {
+		return nil, config.ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// sign signs the claims with the active key, setting the typ header and
+// naming the key in the kid header
+func (s *TokenService) sign(claims jwt.Claims, typ string) (string, error) {
+	key, err := s.keyService.SigningKey()
+	if err != nil {
+		return "", config.ErrFailedToIssueToken
+	}
+
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["typ"] = typ
+	if key.KID != "" {
+		token.Header["kid"] = key.KID
+	}
+
+	signedToken, err := token.SignedString(key.PrivateKey)
+	if err != nil {
+		return "", config.ErrFailedToIssueToken
+	}
+	return signedToken, nil
+}
+
+// authenticationContext returns the acr value for the authentication methods
+// of a session. Sessions that used more than one factor are multi-factor.
+func authenticationContext(amr []string) string {
+	if containsString(amr, config.AMRMultiFactor) {
+		return config.ACRMultiFactor
+	}
+	return config.ACRSingleFactor
+}
+
+func parseIDClaim(value string) (uint, error) {
+	id, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, config.ErrInvalidToken
+	}
+	return uint(id), nil
+}
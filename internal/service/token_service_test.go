@@ -0,0 +1,134 @@
+package service
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func newTestTokenService(t *testing.T, secret, issuer, audience string, ttl time.Duration) *TokenService {
+	keyService, err := NewKeyService(nil, secret, config.SigningAlgorithmHS256, 0, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewTokenService(keyService, issuer, audience, ttl)
+}
+
+func TestParseAccessToken(t *testing.T) {
+	user := &models.User{ID: 7, TenantID: 3, Email: "user@example.com", Role: config.UserRoleTenantUser}
+	tokenService := newTestTokenService(t, "secret", "issuer", "audience", time.Minute)
+
+	tests := []struct {
+		name    string
+		issue   func() (string, error)
+		wantErr error
+	}{
+		{
+			name:  "accepts a token it issued",
+			issue: func() (string, error) { return tokenService.IssueAccessToken(user, TokenGrant{SessionID: "session"}) },
+		},
+		{
+			name: "rejects an expired token",
+			issue: func() (string, error) {
+				return newTestTokenService(t, "secret", "issuer", "audience", -time.Minute).IssueAccessToken(user, TokenGrant{})
+			},
+			wantErr: config.ErrInvalidToken,
+		},
+		{
+			name: "rejects another issuer",
+			issue: func() (string, error) {
+				return newTestTokenService(t, "secret", "other", "audience", time.Minute).IssueAccessToken(user, TokenGrant{})
+			},
+			wantErr: config.ErrInvalidToken,
+		},
+		{
+			name: "rejects another audience",
+			issue: func() (string, error) {
+				return newTestTokenService(t, "secret", "issuer", "other", time.Minute).IssueAccessToken(user, TokenGrant{})
+			},
+			wantErr: config.ErrInvalidToken,
+		},
+		{
+			name: "rejects another signing key",
+			issue: func() (string, error) {
+				return newTestTokenService(t, "other", "issuer", "audience", time.Minute).IssueAccessToken(user, TokenGrant{})
+			},
+			wantErr: config.ErrInvalidToken,
+		},
+		{
+			name: "rejects an unsigned token",
+			issue: func() (string, error) {
+				claims := AccessTokenClaims{RegisteredClaims: jwt.RegisteredClaims{
+					Issuer:    "issuer",
+					Subject:   "7",
+					Audience:  jwt.ClaimStrings{"audience"},
+					ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+				}}
+				return jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+			},
+			wantErr: config.ErrInvalidToken,
+		},
+		{
+			name: "accepts an untyped token issued before access tokens were typed",
+			issue: func() (string, error) {
+				claims := AccessTokenClaims{CompanyID: "3", Role: user.Role, SessionID: "session", RegisteredClaims: jwt.RegisteredClaims{
+					ID:        "jti",
+					Issuer:    "issuer",
+					Subject:   "7",
+					Audience:  jwt.ClaimStrings{"audience"},
+					ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+				}}
+				return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+			},
+		},
+		{
+			name: "rejects an ID token for the audience",
+			issue: func() (string, error) {
+				return tokenService.IssueIDToken(user, TokenGrant{ClientID: "audience"}, "")
+			},
+			wantErr: config.ErrInvalidToken,
+		},
+		{
+			name: "rejects a tampered payload",
+			issue: func() (string, error) {
+				token, err := tokenService.IssueAccessToken(user, TokenGrant{})
+				parts := strings.Split(token, ".")
+				other, _ := tokenService.IssueAccessToken(&models.User{ID: 1, TenantID: 3, Role: config.UserRoleSuperAdmin}, TokenGrant{})
+				parts[1] = strings.Split(other, ".")[1]
+				return strings.Join(parts, "."), err
+			},
+			wantErr: config.ErrInvalidToken,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := tt.issue()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			claims, err := tokenService.ParseAccessToken(token)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ParseAccessToken() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if userID, _ := claims.UserID(); userID != user.ID {
+				t.Errorf("user ID = %d, want %d", userID, user.ID)
+			}
+			if tenantID, _ := claims.TenantID(); tenantID != user.TenantID {
+				t.Errorf("tenant ID = %d, want %d", tenantID, user.TenantID)
+			}
+			if claims.Role != user.Role || claims.SessionID != "session" {
+				t.Errorf("claims = %+v", claims)
+			}
+		})
+	}
+}
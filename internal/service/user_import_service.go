@@ -0,0 +1,172 @@
+package service
+
+import (
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/hasher"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"github.com/geekible-ltd/auth-server/internal/repository"
+	"gorm.io/gorm"
+)
+
+// importedEncodedHashes recognises the algorithms whose exports are complete,
+// self-describing hash strings that can be stored as they are
+var importedEncodedHashes = map[string][]hasher.Validator{
+	"bcrypt": {&hasher.BcryptHasher{}},
+	"argon2": {&hasher.Argon2idHasher{}, hasher.Argon2iVerifier{}},
+	"scrypt": {&hasher.ScryptHasher{}},
+}
+
+// UserImportService creates users exported from another identity provider,
+// keeping their password hashes so they can log in with their existing
+// passwords. The hashes are replaced with the configured hasher's on each
+// user's first login.
+type UserImportService struct {
+	userRepository          *repository.UserRepository
+	tenantLicenceRepository *repository.TenantLicenceRepository
+}
+
+func NewUserImportService(userRepository *repository.UserRepository, tenantLicenceRepository *repository.TenantLicenceRepository) *UserImportService {
+	return &UserImportService{
+		userRepository:          userRepository,
+		tenantLicenceRepository: tenantLicenceRepository,
+	}
+}
+
+// ImportUsers creates the users in the tenant, each taking a licence seat.
+// Users that cannot be imported, for example because their email is already
+// registered or the seats run out, are reported in the result and skipped.
+func (s *UserImportService) ImportUsers(tenantId uint, users []dto.UserImportDTO) (dto.UserImportResultDTO, error) {
+	if len(users) > config.MaxUsersPerImport {
+		return dto.UserImportResultDTO{}, config.ErrTooManyUsersToImport
+	}
+
+	tenantLicence, err := s.tenantLicenceRepository.GetByID(tenantId)
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return dto.UserImportResultDTO{}, config.ErrTenantLicenceNotFound
+	} else if err != nil {
+		return dto.UserImportResultDTO{}, err
+	}
+	if tenantLicence.ExpiryDate != nil && tenantLicence.ExpiryDate.Before(time.Now()) {
+		return dto.UserImportResultDTO{}, config.ErrTenantLicenceExpired
+	}
+
+	result := dto.UserImportResultDTO{Failed: []dto.UserImportFailureDTO{}}
+	for i, userDTO := range users {
+		if err := s.importUser(tenantLicence, userDTO); err != nil {
+			result.Failed = append(result.Failed, dto.UserImportFailureDTO{
+				Index: i,
+				Email: userDTO.Email,
+				Error: err.Error(),
+			})
+			continue
+		}
+		result.Imported++
+	}
+	return result, nil
+}
+
+func (s *UserImportService) importUser(tenantLicence *models.TenantLicence, userDTO dto.UserImportDTO) error {
+	if userDTO.Email == "" {
+		return config.ErrEmailRequired
+	}
+	role := userDTO.Role
+	if role == "" {
+		role = config.UserRoleTenantUser
+	} else if !containsString(userRoles, role) {
+		return config.ErrInvalidRole
+	}
+
+	passwordHash := ""
+	if userDTO.Password != nil {
+		var err error
+		passwordHash, err = importedPasswordHash(*userDTO.Password)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := s.userRepository.GetByEmail(userDTO.Email)
+	if err == nil {
+		return config.ErrUserAlreadyExists
+	} else if err != gorm.ErrRecordNotFound {
+		return err
+	}
+	if tenantLicence.UsedSeats >= tenantLicence.LicencedSeats {
+		return config.ErrTenantLicenceExceeded
+	}
+
+	user := &models.User{
+		TenantID:            tenantLicence.TenantID,
+		FirstName:           userDTO.FirstName,
+		LastName:            userDTO.LastName,
+		Email:               userDTO.Email,
+		PasswordHash:        passwordHash,
+		FailedLoginAttempts: 0,
+		IsActive:            true,
+		Role:                role,
+		IsEmailVerified:     userDTO.IsEmailVerified,
+		CreatedAt:           time.Now(),
+		UpdatedAt:           time.Now(),
+	}
+	if err := s.userRepository.Create(user); err != nil {
+		return config.ErrFailedToCreateUser
+	}
+
+	tenantLicence.UsedSeats++
+	return s.tenantLicenceRepository.Update(tenantLicence)
+}
+
+// importedPasswordHash converts an exported password hash to the tagged
+// string stored in models.User.PasswordHash. The hash itself is kept as it is,
+// but is parsed as it would be at login, so a hash that could never be
+// verified or whose parameters are beyond the verification limits is refused.
+func importedPasswordHash(passwordDTO dto.ImportedPasswordDTO) (string, error) {
+	algorithm := strings.ToLower(passwordDTO.Algorithm)
+	if verifiers, ok := importedEncodedHashes[algorithm]; ok {
+		for _, verifier := range verifiers {
+			if verifier.Handles(passwordDTO.Hash) {
+				return validImportedHash(verifier, passwordDTO.Hash)
+			}
+		}
+		return "", config.ErrMalformedPasswordHash
+	}
+
+	switch algorithm {
+	case "pbkdf2-sha256":
+		salt, errS := decodeImportedBase64(passwordDTO.Salt)
+		key, errK := decodeImportedBase64(passwordDTO.Hash)
+		if errS != nil || errK != nil {
+			return "", config.ErrMalformedPasswordHash
+		}
+		return validImportedHash(hasher.PBKDF2SHA256Verifier{}, hasher.FormatPBKDF2SHA256(passwordDTO.Iterations, salt, key))
+	case "salted-sha512":
+		saltPosition := strings.ToLower(passwordDTO.SaltPosition)
+		if saltPosition == "" {
+			saltPosition = hasher.SaltPositionSuffix
+		}
+		salt, errS := decodeImportedBase64(passwordDTO.Salt)
+		digest, errD := decodeImportedBase64(passwordDTO.Hash)
+		if errS != nil || errD != nil {
+			return "", config.ErrMalformedPasswordHash
+		}
+		return validImportedHash(hasher.SaltedSHA512Verifier{}, hasher.FormatSaltedSHA512(saltPosition, salt, digest))
+	}
+	return "", config.ErrUnsupportedPasswordHash
+}
+
+func validImportedHash(validator hasher.Validator, hash string) (string, error) {
+	if err := validator.Validate(hash); err != nil {
+		return "", config.ErrMalformedPasswordHash
+	}
+	return hash, nil
+}
+
+// decodeImportedBase64 accepts base64 with or without padding, as exports differ
+func decodeImportedBase64(value string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.TrimRight(value, "="))
+}
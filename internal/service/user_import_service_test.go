@@ -0,0 +1,219 @@
+package service
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/hasher"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"github.com/geekible-ltd/auth-server/internal/repository"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// newTestImport returns an import service for the tenant of a new user, whose
+// licence has the given number of seats, one of them taken by that user. The
+// database must hold tenant licences.
+func newTestImport(t *testing.T, db *gorm.DB, seats int) (*UserImportService, uint) {
+	t.Helper()
+
+	user := createTestUser(t, db, "existing@example.com")
+	check(t, db.Create(&models.TenantLicence{TenantID: user.TenantID, LicenceKey: "licence", LicencedSeats: seats, UsedSeats: 1}).Error)
+	return NewUserImportService(repository.NewUserRepository(db), repository.NewTenantLicenceRepository(db)), user.TenantID
+}
+
+func TestImportUsers(t *testing.T) {
+	bcryptHash, _ := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	argon2idHash, _ := hasher.NewArgon2idHasher(64, 1, 1).Hash(testPassword)
+	pbkdf2Key := []byte("exported-key")
+
+	tests := []struct {
+		name     string
+		user     dto.UserImportDTO
+		seats    int
+		wantErr  error
+		wantHash string
+	}{
+		{
+			name:     "imports a bcrypt hash as it is",
+			user:     dto.UserImportDTO{Email: "user@example.com", Password: &dto.ImportedPasswordDTO{Algorithm: "bcrypt", Hash: string(bcryptHash)}},
+			wantHash: string(bcryptHash),
+		},
+		{
+			name:     "imports an argon2id hash as it is",
+			user:     dto.UserImportDTO{Email: "user@example.com", Password: &dto.ImportedPasswordDTO{Algorithm: "Argon2", Hash: argon2idHash}},
+			wantHash: argon2idHash,
+		},
+		{
+			name: "tags a pbkdf2-sha256 hash, with padded base64",
+			user: dto.UserImportDTO{Email: "user@example.com", Password: &dto.ImportedPasswordDTO{
+				Algorithm:  "pbkdf2-sha256",
+				Hash:       base64.StdEncoding.EncodeToString(pbkdf2Key),
+				Salt:       "c2FsdA==",
+				Iterations: 27500,
+			}},
+			wantHash: hasher.FormatPBKDF2SHA256(27500, []byte("salt"), pbkdf2Key),
+		},
+		{name: "imports a user without a password", user: dto.UserImportDTO{Email: "user@example.com"}},
+		{
+			name:    "rejects an unsupported algorithm",
+			user:    dto.UserImportDTO{Email: "user@example.com", Password: &dto.ImportedPasswordDTO{Algorithm: "md5", Hash: "1bc29b36f623ba82aaf6724fd3b16718"}},
+			wantErr: config.ErrUnsupportedPasswordHash,
+		},
+		{
+			name:    "rejects a hash of another algorithm than claimed",
+			user:    dto.UserImportDTO{Email: "user@example.com", Password: &dto.ImportedPasswordDTO{Algorithm: "scrypt", Hash: argon2idHash}},
+			wantErr: config.ErrMalformedPasswordHash,
+		},
+		{
+			name:    "rejects a truncated bcrypt hash",
+			user:    dto.UserImportDTO{Email: "user@example.com", Password: &dto.ImportedPasswordDTO{Algorithm: "bcrypt", Hash: string(bcryptHash[:40])}},
+			wantErr: config.ErrMalformedPasswordHash,
+		},
+		{
+			name:    "rejects a bcrypt cost beyond the verification limit",
+			user:    dto.UserImportDTO{Email: "user@example.com", Password: &dto.ImportedPasswordDTO{Algorithm: "bcrypt", Hash: "$2a$31$" + string(bcryptHash[7:])}},
+			wantErr: config.ErrMalformedPasswordHash,
+		},
+		{
+			name:    "rejects argon2 memory beyond the verification limit",
+			user:    dto.UserImportDTO{Email: "user@example.com", Password: &dto.ImportedPasswordDTO{Algorithm: "argon2", Hash: strings.Replace(argon2idHash, "m=64", "m=4294967295", 1)}},
+			wantErr: config.ErrMalformedPasswordHash,
+		},
+		{
+			name:    "rejects an argon2 hash with bad base64",
+			user:    dto.UserImportDTO{Email: "user@example.com", Password: &dto.ImportedPasswordDTO{Algorithm: "argon2", Hash: "$argon2i$v=19$m=64,t=1,p=1$c2FsdA$!!!"}},
+			wantErr: config.ErrMalformedPasswordHash,
+		},
+		{
+			name:    "rejects a scrypt block size beyond the verification limit",
+			user:    dto.UserImportDTO{Email: "user@example.com", Password: &dto.ImportedPasswordDTO{Algorithm: "scrypt", Hash: "$scrypt$ln=4,r=1024,p=1$c2FsdA$a2V5"}},
+			wantErr: config.ErrMalformedPasswordHash,
+		},
+		{
+			name:    "rejects pbkdf2-sha256 iterations beyond the verification limit",
+			user:    dto.UserImportDTO{Email: "user@example.com", Password: &dto.ImportedPasswordDTO{Algorithm: "pbkdf2-sha256", Hash: "a2V5", Salt: "c2FsdA", Iterations: 1_000_000_000}},
+			wantErr: config.ErrMalformedPasswordHash,
+		},
+		{
+			name:    "rejects pbkdf2-sha256 without iterations",
+			user:    dto.UserImportDTO{Email: "user@example.com", Password: &dto.ImportedPasswordDTO{Algorithm: "pbkdf2-sha256", Hash: "a2V5", Salt: "c2FsdA"}},
+			wantErr: config.ErrMalformedPasswordHash,
+		},
+		{
+			name:    "rejects a salted SHA-512 digest of the wrong length",
+			user:    dto.UserImportDTO{Email: "user@example.com", Password: &dto.ImportedPasswordDTO{Algorithm: "salted-sha512", Hash: "a2V5", Salt: "c2FsdA"}},
+			wantErr: config.ErrMalformedPasswordHash,
+		},
+		{name: "rejects a registered email", user: dto.UserImportDTO{Email: "existing@example.com"}, wantErr: config.ErrUserAlreadyExists},
+		{name: "rejects an unknown role", user: dto.UserImportDTO{Email: "user@example.com", Role: "owner"}, wantErr: config.ErrInvalidRole},
+		{name: "rejects a user without an email", user: dto.UserImportDTO{}, wantErr: config.ErrEmailRequired},
+		{name: "stops when the seats run out", user: dto.UserImportDTO{Email: "user@example.com"}, seats: 1, wantErr: config.ErrTenantLicenceExceeded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t, &models.TenantLicence{})
+			if tt.seats == 0 {
+				tt.seats = 10
+			}
+			importService, tenantID := newTestImport(t, db, tt.seats)
+
+			result, err := importService.ImportUsers(tenantID, []dto.UserImportDTO{tt.user})
+			check(t, err)
+			if tt.wantErr != nil {
+				if result.Imported != 0 || len(result.Failed) != 1 || result.Failed[0].Error != tt.wantErr.Error() {
+					t.Errorf("ImportUsers() = %+v, want the user to fail with %v", result, tt.wantErr)
+				}
+				return
+			}
+			if result.Imported != 1 || len(result.Failed) != 0 {
+				t.Fatalf("ImportUsers() = %+v, want the user imported", result)
+			}
+
+			var user models.User
+			check(t, db.First(&user, "email = ?", tt.user.Email).Error)
+			if user.TenantID != tenantID || user.Role != config.UserRoleTenantUser || user.PasswordHash != tt.wantHash {
+				t.Errorf("imported user = tenant %d role %q hash %q, want tenant %d role %q hash %q", user.TenantID, user.Role, user.PasswordHash, tenantID, config.UserRoleTenantUser, tt.wantHash)
+			}
+			var licence models.TenantLicence
+			check(t, db.First(&licence, "tenant_id = ?", tenantID).Error)
+			if licence.UsedSeats != 2 {
+				t.Errorf("UsedSeats = %d, want 2", licence.UsedSeats)
+			}
+		})
+	}
+}
+
+func TestImportUsersSkipsFailures(t *testing.T) {
+	importService, tenantID := newTestImport(t, newTestDB(t, &models.TenantLicence{}), 10)
+
+	result, err := importService.ImportUsers(tenantID, []dto.UserImportDTO{
+		{Email: "first@example.com"},
+		{Email: "first@example.com"},
+		{Email: "second@example.com"},
+	})
+	check(t, err)
+	if result.Imported != 2 || len(result.Failed) != 1 || result.Failed[0].Index != 1 || result.Failed[0].Email != "first@example.com" {
+		t.Errorf("ImportUsers() = %+v, want the duplicate at index 1 skipped", result)
+	}
+
+	if _, err := importService.ImportUsers(tenantID, make([]dto.UserImportDTO, config.MaxUsersPerImport+1)); !errors.Is(err, config.ErrTooManyUsersToImport) {
+		t.Errorf("ImportUsers() of too many users error = %v, want %v", err, config.ErrTooManyUsersToImport)
+	}
+}
+
+func TestImportedUserLogin(t *testing.T) {
+	// The hashes are the exporting provider's, of testPassword with salt "salt"
+	tests := []struct {
+		name     string
+		password dto.ImportedPasswordDTO
+	}{
+		{
+			name: "pbkdf2-sha256",
+			password: dto.ImportedPasswordDTO{
+				Algorithm:  "pbkdf2-sha256",
+				Hash:       "RKX4PvFY9blw53BAziKgyYSQFXpvw4KCYOQngBVuSIk",
+				Salt:       "c2FsdA",
+				Iterations: 1000,
+			},
+		},
+		{
+			name: "salted-sha512",
+			password: dto.ImportedPasswordDTO{
+				Algorithm:    "salted-sha512",
+				Hash:         "0klnsojf0h5p06ei/wr5u42QXEr0oa5pDjBdTW7rUNdNKewaJoQuucDBZDrYiJNXtpWqSSDhPYYq+/CDy3MZ5Q",
+				Salt:         "c2FsdA",
+				SaltPosition: hasher.SaltPositionPrefix,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServices(t)
+			importService, tenantID := newTestImport(t, s.db, 10)
+			result, err := importService.ImportUsers(tenantID, []dto.UserImportDTO{{Email: "user@example.com", IsEmailVerified: true, Password: &tt.password}})
+			check(t, err)
+			if result.Imported != 1 {
+				t.Fatalf("ImportUsers() = %+v, want the user imported", result)
+			}
+
+			if _, err := s.login.Login(dto.LoginDTO{Email: "user@example.com", Password: "wrong-password"}, "127.0.0.1"); !errors.Is(err, config.ErrInvalidPassword) {
+				t.Errorf("Login() with a wrong password error = %v, want %v", err, config.ErrInvalidPassword)
+			}
+			s.loginUser(t, "user@example.com")
+
+			// The first login replaces the imported hash with the configured hasher's
+			var user models.User
+			check(t, s.db.First(&user, "email = ?", "user@example.com").Error)
+			if match, needsRehash := s.passwordHash.Verify(testPassword, user.PasswordHash); !match || needsRehash {
+				t.Errorf("Verify() of the stored hash %q = %v, %v, want a current match", user.PasswordHash, match, needsRehash)
+			}
+		})
+	}
+}
@@ -5,16 +5,22 @@ import (
 
 	"github.com/geekible-ltd/auth-server/dto"
 	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/models"
 	"github.com/geekible-ltd/auth-server/internal/repository"
 	"gorm.io/gorm"
 )
 
 type UserService struct {
-	userRepository *repository.UserRepository
+	userRepository           *repository.UserRepository
+	revocationService        *RevocationService
+	passwordPolicyService    *PasswordPolicyService
+	passwordHashService      *PasswordHashService
+	lockoutService           *LockoutService
+	emailVerificationService *EmailVerificationService
 }
 
-func NewUserService(userRepository *repository.UserRepository) *UserService {
-	return &UserService{userRepository: userRepository}
+func NewUserService(userRepository *repository.UserRepository, revocationService *RevocationService, passwordPolicyService *PasswordPolicyService, passwordHashService *PasswordHashService, lockoutService *LockoutService, emailVerificationService *EmailVerificationService) *UserService {
+	return &UserService{userRepository: userRepository, revocationService: revocationService, passwordPolicyService: passwordPolicyService, passwordHashService: passwordHashService, lockoutService: lockoutService, emailVerificationService: emailVerificationService}
 }
 
 func (s *UserService) GetUserByID(tenantId, userId uint) (dto.UserResponseDTO, error) {
@@ -26,15 +32,17 @@ func (s *UserService) GetUserByID(tenantId, userId uint) (dto.UserResponseDTO, e
 	}
 
 	return dto.UserResponseDTO{
-		ID:          user.ID,
-		TenantID:    user.TenantID,
-		FirstName:   user.FirstName,
-		LastName:    user.LastName,
-		Email:       user.Email,
-		Role:        user.Role,
-		IsActive:    user.IsActive,
-		LastLoginAt: user.LastLoginAt,
-		CreatedAt:   user.CreatedAt,
+		ID:              user.ID,
+		TenantID:        user.TenantID,
+		FirstName:       user.FirstName,
+		LastName:        user.LastName,
+		Email:           user.Email,
+		Role:            user.Role,
+		IsActive:        user.IsActive,
+		IsEmailVerified: user.IsEmailVerified,
+		LockedUntil:     s.lockoutService.LockedUntil(user),
+		LastLoginAt:     user.LastLoginAt,
+		CreatedAt:       user.CreatedAt,
 	}, nil
 }
 
@@ -47,21 +55,33 @@ func (s *UserService) GetAllUsers(tenantId uint) ([]dto.UserResponseDTO, error)
 	usersDTO := []dto.UserResponseDTO{}
 	for _, user := range users {
 		usersDTO = append(usersDTO, dto.UserResponseDTO{
-			ID:          user.ID,
-			TenantID:    user.TenantID,
-			FirstName:   user.FirstName,
-			LastName:    user.LastName,
-			Email:       user.Email,
-			Role:        user.Role,
-			IsActive:    user.IsActive,
-			LastLoginAt: user.LastLoginAt,
-			CreatedAt:   user.CreatedAt,
+			ID:              user.ID,
+			TenantID:        user.TenantID,
+			FirstName:       user.FirstName,
+			LastName:        user.LastName,
+			Email:           user.Email,
+			Role:            user.Role,
+			IsActive:        user.IsActive,
+			IsEmailVerified: user.IsEmailVerified,
+			LockedUntil:     s.lockoutService.LockedUntil(&user),
+			LastLoginAt:     user.LastLoginAt,
+			CreatedAt:       user.CreatedAt,
 		})
 	}
 	return usersDTO, nil
 }
 
+// UpdateUser changes the user's profile and role. An empty role leaves the
+// role unchanged; a new role revokes the user's tokens, which carry the old one.
+// A new email must not belong to any other user, as logins look users up by
+// email alone. It is unverified until the user confirms it from the
+// verification email sent to it, and also revokes the user's tokens and any
+// password reset sent to the old address.
 func (s *UserService) UpdateUser(tenantId, userId uint, userDTO dto.UserUpdateRequestDTO) error {
+	if userDTO.Role != "" && !containsString(userRoles, userDTO.Role) {
+		return config.ErrInvalidRole
+	}
+
 	user, err := s.userRepository.GetByID(tenantId, userId)
 	if err != nil && err == gorm.ErrRecordNotFound {
 		return config.ErrUserNotFound
@@ -69,13 +89,42 @@ func (s *UserService) UpdateUser(tenantId, userId uint, userDTO dto.UserUpdateRe
 		return err
 	}
 
+	roleChanged := userDTO.Role != "" && userDTO.Role != user.Role
+	emailChanged := userDTO.Email != user.Email
+	if emailChanged {
+		existingUser, err := s.userRepository.GetByEmail(userDTO.Email)
+		if err == nil && existingUser.ID != user.ID {
+			return config.ErrUserAlreadyExists
+		} else if err != nil && err != gorm.ErrRecordNotFound {
+			return err
+		}
+	}
+
 	user.FirstName = userDTO.FirstName
 	user.LastName = userDTO.LastName
-	user.Email = userDTO.Email
-	user.Role = userDTO.Role
+	if roleChanged {
+		user.Role = userDTO.Role
+	}
+	if emailChanged {
+		user.Email = userDTO.Email
+		user.IsEmailVerified = false
+		user.ResetPasswordToken = ""
+		user.ResetPasswordTokenExpiresAt = nil
+	}
 	user.UpdatedAt = time.Now()
 
-	return s.userRepository.Update(user)
+	if err := s.userRepository.Update(user); err != nil {
+		return err
+	}
+	if roleChanged || emailChanged {
+		if err := s.revocationService.RevokeUserTokens(user.ID); err != nil {
+			return err
+		}
+	}
+	if emailChanged {
+		return s.sendVerification(user)
+	}
+	return nil
 }
 
 func (s *UserService) DeleteUser(tenantId, userId uint) error {
@@ -92,5 +141,179 @@ func (s *UserService) DeleteUser(tenantId, userId uint) error {
 	user.UpdatedAt = time.Now()
 	user.DeletedAt = &now
 
-	return s.userRepository.Delete(user)
+	if err := s.userRepository.Delete(user); err != nil {
+		return err
+	}
+
+	return s.revocationService.RevokeUserTokens(user.ID)
+}
+
+// UnlockUser ends the user's lockout and clears their failed login attempts
+// and backoff. Deactivated users stay deactivated.
+func (s *UserService) UnlockUser(tenantId, userId uint) error {
+	user, err := s.userRepository.GetByID(tenantId, userId)
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return config.ErrUserNotFound
+	} else if err != nil {
+		return err
+	}
+	if user.DeletedAt != nil {
+		return config.ErrUserNotFound
+	}
+
+	s.lockoutService.Reset(user)
+	user.UpdatedAt = time.Now()
+	return s.userRepository.Update(user)
+}
+
+// LegacyLockouts returns the users that look deactivated by the lockout of
+// earlier versions: inactive, not deleted and with at least
+// config.LegacyMaxFailedLoginAttempts failed logins. Users an administrator
+// deactivated can match too, so review them before ReactivateLegacyLockouts.
+func (s *UserService) LegacyLockouts() ([]dto.UserResponseDTO, error) {
+	users, err := s.userRepository.GetLockedOut(config.LegacyMaxFailedLoginAttempts)
+	if err != nil {
+		return nil, err
+	}
+
+	usersDTO := []dto.UserResponseDTO{}
+	for _, user := range users {
+		usersDTO = append(usersDTO, dto.UserResponseDTO{
+			ID:              user.ID,
+			TenantID:        user.TenantID,
+			FirstName:       user.FirstName,
+			LastName:        user.LastName,
+			Email:           user.Email,
+			Role:            user.Role,
+			IsActive:        user.IsActive,
+			IsEmailVerified: user.IsEmailVerified,
+			LockedUntil:     s.lockoutService.LockedUntil(&user),
+			LastLoginAt:     user.LastLoginAt,
+			CreatedAt:       user.CreatedAt,
+		})
+	}
+	return usersDTO, nil
+}
+
+// ReactivateLegacyLockouts reactivates the users LegacyLockouts returns and
+// returns how many there were
+func (s *UserService) ReactivateLegacyLockouts() (int64, error) {
+	return s.userRepository.ReactivateLockedOut(config.LegacyMaxFailedLoginAttempts)
+}
+
+// ChangePassword replaces the user's password after checking their current
+// one, and revokes every other session of the user. The session sessionID,
+// from which the change was made, stays signed in. Wrong current passwords
+// count towards the user's failed login attempts, and locked out users cannot
+// change their password until the lock expires.
+func (s *UserService) ChangePassword(tenantId, userId uint, sessionID string, changeDTO dto.ChangePasswordDTO) error {
+	user, err := s.userRepository.GetByID(tenantId, userId)
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return config.ErrUserNotFound
+	} else if err != nil {
+		return err
+	}
+	if !user.IsActive {
+		return config.ErrUserNotFound
+	}
+
+	if err := s.checkCurrentPassword(user, changeDTO.CurrentPassword); err != nil {
+		return err
+	}
+	if err := s.setPassword(user, changeDTO.NewPassword); err != nil {
+		return err
+	}
+
+	return s.revocationService.RevokeOtherUserSessions(user.ID, sessionID)
+}
+
+// ChangeExpiredPassword replaces a password that is older than the tenant's
+// maximum password age. Such users cannot log in to call ChangePassword, so
+// they prove who they are with their email and current password instead.
+// Every session of the user is revoked. Unknown and inactive users take as
+// long as a wrong password.
+func (s *UserService) ChangeExpiredPassword(changeDTO dto.ExpiredPasswordChangeDTO) error {
+	user, err := s.userRepository.GetByEmail(changeDTO.Email)
+	if err != nil && err == gorm.ErrRecordNotFound {
+		s.passwordHashService.VerifyDummy(changeDTO.CurrentPassword)
+		return config.ErrUserNotFound
+	} else if err != nil {
+		return err
+	}
+	if !user.IsActive {
+		s.passwordHashService.VerifyDummy(changeDTO.CurrentPassword)
+		return config.ErrUserNotFound
+	}
+
+	if err := s.checkCurrentPassword(user, changeDTO.CurrentPassword); err != nil {
+		return err
+	}
+	expired, err := s.passwordPolicyService.Expired(user)
+	if err != nil {
+		return err
+	} else if !expired {
+		return config.ErrPasswordNotExpired
+	}
+	if err := s.setPassword(user, changeDTO.NewPassword); err != nil {
+		return err
+	}
+
+	return s.revocationService.RevokeUserTokens(user.ID)
+}
+
+// checkCurrentPassword counts a wrong password towards the user's failed
+// login attempts, like a failed login. Locked out users take as long as a
+// wrong password.
+func (s *UserService) checkCurrentPassword(user *models.User, password string) error {
+	if err := s.lockoutService.CheckLocked(user); err != nil {
+		s.passwordHashService.VerifyDummy(password)
+		return err
+	}
+	if match, _ := s.passwordHashService.Verify(password, user.PasswordHash); !match {
+		if err := s.lockoutService.RecordFailure(user); err != nil {
+			return err
+		}
+		return config.ErrInvalidPassword
+	}
+	return nil
+}
+
+// sendVerification emails the user a verification token for their new email.
+// Without a mailer the email stays unverified. The change is already saved
+// when sending fails, so ErrVerificationEmailNotSent tells the caller to
+// resend the verification rather than retry the update.
+func (s *UserService) sendVerification(user *models.User) error {
+	err := s.emailVerificationService.SendVerification(user)
+	if err == nil || err == config.ErrMailerNotConfigured {
+		return nil
+	}
+	return config.ErrVerificationEmailNotSent
+}
+
+// setPassword checks a new password against the password policy and stores
+// it, keeping the old one in the user's password history
+func (s *UserService) setPassword(user *models.User, newPassword string) error {
+	if err := s.passwordPolicyService.Validate(user, newPassword); err != nil {
+		return err
+	}
+
+	passwordHash, err := s.passwordHashService.Hash(newPassword)
+	if err != nil {
+		return config.ErrFailedToHashPassword
+	}
+
+	previousHash := user.PasswordHash
+	now := time.Now()
+	user.PasswordHash = passwordHash
+	user.PasswordChangedAt = &now
+	user.FailedLoginAttempts = 0
+	// A reset link sent before the change must not undo it
+	user.ResetPasswordToken = ""
+	user.ResetPasswordTokenExpiresAt = nil
+	user.UpdatedAt = now
+	if err := s.userRepository.Update(user); err != nil {
+		return err
+	}
+
+	return s.passwordPolicyService.RecordChange(user, previousHash)
 }
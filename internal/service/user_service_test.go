@@ -0,0 +1,226 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/models"
+)
+
+func TestUpdateUserEmail(t *testing.T) {
+	tests := []struct {
+		name          string
+		email         string
+		wantErr       error
+		wantEmail     string
+		wantVerified  bool
+		wantSessionOK bool
+	}{
+		{name: "an unchanged email stays verified", email: "user@example.com", wantEmail: "user@example.com", wantVerified: true, wantSessionOK: true},
+		{name: "a new email must be verified again", email: "new@example.com", wantEmail: "new@example.com"},
+		{name: "rejects the email of another user", email: "taken@example.com", wantErr: config.ErrUserAlreadyExists, wantEmail: "user@example.com", wantVerified: true, wantSessionOK: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServices(t)
+			user := s.createUser(t, "user@example.com")
+			s.createUser(t, "taken@example.com")
+			session := s.loginUser(t, user.Email)
+			resetToken := s.requestReset(t, user.Email)
+			sent := len(s.mailer.messages)
+
+			err := s.user.UpdateUser(user.TenantID, user.ID, dto.UserUpdateRequestDTO{FirstName: "New", LastName: "Name", Email: tt.email})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("UpdateUser() error = %v, want %v", err, tt.wantErr)
+			}
+
+			var got models.User
+			check(t, s.db.First(&got, user.ID).Error)
+			if got.Email != tt.wantEmail || got.IsEmailVerified != tt.wantVerified {
+				t.Errorf("email = %q verified %v, want %q verified %v", got.Email, got.IsEmailVerified, tt.wantEmail, tt.wantVerified)
+			}
+			_, err = s.login.Refresh(dto.RefreshTokenDTO{RefreshToken: session.RefreshToken})
+			if sessionOK := err == nil; sessionOK != tt.wantSessionOK {
+				t.Errorf("session still valid = %v, want %v", sessionOK, tt.wantSessionOK)
+			}
+
+			emailChanged := tt.wantEmail != user.Email
+			if emailChanged {
+				// The verification goes to the new address, and a reset link
+				// sent to the old one no longer works
+				if len(s.mailer.messages) != sent+1 || s.mailer.last().To != tt.wantEmail {
+					t.Errorf("last email to %q, want a verification to %q", s.mailer.last().To, tt.wantEmail)
+				}
+				if err := s.passwordReset.ResetPassword(dto.ResetPasswordDTO{Token: resetToken, NewPassword: newTestPassword}); !errors.Is(err, config.ErrInvalidResetToken) {
+					t.Errorf("ResetPassword() with a token sent before the change error = %v, want %v", err, config.ErrInvalidResetToken)
+				}
+			} else if len(s.mailer.messages) != sent {
+				t.Errorf("sent %d emails, want none", len(s.mailer.messages)-sent)
+			}
+		})
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T, s *testServices, user *models.User)
+		change  dto.ChangePasswordDTO
+		wantErr error
+	}{
+		{name: "changes the password", change: dto.ChangePasswordDTO{CurrentPassword: testPassword, NewPassword: newTestPassword}},
+		{name: "rejects a wrong current password", change: dto.ChangePasswordDTO{CurrentPassword: "wrong-password", NewPassword: newTestPassword}, wantErr: config.ErrInvalidPassword},
+		{name: "rejects a password failing the policy", change: dto.ChangePasswordDTO{CurrentPassword: testPassword, NewPassword: "short"}, wantErr: config.ErrPasswordPolicyViolation},
+		{
+			name: "wrong current passwords lock the user out",
+			setup: func(t *testing.T, s *testServices, user *models.User) {
+				for i := 0; i < config.DefaultMaxFailedLoginAttempts; i++ {
+					err := s.user.ChangePassword(user.TenantID, user.ID, "", dto.ChangePasswordDTO{CurrentPassword: "wrong-password", NewPassword: newTestPassword})
+					if !errors.Is(err, config.ErrInvalidPassword) {
+						t.Fatalf("ChangePassword() error = %v, want %v", err, config.ErrInvalidPassword)
+					}
+				}
+			},
+			change:  dto.ChangePasswordDTO{CurrentPassword: testPassword, NewPassword: newTestPassword},
+			wantErr: config.ErrAccountLocked,
+		},
+		{
+			name: "rejects a password used before",
+			setup: func(t *testing.T, s *testServices, user *models.User) {
+				policy := s.tenantSettings.DefaultPasswordPolicy()
+				policy.HistoryDepth = 2
+				check(t, s.tenantSettings.UpdatePasswordPolicy(user.TenantID, policy))
+				check(t, s.user.ChangePassword(user.TenantID, user.ID, "", dto.ChangePasswordDTO{CurrentPassword: testPassword, NewPassword: "Another-Staple-10"}))
+			},
+			change:  dto.ChangePasswordDTO{CurrentPassword: "Another-Staple-10", NewPassword: testPassword},
+			wantErr: config.ErrPasswordPolicyViolation,
+		},
+		{
+			name: "refuses a deactivated user",
+			setup: func(t *testing.T, s *testServices, user *models.User) {
+				check(t, s.db.Model(user).Update("is_active", false).Error)
+			},
+			change:  dto.ChangePasswordDTO{CurrentPassword: testPassword, NewPassword: newTestPassword},
+			wantErr: config.ErrUserNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServices(t)
+			user := s.createUser(t, "user@example.com")
+			current := s.loginUser(t, user.Email)
+			other := s.loginUser(t, user.Email)
+			claims, err := s.token.ParseAccessToken(current.AccessToken)
+			check(t, err)
+			if tt.setup != nil {
+				tt.setup(t, s, user)
+			}
+
+			err = s.user.ChangePassword(user.TenantID, user.ID, claims.SessionID, tt.change)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ChangePassword() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if _, err := s.login.Login(dto.LoginDTO{Email: user.Email, Password: tt.change.NewPassword}, "127.0.0.1"); err != nil {
+				t.Errorf("Login() with the new password error = %v", err)
+			}
+			// The session the change was made from stays signed in
+			if _, err := s.login.Refresh(dto.RefreshTokenDTO{RefreshToken: current.RefreshToken}); err != nil {
+				t.Errorf("Refresh() of the current session error = %v", err)
+			}
+			if _, err := s.login.Refresh(dto.RefreshTokenDTO{RefreshToken: other.RefreshToken}); err == nil {
+				t.Error("Refresh() of another session succeeded")
+			}
+		})
+	}
+}
+
+func TestChangeExpiredPassword(t *testing.T) {
+	tests := []struct {
+		name    string
+		age     time.Duration
+		change  dto.ExpiredPasswordChangeDTO
+		wantErr error
+	}{
+		{name: "replaces an expired password", age: 48 * time.Hour, change: dto.ExpiredPasswordChangeDTO{CurrentPassword: testPassword, NewPassword: newTestPassword}},
+		{name: "refuses a password that has not expired", change: dto.ExpiredPasswordChangeDTO{CurrentPassword: testPassword, NewPassword: newTestPassword}, wantErr: config.ErrPasswordNotExpired},
+		{name: "rejects a wrong current password", age: 48 * time.Hour, change: dto.ExpiredPasswordChangeDTO{CurrentPassword: "wrong-password", NewPassword: newTestPassword}, wantErr: config.ErrInvalidPassword},
+		{name: "rejects an unknown email", change: dto.ExpiredPasswordChangeDTO{Email: "nobody@example.com", CurrentPassword: testPassword, NewPassword: newTestPassword}, wantErr: config.ErrUserNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServices(t)
+			user := s.createUser(t, "user@example.com")
+			policy := s.tenantSettings.DefaultPasswordPolicy()
+			policy.MaxAgeDays = 1
+			check(t, s.tenantSettings.UpdatePasswordPolicy(user.TenantID, policy))
+			check(t, s.db.Model(user).Update("password_changed_at", time.Now().Add(-tt.age)).Error)
+			if tt.change.Email == "" {
+				tt.change.Email = user.Email
+			}
+
+			err := s.user.ChangeExpiredPassword(tt.change)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ChangeExpiredPassword() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if _, err := s.login.Login(dto.LoginDTO{Email: user.Email, Password: tt.change.NewPassword}, "127.0.0.1"); err != nil {
+				t.Errorf("Login() with the new password error = %v", err)
+			}
+		})
+	}
+}
+
+func TestReactivateLegacyLockouts(t *testing.T) {
+	s := newTestServices(t)
+	lockedOut := s.createUser(t, "locked@example.com")
+	deactivated := s.createUser(t, "deactivated@example.com")
+	deleted := s.createUser(t, "deleted@example.com")
+	active := s.createUser(t, "active@example.com")
+	deletedAt := time.Now()
+	check(t, s.db.Model(lockedOut).Updates(map[string]interface{}{"is_active": false, "failed_login_attempts": config.LegacyMaxFailedLoginAttempts}).Error)
+	check(t, s.db.Model(deactivated).Update("is_active", false).Error)
+	check(t, s.db.Model(deleted).Updates(map[string]interface{}{"is_active": false, "failed_login_attempts": config.LegacyMaxFailedLoginAttempts, "deleted_at": deletedAt}).Error)
+	check(t, s.db.Model(active).Update("failed_login_attempts", config.LegacyMaxFailedLoginAttempts).Error)
+
+	// Listing them changes nothing
+	users, err := s.user.LegacyLockouts()
+	check(t, err)
+	if len(users) != 1 || users[0].ID != lockedOut.ID {
+		t.Fatalf("LegacyLockouts() = %+v, want only %s", users, lockedOut.Email)
+	}
+	var got models.User
+	check(t, s.db.First(&got, lockedOut.ID).Error)
+	if got.IsActive {
+		t.Fatal("LegacyLockouts() reactivated the user")
+	}
+
+	reactivated, err := s.user.ReactivateLegacyLockouts()
+	check(t, err)
+	if reactivated != 1 {
+		t.Errorf("ReactivateLegacyLockouts() = %d, want 1", reactivated)
+	}
+	for _, user := range []*models.User{lockedOut, deactivated, deleted} {
+		var got models.User
+		check(t, s.db.First(&got, user.ID).Error)
+		if wantActive := user.ID == lockedOut.ID; got.IsActive != wantActive {
+			t.Errorf("%s active = %v, want %v", user.Email, got.IsActive, wantActive)
+		}
+	}
+	var reactivatedUser models.User
+	check(t, s.db.First(&reactivatedUser, lockedOut.ID).Error)
+	if reactivatedUser.FailedLoginAttempts != 0 {
+		t.Errorf("failed attempts = %d after reactivation, want 0", reactivatedUser.FailedLoginAttempts)
+	}
+}
@@ -0,0 +1,515 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"github.com/geekible-ltd/auth-server/internal/repository"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"gorm.io/gorm"
+)
+
+const webAuthnUserIDBytes = 32
+
+const defaultWebAuthnCredentialName = "Security key"
+
+type WebAuthnService struct {
+	webAuthn                     *webauthn.WebAuthn
+	userRepository               *repository.UserRepository
+	webAuthnCredentialRepository *repository.WebAuthnCredentialRepository
+	webAuthnSessionRepository    *repository.WebAuthnSessionRepository
+	sessionTTL                   time.Duration
+}
+
+// NewWebAuthnService configures the relying party. With an empty rpID, or a
+// configuration the WebAuthn library rejects, the service is returned
+// disabled and every ceremony fails with config.ErrWebAuthnNotConfigured.
+func NewWebAuthnService(userRepository *repository.UserRepository, webAuthnCredentialRepository *repository.WebAuthnCredentialRepository, webAuthnSessionRepository *repository.WebAuthnSessionRepository, rpID, rpDisplayName string, rpOrigins []string, sessionTTL time.Duration) (*WebAuthnService, error) {
+	s := &WebAuthnService{
+		userRepository:               userRepository,
+		webAuthnCredentialRepository: webAuthnCredentialRepository,
+		webAuthnSessionRepository:    webAuthnSessionRepository,
+		sessionTTL:                   sessionTTL,
+	}
+	if rpID == "" {
+		return s, nil
+	}
+
+	webAuthn, err := webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: rpDisplayName,
+		RPOrigins:     rpOrigins,
+	})
+	if err != nil {
+		return s, err
+	}
+	s.webAuthn = webAuthn
+	return s, nil
+}
+
+// IsConfigured reports whether a relying party is configured
+func (s *WebAuthnService) IsConfigured() bool {
+	return s.webAuthn != nil
+}
+
+// CountCredentials returns how many security keys and passkeys the user has registered
+func (s *WebAuthnService) CountCredentials(userID uint) (int64, error) {
+	return s.webAuthnCredentialRepository.CountByUserID(userID)
+}
+
+// GetCredentials lists the user's security keys and passkeys
+func (s *WebAuthnService) GetCredentials(tenantID, userID uint) ([]dto.WebAuthnCredentialDTO, error) {
+	credentialsDTO := []dto.WebAuthnCredentialDTO{}
+
+	user, err := s.getUser(tenantID, userID)
+	if err != nil {
+		return credentialsDTO, err
+	}
+
+	credentials, err := s.webAuthnCredentialRepository.GetByUserID(user.ID)
+	if err != nil {
+		return credentialsDTO, err
+	}
+	for _, credential := range credentials {
+		credentialsDTO = append(credentialsDTO, toWebAuthnCredentialDTO(credential))
+	}
+	return credentialsDTO, nil
+}
+
+// BeginRegistration returns the options for navigator.credentials.create().
+// Credentials the user already has are excluded, and a discoverable
+// credential is preferred so the key can also be used as a passkey.
+func (s *WebAuthnService) BeginRegistration(tenantID, userID uint) (dto.WebAuthnOptionsDTO, error) {
+	if !s.IsConfigured() {
+		return dto.WebAuthnOptionsDTO{}, config.ErrWebAuthnNotConfigured
+	}
+
+	user, err := s.getUser(tenantID, userID)
+	if err != nil {
+		return dto.WebAuthnOptionsDTO{}, err
+	}
+	if user.WebAuthnID == "" {
+		handle := make([]byte, webAuthnUserIDBytes)
+		if _, err := rand.Read(handle); err != nil {
+			return dto.WebAuthnOptionsDTO{}, err
+		}
+		user.WebAuthnID = base64.RawURLEncoding.EncodeToString(handle)
+		if err := s.userRepository.Update(user); err != nil {
+			return dto.WebAuthnOptionsDTO{}, err
+		}
+	}
+
+	webAuthnUser, err := s.loadWebAuthnUser(user)
+	if err != nil {
+		return dto.WebAuthnOptionsDTO{}, err
+	}
+
+	creation, sessionData, err := s.webAuthn.BeginRegistration(webAuthnUser,
+		webauthn.WithExclusions(webauthn.Credentials(webAuthnUser.WebAuthnCredentials()).CredentialDescriptors()),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+	)
+	if err != nil {
+		return dto.WebAuthnOptionsDTO{}, err
+	}
+
+	return s.startSession(config.WebAuthnCeremonyRegistration, user.ID, creation, sessionData)
+}
+
+// FinishRegistration verifies the attestation returned by the browser and
+// stores the new credential
+func (s *WebAuthnService) FinishRegistration(tenantID, userID uint, registrationRequest dto.WebAuthnRegistrationDTO) (dto.WebAuthnCredentialDTO, error) {
+	if !s.IsConfigured() {
+		return dto.WebAuthnCredentialDTO{}, config.ErrWebAuthnNotConfigured
+	}
+
+	user, err := s.getUser(tenantID, userID)
+	if err != nil {
+		return dto.WebAuthnCredentialDTO{}, err
+	}
+
+	sessionData, err := s.consumeSession(registrationRequest.SessionID, config.WebAuthnCeremonyRegistration, user.ID)
+	if err != nil {
+		return dto.WebAuthnCredentialDTO{}, err
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(registrationRequest.Credential)
+	if err != nil {
+		return dto.WebAuthnCredentialDTO{}, config.ErrWebAuthnVerificationFailed
+	}
+
+	webAuthnUser, err := s.loadWebAuthnUser(user)
+	if err != nil {
+		return dto.WebAuthnCredentialDTO{}, err
+	}
+	created, err := s.webAuthn.CreateCredential(webAuthnUser, *sessionData, parsed)
+	if err != nil {
+		return dto.WebAuthnCredentialDTO{}, config.ErrWebAuthnVerificationFailed
+	}
+
+	name := strings.TrimSpace(registrationRequest.Name)
+	if name == "" {
+		name = defaultWebAuthnCredentialName
+	}
+	transports := make([]string, 0, len(created.Transport))
+	for _, transport := range created.Transport {
+		transports = append(transports, string(transport))
+	}
+
+	credential := &models.WebAuthnCredential{
+		UserID:          user.ID,
+		TenantID:        user.TenantID,
+		CredentialID:    base64.RawURLEncoding.EncodeToString(created.ID),
+		Name:            name,
+		PublicKey:       created.PublicKey,
+		AttestationType: created.AttestationType,
+		Transports:      transports,
+		AAGUID:          created.Authenticator.AAGUID,
+		SignCount:       created.Authenticator.SignCount,
+		BackupEligible:  created.Flags.BackupEligible,
+		BackupState:     created.Flags.BackupState,
+		CreatedAt:       time.Now(),
+		UpdatedAt:       time.Now(),
+	}
+	if err := s.webAuthnCredentialRepository.Create(credential); err != nil {
+		return dto.WebAuthnCredentialDTO{}, err
+	}
+	return toWebAuthnCredentialDTO(*credential), nil
+}
+
+// DeleteCredential removes one of the user's security keys or passkeys
+func (s *WebAuthnService) DeleteCredential(tenantID, userID, credentialID uint) error {
+	user, err := s.getUser(tenantID, userID)
+	if err != nil {
+		return err
+	}
+
+	credential, err := s.webAuthnCredentialRepository.GetByID(user.ID, credentialID)
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return config.ErrWebAuthnCredentialNotFound
+	} else if err != nil {
+		return err
+	}
+	return s.webAuthnCredentialRepository.Delete(credential)
+}
+
+// BeginLogin returns the options for a passwordless passkey login. No user is
+// named up front; the authenticator offers its discoverable credentials and
+// must verify the user, so the passkey counts as both factors.
+func (s *WebAuthnService) BeginLogin() (dto.WebAuthnOptionsDTO, error) {
+	if !s.IsConfigured() {
+		return dto.WebAuthnOptionsDTO{}, config.ErrWebAuthnNotConfigured
+	}
+
+	assertion, sessionData, err := s.webAuthn.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		return dto.WebAuthnOptionsDTO{}, err
+	}
+
+	return s.startSession(config.WebAuthnCeremonyLogin, 0, assertion, sessionData)
+}
+
+// FinishLogin verifies a passkey assertion and returns the user it belongs to
+func (s *WebAuthnService) FinishLogin(loginRequest dto.WebAuthnLoginDTO) (*models.User, error) {
+	if !s.IsConfigured() {
+		return nil, config.ErrWebAuthnNotConfigured
+	}
+
+	sessionData, err := s.consumeSession(loginRequest.SessionID, config.WebAuthnCeremonyLogin, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(loginRequest.Credential)
+	if err != nil {
+		return nil, config.ErrWebAuthnVerificationFailed
+	}
+
+	var webAuthnUser *webAuthnUser
+	handler := func(rawID, userHandle []byte) (webauthn.User, error) {
+		user, err := s.userRepository.GetByWebAuthnID(base64.RawURLEncoding.EncodeToString(userHandle))
+		if err != nil {
+			return nil, err
+		}
+		webAuthnUser, err = s.loadWebAuthnUser(user)
+		return webAuthnUser, err
+	}
+
+	_, validated, err := s.webAuthn.ValidatePasskeyLogin(handler, *sessionData, parsed)
+	if err != nil {
+		return nil, config.ErrWebAuthnVerificationFailed
+	}
+	if err := s.recordUse(webAuthnUser, validated); err != nil {
+		return nil, err
+	}
+	return webAuthnUser.user, nil
+}
+
+// BeginReauthentication returns the options for a signed-in user to confirm
+// their identity again with one of their security keys or passkeys
+func (s *WebAuthnService) BeginReauthentication(tenantID, userID uint) (dto.WebAuthnOptionsDTO, error) {
+	if !s.IsConfigured() {
+		return dto.WebAuthnOptionsDTO{}, config.ErrWebAuthnNotConfigured
+	}
+
+	user, err := s.getUser(tenantID, userID)
+	if err != nil {
+		return dto.WebAuthnOptionsDTO{}, err
+	}
+	webAuthnUser, err := s.loadWebAuthnUser(user)
+	if err != nil {
+		return dto.WebAuthnOptionsDTO{}, err
+	}
+	if len(webAuthnUser.credentials) == 0 {
+		return dto.WebAuthnOptionsDTO{}, config.ErrWebAuthnCredentialNotFound
+	}
+
+	assertion, sessionData, err := s.webAuthn.BeginLogin(webAuthnUser)
+	if err != nil {
+		return dto.WebAuthnOptionsDTO{}, err
+	}
+
+	return s.startSession(config.WebAuthnCeremonyReauthentication, user.ID, assertion, sessionData)
+}
+
+// FinishReauthentication verifies the assertion of a ceremony started with
+// BeginReauthentication
+func (s *WebAuthnService) FinishReauthentication(user *models.User, sessionID string, credential json.RawMessage) error {
+	if !s.IsConfigured() {
+		return config.ErrWebAuthnNotConfigured
+	}
+
+	sessionData, err := s.consumeSession(sessionID, config.WebAuthnCeremonyReauthentication, user.ID)
+	if err != nil {
+		return err
+	}
+	return s.validateAssertion(user, *sessionData, credential)
+}
+
+// beginAssertion starts a second factor assertion limited to the user's
+// credentials and returns the options and the session state to keep
+func (s *WebAuthnService) beginAssertion(user *models.User) (json.RawMessage, string, error) {
+	if !s.IsConfigured() {
+		return nil, "", config.ErrWebAuthnNotConfigured
+	}
+
+	webAuthnUser, err := s.loadWebAuthnUser(user)
+	if err != nil {
+		return nil, "", err
+	}
+
+	assertion, sessionData, err := s.webAuthn.BeginLogin(webAuthnUser)
+	if err != nil {
+		return nil, "", err
+	}
+
+	options, err := json.Marshal(assertion)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := json.Marshal(sessionData)
+	if err != nil {
+		return nil, "", err
+	}
+	return options, string(data), nil
+}
+
+// finishAssertion verifies a second factor assertion against the session state
+// kept by beginAssertion
+func (s *WebAuthnService) finishAssertion(user *models.User, data string, credential json.RawMessage) error {
+	if !s.IsConfigured() {
+		return config.ErrWebAuthnNotConfigured
+	}
+
+	var sessionData webauthn.SessionData
+	if data == "" || json.Unmarshal([]byte(data), &sessionData) != nil {
+		return config.ErrInvalidWebAuthnSession
+	}
+	return s.validateAssertion(user, sessionData, credential)
+}
+
+// validateAssertion verifies an assertion by one of the user's credentials
+func (s *WebAuthnService) validateAssertion(user *models.User, sessionData webauthn.SessionData, credential json.RawMessage) error {
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(credential)
+	if err != nil {
+		return config.ErrWebAuthnVerificationFailed
+	}
+
+	webAuthnUser, err := s.loadWebAuthnUser(user)
+	if err != nil {
+		return err
+	}
+	validated, err := s.webAuthn.ValidateLogin(webAuthnUser, sessionData, parsed)
+	if err != nil {
+		return config.ErrWebAuthnVerificationFailed
+	}
+	return s.recordUse(webAuthnUser, validated)
+}
+
+// PurgeExpired removes registration and login ceremonies that were never finished
+func (s *WebAuthnService) PurgeExpired() error {
+	return s.webAuthnSessionRepository.DeleteExpired(time.Now())
+}
+
+// recordUse stores the new signature counter. A counter that did not advance
+// suggests a cloned authenticator, so the assertion is rejected.
+func (s *WebAuthnService) recordUse(webAuthnUser *webAuthnUser, validated *webauthn.Credential) error {
+	if validated.Authenticator.CloneWarning {
+		return config.ErrWebAuthnVerificationFailed
+	}
+
+	credentialID := base64.RawURLEncoding.EncodeToString(validated.ID)
+	for _, credential := range webAuthnUser.credentials {
+		if credential.CredentialID == credentialID {
+			return s.webAuthnCredentialRepository.RecordUse(credential.ID, validated.Authenticator.SignCount, validated.Flags.BackupState, time.Now())
+		}
+	}
+	return config.ErrWebAuthnVerificationFailed
+}
+
+// startSession stores the ceremony state and returns the options for the browser
+func (s *WebAuthnService) startSession(ceremony string, userID uint, options interface{}, sessionData *webauthn.SessionData) (dto.WebAuthnOptionsDTO, error) {
+	optionsJSON, err := json.Marshal(options)
+	if err != nil {
+		return dto.WebAuthnOptionsDTO{}, err
+	}
+	data, err := json.Marshal(sessionData)
+	if err != nil {
+		return dto.WebAuthnOptionsDTO{}, err
+	}
+
+	rawSessionID, err := generateSecureToken()
+	if err != nil {
+		return dto.WebAuthnOptionsDTO{}, err
+	}
+
+	now := time.Now()
+	session := &models.WebAuthnSession{
+		SessionHash: hashSecureToken(rawSessionID),
+		UserID:      userID,
+		Ceremony:    ceremony,
+		Data:        string(data),
+		ExpiresAt:   now.Add(s.sessionTTL),
+		CreatedAt:   now,
+	}
+	if err := s.webAuthnSessionRepository.Create(session); err != nil {
+		return dto.WebAuthnOptionsDTO{}, err
+	}
+
+	return dto.WebAuthnOptionsDTO{
+		SessionID: rawSessionID,
+		Options:   optionsJSON,
+	}, nil
+}
+
+// consumeSession takes the ceremony state for a session ID. Sessions are
+// single use, so a failed ceremony has to be started again.
+func (s *WebAuthnService) consumeSession(rawSessionID, ceremony string, userID uint) (*webauthn.SessionData, error) {
+	session, err := s.webAuthnSessionRepository.GetBySessionHash(hashSecureToken(rawSessionID))
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return nil, config.ErrInvalidWebAuthnSession
+	} else if err != nil {
+		return nil, err
+	}
+
+	consumed, err := s.webAuthnSessionRepository.Consume(session.ID)
+	if err != nil {
+		return nil, err
+	} else if !consumed {
+		return nil, config.ErrInvalidWebAuthnSession
+	}
+
+	if session.Ceremony != ceremony || session.UserID != userID || session.ExpiresAt.Before(time.Now()) {
+		return nil, config.ErrInvalidWebAuthnSession
+	}
+
+	var sessionData webauthn.SessionData
+	if err := json.Unmarshal([]byte(session.Data), &sessionData); err != nil {
+		return nil, config.ErrInvalidWebAuthnSession
+	}
+	return &sessionData, nil
+}
+
+func (s *WebAuthnService) loadWebAuthnUser(user *models.User) (*webAuthnUser, error) {
+	credentials, err := s.webAuthnCredentialRepository.GetByUserID(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &webAuthnUser{user: user, credentials: credentials}, nil
+}
+
+func (s *WebAuthnService) getUser(tenantID, userID uint) (*models.User, error) {
+	user, err := s.userRepository.GetByID(tenantID, userID)
+	if err != nil && err == gorm.ErrRecordNotFound {
+		return nil, config.ErrUserNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// webAuthnUser adapts a user and their credentials to webauthn.User
+type webAuthnUser struct {
+	user        *models.User
+	credentials []models.WebAuthnCredential
+}
+
+func (u *webAuthnUser) WebAuthnID() []byte {
+	handle, _ := base64.RawURLEncoding.DecodeString(u.user.WebAuthnID)
+	return handle
+}
+
+func (u *webAuthnUser) WebAuthnName() string {
+	return u.user.Email
+}
+
+func (u *webAuthnUser) WebAuthnDisplayName() string {
+	return strings.TrimSpace(u.user.FirstName + " " + u.user.LastName)
+}
+
+func (u *webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, 0, len(u.credentials))
+	for _, credential := range u.credentials {
+		id, err := base64.RawURLEncoding.DecodeString(credential.CredentialID)
+		if err != nil {
+			continue
+		}
+		transports := make([]protocol.AuthenticatorTransport, 0, len(credential.Transports))
+		for _, transport := range credential.Transports {
+			transports = append(transports, protocol.AuthenticatorTransport(transport))
+		}
+
+		credentials = append(credentials, webauthn.Credential{
+			ID:              id,
+			PublicKey:       credential.PublicKey,
+			AttestationType: credential.AttestationType,
+			Transport:       transports,
+			Flags: webauthn.CredentialFlags{
+				BackupEligible: credential.BackupEligible,
+				BackupState:    credential.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    credential.AAGUID,
+				SignCount: credential.SignCount,
+			},
+		})
+	}
+	return credentials
+}
+
+func toWebAuthnCredentialDTO(credential models.WebAuthnCredential) dto.WebAuthnCredentialDTO {
+	return dto.WebAuthnCredentialDTO{
+		ID:             credential.ID,
+		Name:           credential.Name,
+		Transports:     credential.Transports,
+		BackupEligible: credential.BackupEligible,
+		LastUsedAt:     credential.LastUsedAt,
+		CreatedAt:      credential.CreatedAt,
+	}
+}
@@ -0,0 +1,323 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/internal/models"
+	"github.com/geekible-ltd/auth-server/internal/repository"
+)
+
+const (
+	testRPID   = "example.com"
+	testOrigin = "https://example.com"
+)
+
+// softAuthenticator is a software ES256 authenticator producing the responses
+// a browser returns from navigator.credentials.create() and get()
+type softAuthenticator struct {
+	t          *testing.T
+	key        *ecdsa.PrivateKey
+	id         []byte
+	userHandle []byte
+	signCount  uint32
+	origin     string
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		t.Fatal(err)
+	}
+	return &softAuthenticator{t: t, key: key, id: id, origin: testOrigin}
+}
+
+// create answers registration options with a "none" attestation
+func (a *softAuthenticator) create(options json.RawMessage) json.RawMessage {
+	var creation struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+			User      struct {
+				ID string `json:"id"`
+			} `json:"user"`
+		} `json:"publicKey"`
+	}
+	if err := json.Unmarshal(options, &creation); err != nil {
+		a.t.Fatal(err)
+	}
+	a.userHandle, _ = base64.RawURLEncoding.DecodeString(creation.PublicKey.User.ID)
+
+	publicKey, err := cbor.Marshal(map[int]interface{}{
+		1:  2,  // kty: EC2
+		3:  -7, // alg: ES256
+		-1: 1,  // crv: P-256
+		-2: a.key.X.FillBytes(make([]byte, 32)),
+		-3: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	// Flags: user present, user verified, attested credential data
+	authData := a.authenticatorData(0x45)
+	authData = append(authData, make([]byte, 16)...) // AAGUID
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(a.id)))
+	authData = append(authData, a.id...)
+	authData = append(authData, publicKey...)
+
+	attestation, err := cbor.Marshal(map[string]interface{}{"fmt": "none", "attStmt": map[string]interface{}{}, "authData": authData})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return a.credential(map[string]interface{}{
+		"clientDataJSON":    a.clientData("webauthn.create", creation.PublicKey.Challenge),
+		"attestationObject": base64.RawURLEncoding.EncodeToString(attestation),
+		"transports":        []string{"internal"},
+	})
+}
+
+// get answers assertion options, advancing the signature counter
+func (a *softAuthenticator) get(options json.RawMessage) json.RawMessage {
+	var assertion struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+		} `json:"publicKey"`
+	}
+	if err := json.Unmarshal(options, &assertion); err != nil {
+		a.t.Fatal(err)
+	}
+
+	a.signCount++
+	clientData := a.clientData("webauthn.get", assertion.PublicKey.Challenge)
+	clientDataJSON, _ := base64.RawURLEncoding.DecodeString(clientData)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+
+	// Flags: user present, user verified
+	authData := a.authenticatorData(0x05)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	return a.credential(map[string]interface{}{
+		"clientDataJSON":    clientData,
+		"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+		"signature":         base64.RawURLEncoding.EncodeToString(signature),
+		"userHandle":        base64.RawURLEncoding.EncodeToString(a.userHandle),
+	})
+}
+
+func (a *softAuthenticator) authenticatorData(flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(testRPID))
+	authData := append(rpIDHash[:], flags)
+	return binary.BigEndian.AppendUint32(authData, a.signCount)
+}
+
+func (a *softAuthenticator) clientData(ceremony, challenge string) string {
+	clientData, err := json.Marshal(map[string]string{"type": ceremony, "challenge": challenge, "origin": a.origin})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(clientData)
+}
+
+func (a *softAuthenticator) credential(response map[string]interface{}) json.RawMessage {
+	credential, err := json.Marshal(map[string]interface{}{
+		"id":       base64.RawURLEncoding.EncodeToString(a.id),
+		"rawId":    base64.RawURLEncoding.EncodeToString(a.id),
+		"type":     "public-key",
+		"response": response,
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return credential
+}
+
+func newTestWebAuthnService(t *testing.T) (*WebAuthnService, *models.User) {
+	db := newTestDB(t, &models.WebAuthnCredential{}, &models.WebAuthnSession{})
+	s, err := NewWebAuthnService(repository.NewUserRepository(db), repository.NewWebAuthnCredentialRepository(db), repository.NewWebAuthnSessionRepository(db), testRPID, "Example", []string{testOrigin}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, createTestUser(t, db, "user@example.com")
+}
+
+// registerSoftAuthenticator runs a registration ceremony for the user
+func registerSoftAuthenticator(t *testing.T, s *WebAuthnService, user *models.User) *softAuthenticator {
+	authenticator := newSoftAuthenticator(t)
+	options, err := s.BeginRegistration(user.TenantID, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.FinishRegistration(user.TenantID, user.ID, dto.WebAuthnRegistrationDTO{SessionID: options.SessionID, Credential: authenticator.create(options.Options)}); err != nil {
+		t.Fatal(err)
+	}
+	return authenticator
+}
+
+func TestWebAuthnRegistration(t *testing.T) {
+	tests := []struct {
+		name            string
+		origin          string
+		replay          bool
+		wantErr         error
+		wantCredentials int64
+	}{
+		{name: "registers the credential", origin: testOrigin, wantCredentials: 1},
+		{name: "rejects another origin", origin: "https://evil.example", wantErr: config.ErrWebAuthnVerificationFailed},
+		{name: "rejects a replayed session", origin: testOrigin, replay: true, wantErr: config.ErrInvalidWebAuthnSession, wantCredentials: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, user := newTestWebAuthnService(t)
+			authenticator := newSoftAuthenticator(t)
+			authenticator.origin = tt.origin
+
+			options, err := s.BeginRegistration(user.TenantID, user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			request := dto.WebAuthnRegistrationDTO{SessionID: options.SessionID, Name: "Laptop", Credential: authenticator.create(options.Options)}
+			if tt.replay {
+				if _, err := s.FinishRegistration(user.TenantID, user.ID, request); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			credential, err := s.FinishRegistration(user.TenantID, user.ID, request)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("FinishRegistration() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && credential.Name != "Laptop" {
+				t.Errorf("credential name = %q, want Laptop", credential.Name)
+			}
+
+			count, err := s.CountCredentials(user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != tt.wantCredentials {
+				t.Errorf("credentials = %d, want %d", count, tt.wantCredentials)
+			}
+		})
+	}
+}
+
+func TestWebAuthnPasskeyLogin(t *testing.T) {
+	tests := []struct {
+		name    string
+		tamper  func(a *softAuthenticator)
+		wantErr error
+	}{
+		{name: "accepts a valid assertion"},
+		{
+			name:    "rejects a signature counter that went backwards",
+			tamper:  func(a *softAuthenticator) { a.signCount = 0 },
+			wantErr: config.ErrWebAuthnVerificationFailed,
+		},
+		{
+			name:    "rejects another origin",
+			tamper:  func(a *softAuthenticator) { a.origin = "https://evil.example" },
+			wantErr: config.ErrWebAuthnVerificationFailed,
+		},
+		{
+			name: "rejects a signature by another key",
+			tamper: func(a *softAuthenticator) {
+				a.key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			},
+			wantErr: config.ErrWebAuthnVerificationFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, user := newTestWebAuthnService(t)
+			authenticator := registerSoftAuthenticator(t, s, user)
+
+			// A first login moves the stored counter on from zero
+			options, err := s.BeginLogin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			authenticator.signCount = 4
+			if _, err := s.FinishLogin(dto.WebAuthnLoginDTO{SessionID: options.SessionID, Credential: authenticator.get(options.Options)}); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.tamper != nil {
+				tt.tamper(authenticator)
+			}
+			options, err = s.BeginLogin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			loggedIn, err := s.FinishLogin(dto.WebAuthnLoginDTO{SessionID: options.SessionID, Credential: authenticator.get(options.Options)})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("FinishLogin() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && loggedIn.ID != user.ID {
+				t.Errorf("FinishLogin() user = %d, want %d", loggedIn.ID, user.ID)
+			}
+		})
+	}
+}
+
+func TestWebAuthnSecondFactor(t *testing.T) {
+	tests := []struct {
+		name    string
+		origin  string
+		replay  bool
+		wantErr error
+	}{
+		{name: "accepts a valid assertion", origin: testOrigin},
+		{name: "rejects another origin", origin: "https://evil.example", wantErr: config.ErrWebAuthnVerificationFailed},
+		{name: "rejects a replayed assertion", origin: testOrigin, replay: true, wantErr: config.ErrWebAuthnVerificationFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, user := newTestWebAuthnService(t)
+			authenticator := registerSoftAuthenticator(t, s, user)
+			authenticator.origin = tt.origin
+
+			// Registration gave the user a WebAuthn user handle
+			user, err := s.getUser(user.TenantID, user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			options, data, err := s.beginAssertion(user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			credential := authenticator.get(options)
+			if tt.replay {
+				if err := s.finishAssertion(user, data, credential); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := s.finishAssertion(user, data, credential); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("finishAssertion() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+// Package mailer defines how the auth server sends email, such as
+// passwordless sign-in codes, and provides SMTP, logging and background
+// implementations.
+package mailer
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+)
+
+// Message is a plain text email to a single recipient
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends email on behalf of the auth server. Implementations should
+// return once the message is accepted for delivery.
+type Mailer interface {
+	Send(message Message) error
+}
+
+// SMTPMailer sends email through an SMTP server using PLAIN authentication
+// when a username is set
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+func NewSMTPMailer(host string, port int, username, password, from string) *SMTPMailer {
+	return &SMTPMailer{
+		Host:     host,
+		Port:     port,
+		Username: username,
+		Password: password,
+		From:     from,
+	}
+}
+
+func (m *SMTPMailer) Send(message Message) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "From: %s\r\n", headerValue(m.From))
+	fmt.Fprintf(&body, "To: %s\r\n", headerValue(message.To))
+	fmt.Fprintf(&body, "Subject: %s\r\n", headerValue(message.Subject))
+	body.WriteString("MIME-Version: 1.0\r\n")
+	body.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	body.WriteString(message.Body)
+
+	addr := net.JoinHostPort(m.Host, strconv.Itoa(m.Port))
+	return smtp.SendMail(addr, auth, m.From, []string{message.To}, []byte(body.String()))
+}
+
+// headerValue strips line breaks so a value cannot add headers of its own
+func headerValue(value string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(value)
+}
+
+// LogMailer writes messages to the standard logger instead of sending them.
+// It is meant for development; messages may contain sign-in codes.
+type LogMailer struct{}
+
+func (LogMailer) Send(message Message) error {
+	log.Printf("auth-server: mail to %s: %s\n%s", message.To, message.Subject, message.Body)
+	return nil
+}
+
+// BackgroundMailer sends messages with another mailer in the background and
+// returns at once, so how long a request takes does not reveal whether an
+// email was sent. Failures are passed to OnError, if set.
+type BackgroundMailer struct {
+	Mailer  Mailer
+	OnError func(message Message, err error)
+}
+
+func NewBackgroundMailer(m Mailer, onError func(message Message, err error)) *BackgroundMailer {
+	return &BackgroundMailer{
+		Mailer:  m,
+		OnError: onError,
+	}
+}
+
+func (m *BackgroundMailer) Send(message Message) error {
+	go func() {
+		if err := m.Mailer.Send(message); err != nil && m.OnError != nil {
+			m.OnError(message, err)
+		}
+	}()
+	return nil
+}
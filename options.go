@@ -0,0 +1,372 @@
+package authserver
+
+import (
+	"time"
+
+	"github.com/geekible-ltd/auth-server/breached"
+	"github.com/geekible-ltd/auth-server/dto"
+	"github.com/geekible-ltd/auth-server/hasher"
+	"github.com/geekible-ltd/auth-server/internal/config"
+	"github.com/geekible-ltd/auth-server/mailer"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Option configures optional AuthServer behaviour
+type Option func(*options)
+
+type options struct {
+	tokenIssuer     string
+	tokenAudience   string
+	accessTokenTTL  time.Duration
+	refreshTokenTTL time.Duration
+
+	signingAlgorithm    string
+	keyRotationInterval time.Duration
+	keyRotationOverlap  time.Duration
+	keyRetention        time.Duration
+	keyEncryptionKey    []byte
+
+	loginURL             string
+	consentURL           string
+	authorizationCodeTTL time.Duration
+
+	deviceCodeTTL         time.Duration
+	deviceVerificationURL string
+
+	mfaIssuer       string
+	mfaChallengeTTL time.Duration
+	stepUpMaxAge    time.Duration
+	trustedProxies  []string
+
+	webAuthnRPID          string
+	webAuthnRPDisplayName string
+	webAuthnRPOrigins     []string
+	webAuthnSessionTTL    time.Duration
+
+	mailer              mailer.Mailer
+	passwordlessTTL     time.Duration
+	passwordlessLinkURL string
+
+	passwordResetTTL     time.Duration
+	passwordResetLinkURL string
+
+	emailVerificationTTL     time.Duration
+	emailVerificationLinkURL string
+
+	passwordPolicy          dto.PasswordPolicyDTO
+	breachedPasswordChecker breached.Checker
+	passwordHasher          hasher.Hasher
+	passwordPepperVersion   int
+	passwordPeppers         map[int][]byte
+
+	maxFailedLoginAttempts int
+	lockoutDuration        time.Duration
+	maxLockoutDuration     time.Duration
+}
+
+func defaultOptions() *options {
+	return &options{
+		tokenIssuer:     config.DefaultTokenIssuer,
+		tokenAudience:   config.DefaultTokenAudience,
+		accessTokenTTL:  config.DefaultAccessTokenTTL,
+		refreshTokenTTL: config.DefaultRefreshTokenTTL,
+
+		signingAlgorithm:    config.SigningAlgorithmHS256,
+		keyRotationInterval: config.DefaultKeyRotationInterval,
+		keyRotationOverlap:  config.DefaultKeyRotationOverlap,
+		keyRetention:        config.DefaultKeyRetention,
+
+		authorizationCodeTTL: config.DefaultAuthorizationCodeTTL,
+
+		deviceCodeTTL: config.DefaultDeviceCodeTTL,
+
+		mfaChallengeTTL: config.DefaultMFAChallengeTTL,
+		stepUpMaxAge:    config.DefaultStepUpMaxAge,
+
+		webAuthnSessionTTL: config.DefaultWebAuthnSessionTTL,
+
+		passwordlessTTL: config.DefaultPasswordlessTTL,
+
+		passwordResetTTL: config.DefaultPasswordResetTTL,
+
+		emailVerificationTTL: config.DefaultEmailVerificationTTL,
+
+		passwordPolicy: dto.PasswordPolicyDTO{
+			MinLength:            config.DefaultPasswordMinLength,
+			MaxLength:            config.DefaultPasswordMaxLength,
+			DisallowPersonalInfo: true,
+		},
+
+		passwordHasher: hasher.NewBcryptHasher(bcrypt.DefaultCost),
+
+		maxFailedLoginAttempts: config.DefaultMaxFailedLoginAttempts,
+		lockoutDuration:        config.DefaultLockoutDuration,
+		maxLockoutDuration:     config.DefaultMaxLockoutDuration,
+	}
+}
+
+// WithTokenIssuer sets the "iss" claim of issued tokens
+func WithTokenIssuer(issuer string) Option {
+	return func(o *options) {
+		o.tokenIssuer = issuer
+	}
+}
+
+// WithTokenAudience sets the "aud" claim of issued access tokens
+func WithTokenAudience(audience string) Option {
+	return func(o *options) {
+		o.tokenAudience = audience
+	}
+}
+
+// WithAccessTokenTTL sets how long issued access tokens remain valid
+func WithAccessTokenTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.accessTokenTTL = ttl
+	}
+}
+
+// WithRefreshTokenTTL sets how long an unused refresh token remains valid
+func WithRefreshTokenTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.refreshTokenTTL = ttl
+	}
+}
+
+// WithSigningAlgorithm selects the token signing algorithm: "HS256" (the
+// default, using the shared jwtSecret), "RS256", "ES256" or "EdDSA". The
+// asymmetric algorithms use rotating keys stored in the database and
+// published at /.well-known/jwks.json.
+func WithSigningAlgorithm(algorithm string) Option {
+	return func(o *options) {
+		o.signingAlgorithm = algorithm
+	}
+}
+
+// WithKeyRotation configures asymmetric key rotation. A new key is published
+// overlap before it starts signing, and retired keys keep verifying tokens for
+// retention after they stop signing.
+func WithKeyRotation(interval, overlap, retention time.Duration) Option {
+	return func(o *options) {
+		o.keyRotationInterval = interval
+		o.keyRotationOverlap = overlap
+		o.keyRetention = retention
+	}
+}
+
+// WithSigningKeyEncryptionKey sets the 32 byte AES-256 key that encrypts the
+// private signing keys stored in the database. It is required with an
+// asymmetric signing algorithm; load it from a secret store rather than the
+// database. Keys stored before it was set are encrypted when next loaded.
+func WithSigningKeyEncryptionKey(key []byte) Option {
+	return func(o *options) {
+		o.keyEncryptionKey = key
+	}
+}
+
+// WithLoginURL sets the login page that /oauth/authorize redirects
+// unauthenticated users to. The page receives the authorization request to
+// resume in the return_to query parameter.
+func WithLoginURL(loginURL string) Option {
+	return func(o *options) {
+		o.loginURL = loginURL
+	}
+}
+
+// WithConsentURL sets the page that /oauth/authorize sends users to when they
+// have not yet allowed a third-party client the scopes it asks for. The page
+// receives the request to resume in return_to, with client_id, client_name and
+// scope to show, and answers by POSTing the return_to parameters to
+// /oauth/authorize with consent set to approve or deny.
+func WithConsentURL(consentURL string) Option {
+	return func(o *options) {
+		o.consentURL = consentURL
+	}
+}
+
+// WithAuthorizationCodeTTL sets how long an OAuth authorization code can be redeemed
+func WithAuthorizationCodeTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.authorizationCodeTTL = ttl
+	}
+}
+
+// WithDeviceCodeTTL sets how long a device authorization can be approved and polled for
+func WithDeviceCodeTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.deviceCodeTTL = ttl
+	}
+}
+
+// WithDeviceVerificationURL sets the page devices tell users to visit to enter
+// their user code. It defaults to the built-in /oauth/device endpoint.
+func WithDeviceVerificationURL(verificationURL string) Option {
+	return func(o *options) {
+		o.deviceVerificationURL = verificationURL
+	}
+}
+
+// WithMFAIssuer sets the issuer name authenticator apps show next to TOTP
+// codes. It defaults to the token issuer.
+func WithMFAIssuer(issuer string) Option {
+	return func(o *options) {
+		o.mfaIssuer = issuer
+	}
+}
+
+// WithMFAChallengeTTL sets how long a user has to enter their second factor
+// after a correct password
+func WithMFAChallengeTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.mfaChallengeTTL = ttl
+	}
+}
+
+// WithStepUpMaxAge sets how recently a user must have logged in or
+// re-authenticated to change roles, delete users or update the tenant licence
+func WithStepUpMaxAge(maxAge time.Duration) Option {
+	return func(o *options) {
+		o.stepUpMaxAge = maxAge
+	}
+}
+
+// WithTrustedProxies lists the reverse proxies, as CIDR prefixes or single
+// addresses, whose X-Forwarded-For header gives the client address of a login.
+// Without it the peer address is used, so a client cannot claim to be on a
+// tenant's trusted network to skip MFA.
+func WithTrustedProxies(proxies ...string) Option {
+	return func(o *options) {
+		o.trustedProxies = proxies
+	}
+}
+
+// WithWebAuthn enables security keys and passkeys for the relying party rpID,
+// usually the site's registrable domain. rpOrigins lists the exact origins
+// browsers may run ceremonies from, e.g. "https://login.example.com". The
+// display name defaults to the MFA issuer.
+func WithWebAuthn(rpID, rpDisplayName string, rpOrigins ...string) Option {
+	return func(o *options) {
+		o.webAuthnRPID = rpID
+		o.webAuthnRPDisplayName = rpDisplayName
+		o.webAuthnRPOrigins = rpOrigins
+	}
+}
+
+// WithWebAuthnSessionTTL sets how long a WebAuthn registration or passkey
+// login may take between its begin and finish calls
+func WithWebAuthnSessionTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.webAuthnSessionTTL = ttl
+	}
+}
+
+// WithMailer sets how the server sends email, such as passwordless sign-in
+// codes, password reset links and email verification. Without a mailer those
+// features are disabled and new users stay unverified. Emails are sent in the
+// background and failures are logged.
+func WithMailer(m mailer.Mailer) Option {
+	return func(o *options) {
+		o.mailer = m
+	}
+}
+
+// WithPasswordlessTTL sets how long an emailed sign-in code or magic link stays valid
+func WithPasswordlessTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.passwordlessTTL = ttl
+	}
+}
+
+// WithPasswordlessLinkURL sets the sign-in page magic links point to. The page
+// receives a "token" query parameter and posts it to /auth/passwordless/verify
+// as link_token. Without it only codes are emailed.
+func WithPasswordlessLinkURL(linkURL string) Option {
+	return func(o *options) {
+		o.passwordlessLinkURL = linkURL
+	}
+}
+
+// WithPasswordResetTTL sets how long an emailed password reset token stays valid
+func WithPasswordResetTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.passwordResetTTL = ttl
+	}
+}
+
+// WithPasswordResetLinkURL sets the page password reset emails link to. The
+// page receives a "token" query parameter and posts it to /auth/password/reset
+// with the new password. Without it the token itself is emailed.
+func WithPasswordResetLinkURL(linkURL string) Option {
+	return func(o *options) {
+		o.passwordResetLinkURL = linkURL
+	}
+}
+
+// WithEmailVerificationTTL sets how long an email verification token stays valid
+func WithEmailVerificationTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.emailVerificationTTL = ttl
+	}
+}
+
+// WithEmailVerificationLinkURL sets the page verification emails link to. The
+// page receives a "token" query parameter and posts it to /auth/email/verify.
+// Without it the token itself is emailed.
+func WithEmailVerificationLinkURL(linkURL string) Option {
+	return func(o *options) {
+		o.emailVerificationLinkURL = linkURL
+	}
+}
+
+// WithPasswordPolicy sets the password policy for tenants that have not set
+// their own. By default passwords need 8 to 64 characters and must not contain
+// the user's email or name.
+func WithPasswordPolicy(policy dto.PasswordPolicyDTO) Option {
+	return func(o *options) {
+		o.passwordPolicy = policy
+	}
+}
+
+// WithBreachedPasswordChecker rejects new passwords that the checker reports
+// as exposed in a data breach, whatever the tenant's password policy. Use
+// breached.NewRangeFileChecker to screen against a downloaded corpus offline.
+func WithBreachedPasswordChecker(checker breached.Checker) Option {
+	return func(o *options) {
+		o.breachedPasswordChecker = checker
+	}
+}
+
+// WithPasswordHasher sets how new passwords are hashed, e.g.
+// hasher.NewArgon2idHasher(hasher.DefaultArgon2idMemory, hasher.DefaultArgon2idIterations, hasher.DefaultArgon2idParallelism).
+// Existing bcrypt, argon2id and scrypt hashes keep working and are rehashed
+// with it when their users next log in. It defaults to bcrypt with cost 10.
+func WithPasswordHasher(passwordHasher hasher.Hasher) Option {
+	return func(o *options) {
+		o.passwordHasher = passwordHasher
+	}
+}
+
+// WithPasswordPepper HMACs passwords with a secret key before hashing them.
+// peppers maps versions to keys of at least 32 bytes, and new hashes use the
+// key of currentVersion. Keep retired keys in peppers: hashes made with them
+// keep working and are re-peppered with the current key at the user's next
+// login, while hashes whose key is removed stop matching.
+func WithPasswordPepper(currentVersion int, peppers map[int][]byte) Option {
+	return func(o *options) {
+		o.passwordPepperVersion = currentVersion
+		o.passwordPeppers = peppers
+	}
+}
+
+// WithAccountLockout locks users out for lockoutDuration after
+// maxFailedAttempts wrong passwords, sign-in codes or MFA codes in a row. Each
+// further lockout before a successful login lasts twice as long, up to
+// maxLockoutDuration. It defaults to 3 attempts, 5 minutes and 24 hours; a
+// maxFailedAttempts of zero turns lockout off.
+func WithAccountLockout(maxFailedAttempts int, lockoutDuration, maxLockoutDuration time.Duration) Option {
+	return func(o *options) {
+		o.maxFailedLoginAttempts = maxFailedAttempts
+		o.lockoutDuration = lockoutDuration
+		o.maxLockoutDuration = maxLockoutDuration
+	}
+}